@@ -1,7 +1,11 @@
 package config
 
 import (
+	"fmt"
+	"net/url"
 	"os"
+	"strconv"
+	"strings"
 
 	"gopkg.in/yaml.v3"
 )
@@ -17,7 +21,90 @@ type Config struct {
 	AppID         string `yaml:"app_id"`
 	AppSecret     string `yaml:"app_secret"`
 	PrivateKey    string `yaml:"private_key"`
-	Salt          string `yaml:"salt"`
+	// trade system v2: version of the app public key uploaded to the platform, and the
+	// platform public key that signs pay notifications
+	KeyVersion        string           `yaml:"key_version"`
+	PlatformPublicKey string           `yaml:"platform_public_key"`
+	TradeTagGroupID   string           `yaml:"trade_tag_group_id"`
+	TradeEntryPath    string           `yaml:"trade_entry_path"`
+	Salt              string           `yaml:"salt"`
+	Payment           PaymentConfig    `yaml:"payment"`
+	DouyinHTTP        DouyinHTTPConfig `yaml:"douyin_http"`
+	// "douyin" (default) or "fake" to create new orders through the in-process fake gateway
+	PaymentGateway string `yaml:"payment_gateway"`
+	// other merchants that get a share of every settled order, sent as other_settle_params
+	SettleParties []SettleParty `yaml:"settle_parties"`
+	// VIP plans that unlock every topic for a number of days
+	MembershipPlans []MembershipPlan `yaml:"membership_plans"`
+	// most devices a user can be signed in on at once; past it the least recently used session
+	// is signed out. 0 means no limit.
+	MaxSessions int `yaml:"max_sessions"`
+}
+
+// MembershipPlan is a VIP plan on sale; Price is in fen like topic prices
+type MembershipPlan struct {
+	Code         string `yaml:"code" json:"code"`
+	Name         string `yaml:"name" json:"name"`
+	Price        int    `yaml:"price" json:"price"`
+	DurationDays int    `yaml:"duration_days" json:"duration_days"`
+}
+
+// MembershipPlan looks up a plan by code
+func (c Config) MembershipPlan(code string) (MembershipPlan, bool) {
+	for _, plan := range c.MembershipPlans {
+		if plan.Code == code {
+			return plan, true
+		}
+	}
+	return MembershipPlan{}, false
+}
+
+// PaymentConfig is the merchant and callback setup of the Douyin payment gateways
+type PaymentConfig struct {
+	StoreUid string `yaml:"store_uid"`
+	// public base URL of this deployment; gateways post notifications to NotifyURL + /pay/callback etc.
+	NotifyURL string `yaml:"notify_url"`
+	// seconds an ecpay order can be paid
+	ValidTime int `yaml:"valid_time"`
+	// ecpay API root and trade system v2 OpenAPI host
+	BaseURL      string `yaml:"base_url"`
+	TradeBaseURL string `yaml:"trade_base_url"`
+	// token ecpay notifications are signed with
+	CallbackToken string `yaml:"callback_token"`
+	// order sync API that lists ecpay orders in the user's Douyin order center
+	OrderSyncURL string `yaml:"order_sync_url"`
+	// API the daily ecpay bill is downloaded from
+	BillURL string `yaml:"bill_url"`
+}
+
+// CallbackURL returns the URL gateways post the notifications of path to
+func (p PaymentConfig) CallbackURL(path string) string {
+	return strings.TrimRight(p.NotifyURL, "/") + path
+}
+
+// maxValidTime is the longest valid_time ecpay accepts, two days
+const maxValidTime = 2 * 24 * 60 * 60
+
+// DouyinHTTPConfig sets up the shared client that every call to a Douyin API goes through
+type DouyinHTTPConfig struct {
+	// PEM files of the CAs Douyin certificates chain up to, trusted on top of the system roots
+	CABundle []string `yaml:"ca_bundle"`
+	// seconds a single attempt may take
+	Timeout int `yaml:"timeout"`
+	// extra attempts for idempotent calls, and milliseconds before the first of them (doubled each time)
+	MaxRetries   int `yaml:"max_retries"`
+	RetryBackoff int `yaml:"retry_backoff"`
+	// consecutive failures against a host that open its circuit, and seconds it stays open
+	BreakerFailures int `yaml:"breaker_failures"`
+	BreakerCooldown int `yaml:"breaker_cooldown"`
+	// developer.toutiao.com root of the jscode2session login API
+	LoginBaseURL string `yaml:"login_base_url"`
+}
+
+// SettleParty is a merchant that receives a percentage of each settled order
+type SettleParty struct {
+	MerchantUID string `yaml:"merchant_uid"`
+	Percent     int    `yaml:"percent"`
 }
 
 type yamlConfig struct {
@@ -81,13 +168,120 @@ func LoadConfig() Config {
 	if v := os.Getenv("PRIVATE_KEY"); v != "" {
 		cfg.PrivateKey = v
 	}
+	if v := os.Getenv("KEY_VERSION"); v != "" {
+		cfg.KeyVersion = v
+	}
+	if v := os.Getenv("PLATFORM_PUBLIC_KEY"); v != "" {
+		cfg.PlatformPublicKey = v
+	}
 	if v := os.Getenv("SALT"); v != "" {
 		cfg.Salt = v
 	}
+	if v := os.Getenv("CALLBACK_TOKEN"); v != "" {
+		cfg.Payment.CallbackToken = v
+	}
+	if v := os.Getenv("STORE_UID"); v != "" {
+		cfg.Payment.StoreUid = v
+	}
+	if v := os.Getenv("NOTIFY_URL"); v != "" {
+		cfg.Payment.NotifyURL = v
+	}
+	if v := os.Getenv("VALID_TIME"); v != "" {
+		cfg.Payment.ValidTime, _ = strconv.Atoi(v)
+	}
+	if v := os.Getenv("ECPAY_BASE_URL"); v != "" {
+		cfg.Payment.BaseURL = v
+	}
+	if v := os.Getenv("TRADE_BASE_URL"); v != "" {
+		cfg.Payment.TradeBaseURL = v
+	}
+	if v := os.Getenv("ORDER_SYNC_URL"); v != "" {
+		cfg.Payment.OrderSyncURL = v
+	}
+	if v := os.Getenv("ECPAY_BILL_URL"); v != "" {
+		cfg.Payment.BillURL = v
+	}
+	if v := os.Getenv("DOUYIN_CA_BUNDLE"); v != "" {
+		cfg.DouyinHTTP.CABundle = strings.Split(v, ",")
+	}
+	if v := os.Getenv("DOUYIN_LOGIN_BASE_URL"); v != "" {
+		cfg.DouyinHTTP.LoginBaseURL = v
+	}
+	if v := os.Getenv("PAYMENT_GATEWAY"); v != "" {
+		cfg.PaymentGateway = v
+	}
+	if v := os.Getenv("MAX_SESSIONS"); v != "" {
+		cfg.MaxSessions, _ = strconv.Atoi(v)
+	}
 
 	return cfg
 }
 
+// Validate reports payment, membership and Douyin API settings that would make orders or logins
+// fail, or leave notifications unverifiable.
+// The fake gateway never calls Douyin, so it only needs to stay out of production.
+func (c Config) Validate() error {
+	var problems []string
+	switch c.PaymentGateway {
+	case "", "douyin":
+	case "fake":
+		if c.Profile == "production" {
+			problems = append(problems, "payment_gateway fake must not be used in production")
+		}
+	default:
+		problems = append(problems, fmt.Sprintf("unknown payment_gateway %q", c.PaymentGateway))
+	}
+
+	if c.PaymentGateway != "fake" {
+		p := c.Payment
+		if p.StoreUid == "" {
+			problems = append(problems, "payment.store_uid is empty")
+		}
+		if p.ValidTime <= 0 || p.ValidTime > maxValidTime {
+			problems = append(problems, fmt.Sprintf("payment.valid_time must be between 1 and %d seconds", maxValidTime))
+		}
+		if p.CallbackToken == "" {
+			problems = append(problems, "payment.callback_token is empty")
+		}
+		urls := []struct{ name, value string }{
+			{"notify_url", p.NotifyURL},
+			{"base_url", p.BaseURL},
+			{"trade_base_url", p.TradeBaseURL},
+			{"order_sync_url", p.OrderSyncURL},
+			{"bill_url", p.BillURL},
+		}
+		for _, u := range urls {
+			if parsed, err := url.Parse(u.value); err != nil || parsed.Host == "" || (parsed.Scheme != "https" && parsed.Scheme != "http") {
+				problems = append(problems, fmt.Sprintf("payment.%s %q is not an absolute URL", u.name, u.value))
+			}
+		}
+	}
+
+	if parsed, err := url.Parse(c.DouyinHTTP.LoginBaseURL); err != nil || parsed.Host == "" {
+		problems = append(problems, fmt.Sprintf("douyin_http.login_base_url %q is not an absolute URL", c.DouyinHTTP.LoginBaseURL))
+	}
+
+	if c.MaxSessions < 0 {
+		problems = append(problems, "max_sessions must not be negative")
+	}
+
+	codes := map[string]bool{}
+	for i, plan := range c.MembershipPlans {
+		if plan.Code == "" || codes[plan.Code] {
+			problems = append(problems, fmt.Sprintf("membership_plans[%d] code %q is empty or not unique", i, plan.Code))
+		}
+		codes[plan.Code] = true
+		if plan.Price <= 0 || plan.DurationDays <= 0 {
+			problems = append(problems, fmt.Sprintf("membership plan %q needs a positive price and duration_days", plan.Code))
+		}
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("invalid %s config: %s", c.Profile, strings.Join(problems, "; "))
+	}
+	return nil
+}
+
 func getEnv(key, fallback string) string {
 	if value := os.Getenv(key); value != "" {
 		return value
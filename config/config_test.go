@@ -0,0 +1,59 @@
+package config
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidate(t *testing.T) {
+	t.Setenv("CALLBACK_TOKEN", "token")
+	cfg := LoadConfig()
+	assert.NoError(t, cfg.Validate())
+
+	invalid := cfg
+	invalid.Payment.StoreUid = ""
+	invalid.Payment.ValidTime = 0
+	invalid.Payment.NotifyURL = "/pay"
+	err := invalid.Validate()
+	assert.ErrorContains(t, err, "payment.store_uid is empty")
+	assert.ErrorContains(t, err, "payment.valid_time")
+	assert.ErrorContains(t, err, "payment.notify_url")
+
+	fake := cfg
+	fake.PaymentGateway = "fake"
+	fake.Payment = PaymentConfig{}
+	assert.NoError(t, fake.Validate())
+	fake.Profile = "production"
+	assert.ErrorContains(t, fake.Validate(), "must not be used in production")
+
+	assert.ErrorContains(t, Config{PaymentGateway: "alipay"}.Validate(), "unknown payment_gateway")
+
+	invalid = cfg
+	invalid.DouyinHTTP.LoginBaseURL = ""
+	assert.ErrorContains(t, invalid.Validate(), "douyin_http.login_base_url")
+
+	invalid = cfg
+	invalid.MembershipPlans = []MembershipPlan{{Code: "monthly", Price: 1800, DurationDays: 31}, {Code: "monthly", Price: 0, DurationDays: 31}}
+	err = invalid.Validate()
+	assert.ErrorContains(t, err, `membership_plans[1] code "monthly" is empty or not unique`)
+	assert.ErrorContains(t, err, "positive price")
+
+	invalid = cfg
+	invalid.MaxSessions = -1
+	assert.ErrorContains(t, invalid.Validate(), "max_sessions")
+}
+
+func TestMembershipPlan(t *testing.T) {
+	cfg := Config{MembershipPlans: []MembershipPlan{{Code: "monthly", Price: 1800, DurationDays: 31}}}
+	plan, ok := cfg.MembershipPlan("monthly")
+	assert.True(t, ok)
+	assert.Equal(t, 31, plan.DurationDays)
+	_, ok = cfg.MembershipPlan("weekly")
+	assert.False(t, ok)
+}
+
+func TestPaymentConfig_CallbackURL(t *testing.T) {
+	p := PaymentConfig{NotifyURL: "https://api.example.com/"}
+	assert.Equal(t, "https://api.example.com/pay/callback", p.CallbackURL("/pay/callback"))
+}
@@ -0,0 +1,252 @@
+package handlers
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+
+	"learning-api/models"
+	"learning-api/payment"
+
+	"github.com/gin-gonic/gin"
+)
+
+// BundleRequest is the input struct for creating and updating bundles
+type BundleRequest struct {
+	Name                string `json:"name" binding:"required"`
+	Description         string `json:"description"`
+	CoverURL            string `json:"cover_url"`
+	Price               int    `json:"price"`
+	IncludeFutureTopics bool   `json:"include_future_topics"`
+	OnSale              *bool  `json:"on_sale"`
+	TopicIDs            []uint `json:"topic_ids"`
+}
+
+// BundleOrderRequest is the input struct for /bundles/:id/order
+type BundleOrderRequest struct {
+	CpExtra string `json:"cp_extra"`
+}
+
+// findBundle loads the bundle named by the :id param with its topics. On failure it has already replied.
+func findBundle(c *gin.Context) (*models.Bundle, bool) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid bundle id"})
+		return nil, false
+	}
+	var bundle models.Bundle
+	if err := models.GetDB().Preload("Topics").First(&bundle, id).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "bundle not found"})
+		return nil, false
+	}
+	return &bundle, true
+}
+
+// ListBundles handles GET /bundles, the bundles on sale
+func ListBundles(c *gin.Context) {
+	var bundles []models.Bundle
+	if err := models.GetDB().Preload("Topics").Where("on_sale = ?", true).Order("id ASC").Find(&bundles).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, bundles)
+}
+
+// GetBundle handles GET /bundles/:id
+func GetBundle(c *gin.Context) {
+	bundle, ok := findBundle(c)
+	if !ok {
+		return
+	}
+	c.JSON(http.StatusOK, bundle)
+}
+
+// PayBundleOrder handles POST /bundles/:id/order. It creates an ecpay order for the bundle; its
+// topics are unlocked when the order is paid.
+func PayBundleOrder(c *gin.Context) {
+	var req BundleOrderRequest
+	if err := c.ShouldBindJSON(&req); err != nil && !errors.Is(err, io.EOF) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	currentUser, exists := c.Get("currentUser")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return
+	}
+	user := currentUser.(models.User)
+
+	bundle, ok := findBundle(c)
+	if !ok {
+		return
+	}
+	if !bundle.OnSale || bundle.Price <= 0 || len(bundle.Topics) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "bundle is not for sale"})
+		return
+	}
+	owned, err := models.EntitledTopicIDs(user.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	ownsAll := true
+	for _, topic := range bundle.Topics {
+		ownsAll = ownsAll && owned[topic.ID]
+	}
+	if ownsAll && !bundle.IncludeFutureTopics {
+		c.JSON(http.StatusConflict, gin.H{"error": "every topic of the bundle is already unlocked"})
+		return
+	}
+
+	gateway, err := paymentGatewayFunc(payment.Resolve(payment.GatewayEcpay))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	openOrder, err := models.FindOpenBundleOrder(user.ID, bundle.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if openOrder != nil {
+		if openOrder.Gateway != gateway.Name() {
+			c.JSON(http.StatusConflict, gin.H{"error": "an unpaid order with another payment method is open", "order": openOrder})
+			return
+		}
+		// Hand back the unpaid order so the client can resume it instead of paying twice
+		c.JSON(http.StatusOK, payOrderResponse(openOrder))
+		return
+	}
+
+	order := models.Order{
+		UserID:     user.ID,
+		BundleID:   &bundle.ID,
+		Price:      bundle.Price,
+		Gateway:    gateway.Name(),
+		OutOrderNo: randomOrderNo(),
+	}
+	err = order.CreateWithGatewayOrder(func(o *models.Order) (string, string, error) {
+		created, err := gateway.CreateOrder(payment.OrderRequest{
+			OutOrderNo:  o.OutOrderNo,
+			Amount:      o.Price,
+			Subject:     truncateRunes(bundle.Name, maxOrderTextLength),
+			Body:        truncateRunes(bundleOrderBody(bundle), maxOrderTextLength),
+			CpExtra:     req.CpExtra,
+			SkuID:       "bundle_" + strconv.FormatUint(uint64(bundle.ID), 10),
+			ImageURL:    bundle.CoverURL,
+			EntryParams: orderEntryParams(o),
+		})
+		if err != nil {
+			return "", "", err
+		}
+		return created.OrderID, created.OrderToken, nil
+	})
+	if err != nil {
+		c.JSON(http.StatusBadGateway, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, payOrderResponse(&order))
+}
+
+// bundleOrderBody describes what the buyer unlocks, falling back to the bundle name
+func bundleOrderBody(bundle *models.Bundle) string {
+	if bundle.Description != "" {
+		return bundle.Description
+	}
+	return bundle.Name
+}
+
+// CreateBundle handles POST /admin/bundles
+func CreateBundle(c *gin.Context) {
+	var req BundleRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	bundle := models.Bundle{OnSale: true}
+	saveBundle(c, &bundle, req, http.StatusCreated)
+}
+
+// UpdateBundle handles PUT /admin/bundles/:id. topic_ids replaces the topics of the bundle.
+func UpdateBundle(c *gin.Context) {
+	var req BundleRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	bundle, ok := findBundle(c)
+	if !ok {
+		return
+	}
+	saveBundle(c, bundle, req, http.StatusOK)
+}
+
+func saveBundle(c *gin.Context, bundle *models.Bundle, req BundleRequest, status int) {
+	if req.Price < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "price must not be negative"})
+		return
+	}
+	var found int64
+	if len(req.TopicIDs) > 0 {
+		if err := models.GetDB().Model(&models.Topic{}).Where("id IN ?", req.TopicIDs).Count(&found).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+	}
+	if int(found) != len(uniqueIDs(req.TopicIDs)) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "topic not found"})
+		return
+	}
+
+	bundle.Name = req.Name
+	bundle.Description = req.Description
+	bundle.CoverURL = req.CoverURL
+	bundle.Price = req.Price
+	bundle.IncludeFutureTopics = req.IncludeFutureTopics
+	if req.OnSale != nil {
+		bundle.OnSale = *req.OnSale
+	}
+	// topics are saved by SetTopics, which also unlocks added topics for earlier buyers
+	if err := models.GetDB().Omit("Topics").Save(bundle).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if err := bundle.SetTopics(req.TopicIDs); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(status, bundle)
+}
+
+func uniqueIDs(ids []uint) map[uint]bool {
+	unique := make(map[uint]bool, len(ids))
+	for _, id := range ids {
+		unique[id] = true
+	}
+	return unique
+}
+
+// DeleteBundle handles DELETE /admin/bundles/:id. A bundle that was ever ordered is kept for its
+// orders; take it off sale instead.
+func DeleteBundle(c *gin.Context) {
+	bundle, ok := findBundle(c)
+	if !ok {
+		return
+	}
+	ordered, err := bundle.HasOrders()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if ordered {
+		c.JSON(http.StatusConflict, gin.H{"error": "bundle has orders; set on_sale to false instead"})
+		return
+	}
+	if err := models.GetDB().Select("Topics").Delete(bundle).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
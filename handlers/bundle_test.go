@@ -0,0 +1,95 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"learning-api/models"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBundles(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	db := models.InitTestDB()
+	db.AutoMigrate(&models.Topic{}, &models.Experience{})
+	models.SetDB(db)
+	gateway := newFakeEcpayGateway(t)
+
+	user := models.User{OpenID: "bundle_user"}
+	db.Create(&user)
+	topics := []models.Topic{{Name: "A", Price: 990}, {Name: "B", Price: 990}, {Name: "C", Price: 990}}
+	db.Create(&topics)
+	experience := models.Experience{TopicID: topics[1].ID, UserID: user.ID}
+	db.Create(&experience)
+
+	router := gin.New()
+	router.Use(func(c *gin.Context) {
+		c.Set("currentUser", user)
+		c.Next()
+	})
+	router.GET("/bundles", ListBundles)
+	router.POST("/bundles/:id/order", PayBundleOrder)
+	router.POST("/admin/bundles", CreateBundle)
+	router.PUT("/admin/bundles/:id", UpdateBundle)
+	router.DELETE("/admin/bundles/:id", DeleteBundle)
+	serve := func(method, path string, body interface{}) (*httptest.ResponseRecorder, map[string]interface{}) {
+		var buf bytes.Buffer
+		if body != nil {
+			json.NewEncoder(&buf).Encode(body)
+		}
+		req, _ := http.NewRequest(method, path, &buf)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		var response map[string]interface{}
+		json.Unmarshal(w.Body.Bytes(), &response)
+		return w, response
+	}
+
+	w, _ := serve("POST", "/admin/bundles", BundleRequest{Name: "Pack", Price: 1990, TopicIDs: []uint{topics[0].ID, 999}})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	w, response := serve("POST", "/admin/bundles", BundleRequest{Name: "Pack", Description: "Two topics", Price: 1990, IncludeFutureTopics: true, TopicIDs: []uint{topics[0].ID, topics[1].ID}})
+	assert.Equal(t, http.StatusCreated, w.Code)
+	assert.Equal(t, true, response["on_sale"])
+	assert.Len(t, response["topics"], 2)
+	path := "/admin/bundles/" + strconv.FormatUint(uint64(response["id"].(float64)), 10)
+	bundleID := uint(response["id"].(float64))
+
+	offSale := false
+	serve("POST", "/admin/bundles", BundleRequest{Name: "Hidden", Price: 990, OnSale: &offSale})
+	w = httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/bundles", nil)
+	router.ServeHTTP(w, req)
+	var listed []models.Bundle
+	json.Unmarshal(w.Body.Bytes(), &listed)
+	assert.Len(t, listed, 1)
+	assert.Equal(t, "Pack", listed[0].Name)
+
+	orderPath := "/bundles/" + strconv.FormatUint(uint64(bundleID), 10) + "/order"
+	w, response = serve("POST", orderPath, nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	created := gateway.createdOrders()
+	assert.Len(t, created, 1)
+	assert.Equal(t, 1990, created[0].TotalAmount)
+	assert.Equal(t, "Two topics", created[0].Body)
+
+	// Paying unlocks the contained topics, and a topic added later
+	order, _ := models.FindOrderByOutOrderNo(response["out_order_no"].(string))
+	assert.Equal(t, bundleID, *order.BundleID)
+	_, err := order.MarkPaid("DY_1", models.OrderSourceCallback)
+	assert.NoError(t, err)
+	assert.True(t, experience.IsPaid())
+	w, _ = serve("PUT", path, BundleRequest{Name: "Pack", Price: 1990, IncludeFutureTopics: true, TopicIDs: []uint{topics[0].ID, topics[1].ID, topics[2].ID}})
+	assert.Equal(t, http.StatusOK, w.Code)
+	owned, _ := models.EntitledTopicIDs(user.ID)
+	assert.True(t, owned[topics[2].ID])
+
+	// An ordered bundle is kept
+	w, _ = serve("DELETE", path, nil)
+	assert.Equal(t, http.StatusConflict, w.Code)
+}
@@ -0,0 +1,192 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"learning-api/models"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ValidateCouponRequest is the input struct for /coupons/validate
+type ValidateCouponRequest struct {
+	Code    string `json:"code" binding:"required"`
+	TopicID uint   `json:"topic_id" binding:"required"`
+}
+
+// CouponRequest is the input struct for creating and updating coupons
+type CouponRequest struct {
+	Code           string            `json:"code"`
+	Type           models.CouponType `json:"type"`
+	Value          int               `json:"value"`
+	TopicID        *uint             `json:"topic_id"`
+	MaxUses        int               `json:"max_uses"`
+	MaxUsesPerUser int               `json:"max_uses_per_user"`
+	StartsAt       *time.Time        `json:"starts_at"`
+	EndsAt         *time.Time        `json:"ends_at"`
+}
+
+// couponErrorStatus maps the reasons a coupon cannot be applied to HTTP statuses
+var couponErrorStatus = map[error]int{
+	models.ErrCouponNotFound:      http.StatusNotFound,
+	models.ErrCouponNotStarted:    http.StatusBadRequest,
+	models.ErrCouponExpired:       http.StatusBadRequest,
+	models.ErrCouponNotApplicable: http.StatusBadRequest,
+	models.ErrCouponExhausted:     http.StatusConflict,
+	models.ErrCouponUserLimit:     http.StatusConflict,
+}
+
+// replyCouponError replies with the reason a coupon cannot be applied. It reports false, without
+// replying, when err is not about the coupon.
+func replyCouponError(c *gin.Context, err error) bool {
+	for couponErr, status := range couponErrorStatus {
+		if errors.Is(err, couponErr) {
+			c.JSON(status, gin.H{"error": couponErr.Error()})
+			return true
+		}
+	}
+	return false
+}
+
+// applicableCoupon loads the coupon with code and checks userID can use it for topicID now.
+// ok is false when it has already replied.
+func applicableCoupon(c *gin.Context, code string, userID uint, topicID uint) (*models.Coupon, bool) {
+	coupon, err := models.FindCouponByCode(code)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return nil, false
+	}
+	if coupon == nil {
+		err = models.ErrCouponNotFound
+	} else {
+		err = coupon.Check(userID, topicID, time.Now())
+	}
+	if err != nil {
+		if !replyCouponError(c, err) {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		}
+		return nil, false
+	}
+	return coupon, true
+}
+
+// ValidateCoupon handles POST /coupons/validate. It previews the price of the topic with the
+// coupon without using it up.
+func ValidateCoupon(c *gin.Context) {
+	var req ValidateCouponRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	currentUser, exists := c.Get("currentUser")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return
+	}
+	user := currentUser.(models.User)
+
+	var topic models.Topic
+	if err := models.GetDB().First(&topic, req.TopicID).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "topic not found"})
+		return
+	}
+	if topic.Price <= 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "topic is not for sale"})
+		return
+	}
+	coupon, ok := applicableCoupon(c, req.Code, user.ID, topic.ID)
+	if !ok {
+		return
+	}
+
+	discount := coupon.Discount(topic.Price)
+	c.JSON(http.StatusOK, gin.H{
+		"code":           coupon.Code,
+		"type":           coupon.Type,
+		"original_price": topic.Price,
+		"discount":       discount,
+		"price":          topic.Price - discount,
+	})
+}
+
+// ListCoupons handles GET /admin/coupons
+func ListCoupons(c *gin.Context) {
+	var coupons []models.Coupon
+	if err := models.GetDB().Order("id DESC").Find(&coupons).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, coupons)
+}
+
+// CreateCoupon handles POST /admin/coupons
+func CreateCoupon(c *gin.Context) {
+	var req CouponRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	var coupon models.Coupon
+	saveCoupon(c, &coupon, req, http.StatusCreated)
+}
+
+// UpdateCoupon handles PUT /admin/coupons/:id. The use count is kept; setting ends_at to now
+// stops a campaign.
+func UpdateCoupon(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid coupon id"})
+		return
+	}
+	var req CouponRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	var coupon models.Coupon
+	if err := models.GetDB().First(&coupon, id).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "coupon not found"})
+		return
+	}
+	saveCoupon(c, &coupon, req, http.StatusOK)
+}
+
+func saveCoupon(c *gin.Context, coupon *models.Coupon, req CouponRequest, status int) {
+	coupon.Code = models.NormalizeCouponCode(req.Code)
+	coupon.Type = req.Type
+	coupon.Value = req.Value
+	coupon.TopicID = req.TopicID
+	coupon.MaxUses = req.MaxUses
+	coupon.MaxUsesPerUser = req.MaxUsesPerUser
+	coupon.StartsAt = req.StartsAt
+	coupon.EndsAt = req.EndsAt
+	if err := coupon.Validate(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	existing, err := models.FindCouponByCode(coupon.Code)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if existing != nil && existing.ID != coupon.ID {
+		c.JSON(http.StatusConflict, gin.H{"error": "coupon code already exists"})
+		return
+	}
+	if coupon.ID == 0 {
+		err = models.GetDB().Create(coupon).Error
+	} else {
+		// used_count is left out so a concurrent redemption is not overwritten
+		err = models.GetDB().Model(coupon).
+			Select("Code", "Type", "Value", "TopicID", "MaxUses", "MaxUsesPerUser", "StartsAt", "EndsAt", "UpdatedAt").
+			Updates(coupon).Error
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(status, coupon)
+}
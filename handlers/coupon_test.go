@@ -0,0 +1,132 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"learning-api/models"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateCoupon(t *testing.T) {
+	router, db, _, experience, _ := setupPayOrderTest(t)
+	router.POST("/coupons/validate", ValidateCoupon)
+	otherTopic := models.Topic{Name: "Other Topic", Price: 1990}
+	db.Create(&otherTopic)
+	db.Create(&models.Coupon{Code: "SPRING20", Type: models.CouponTypePercentOff, Value: 20, TopicID: &experience.TopicID})
+
+	validate := func(body interface{}) (*httptest.ResponseRecorder, map[string]interface{}) {
+		jsonBody, _ := json.Marshal(body)
+		req, _ := http.NewRequest("POST", "/coupons/validate", bytes.NewBuffer(jsonBody))
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		var response map[string]interface{}
+		json.Unmarshal(w.Body.Bytes(), &response)
+		return w, response
+	}
+
+	// Codes are case-insensitive
+	w, response := validate(ValidateCouponRequest{Code: "spring20", TopicID: experience.TopicID})
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, float64(990), response["original_price"])
+	assert.Equal(t, float64(198), response["discount"])
+	assert.Equal(t, float64(792), response["price"])
+
+	w, _ = validate(ValidateCouponRequest{Code: "SPRING20", TopicID: otherTopic.ID})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	w, _ = validate(ValidateCouponRequest{Code: "WINTER", TopicID: experience.TopicID})
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	// Validating does not use the coupon up
+	coupon, _ := models.FindCouponByCode("SPRING20")
+	assert.Equal(t, 0, coupon.UsedCount)
+}
+
+func TestPayOrder_WithCoupon(t *testing.T) {
+	router, db, _, experience, gateway := setupPayOrderTest(t)
+	db.Create(&models.Coupon{Code: "MINUS300", Type: models.CouponTypeFixedOff, Value: 300, MaxUsesPerUser: 1})
+
+	w := postPayOrder(router, PayOrderRequest{ExperienceID: experience.ID, CouponCode: "minus300"})
+	assert.Equal(t, http.StatusOK, w.Code)
+	created := gateway.createdOrders()
+	assert.Len(t, created, 1)
+	assert.Equal(t, 690, created[0].TotalAmount)
+
+	var order models.Order
+	db.Where("experience_id = ?", experience.ID).First(&order)
+	assert.Equal(t, 690, order.Price)
+	assert.Equal(t, 990, order.OriginalPrice)
+	assert.Equal(t, 300, order.Discount)
+	assert.Equal(t, "MINUS300", order.CouponCode)
+
+	// The unpaid order is only resumed with the same coupon
+	w = postPayOrder(router, PayOrderRequest{ExperienceID: experience.ID})
+	assert.Equal(t, http.StatusConflict, w.Code)
+	w = postPayOrder(router, PayOrderRequest{ExperienceID: experience.ID, CouponCode: "MINUS300"})
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Len(t, gateway.createdOrders(), 1)
+
+	// Once that order is gone the per-user limit is free again
+	assert.NoError(t, order.Transition(models.OrderStatusCancelled, models.OrderSourceUser, "", nil))
+	w = postPayOrder(router, PayOrderRequest{ExperienceID: experience.ID, CouponCode: "MINUS300"})
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Len(t, gateway.createdOrders(), 2)
+}
+
+func TestPayOrder_FreeUnlockCoupon(t *testing.T) {
+	router, db, _, experience, gateway := setupPayOrderTest(t)
+	db.Create(&models.Coupon{Code: "FREE", Type: models.CouponTypeFreeUnlock, MaxUses: 1})
+
+	w := postPayOrder(router, PayOrderRequest{ExperienceID: experience.ID, CouponCode: "FREE"})
+	assert.Equal(t, http.StatusOK, w.Code)
+	var response map[string]interface{}
+	json.Unmarshal(w.Body.Bytes(), &response)
+	assert.Equal(t, true, response["paid"])
+	assert.Empty(t, gateway.createdOrders(), "a free order is not sent to the gateway")
+	assert.True(t, experience.IsPaid())
+
+	// The only use is taken
+	topic := models.Topic{Name: "Another Topic", Price: 990}
+	db.Create(&topic)
+	other := models.Experience{TopicID: topic.ID, UserID: experience.UserID}
+	db.Create(&other)
+	w = postPayOrder(router, PayOrderRequest{ExperienceID: other.ID, CouponCode: "FREE"})
+	assert.Equal(t, http.StatusConflict, w.Code)
+}
+
+func TestCreateCoupon(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	models.SetDB(models.InitTestDB())
+	router := gin.New()
+	router.POST("/admin/coupons", CreateCoupon)
+	router.PUT("/admin/coupons/:id", UpdateCoupon)
+	send := func(method, path string, body interface{}) *httptest.ResponseRecorder {
+		jsonBody, _ := json.Marshal(body)
+		req, _ := http.NewRequest(method, path, bytes.NewBuffer(jsonBody))
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	w := send("POST", "/admin/coupons", CouponRequest{Code: " launch ", Type: models.CouponTypePercentOff, Value: 30, MaxUses: 100})
+	assert.Equal(t, http.StatusCreated, w.Code)
+	var coupon models.Coupon
+	json.Unmarshal(w.Body.Bytes(), &coupon)
+	assert.Equal(t, "LAUNCH", coupon.Code)
+
+	assert.Equal(t, http.StatusConflict, send("POST", "/admin/coupons", CouponRequest{Code: "LAUNCH", Type: models.CouponTypeFreeUnlock}).Code)
+	assert.Equal(t, http.StatusBadRequest, send("POST", "/admin/coupons", CouponRequest{Code: "BAD", Type: models.CouponTypePercentOff, Value: 0}).Code)
+
+	models.GetDB().Model(&coupon).Update("used_count", 7)
+	w = send("PUT", "/admin/coupons/"+strconv.FormatUint(uint64(coupon.ID), 10), CouponRequest{Code: "LAUNCH", Type: models.CouponTypePercentOff, Value: 40, MaxUses: 100})
+	assert.Equal(t, http.StatusOK, w.Code)
+	stored, _ := models.FindCouponByCode("launch")
+	assert.Equal(t, 40, stored.Value)
+	assert.Equal(t, 7, stored.UsedCount)
+}
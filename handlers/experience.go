@@ -1,7 +1,11 @@
 package handlers
 
 import (
+	"errors"
+	"fmt"
+	"io"
 	"learning-api/models"
+	"learning-api/payment"
 	"net/http"
 	"strconv"
 	"time"
@@ -60,7 +64,7 @@ func GetExperience(c *gin.Context) {
 	user := currentUser.(models.User)
 
 	var experience models.Experience
-	err = db.Preload("Replies").Preload("User").Preload("Order").Preload("Topic.Questions.Answers").First(&experience, id).Error
+	err = db.Preload("Replies").Preload("User").Preload("Order", models.LatestOrder).Preload("Topic.Questions.Answers").First(&experience, id).Error
 	if err != nil {
 		c.JSON(http.StatusNotFound, gin.H{"error": "experience not found"})
 		return
@@ -120,10 +124,9 @@ func GetMyExperiences(c *gin.Context) {
 	c.JSON(http.StatusOK, resp)
 }
 
+// MarkPaidRequest optionally names the order the client just paid; the server only trusts the gateway
 type MarkPaidRequest struct {
-	OrderNo    string `json:"order_no" binding:"required"`
-	OutOrderNo string `json:"out_order_no" binding:"required"`
-	Price      int    `json:"price" binding:"required"`
+	OutOrderNo string `json:"out_order_no"`
 }
 
 func MarkExperiencePaid(c *gin.Context) {
@@ -145,16 +148,16 @@ func MarkExperiencePaid(c *gin.Context) {
 	}
 	user := currentUser.(models.User)
 
-	// Parse request body
+	// Parse request body, which may be empty
 	var req MarkPaidRequest
-	if err := c.ShouldBindJSON(&req); err != nil {
+	if err := c.ShouldBindJSON(&req); err != nil && !errors.Is(err, io.EOF) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
 
 	// Load the experience
 	var experience models.Experience
-	err = db.Preload("Order").First(&experience, experienceID).Error
+	err = db.Preload("Order", models.LatestOrder).First(&experience, experienceID).Error
 	if err != nil {
 		c.JSON(http.StatusNotFound, gin.H{"error": "experience not found"})
 		return
@@ -166,34 +169,56 @@ func MarkExperiencePaid(c *gin.Context) {
 		return
 	}
 
-	// Check if experience already has an order
-	if experience.Order != nil {
-		c.JSON(http.StatusConflict, gin.H{"error": "experience already has an order"})
-		return
-	}
-
-	// Create new order with paid status
-	order := models.Order{
-		UserID:       user.ID,
-		ExperienceID: uint(experienceID),
-		Price:        req.Price,
-		Status:       models.OrderStatusPaid,
-		OrderNo:      req.OrderNo,
-		OutOrderNo:   req.OutOrderNo,
-	}
-
-	// Save the order
-	if err := db.Create(&order).Error; err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to create order: " + err.Error()})
-		return
-	}
-
-	// Reload experience with the new order
-	err = db.Preload("Order").First(&experience, experienceID).Error
+	// Unless the user already owns the topic, the order must have been created through /pay/order
+	paid := experience.IsPaid()
+	order := experience.Order
+	if order == nil && !paid {
+		c.JSON(http.StatusNotFound, gin.H{"error": "order not found"})
+		return
+	}
+	if order != nil && req.OutOrderNo != "" && req.OutOrderNo != order.OutOrderNo {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "out_order_no does not match the experience order"})
+		return
+	}
+
+	// Ask the order's gateway unless the payment notification already marked the order paid
+	if !paid {
+		gateway, err := paymentGatewayFunc(order.Gateway)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		result, err := gateway.QueryOrder(order.OutOrderNo)
+		if err != nil {
+			c.JSON(http.StatusBadGateway, gin.H{"error": "failed to query order: " + err.Error()})
+			return
+		}
+		if !result.Found {
+			c.JSON(http.StatusBadGateway, gin.H{"error": "failed to query order: " + result.Message})
+			return
+		}
+		if result.Status != payment.StatusSuccess {
+			c.JSON(http.StatusPaymentRequired, gin.H{"error": "order is not paid", "order_status": result.Status})
+			return
+		}
+		if result.Amount != order.Price {
+			fmt.Println("mark paid rejected: order", order.OutOrderNo, "amount", result.Amount, "does not match price", order.Price)
+			c.JSON(http.StatusConflict, gin.H{"error": "paid amount does not match order price"})
+			return
+		}
+		if _, err := order.MarkPaid(result.OrderID, models.OrderSourceUser); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to update order: " + err.Error()})
+			return
+		}
+	}
+
+	// Reload experience with the updated order
+	err = db.Preload("Order", models.LatestOrder).First(&experience, experienceID).Error
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to reload experience"})
 		return
 	}
+	order = experience.Order
 
 	// Return the updated experience with paid status
 	response := gin.H{
@@ -203,7 +228,11 @@ func MarkExperiencePaid(c *gin.Context) {
 		"paid":       experience.Paid(),
 		"created_at": experience.CreatedAt,
 		"updated_at": experience.UpdatedAt,
-		"order": gin.H{
+		"order":      nil,
+	}
+	// A retake of an owned topic has no order of its own
+	if order != nil {
+		response["order"] = gin.H{
 			"id":           order.ID,
 			"order_no":     order.OrderNo,
 			"out_order_no": order.OutOrderNo,
@@ -211,7 +240,7 @@ func MarkExperiencePaid(c *gin.Context) {
 			"status":       order.Status.String(),
 			"created_at":   order.CreatedAt,
 			"updated_at":   order.UpdatedAt,
-		},
+		}
 	}
 
 	c.JSON(http.StatusOK, response)
@@ -3,6 +3,7 @@ package handlers
 import (
 	"bytes"
 	"encoding/json"
+	"fmt"
 	"learning-api/models"
 	"net/http"
 	"net/http/httptest"
@@ -18,6 +19,8 @@ func TestMarkExperiencePaid(t *testing.T) {
 	db.AutoMigrate(&models.User{}, &models.Topic{}, &models.Experience{}, &models.Order{})
 	models.SetDB(db)
 
+	gateway := newFakeEcpayGateway(t)
+
 	// Create test user
 	user := models.User{
 		OpenID: "test_user",
@@ -27,16 +30,32 @@ func TestMarkExperiencePaid(t *testing.T) {
 
 	// Create test topic
 	topic := models.Topic{
-		Name: "Test Topic",
+		Name:  "Test Topic",
+		Price: 1000,
 	}
 	db.Create(&topic)
 
-	// Create test experience
-	experience := models.Experience{
-		TopicID: topic.ID,
-		UserID:  user.ID,
+	// createPendingExperience creates an experience with the order /pay/order would have left behind.
+	// Each gets its own topic, since paying for a topic unlocks every experience of it.
+	createPendingExperience := func(outOrderNo string) (models.Experience, models.Order) {
+		topic := models.Topic{Name: "Topic " + outOrderNo, Price: 1000}
+		db.Create(&topic)
+		experience := models.Experience{
+			TopicID: topic.ID,
+			UserID:  user.ID,
+		}
+		db.Create(&experience)
+		order := models.Order{
+			UserID:       user.ID,
+			ExperienceID: &experience.ID,
+			Price:        1000,
+			Status:       models.OrderStatusPending,
+			OrderNo:      outOrderNo,
+			OutOrderNo:   outOrderNo,
+		}
+		db.Create(&order)
+		return experience, order
 	}
-	db.Create(&experience)
 
 	// Setup Gin router
 	gin.SetMode(gin.TestMode)
@@ -50,35 +69,27 @@ func TestMarkExperiencePaid(t *testing.T) {
 
 	router.POST("/experiences/:id/paid", MarkExperiencePaid)
 
-	t.Run("successful payment", func(t *testing.T) {
-		// Prepare request body
-		requestBody := MarkPaidRequest{
-			OrderNo:    "ORD20250624001",
-			OutOrderNo: "PAY20250624001",
-			Price:      1000,
-		}
-		jsonBody, _ := json.Marshal(requestBody)
-
-		// Create request
-		req, _ := http.NewRequest("POST", "/experiences/1/paid", bytes.NewBuffer(jsonBody))
+	markPaid := func(experienceID string, body interface{}) (*httptest.ResponseRecorder, map[string]interface{}) {
+		jsonBody, _ := json.Marshal(body)
+		req, _ := http.NewRequest("POST", "/experiences/"+experienceID+"/paid", bytes.NewBuffer(jsonBody))
 		req.Header.Set("Content-Type", "application/json")
-
-		// Create response recorder
 		w := httptest.NewRecorder()
-
-		// Perform request
 		router.ServeHTTP(w, req)
+		var response map[string]interface{}
+		json.Unmarshal(w.Body.Bytes(), &response)
+		return w, response
+	}
 
-		// Assert response
-		assert.Equal(t, http.StatusOK, w.Code)
+	t.Run("gateway confirms payment", func(t *testing.T) {
+		experience, _ := createPendingExperience("PAY20250624001")
+		gateway.setOrder("PAY20250624001", "ORD20250624001", "SUCCESS", 1000)
 
-		var response map[string]interface{}
-		err := json.Unmarshal(w.Body.Bytes(), &response)
-		assert.NoError(t, err)
+		w, response := markPaid(fmt.Sprint(experience.ID), MarkPaidRequest{OutOrderNo: "PAY20250624001"})
 
-		// Check response structure
-		assert.Equal(t, float64(1), response["id"])
-		assert.Equal(t, float64(topic.ID), response["topic_id"])
+		// Assert response
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, float64(experience.ID), response["id"])
+		assert.Equal(t, float64(experience.TopicID), response["topic_id"])
 		assert.Equal(t, float64(user.ID), response["user_id"])
 		assert.Equal(t, true, response["paid"])
 
@@ -94,91 +105,111 @@ func TestMarkExperiencePaid(t *testing.T) {
 		var dbExperience models.Experience
 		db.Preload("Order").First(&dbExperience, experience.ID)
 		assert.True(t, dbExperience.Paid())
-		assert.NotNil(t, dbExperience.Order)
 		assert.Equal(t, models.OrderStatusPaid, dbExperience.Order.Status)
 	})
 
-	t.Run("invalid experience ID", func(t *testing.T) {
-		requestBody := MarkPaidRequest{
-			OrderNo:    "ORD20250624002",
-			OutOrderNo: "PAY20250624002",
-			Price:      500,
-		}
-		jsonBody, _ := json.Marshal(requestBody)
-
-		req, _ := http.NewRequest("POST", "/experiences/invalid/paid", bytes.NewBuffer(jsonBody))
-		req.Header.Set("Content-Type", "application/json")
+	t.Run("order already paid by callback", func(t *testing.T) {
+		experience, order := createPendingExperience("PAY20250624002")
+		assert.NoError(t, order.Transition(models.OrderStatusPaid, models.OrderSourceCallback, "", nil))
+		before := gateway.requestCount()
 
-		w := httptest.NewRecorder()
-		router.ServeHTTP(w, req)
+		w, response := markPaid(fmt.Sprint(experience.ID), nil)
 
-		assert.Equal(t, http.StatusBadRequest, w.Code)
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, true, response["paid"])
+		assert.Equal(t, before, gateway.requestCount(), "stored callback result should be used without querying the gateway")
 	})
 
-	t.Run("experience not found", func(t *testing.T) {
-		requestBody := MarkPaidRequest{
-			OrderNo:    "ORD20250624003",
-			OutOrderNo: "PAY20250624003",
-			Price:      750,
-		}
-		jsonBody, _ := json.Marshal(requestBody)
+	t.Run("gateway reports payment still processing", func(t *testing.T) {
+		experience, order := createPendingExperience("PAY20250624003")
+		gateway.setOrder("PAY20250624003", "ORD20250624003", "PROCESSING", 1000)
 
-		req, _ := http.NewRequest("POST", "/experiences/999/paid", bytes.NewBuffer(jsonBody))
-		req.Header.Set("Content-Type", "application/json")
+		w, _ := markPaid(fmt.Sprint(experience.ID), nil)
 
-		w := httptest.NewRecorder()
-		router.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusPaymentRequired, w.Code)
+		var dbOrder models.Order
+		db.First(&dbOrder, order.ID)
+		assert.Equal(t, models.OrderStatusPending, dbOrder.Status)
+	})
 
-		assert.Equal(t, http.StatusNotFound, w.Code)
+	t.Run("gateway amount does not match price", func(t *testing.T) {
+		experience, order := createPendingExperience("PAY20250624004")
+		gateway.setOrder("PAY20250624004", "ORD20250624004", "SUCCESS", 1)
+
+		w, _ := markPaid(fmt.Sprint(experience.ID), nil)
+
+		assert.Equal(t, http.StatusConflict, w.Code)
+		var dbOrder models.Order
+		db.First(&dbOrder, order.ID)
+		assert.Equal(t, models.OrderStatusPending, dbOrder.Status)
 	})
 
-	t.Run("missing required fields", func(t *testing.T) {
-		requestBody := map[string]interface{}{
-			"order_no": "ORD20250624004",
-			// Missing out_order_no and price
-		}
-		jsonBody, _ := json.Marshal(requestBody)
+	t.Run("gateway does not know the order", func(t *testing.T) {
+		experience, _ := createPendingExperience("PAY20250624005")
 
-		req, _ := http.NewRequest("POST", "/experiences/1/paid", bytes.NewBuffer(jsonBody))
-		req.Header.Set("Content-Type", "application/json")
+		w, _ := markPaid(fmt.Sprint(experience.ID), nil)
 
-		w := httptest.NewRecorder()
-		router.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusBadGateway, w.Code)
+	})
+
+	t.Run("mismatched out_order_no", func(t *testing.T) {
+		experience, _ := createPendingExperience("PAY20250624006")
+
+		w, _ := markPaid(fmt.Sprint(experience.ID), MarkPaidRequest{OutOrderNo: "SOMEONE_ELSES_ORDER"})
 
 		assert.Equal(t, http.StatusBadRequest, w.Code)
 	})
 
-	t.Run("experience already has order", func(t *testing.T) {
-		// Create another experience with an existing order
-		experience2 := models.Experience{
+	t.Run("experience without order", func(t *testing.T) {
+		experience := models.Experience{
 			TopicID: topic.ID,
 			UserID:  user.ID,
 		}
-		db.Create(&experience2)
+		db.Create(&experience)
 
-		existingOrder := models.Order{
-			UserID:       user.ID,
-			ExperienceID: experience2.ID,
-			Price:        500,
-			Status:       models.OrderStatusCreated,
-			OrderNo:      "ORD20250624005",
-			OutOrderNo:   "PAY20250624005",
-		}
-		db.Create(&existingOrder)
+		w, _ := markPaid(fmt.Sprint(experience.ID), nil)
 
-		requestBody := MarkPaidRequest{
-			OrderNo:    "ORD20250624006",
-			OutOrderNo: "PAY20250624006",
-			Price:      1200,
-		}
-		jsonBody, _ := json.Marshal(requestBody)
+		assert.Equal(t, http.StatusNotFound, w.Code)
+	})
 
-		req, _ := http.NewRequest("POST", "/experiences/2/paid", bytes.NewBuffer(jsonBody))
-		req.Header.Set("Content-Type", "application/json")
+	t.Run("retake of a paid topic", func(t *testing.T) {
+		paidExperience, _ := createPendingExperience("PAY20250624007")
+		gateway.setOrder("PAY20250624007", "ORD20250624007", "SUCCESS", 1000)
+		w, _ := markPaid(fmt.Sprint(paidExperience.ID), nil)
+		assert.Equal(t, http.StatusOK, w.Code)
 
-		w := httptest.NewRecorder()
-		router.ServeHTTP(w, req)
+		retake := models.Experience{TopicID: paidExperience.TopicID, UserID: user.ID}
+		db.Create(&retake)
+		w, response := markPaid(fmt.Sprint(retake.ID), nil)
 
-		assert.Equal(t, http.StatusConflict, w.Code)
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, true, response["paid"])
+		assert.Nil(t, response["order"])
+	})
+
+	t.Run("invalid experience ID", func(t *testing.T) {
+		w, _ := markPaid("invalid", nil)
+
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+	})
+
+	t.Run("experience not found", func(t *testing.T) {
+		w, _ := markPaid("999", nil)
+
+		assert.Equal(t, http.StatusNotFound, w.Code)
+	})
+
+	t.Run("not your experience", func(t *testing.T) {
+		other := models.User{OpenID: "other_user"}
+		db.Create(&other)
+		experience := models.Experience{
+			TopicID: topic.ID,
+			UserID:  other.ID,
+		}
+		db.Create(&experience)
+
+		w, _ := markPaid(fmt.Sprint(experience.ID), nil)
+
+		assert.Equal(t, http.StatusForbidden, w.Code)
 	})
 }
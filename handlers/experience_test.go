@@ -92,13 +92,14 @@ func TestGetExperience_Success(t *testing.T) {
 	// Create a paid order for the experience
 	order := models.Order{
 		UserID:       user.ID,
-		ExperienceID: exp.ID,
+		ExperienceID: &exp.ID,
 		Price:        1000,
 		Status:       models.OrderStatusPaid,
 		OrderNo:      "ORD20250624001",
 		OutOrderNo:   "PAY20250624001",
 	}
 	db.Create(&order)
+	order.SyncEntitlement()
 
 	req, _ := http.NewRequest("GET", "/experience/11", nil)
 	w := httptest.NewRecorder()
@@ -110,11 +111,12 @@ func TestGetExperience_Success(t *testing.T) {
 		ID    uint `json:"id"`
 		Paid  bool `json:"paid"`
 		Order *struct {
-			ID         uint   `json:"id"`
-			Price      int    `json:"price"`
-			Status     string `json:"status"`
-			OrderNo    string `json:"order_no"`
-			OutOrderNo string `json:"out_order_no"`
+			ID           uint   `json:"id"`
+			Price        int    `json:"price"`
+			Status       string `json:"status"`
+			OrderNo      string `json:"order_no"`
+			OutOrderNo   string `json:"out_order_no"`
+			SettleStatus string `json:"settle_status"`
 		} `json:"order"`
 		Topic struct {
 			Questions []struct {
@@ -145,9 +147,13 @@ func TestGetExperience_Success(t *testing.T) {
 		if resp.Order.Price != 1000 {
 			t.Errorf("Expected order price 1000, got %d", resp.Order.Price)
 		}
+		// Reading the results changes nothing; the client confirms delivery with a POST
 		if resp.Order.Status != "paid" {
 			t.Errorf("Expected order status 'paid', got %s", resp.Order.Status)
 		}
+		if resp.Order.SettleStatus != "none" {
+			t.Errorf("Expected settle status 'none', got %s", resp.Order.SettleStatus)
+		}
 		if resp.Order.OrderNo != "ORD20250624001" {
 			t.Errorf("Expected order number 'ORD20250624001', got %s", resp.Order.OrderNo)
 		}
@@ -179,7 +185,7 @@ func TestGetExperience_Success(t *testing.T) {
 func TestGetExperience_Forbidden(t *testing.T) {
 	gin.SetMode(gin.TestMode)
 	db, _ := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{})
-	db.AutoMigrate(&models.User{}, &models.Topic{}, &models.Question{}, &models.Answer{}, &models.Experience{}, &models.Reply{}, &models.Order{})
+	db.AutoMigrate(&models.User{}, &models.Topic{}, &models.Question{}, &models.Answer{}, &models.Experience{}, &models.Reply{}, &models.Order{}, &models.Entitlement{})
 	models.SetDB(db)
 	user := models.User{ID: 1, Name: "testuser"}
 	db.Create(&user)
@@ -205,7 +211,7 @@ func TestGetExperience_Forbidden(t *testing.T) {
 func setupGetExperienceTestDB() (*gin.Engine, *gorm.DB, models.User, models.Experience, []models.Answer) {
 	gin.SetMode(gin.TestMode)
 	db, _ := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{})
-	db.AutoMigrate(&models.User{}, &models.Topic{}, &models.Question{}, &models.Answer{}, &models.Experience{}, &models.Reply{}, &models.Order{})
+	db.AutoMigrate(&models.User{}, &models.Topic{}, &models.Question{}, &models.Answer{}, &models.Experience{}, &models.Reply{}, &models.Order{}, &models.OrderStatusHistory{}, &models.Entitlement{}, &models.OrderSyncTask{})
 	models.SetDB(db)
 
 	user := models.User{ID: 1, Name: "testuser"}
@@ -237,7 +243,7 @@ func setupGetExperienceTestDB() (*gin.Engine, *gorm.DB, models.User, models.Expe
 func TestGetMyExperiences(t *testing.T) {
 	gin.SetMode(gin.TestMode)
 	db, _ := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{})
-	db.AutoMigrate(&models.User{}, &models.Topic{}, &models.Experience{})
+	db.AutoMigrate(&models.User{}, &models.Topic{}, &models.Experience{}, &models.Entitlement{})
 	models.SetDB(db)
 
 	user := models.User{ID: 1, Name: "testuser"}
@@ -0,0 +1,98 @@
+package handlers
+
+import (
+	"encoding/json"
+	"learning-api/helpers"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+// fakeEcpayGateway is a local stand-in for the Douyin ecpay API. It answers create_order,
+// query_order and create_refund and records what it was sent.
+type fakeEcpayGateway struct {
+	mu          sync.Mutex
+	orders      map[string]helpers.DouyinQueryOrderResponse
+	requests    int
+	created     []helpers.DouyinOrderRequest
+	refunds     []helpers.DouyinRefundRequest
+	createReply *helpers.DouyinOrderResponse
+	refundReply *helpers.DouyinRefundResponse
+}
+
+func newFakeEcpayGateway(t *testing.T) *fakeEcpayGateway {
+	gateway := &fakeEcpayGateway{orders: map[string]helpers.DouyinQueryOrderResponse{}}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gateway.mu.Lock()
+		defer gateway.mu.Unlock()
+		gateway.requests++
+		w.Header().Set("Content-Type", "application/json")
+
+		switch r.URL.Path {
+		case "/create_order":
+			var order helpers.DouyinOrderRequest
+			json.NewDecoder(r.Body).Decode(&order)
+			gateway.created = append(gateway.created, order)
+			resp := helpers.DouyinOrderResponse{}
+			if gateway.createReply != nil {
+				resp = *gateway.createReply
+			} else {
+				resp.Data.OrderID = "DY_" + order.OutOrderNo
+				resp.Data.OrderToken = "token_" + order.OutOrderNo
+			}
+			json.NewEncoder(w).Encode(resp)
+		case "/query_order":
+			var query helpers.DouyinQueryOrderRequest
+			json.NewDecoder(r.Body).Decode(&query)
+			resp, ok := gateway.orders[query.OutOrderNo]
+			if !ok {
+				resp = helpers.DouyinQueryOrderResponse{ErrNo: helpers.EcpayErrOrderNotFound, ErrTips: "order not exist"}
+			}
+			json.NewEncoder(w).Encode(resp)
+		case "/create_refund":
+			var refund helpers.DouyinRefundRequest
+			json.NewDecoder(r.Body).Decode(&refund)
+			gateway.refunds = append(gateway.refunds, refund)
+			resp := helpers.DouyinRefundResponse{RefundNo: "DY_" + refund.OutRefundNo}
+			if gateway.refundReply != nil {
+				resp = *gateway.refundReply
+			}
+			json.NewEncoder(w).Encode(resp)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+
+	t.Setenv("ECPAY_BASE_URL", server.URL)
+	t.Cleanup(server.Close)
+	return gateway
+}
+
+func (g *fakeEcpayGateway) setOrder(outOrderNo, orderID, status string, totalFee int) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	resp := helpers.DouyinQueryOrderResponse{OutOrderNo: outOrderNo, OrderID: orderID}
+	resp.PaymentInfo.OrderStatus = status
+	resp.PaymentInfo.TotalFee = totalFee
+	g.orders[outOrderNo] = resp
+}
+
+func (g *fakeEcpayGateway) requestCount() int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.requests
+}
+
+func (g *fakeEcpayGateway) createdOrders() []helpers.DouyinOrderRequest {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return append([]helpers.DouyinOrderRequest(nil), g.created...)
+}
+
+func (g *fakeEcpayGateway) reply(create *helpers.DouyinOrderResponse, refund *helpers.DouyinRefundResponse) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.createReply = create
+	g.refundReply = refund
+}
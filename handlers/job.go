@@ -0,0 +1,42 @@
+package handlers
+
+import (
+	"encoding/json"
+	"learning-api/models"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// GetJobStatus returns the lease holder and last run of a background job
+func GetJobStatus(c *gin.Context) {
+	lock, err := models.FindJobLock(c.Param("name"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load job status"})
+		return
+	}
+	if lock == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "job has not run yet"})
+		return
+	}
+
+	// A run is in progress if it started after the last finish and its lease is still live
+	running := lock.LastStartedAt != nil && lock.LockedUntil.After(time.Now()) &&
+		(lock.LastFinishedAt == nil || lock.LastFinishedAt.Before(*lock.LastStartedAt))
+
+	var lastResult interface{}
+	if lock.LastResult != "" {
+		lastResult = json.RawMessage(lock.LastResult)
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"name":             lock.Name,
+		"owner":            lock.Owner,
+		"running":          running,
+		"locked_until":     lock.LockedUntil,
+		"last_started_at":  lock.LastStartedAt,
+		"last_finished_at": lock.LastFinishedAt,
+		"last_result":      lastResult,
+		"last_error":       lock.LastError,
+	})
+}
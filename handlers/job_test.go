@@ -0,0 +1,47 @@
+package handlers
+
+import (
+	"encoding/json"
+	"learning-api/models"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetJobStatus(t *testing.T) {
+	db := models.InitTestDB()
+	models.SetDB(db)
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.GET("/admin/jobs/:name", GetJobStatus)
+
+	getStatus := func(name string) (*httptest.ResponseRecorder, map[string]interface{}) {
+		req, _ := http.NewRequest("GET", "/admin/jobs/"+name, nil)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		var response map[string]interface{}
+		json.Unmarshal(w.Body.Bytes(), &response)
+		return w, response
+	}
+
+	w, _ := getStatus("order_reconciler")
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	models.AcquireJobLock("order_reconciler", "replica-a", time.Minute)
+	w, response := getStatus("order_reconciler")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, true, response["running"])
+	assert.Equal(t, "replica-a", response["owner"])
+
+	models.FinishJobRun("order_reconciler", "replica-a", `{"checked":2,"paid":1}`, nil)
+	w, response = getStatus("order_reconciler")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, false, response["running"])
+	assert.Equal(t, map[string]interface{}{"checked": float64(2), "paid": float64(1)}, response["last_result"])
+	assert.Equal(t, "", response["last_error"])
+}
@@ -0,0 +1,134 @@
+package handlers
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"learning-api/config"
+	"learning-api/models"
+	"learning-api/payment"
+
+	"github.com/gin-gonic/gin"
+)
+
+// MembershipOrderRequest is the input struct for /membership/order
+type MembershipOrderRequest struct {
+	PlanCode string `json:"plan_code" binding:"required"`
+	CpExtra  string `json:"cp_extra"`
+}
+
+// ListMembershipPlans handles GET /membership/plans
+func ListMembershipPlans(c *gin.Context) {
+	plans := config.LoadConfig().MembershipPlans
+	if plans == nil {
+		plans = []config.MembershipPlan{}
+	}
+	c.JSON(http.StatusOK, gin.H{"plans": plans})
+}
+
+// PayMembershipOrder handles POST /membership/order. It creates an ecpay order for the plan;
+// the membership period is added when the order is paid, after any period the user already has.
+func PayMembershipOrder(c *gin.Context) {
+	var req MembershipOrderRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	currentUser, exists := c.Get("currentUser")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return
+	}
+	user := currentUser.(models.User)
+
+	plan, ok := config.LoadConfig().MembershipPlan(req.PlanCode)
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "membership plan not found"})
+		return
+	}
+	gateway, err := paymentGatewayFunc(payment.Resolve(payment.GatewayEcpay))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	openOrder, err := models.FindOpenMembershipOrder(user.ID, plan.Code)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if openOrder != nil {
+		if openOrder.Gateway != gateway.Name() {
+			c.JSON(http.StatusConflict, gin.H{"error": "an unpaid order with another payment method is open", "order": openOrder})
+			return
+		}
+		// Hand back the unpaid order so the client can resume it instead of paying twice
+		c.JSON(http.StatusOK, payOrderResponse(openOrder))
+		return
+	}
+
+	order := models.Order{
+		UserID:     user.ID,
+		PlanCode:   plan.Code,
+		PlanDays:   plan.DurationDays,
+		Price:      plan.Price,
+		Gateway:    gateway.Name(),
+		OutOrderNo: randomOrderNo(),
+	}
+	err = order.CreateWithGatewayOrder(func(o *models.Order) (string, string, error) {
+		created, err := gateway.CreateOrder(membershipOrderRequest(plan, o, req.CpExtra))
+		if err != nil {
+			return "", "", err
+		}
+		return created.OrderID, created.OrderToken, nil
+	})
+	if err != nil {
+		c.JSON(http.StatusBadGateway, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, payOrderResponse(&order))
+}
+
+// membershipOrderRequest describes the plan to the gateway
+func membershipOrderRequest(plan config.MembershipPlan, order *models.Order, cpExtra string) payment.OrderRequest {
+	return payment.OrderRequest{
+		OutOrderNo:  order.OutOrderNo,
+		Amount:      order.Price,
+		Subject:     truncateRunes(plan.Name, maxOrderTextLength),
+		Body:        truncateRunes(plan.Name+"，"+strconv.Itoa(plan.DurationDays)+" 天内解锁全部测评", maxOrderTextLength),
+		CpExtra:     cpExtra,
+		SkuID:       "membership_" + plan.Code,
+		EntryParams: orderEntryParams(order),
+	}
+}
+
+// GetMyMembership handles GET /me/membership. expires_at follows renewals that start right where
+// the running period ends; periods lists the running and upcoming periods.
+func GetMyMembership(c *gin.Context) {
+	currentUser, exists := c.Get("currentUser")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return
+	}
+	user := currentUser.(models.User)
+
+	memberships, err := models.FindCurrentMemberships(user.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	now := time.Now()
+	resp := gin.H{"active": false, "plan_code": nil, "expires_at": nil, "periods": memberships}
+	if until := models.MembershipActiveUntil(memberships, now); until != nil {
+		resp["active"] = true
+		resp["expires_at"] = until
+		for _, m := range memberships {
+			if m.IsActive(now) {
+				resp["plan_code"] = m.PlanCode
+			}
+		}
+	}
+	c.JSON(http.StatusOK, resp)
+}
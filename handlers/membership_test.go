@@ -0,0 +1,97 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"learning-api/models"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMembership(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	db := models.InitTestDB()
+	db.AutoMigrate(&models.Topic{}, &models.Experience{})
+	models.SetDB(db)
+	gateway := newFakeEcpayGateway(t)
+
+	user := models.User{OpenID: "vip_user"}
+	db.Create(&user)
+	topic := models.Topic{Name: "Test Topic", Price: 990}
+	db.Create(&topic)
+	experience := models.Experience{TopicID: topic.ID, UserID: user.ID}
+	db.Create(&experience)
+
+	router := gin.New()
+	router.Use(func(c *gin.Context) {
+		c.Set("currentUser", user)
+		c.Next()
+	})
+	router.GET("/membership/plans", ListMembershipPlans)
+	router.POST("/membership/order", PayMembershipOrder)
+	router.GET("/me/membership", GetMyMembership)
+	router.POST("/pay/order", PayOrder)
+	serve := func(method, path string, body interface{}) (*httptest.ResponseRecorder, map[string]interface{}) {
+		jsonBody, _ := json.Marshal(body)
+		req, _ := http.NewRequest(method, path, bytes.NewBuffer(jsonBody))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		var response map[string]interface{}
+		json.Unmarshal(w.Body.Bytes(), &response)
+		return w, response
+	}
+
+	w, response := serve("GET", "/membership/plans", nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Len(t, response["plans"], 2)
+
+	w, response = serve("GET", "/me/membership", nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, false, response["active"])
+	assert.Empty(t, response["periods"])
+
+	w, _ = serve("POST", "/membership/order", MembershipOrderRequest{PlanCode: "weekly"})
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	w, response = serve("POST", "/membership/order", MembershipOrderRequest{PlanCode: "monthly"})
+	assert.Equal(t, http.StatusOK, w.Code)
+	created := gateway.createdOrders()
+	assert.Len(t, created, 1)
+	assert.Equal(t, 1800, created[0].TotalAmount)
+	assert.Equal(t, "月度会员", created[0].Subject)
+	order, _ := models.FindOrderByOutOrderNo(response["out_order_no"].(string))
+	assert.Nil(t, order.ExperienceID)
+	assert.Equal(t, 31, order.PlanDays)
+
+	// Ordering the same plan again resumes the unpaid order
+	w, response = serve("POST", "/membership/order", MembershipOrderRequest{PlanCode: "monthly"})
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, order.OutOrderNo, response["out_order_no"])
+	assert.Len(t, gateway.createdOrders(), 1)
+
+	// Paying the order unlocks every topic, so the experience no longer needs an order of its own
+	changed, err := order.MarkPaid("DY_1", models.OrderSourceCallback)
+	assert.NoError(t, err)
+	assert.True(t, changed)
+	assert.True(t, experience.IsPaid())
+	w, _ = serve("POST", "/pay/order", PayOrderRequest{ExperienceID: experience.ID})
+	assert.Equal(t, http.StatusConflict, w.Code)
+
+	w, response = serve("GET", "/me/membership", nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, true, response["active"])
+	assert.Equal(t, "monthly", response["plan_code"])
+	assert.Len(t, response["periods"], 1)
+
+	// A full refund ends the membership
+	assert.NoError(t, order.Transition(models.OrderStatusRefunded, models.OrderSourceCallback, "", nil))
+	assert.False(t, experience.IsPaid())
+	_, response = serve("GET", "/me/membership", nil)
+	assert.Equal(t, false, response["active"])
+}
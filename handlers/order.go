@@ -0,0 +1,104 @@
+package handlers
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+
+	"learning-api/models"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	defaultPageSize = 20
+	maxPageSize     = 100
+)
+
+// pageParams reads the page and page_size query params of a paged list. On failure it has
+// already replied.
+func pageParams(c *gin.Context) (int, int, bool) {
+	page, err := strconv.Atoi(c.DefaultQuery("page", "1"))
+	if err != nil || page < 1 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid page"})
+		return 0, 0, false
+	}
+	pageSize, err := strconv.Atoi(c.DefaultQuery("page_size", strconv.Itoa(defaultPageSize)))
+	if err != nil || pageSize < 1 || pageSize > maxPageSize {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "page_size must be between 1 and " + strconv.Itoa(maxPageSize)})
+		return 0, 0, false
+	}
+	return page, pageSize, true
+}
+
+// GetMyOrders handles GET /orders/my. It lists the user's orders newest first, a page at a time;
+// ?status=paid,refunded keeps the orders in the given statuses.
+func GetMyOrders(c *gin.Context) {
+	currentUser, exists := c.Get("currentUser")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return
+	}
+	user := currentUser.(models.User)
+
+	page, pageSize, ok := pageParams(c)
+	if !ok {
+		return
+	}
+	var statuses []models.OrderStatus
+	if status := c.Query("status"); status != "" {
+		for _, name := range strings.Split(status, ",") {
+			s, ok := models.ParseOrderStatus(strings.TrimSpace(name))
+			if !ok {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "invalid status: " + name})
+				return
+			}
+			statuses = append(statuses, s)
+		}
+	}
+
+	orders, total, err := models.FindUserOrders(user.ID, statuses, (page-1)*pageSize, pageSize)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"orders":    models.ToOrderResponses(orders),
+		"page":      page,
+		"page_size": pageSize,
+		"total":     total,
+	})
+}
+
+// GetOrder handles GET /orders/:id for the order's buyer
+func GetOrder(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid order id"})
+		return
+	}
+
+	currentUser, exists := c.Get("currentUser")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return
+	}
+	user := currentUser.(models.User)
+
+	order, err := models.FindOrderForHistory(uint(id))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if order == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "order not found"})
+		return
+	}
+
+	if order.UserID != user.ID {
+		c.JSON(http.StatusForbidden, gin.H{"error": "forbidden: not your order"})
+		return
+	}
+
+	c.JSON(http.StatusOK, models.ToOrderResponses([]models.Order{*order})[0])
+}
@@ -0,0 +1,61 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"learning-api/models"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ListOrderSyncTasks handles GET /admin/order-sync. It pages through the Douyin order sync queue,
+// most recently updated first; ?state=failed shows the pushes that gave up.
+func ListOrderSyncTasks(c *gin.Context) {
+	page, pageSize, ok := pageParams(c)
+	if !ok {
+		return
+	}
+	var state *models.OrderSyncState
+	if name := c.Query("state"); name != "" {
+		s, ok := models.ParseOrderSyncState(name)
+		if !ok {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid state: " + name})
+			return
+		}
+		state = &s
+	}
+
+	tasks, total, err := models.FindOrderSyncTasks(state, (page-1)*pageSize, pageSize)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"tasks":     tasks,
+		"page":      page,
+		"page_size": pageSize,
+		"total":     total,
+	})
+}
+
+// RetryOrderSyncTask handles POST /admin/order-sync/:id/retry. The task is pushed on the next
+// syncer run with a fresh set of retries.
+func RetryOrderSyncTask(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid task id"})
+		return
+	}
+	task, err := models.RequeueOrderSyncTask(uint(id))
+	if errors.Is(err, models.ErrOrderSyncTaskNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, task)
+}
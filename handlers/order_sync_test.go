@@ -0,0 +1,67 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"learning-api/models"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOrderSyncTasks(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	db := models.InitTestDB()
+	models.SetDB(db)
+
+	experienceID := uint(1)
+	for _, outOrderNo := range []string{"OUT_1", "OUT_2"} {
+		order := models.Order{UserID: 1, ExperienceID: &experienceID, Price: 990, Status: models.OrderStatusPending, OrderNo: outOrderNo, OutOrderNo: outOrderNo}
+		db.Create(&order)
+		assert.NoError(t, order.Transition(models.OrderStatusCancelled, models.OrderSourceUser, "", nil))
+	}
+	var failed models.OrderSyncTask
+	db.Where("out_order_no = ?", "OUT_2").First(&failed)
+	failed.MarkAttemptFailed(errors.New("err_code 10001"), time.Now(), true)
+
+	router := gin.New()
+	router.GET("/admin/order-sync", ListOrderSyncTasks)
+	router.POST("/admin/order-sync/:id/retry", RetryOrderSyncTask)
+	serve := func(method, path string) (*httptest.ResponseRecorder, map[string]interface{}) {
+		req, _ := http.NewRequest(method, path, nil)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		var response map[string]interface{}
+		json.Unmarshal(w.Body.Bytes(), &response)
+		return w, response
+	}
+
+	w, response := serve("GET", "/admin/order-sync")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, float64(2), response["total"])
+
+	w, response = serve("GET", "/admin/order-sync?state=failed")
+	assert.Equal(t, http.StatusOK, w.Code)
+	tasks := response["tasks"].([]interface{})
+	assert.Len(t, tasks, 1)
+	task := tasks[0].(map[string]interface{})
+	assert.Equal(t, "OUT_2", task["out_order_no"])
+	assert.Equal(t, "cancelled", task["order_status"])
+	assert.Equal(t, "err_code 10001", task["last_error"])
+
+	w, response = serve("POST", "/admin/order-sync/"+strconv.FormatUint(uint64(failed.ID), 10)+"/retry")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "pending", response["state"])
+	assert.Equal(t, float64(0), response["attempts"])
+
+	w, _ = serve("GET", "/admin/order-sync?state=stuck")
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	w, _ = serve("POST", "/admin/order-sync/9999/retry")
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
@@ -0,0 +1,99 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"learning-api/models"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOrderHistory(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	db := models.InitTestDB()
+	db.AutoMigrate(&models.Topic{}, &models.Experience{})
+	models.SetDB(db)
+
+	user := models.User{OpenID: "history_user"}
+	other := models.User{OpenID: "other_user"}
+	db.Create(&user)
+	db.Create(&other)
+	topic := models.Topic{Name: "Test Topic", Price: 990}
+	db.Create(&topic)
+	experience := models.Experience{TopicID: topic.ID, UserID: user.ID}
+	db.Create(&experience)
+	bundle := models.Bundle{Name: "Pack", Price: 1990, OnSale: true}
+	db.Create(&bundle)
+
+	orders := []models.Order{
+		{UserID: user.ID, ExperienceID: &experience.ID, Price: 990, Status: models.OrderStatusPartiallyRefunded, RefundedAmount: 300, OrderNo: "DY_1", OutOrderNo: "OUT_1"},
+		{UserID: user.ID, PlanCode: "monthly", PlanDays: 31, Price: 1800, Status: models.OrderStatusExpired, OrderNo: "DY_2", OutOrderNo: "OUT_2"},
+		{UserID: user.ID, BundleID: &bundle.ID, Price: 1990, Status: models.OrderStatusPaid, OrderNo: "DY_3", OutOrderNo: "OUT_3"},
+		{UserID: other.ID, ExperienceID: &experience.ID, Price: 990, Status: models.OrderStatusPaid, OrderNo: "DY_4", OutOrderNo: "OUT_4"},
+	}
+	db.Create(&orders)
+	db.Create(&models.Refund{OrderID: orders[0].ID, OutRefundNo: "REFUND_1", Amount: 300, Reason: "partial", Status: models.RefundStatusSucceeded, OperatorID: 99})
+
+	router := gin.New()
+	router.Use(func(c *gin.Context) {
+		c.Set("currentUser", user)
+		c.Next()
+	})
+	router.GET("/orders/my", GetMyOrders)
+	router.GET("/orders/:id", GetOrder)
+	serve := func(path string) (*httptest.ResponseRecorder, map[string]interface{}) {
+		req, _ := http.NewRequest("GET", path, nil)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		var response map[string]interface{}
+		json.Unmarshal(w.Body.Bytes(), &response)
+		return w, response
+	}
+
+	w, response := serve("/orders/my")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, float64(3), response["total"])
+	listed := response["orders"].([]interface{})
+	assert.Len(t, listed, 3)
+	assert.Equal(t, "Pack", listed[0].(map[string]interface{})["title"])
+	assert.Equal(t, "月度会员", listed[1].(map[string]interface{})["title"])
+	assert.Equal(t, "expired", listed[1].(map[string]interface{})["status"])
+
+	w, response = serve("/orders/my?page=2&page_size=2")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Len(t, response["orders"], 1)
+	assert.Equal(t, float64(3), response["total"])
+
+	w, response = serve("/orders/my?status=paid,partially_refunded")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, float64(2), response["total"])
+
+	w, _ = serve("/orders/my?status=unknown")
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	w, _ = serve("/orders/my?page_size=1000")
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	w, response = serve("/orders/" + strconv.FormatUint(uint64(orders[0].ID), 10))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "Test Topic", response["title"])
+	assert.Equal(t, float64(topic.ID), response["topic_id"])
+	assert.Equal(t, "partially_refunded", response["status"])
+	assert.Equal(t, float64(300), response["refunded_amount"])
+	refunds := response["refunds"].([]interface{})
+	assert.Len(t, refunds, 1)
+	assert.Equal(t, "succeeded", refunds[0].(map[string]interface{})["status"])
+	assert.NotContains(t, refunds[0], "operator_id", "buyers do not see who issued a refund")
+
+	// Another user's order is forbidden, a missing one not found
+	w, _ = serve("/orders/" + strconv.FormatUint(uint64(orders[3].ID), 10))
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	w, _ = serve("/orders/9999")
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	w, _ = serve("/orders/abc")
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
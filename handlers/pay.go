@@ -1,45 +1,32 @@
 package handlers
 
 import (
-	"bytes"
-	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"io/ioutil"
 	"math/rand"
 	"net/http"
 	"strconv"
 	"time"
 
-	"learning-api/config"
-	"learning-api/helpers"
-
-	"crypto/tls"
-	"crypto/x509"
+	"learning-api/models"
+	"learning-api/payment"
 
 	"github.com/gin-gonic/gin"
 )
 
 // PayOrderRequest is the input struct for /pay/order
+// The amount, subject and body are derived from the experience's topic on the server
 type PayOrderRequest struct {
-	TotalAmount int    `json:"total_amount"`
-	Subject     string `json:"subject"`
-	Body        string `json:"body"`
-	CpExtra     string `json:"cp_extra"`
+	ExperienceID uint   `json:"experience_id" binding:"required"`
+	CpExtra      string `json:"cp_extra"`
+	CouponCode   string `json:"coupon_code"`
 }
 
-// DouyinOrderRequest is the struct for Douyin API
-type DouyinOrderRequest struct {
-	AppID       string `json:"app_id"`
-	OutOrderNo  string `json:"out_order_no"`
-	TotalAmount int    `json:"total_amount"`
-	Subject     string `json:"subject"`
-	Body        string `json:"body"`
-	ValidTime   int    `json:"valid_time"`
-	Sign        string `json:"sign"`
-	NotifyURL   string `json:"notify_url"`
-	StoreUid    string `json:"store_uid"`
-}
+// Douyin limits subject and body to 128 characters
+const maxOrderTextLength = 128
+
+var paymentGatewayFunc = payment.New
 
 func randomOrderNo() string {
 	return strconv.FormatInt(time.Now().UnixNano(), 36) + RandString(4)
@@ -55,23 +42,84 @@ func RandString(n int) string {
 	return string(b)
 }
 
-func createSecureHTTPClient() (*http.Client, error) {
-	roots, err := x509.SystemCertPool()
-	if err != nil {
-		return nil, err
+// payableExperience loads the experience a pay request is for, with its topic and latest order,
+// and checks the current user owns it and has not paid yet. On failure it has already replied.
+func payableExperience(c *gin.Context, experienceID uint) (*models.Experience, bool) {
+	currentUser, exists := c.Get("currentUser")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return nil, false
+	}
+	user := currentUser.(models.User)
+
+	var experience models.Experience
+	if err := models.GetDB().Preload("Order", models.LatestOrder).Preload("Topic").First(&experience, experienceID).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "experience not found"})
+		return nil, false
 	}
-	tr := &http.Transport{
-		TLSClientConfig: &tls.Config{RootCAs: roots},
+	if experience.UserID != user.ID {
+		c.JSON(http.StatusForbidden, gin.H{"error": "forbidden: not your experience"})
+		return nil, false
 	}
-	client := &http.Client{Transport: tr}
-	return client, nil
+	if experience.IsPaid() {
+		c.JSON(http.StatusConflict, gin.H{"error": "experience already paid"})
+		return nil, false
+	}
+	return &experience, true
 }
 
-func createInsecureHTTPClient() *http.Client {
-	tr := &http.Transport{
-		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+// openOrderForGateway returns the experience's unpaid order if it can be resumed through gateway.
+// An unpaid order of another gateway or with another coupon could still be paid, so it gets a 409
+// instead of a second order. ok is false when it has already replied.
+func openOrderForGateway(c *gin.Context, experience *models.Experience, gateway string, couponCode string) (*models.Order, bool) {
+	if experience.Order == nil || !experience.Order.IsOpen() {
+		return nil, true
+	}
+	if experience.Order.Gateway != gateway {
+		c.JSON(http.StatusConflict, gin.H{"error": "an unpaid order with another payment method is open", "order": experience.Order})
+		return nil, false
+	}
+	if experience.Order.CouponCode != models.NormalizeCouponCode(couponCode) {
+		c.JSON(http.StatusConflict, gin.H{"error": "an unpaid order with another coupon is open", "order": experience.Order})
+		return nil, false
 	}
-	return &http.Client{Transport: tr}
+	return experience.Order, true
+}
+
+// newTopicOrder builds the order for the experience's topic at the topic price, less the coupon
+// if the request has one. ok is false when it has already replied.
+func newTopicOrder(c *gin.Context, experience *models.Experience, gateway string, couponCode string) (*models.Order, bool) {
+	if experience.Topic.Price <= 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "topic is not for sale"})
+		return nil, false
+	}
+	order := &models.Order{
+		UserID:       experience.UserID,
+		ExperienceID: &experience.ID,
+		Price:        experience.Topic.Price,
+		Gateway:      gateway,
+		OutOrderNo:   randomOrderNo(),
+	}
+	if couponCode != "" {
+		coupon, ok := applicableCoupon(c, couponCode, experience.UserID, experience.TopicID)
+		if !ok {
+			return nil, false
+		}
+		order.ApplyCoupon(coupon, experience.Topic.Price)
+	}
+	return order, true
+}
+
+// createFreeOrder saves an order its coupon covers in full as paid; there is nothing to pay
+// through the gateway
+func createFreeOrder(c *gin.Context, order *models.Order) {
+	if err := order.CreateFree(); err != nil {
+		if !replyCouponError(c, err) {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		}
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"paid": true, "out_order_no": order.OutOrderNo, "order": order})
 }
 
 func PayOrder(c *gin.Context) {
@@ -80,100 +128,229 @@ func PayOrder(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
-	cfg := config.LoadConfig()
-	orderNo := randomOrderNo()
-	order := DouyinOrderRequest{
-		AppID:       cfg.AppID,
-		OutOrderNo:  orderNo,
-		TotalAmount: req.TotalAmount,
-		Subject:     req.Subject,
-		Body:        req.Body,
-		ValidTime:   180,
-		StoreUid:    "75169185453352082020",
-		NotifyURL:   "https://1l2v8anoldbg6-env-KfJ4EiJx5I.service.douyincloud.run/pay/callback",
-	}
-	// Prepare sign params (as map)
-	signParams := map[string]interface{}{
-		"app_id":       order.AppID,
-		"out_order_no": order.OutOrderNo,
-		"total_amount": order.TotalAmount,
-		"subject":      order.Subject,
-		"body":         order.Body,
-		"valid_time":   order.ValidTime,
-		"notify_url":   order.NotifyURL,
+
+	experience, ok := payableExperience(c, req.ExperienceID)
+	if !ok {
+		return
+	}
+	gateway, err := paymentGatewayFunc(payment.Resolve(payment.GatewayEcpay))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	openOrder, ok := openOrderForGateway(c, experience, gateway.Name(), req.CouponCode)
+	if !ok {
+		return
+	}
+	if openOrder != nil {
+		// Hand back the unpaid order so the client can resume it instead of paying twice
+		c.JSON(http.StatusOK, payOrderResponse(openOrder))
+		return
+	}
+
+	order, ok := newTopicOrder(c, experience, gateway.Name(), req.CouponCode)
+	if !ok {
+		return
+	}
+	if order.Price == 0 {
+		createFreeOrder(c, order)
+		return
+	}
+	err = order.CreateWithGatewayOrder(func(o *models.Order) (string, string, error) {
+		created, err := gateway.CreateOrder(orderRequest(experience, o, req.CpExtra))
+		if err != nil {
+			return "", "", err
+		}
+		return created.OrderID, created.OrderToken, nil
+	})
+	if err != nil {
+		if !replyCouponError(c, err) {
+			c.JSON(http.StatusBadGateway, gin.H{"error": err.Error()})
+		}
+		return
 	}
-	order.Sign = helpers.RequestSign(signParams)
 
-	jsonBody, _ := json.Marshal(order)
-	fmt.Println("Request Body:", string(jsonBody))
+	c.JSON(http.StatusOK, payOrderResponse(order))
+}
 
-	client := createInsecureHTTPClient()
+// orderRequest describes the experience's topic to the gateway
+func orderRequest(experience *models.Experience, order *models.Order, cpExtra string) payment.OrderRequest {
+	return payment.OrderRequest{
+		OutOrderNo:  order.OutOrderNo,
+		Amount:      order.Price,
+		Subject:     truncateRunes(experience.Topic.Name, maxOrderTextLength),
+		Body:        truncateRunes(orderBody(experience.Topic), maxOrderTextLength),
+		CpExtra:     cpExtra,
+		SkuID:       strconv.FormatUint(uint64(experience.TopicID), 10),
+		ImageURL:    experience.Topic.CoverURL,
+		EntryParams: orderEntryParams(order),
+	}
+}
 
-	reqHttp, err := http.NewRequest(
-		"POST",
-		"https://developer.toutiao.com/api/apps/ecpay/v1/create_order",
-		bytes.NewBuffer(jsonBody),
-	)
+// orderEntryParams are the params of the mini program page an order links back to: the
+// experience it unlocks, the bundle it buys, or the plan of a membership order
+func orderEntryParams(order *models.Order) string {
+	var params []byte
+	switch {
+	case order.ExperienceID != nil:
+		params, _ = json.Marshal(map[string]uint{"id": *order.ExperienceID})
+	case order.BundleID != nil:
+		params, _ = json.Marshal(map[string]uint{"bundle": *order.BundleID})
+	default:
+		params, _ = json.Marshal(map[string]string{"plan": order.PlanCode})
+	}
+	return string(params)
+}
+
+// orderBody describes what the buyer unlocks, falling back to the topic name
+func orderBody(topic models.Topic) string {
+	if topic.Description != "" {
+		return topic.Description
+	}
+	return topic.Name
+}
+
+func truncateRunes(s string, n int) string {
+	runes := []rune(s)
+	if len(runes) <= n {
+		return s
+	}
+	return string(runes[:n])
+}
+
+// payOrderResponse keeps the Douyin create_order response shape and merges the local order into it
+func payOrderResponse(order *models.Order) gin.H {
+	return gin.H{
+		"err_no":   0,
+		"err_tips": "success",
+		"data": gin.H{
+			"order_id":    order.OrderNo,
+			"order_token": order.OrderToken,
+		},
+		"out_order_no": order.OutOrderNo,
+		"order":        order,
+	}
+}
+
+// callbackReply writes the err_no/err_tips body Douyin expects; any non-zero err_no makes Douyin retry
+func callbackReply(c *gin.Context, httpStatus int, errNo int, errTips string) {
+	c.JSON(httpStatus, gin.H{"err_no": errNo, "err_tips": errTips})
+}
+
+// handleNotification verifies a notification posted by the named gateway and applies it to the
+// order, refund or settle it is about. Notification types other than accepted are rejected.
+func handleNotification(c *gin.Context, gatewayName string, label string, accepted ...string) {
+	gateway, err := paymentGatewayFunc(gatewayName)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		fmt.Println(label, "failed:", err)
+		callbackReply(c, http.StatusInternalServerError, 1, "internal error")
+		return
+	}
+	notification, err := gateway.VerifyNotification(c.Request)
+	if errors.Is(err, payment.ErrNotConfigured) {
+		fmt.Println(label, "rejected:", err)
+		callbackReply(c, http.StatusInternalServerError, 1, "gateway not configured")
 		return
 	}
-	reqHttp.Header.Set("Content-Type", "application/json")
-
-	resp, err := client.Do(reqHttp)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		fmt.Println(label, "rejected:", err)
+		callbackReply(c, http.StatusBadRequest, 1, "invalid notification")
 		return
 	}
-	defer resp.Body.Close()
-	body, _ := ioutil.ReadAll(resp.Body)
 
-	// Parse the response to merge out_order_no
-	var douyinResponse map[string]interface{}
-	if err := json.Unmarshal(body, &douyinResponse); err != nil {
-		// If parsing fails, return original response
-		c.Data(resp.StatusCode, "application/json", body)
+	supported := false
+	for _, t := range accepted {
+		supported = supported || t == notification.Type
+	}
+	if !supported {
+		fmt.Println(label, "rejected: unexpected type:", notification.Type)
+		callbackReply(c, http.StatusBadRequest, 1, "unsupported callback type")
 		return
 	}
 
-	// Add out_order_no to the response
-	douyinResponse["out_order_no"] = orderNo
+	switch notification.Type {
+	case payment.NotificationPayment:
+		applyPaymentNotification(c, label, gateway, notification)
+	case payment.NotificationRefund:
+		applyRefundNotification(c, label, notification)
+	case payment.NotificationSettle:
+		applySettleNotification(c, label, notification)
+	}
+}
 
-	// Return the merged response
-	c.JSON(resp.StatusCode, douyinResponse)
+// paymentFailures maps the final payment results that close an order unpaid
+var paymentFailures = map[payment.Status]models.OrderStatus{
+	payment.StatusExpired:   models.OrderStatusExpired,
+	payment.StatusFailed:    models.OrderStatusFailed,
+	payment.StatusCancelled: models.OrderStatusCancelled,
 }
 
-func PayOrderCallback(c *gin.Context) {
-	// This is a placeholder for the callback handler
-	// You would typically handle the payment notification here
-	fmt.Println("Payment callback received")
-	c.JSON(http.StatusOK, gin.H{"message": "Payment callback received"})
-}
-
-func PayDouOrder(c *gin.Context) {
-	cfg := config.LoadConfig()
-	var (
-		// 请求时间戳
-		timestamp = strconv.FormatInt(time.Now().Unix(), 10)
-		// 开发者填入自己的小程序app_id
-		appId = cfg.AppID
-		// 随机字符串
-		nonceStr = helpers.RandStr(10)
-		// 应用公钥版本,每次重新上传公钥后需要更新,可通过「开发管理-开发设置-密钥设置」处获取
-		keyVersion = "1"
-		// 应用私钥,用于加签 重要：1.测试时请修改为开发者自行生成的私钥;2.请勿将示例密钥用于生产环境;3.建议开发者不要将私钥文本写在代码中
-		privateKeyStr       = cfg.PrivateKey
-		privateKeyBase64Str = base64.StdEncoding.EncodeToString([]byte(privateKeyStr))
-		// 生成好的data
-		data = "{\"skuList\":[{\"skuId\":\"657\",\"price\":1,\"quantity\":1,\"title\":\"test_title\",\"imageList\":[\"https://xxxx.com/xxxxx.jpg\"],\"type\":301,\"tagGroupId\":\"tag_group_7272625659888058380\"}],\"outOrderNo\":\"test_out_order_no\",\"totalAmount\":1,\"payExpireSeconds\":300,\"orderEntrySchema\":{\"path\":\"\",\"params\":\"\"},\"payNotifyUrl\":\"https://xxxxx/xxx\"}"
-		//data = "{\"skuList\":[{\"skuId\":\"1\",\"price\":9999,\"quantity\":1,\"title\":\"标题\",\"imageList\":[\"https://dummyimage.com/234x60\"],\"type\":301,\"tagGroupId\":\"tag_group_7272625659888058380\"}],\"outOrderNo\":\"1213\",\"totalAmount\":9999,\"limitPayWayList\":[],\"payExpireSeconds\":3000,\"orderEntrySchema\":{\"path\":\"page/index/index\",\"params\":\"{\\\"poi\\\":\\\"6601248937917548558\\\",\\\"aweme_useTemplate\\\":1}\"}}"
-	)
-	byteAuthorization, err := helpers.GetByteAuthorization(privateKeyBase64Str, data, appId, nonceStr, timestamp, keyVersion)
+func applyPaymentNotification(c *gin.Context, label string, gateway payment.PaymentGateway, n *payment.Notification) {
+	order, err := models.FindOrderByOutOrderNo(n.OutNo)
+	if err != nil {
+		fmt.Println(label, "failed: load order", n.OutNo, "error:", err)
+		callbackReply(c, http.StatusInternalServerError, 1, "internal error")
+		return
+	}
+	if order == nil || order.Gateway != gateway.Name() {
+		fmt.Println(label, "rejected: unknown out_order_no:", n.OutNo)
+		callbackReply(c, http.StatusBadRequest, 1, "order not found")
+		return
+	}
+
+	if next, ok := paymentFailures[n.Status]; ok {
+		if order.Status == next || !order.Status.CanTransitionTo(next) {
+			fmt.Println(label+": order", n.OutNo, "reported", n.Status, "- left as", order.Status.String())
+		} else if err := order.Transition(next, models.OrderSourceCallback, n.Message, nil); err != nil {
+			fmt.Println(label, "failed: move order", n.OutNo, "to", next.String(), "error:", err)
+			callbackReply(c, http.StatusInternalServerError, 1, "internal error")
+			return
+		}
+		callbackReply(c, http.StatusOK, 0, "success")
+		return
+	}
+	if n.Status != payment.StatusSuccess {
+		fmt.Println(label+": order", n.OutNo, "reported status", n.Status, "- left as", order.Status.String())
+		callbackReply(c, http.StatusOK, 0, "success")
+		return
+	}
+
+	if n.Amount != order.Price {
+		fmt.Println(label, "rejected: order", n.OutNo, "amount", n.Amount, "does not match price", order.Price)
+		callbackReply(c, http.StatusBadRequest, 1, "amount mismatch")
+		return
+	}
+
+	changed, err := order.MarkPaid(n.GatewayNo, models.OrderSourceCallback)
+	if errors.Is(err, models.ErrInvalidOrderTransition) {
+		fmt.Println(label, "rejected: order", n.OutNo, "cannot be paid from", order.Status.String())
+		callbackReply(c, http.StatusConflict, 1, "order cannot be paid")
+		return
+	}
 	if err != nil {
-		fmt.Println("getByteAuthorization err:", err)
-	} else {
-		fmt.Println("getByteAuthorization res:", byteAuthorization)
+		fmt.Println(label, "failed: mark order", n.OutNo, "paid error:", err)
+		callbackReply(c, http.StatusInternalServerError, 1, "internal error")
+		return
 	}
-	// return json response and { "auth": byteAuthorization.to_s}
-	c.JSON(http.StatusOK, gin.H{"auth": string(byteAuthorization)})
+	if !changed {
+		// Douyin retries until it sees err_no 0, so a replay is acknowledged but never applied twice
+		fmt.Println(label, "replay ignored: order", n.OutNo, "is already", order.Status.String())
+		callbackReply(c, http.StatusOK, 0, "success")
+		return
+	}
+
+	fmt.Println(label+": order", n.OutNo, "marked paid")
+	callbackReply(c, http.StatusOK, 0, "success")
+}
+
+// PayOrderCallback handles POST /pay/callback, the ecpay payment notification
+func PayOrderCallback(c *gin.Context) {
+	handleNotification(c, payment.GatewayEcpay, "pay callback", payment.NotificationPayment)
+}
+
+// FakePayCallback handles POST /pay/fake/callback, registered when config selects the fake
+// gateway so dev environments can post payment, refund and settle results by hand
+func FakePayCallback(c *gin.Context) {
+	handleNotification(c, payment.GatewayFake, "fake pay callback",
+		payment.NotificationPayment, payment.NotificationRefund, payment.NotificationSettle)
 }
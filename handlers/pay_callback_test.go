@@ -0,0 +1,245 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"learning-api/helpers"
+	"learning-api/models"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"gorm.io/gorm"
+)
+
+const testCallbackToken = "test_callback_token"
+
+func setupPayCallbackTest(t *testing.T) (*gin.Engine, *gorm.DB, models.Order) {
+	t.Setenv("CALLBACK_TOKEN", testCallbackToken)
+	gin.SetMode(gin.TestMode)
+	db := models.InitTestDB()
+	db.AutoMigrate(&models.Topic{}, &models.Experience{})
+	models.SetDB(db)
+
+	user := models.User{OpenID: "callback_user"}
+	db.Create(&user)
+	experience := models.Experience{TopicID: 1, UserID: user.ID}
+	db.Create(&experience)
+	order := models.Order{
+		UserID:       user.ID,
+		ExperienceID: &experience.ID,
+		Price:        990,
+		Status:       models.OrderStatusPending,
+		OrderNo:      "placeholder_order_no",
+		OutOrderNo:   "out_order_no_1",
+	}
+	db.Create(&order)
+
+	r := gin.New()
+	r.POST("/pay/callback", PayOrderCallback)
+	return r, db, order
+}
+
+func signedCallback(token string, msg helpers.EcpayPaymentMsg) helpers.EcpayCallbackRequest {
+	msgBytes, _ := json.Marshal(msg)
+	req := helpers.EcpayCallbackRequest{
+		Timestamp: json.Number(strconv.FormatInt(time.Now().Unix(), 10)),
+		Nonce:     "9999",
+		Msg:       string(msgBytes),
+		Type:      "payment",
+	}
+	req.MsgSignature = helpers.CallbackSign([]string{token, req.Timestamp.String(), req.Nonce, req.Msg})
+	return req
+}
+
+func postCallback(r *gin.Engine, body helpers.EcpayCallbackRequest) (*httptest.ResponseRecorder, map[string]interface{}) {
+	jsonBody, _ := json.Marshal(body)
+	req, _ := http.NewRequest("POST", "/pay/callback", bytes.NewBuffer(jsonBody))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	var resp map[string]interface{}
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	return w, resp
+}
+
+func TestPayOrderCallback_MarksOrderPaid(t *testing.T) {
+	r, db, order := setupPayCallbackTest(t)
+
+	body := signedCallback(testCallbackToken, helpers.EcpayPaymentMsg{
+		CpOrderNo:   order.OutOrderNo,
+		TotalAmount: order.Price,
+		Status:      "SUCCESS",
+		OrderID:     "N71016888186626816",
+	})
+	w, resp := postCallback(r, body)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, float64(0), resp["err_no"])
+	assert.Equal(t, "success", resp["err_tips"])
+
+	var updated models.Order
+	db.First(&updated, order.ID)
+	assert.Equal(t, models.OrderStatusPaid, updated.Status)
+	assert.Equal(t, "N71016888186626816", updated.OrderNo)
+}
+
+func TestPayOrderCallback_ReplayIsIdempotent(t *testing.T) {
+	r, db, order := setupPayCallbackTest(t)
+
+	body := signedCallback(testCallbackToken, helpers.EcpayPaymentMsg{
+		CpOrderNo:   order.OutOrderNo,
+		TotalAmount: order.Price,
+		Status:      "SUCCESS",
+		OrderID:     "N71016888186626816",
+	})
+	w, _ := postCallback(r, body)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	// Move the order on so a replay would be visible if it were applied
+	db.Model(&models.Order{}).Where("id = ?", order.ID).Update("status", models.OrderStatusConfirmed)
+
+	w, resp := postCallback(r, body)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, float64(0), resp["err_no"])
+
+	var updated models.Order
+	db.First(&updated, order.ID)
+	assert.Equal(t, models.OrderStatusConfirmed, updated.Status)
+}
+
+func TestPayOrderCallback_TimeoutExpiresOrder(t *testing.T) {
+	r, db, order := setupPayCallbackTest(t)
+
+	body := signedCallback(testCallbackToken, helpers.EcpayPaymentMsg{
+		CpOrderNo:   order.OutOrderNo,
+		TotalAmount: order.Price,
+		Status:      "TIMEOUT",
+	})
+	w, resp := postCallback(r, body)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, float64(0), resp["err_no"])
+
+	var updated models.Order
+	db.First(&updated, order.ID)
+	assert.Equal(t, models.OrderStatusExpired, updated.Status)
+
+	histories, _ := models.FindOrderStatusHistories(order.ID)
+	assert.Len(t, histories, 1)
+	assert.Equal(t, models.OrderSourceCallback, histories[0].Source)
+}
+
+func TestPayOrderCallback_LatePaymentOfCancelledOrder(t *testing.T) {
+	r, db, order := setupPayCallbackTest(t)
+	assert.NoError(t, order.Transition(models.OrderStatusCancelled, models.OrderSourceUser, "", nil))
+
+	body := signedCallback(testCallbackToken, helpers.EcpayPaymentMsg{
+		CpOrderNo:   order.OutOrderNo,
+		TotalAmount: order.Price,
+		Status:      "SUCCESS",
+		OrderID:     "N71016888186626816",
+	})
+	w, resp := postCallback(r, body)
+
+	// The buyer was charged, so the payment is accepted and Douyin stops retrying
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, float64(0), resp["err_no"])
+
+	var updated models.Order
+	db.First(&updated, order.ID)
+	assert.Equal(t, models.OrderStatusPaid, updated.Status)
+	assert.Equal(t, "N71016888186626816", updated.OrderNo)
+
+	histories, _ := models.FindOrderStatusHistories(order.ID)
+	assert.Len(t, histories, 2)
+	assert.Equal(t, models.OrderStatusCancelled, histories[1].FromStatus)
+	assert.Equal(t, models.OrderStatusPaid, histories[1].ToStatus)
+
+	paid, err := models.HasTopicEntitlement(updated.UserID, 1)
+	assert.NoError(t, err)
+	assert.True(t, paid)
+}
+
+func TestPayOrderCallback_InvalidSignature(t *testing.T) {
+	r, db, order := setupPayCallbackTest(t)
+
+	body := signedCallback("wrong_token", helpers.EcpayPaymentMsg{
+		CpOrderNo: order.OutOrderNo,
+		Status:    "SUCCESS",
+	})
+	w, resp := postCallback(r, body)
+
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.NotEqual(t, float64(0), resp["err_no"])
+
+	var updated models.Order
+	db.First(&updated, order.ID)
+	assert.Equal(t, models.OrderStatusPending, updated.Status)
+}
+
+func TestPayOrderCallback_StaleTimestamp(t *testing.T) {
+	r, db, order := setupPayCallbackTest(t)
+
+	// A correctly signed callback captured ten minutes ago cannot be replayed
+	body := signedCallback(testCallbackToken, helpers.EcpayPaymentMsg{
+		CpOrderNo:   order.OutOrderNo,
+		TotalAmount: order.Price,
+		Status:      "SUCCESS",
+	})
+	body.Timestamp = json.Number(strconv.FormatInt(time.Now().Add(-10*time.Minute).Unix(), 10))
+	body.MsgSignature = helpers.CallbackSign([]string{testCallbackToken, body.Timestamp.String(), body.Nonce, body.Msg})
+	w, resp := postCallback(r, body)
+
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.NotEqual(t, float64(0), resp["err_no"])
+	var updated models.Order
+	db.First(&updated, order.ID)
+	assert.Equal(t, models.OrderStatusPending, updated.Status)
+}
+
+func TestPayOrderCallback_AmountMismatch(t *testing.T) {
+	r, db, order := setupPayCallbackTest(t)
+
+	body := signedCallback(testCallbackToken, helpers.EcpayPaymentMsg{
+		CpOrderNo:   order.OutOrderNo,
+		TotalAmount: 1,
+		Status:      "SUCCESS",
+	})
+	w, resp := postCallback(r, body)
+
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.NotEqual(t, float64(0), resp["err_no"])
+
+	var updated models.Order
+	db.First(&updated, order.ID)
+	assert.Equal(t, models.OrderStatusPending, updated.Status)
+}
+
+func TestPayOrderCallback_UnknownOrder(t *testing.T) {
+	r, _, _ := setupPayCallbackTest(t)
+
+	body := signedCallback(testCallbackToken, helpers.EcpayPaymentMsg{
+		CpOrderNo: "does_not_exist",
+		Status:    "SUCCESS",
+	})
+	w, resp := postCallback(r, body)
+
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.NotEqual(t, float64(0), resp["err_no"])
+}
+
+func TestPayOrderCallback_InvalidBody(t *testing.T) {
+	r, _, _ := setupPayCallbackTest(t)
+
+	req, _ := http.NewRequest("POST", "/pay/callback", bytes.NewBuffer([]byte("invalid json")))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
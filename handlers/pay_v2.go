@@ -0,0 +1,86 @@
+package handlers
+
+import (
+	"fmt"
+	"learning-api/models"
+	"learning-api/payment"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// PayDouOrder handles POST /pay/v2/order. It creates a local order for the experience and returns the
+// data and byteAuthorization the mini program passes to tt.requestOrder of the trade system v2.
+func PayDouOrder(c *gin.Context) {
+	var req PayOrderRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	experience, ok := payableExperience(c, req.ExperienceID)
+	if !ok {
+		return
+	}
+	gateway, err := paymentGatewayFunc(payment.Resolve(payment.GatewayTradeV2))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	openOrder, ok := openOrderForGateway(c, experience, gateway.Name(), req.CouponCode)
+	if !ok {
+		return
+	}
+
+	if openOrder != nil {
+		// Sign the same outOrderNo again so the client resumes the order instead of paying twice
+		created, err := gateway.CreateOrder(orderRequest(experience, openOrder, req.CpExtra))
+		if err != nil {
+			fmt.Println("pay v2 order: sign order", openOrder.OutOrderNo, "error:", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to sign order"})
+			return
+		}
+		c.JSON(http.StatusOK, tradeOrderResponse(openOrder, created))
+		return
+	}
+
+	order, ok := newTopicOrder(c, experience, gateway.Name(), req.CouponCode)
+	if !ok {
+		return
+	}
+	if order.Price == 0 {
+		createFreeOrder(c, order)
+		return
+	}
+	var created *payment.CreatedOrder
+	// The Douyin order is created by the client, so signing is the only step that can fail
+	err = order.CreateWithGatewayOrder(func(o *models.Order) (string, string, error) {
+		var err error
+		created, err = gateway.CreateOrder(orderRequest(experience, o, req.CpExtra))
+		return "", "", err
+	})
+	if err != nil {
+		if replyCouponError(c, err) {
+			return
+		}
+		fmt.Println("pay v2 order: sign order for experience", experience.ID, "error:", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to sign order"})
+		return
+	}
+
+	c.JSON(http.StatusOK, tradeOrderResponse(order, created))
+}
+
+func tradeOrderResponse(order *models.Order, created *payment.CreatedOrder) gin.H {
+	return gin.H{
+		"data":              created.Data,
+		"byteAuthorization": created.ByteAuthorization,
+		"out_order_no":      order.OutOrderNo,
+		"order":             order,
+	}
+}
+
+// PayDouOrderCallback handles POST /pay/v2/callback, the trade system v2 pay and refund notification
+func PayDouOrderCallback(c *gin.Context) {
+	handleNotification(c, payment.GatewayTradeV2, "pay v2 callback", payment.NotificationPayment, payment.NotificationRefund)
+}
@@ -0,0 +1,191 @@
+package handlers
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"learning-api/helpers"
+	"learning-api/models"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"gorm.io/gorm"
+)
+
+// tradeKeys holds the app key pair used for byteAuthorization and the platform key pair
+// that signs pay notifications
+type tradeKeys struct {
+	app      *rsa.PrivateKey
+	platform *rsa.PrivateKey
+}
+
+func setupPayV2Test(t *testing.T) (*gin.Engine, *gorm.DB, models.Experience, tradeKeys) {
+	appKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	platformKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	platformPublic, _ := x509.MarshalPKIXPublicKey(&platformKey.PublicKey)
+	t.Setenv("PRIVATE_KEY", string(pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(appKey)})))
+	t.Setenv("PLATFORM_PUBLIC_KEY", string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: platformPublic})))
+	t.Setenv("KEY_VERSION", "3")
+
+	router, db, _, experience, _ := setupPayOrderTest(t)
+	db.Model(&models.Topic{}).Where("id = ?", experience.TopicID).Update("cover_url", "https://example.com/cover.jpg")
+	router.POST("/pay/v2/order", PayDouOrder)
+	router.POST("/pay/v2/callback", PayDouOrderCallback)
+	return router, db, experience, tradeKeys{app: appKey, platform: platformKey}
+}
+
+func postPayV2Order(router *gin.Engine, experienceID uint) (*httptest.ResponseRecorder, map[string]interface{}) {
+	jsonBody, _ := json.Marshal(map[string]interface{}{"experience_id": experienceID, "cp_extra": "from test"})
+	req, _ := http.NewRequest("POST", "/pay/v2/order", bytes.NewBuffer(jsonBody))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	var response map[string]interface{}
+	json.Unmarshal(w.Body.Bytes(), &response)
+	return w, response
+}
+
+// parseByteAuthorization splits "SHA256-RSA2048 appid=..,nonce_str=..,..." into its fields
+func parseByteAuthorization(auth string) map[string]string {
+	fields := map[string]string{}
+	for _, pair := range strings.Split(strings.TrimPrefix(auth, "SHA256-RSA2048 "), ",") {
+		kv := strings.SplitN(pair, "=", 2)
+		fields[kv[0]] = kv[1]
+	}
+	return fields
+}
+
+func postPayV2Callback(router *gin.Engine, signer *rsa.PrivateKey, msg helpers.TradePaymentMsg) *httptest.ResponseRecorder {
+	return postPayV2CallbackAt(router, signer, msg, time.Now())
+}
+
+func postPayV2CallbackAt(router *gin.Engine, signer *rsa.PrivateKey, msg helpers.TradePaymentMsg, at time.Time) *httptest.ResponseRecorder {
+	msgBytes, _ := json.Marshal(msg)
+	body, _ := json.Marshal(helpers.TradeNotification{Version: "2.0", Msg: string(msgBytes), Type: "payment"})
+	timestamp, nonce := strconv.FormatInt(at.Unix(), 10), "nonce123"
+	digest := sha256.Sum256([]byte(timestamp + "\n" + nonce + "\n" + string(body) + "\n"))
+	signature, _ := rsa.SignPKCS1v15(rand.Reader, signer, crypto.SHA256, digest[:])
+
+	req, _ := http.NewRequest("POST", "/pay/v2/callback", bytes.NewBuffer(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Byte-Timestamp", timestamp)
+	req.Header.Set("Byte-Nonce-Str", nonce)
+	req.Header.Set("Byte-Signature", base64.StdEncoding.EncodeToString(signature))
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	return w
+}
+
+func TestPayDouOrder(t *testing.T) {
+	router, db, experience, keys := setupPayV2Test(t)
+
+	w, response := postPayV2Order(router, experience.ID)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	data := response["data"].(string)
+	var tradeData helpers.TradeOrderData
+	assert.NoError(t, json.Unmarshal([]byte(data), &tradeData))
+	assert.Equal(t, 990, tradeData.TotalAmount)
+	assert.Equal(t, response["out_order_no"], tradeData.OutOrderNo)
+	assert.Equal(t, "from test", tradeData.CpExtra)
+	assert.True(t, strings.HasSuffix(tradeData.PayNotifyURL, "/pay/v2/callback"))
+	assert.Len(t, tradeData.SkuList, 1)
+	assert.Equal(t, "Test Topic", tradeData.SkuList[0].Title)
+	assert.Equal(t, 990, tradeData.SkuList[0].Price)
+	assert.Equal(t, []string{"https://example.com/cover.jpg"}, tradeData.SkuList[0].ImageList)
+
+	// byteAuthorization signs the exact data string with the app private key
+	auth := parseByteAuthorization(response["byteAuthorization"].(string))
+	assert.Equal(t, "3", auth["key_version"])
+	signature, _ := base64.StdEncoding.DecodeString(auth["signature"])
+	digest := sha256.Sum256([]byte("POST\n/requestOrder\n" + auth["timestamp"] + "\n" + auth["nonce_str"] + "\n" + data + "\n"))
+	assert.NoError(t, rsa.VerifyPKCS1v15(&keys.app.PublicKey, crypto.SHA256, digest[:], signature))
+
+	var order models.Order
+	db.Where("out_order_no = ?", tradeData.OutOrderNo).First(&order)
+	assert.Equal(t, models.OrderStatusPending, order.Status)
+	assert.Equal(t, models.OrderGatewayTradeV2, order.Gateway)
+
+	// Asking again resumes the same order
+	w, response = postPayV2Order(router, experience.ID)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, tradeData.OutOrderNo, response["out_order_no"])
+}
+
+func TestPayDouOrder_OpenEcpayOrder(t *testing.T) {
+	router, db, experience, _ := setupPayV2Test(t)
+	db.Create(&models.Order{UserID: experience.UserID, ExperienceID: &experience.ID, Price: 990, Status: models.OrderStatusPending, Gateway: models.OrderGatewayEcpay, OrderNo: "ecpay_out", OutOrderNo: "ecpay_out"})
+
+	w, _ := postPayV2Order(router, experience.ID)
+
+	assert.Equal(t, http.StatusConflict, w.Code)
+}
+
+func TestPayDouOrder_MissingPrivateKey(t *testing.T) {
+	router, db, experience, _ := setupPayV2Test(t)
+	t.Setenv("PRIVATE_KEY", "")
+
+	w, _ := postPayV2Order(router, experience.ID)
+
+	assert.Equal(t, http.StatusInternalServerError, w.Code)
+	var count int64
+	db.Model(&models.Order{}).Count(&count)
+	assert.Equal(t, int64(0), count, "an order that could not be signed is rolled back")
+}
+
+func TestPayDouOrderCallback(t *testing.T) {
+	router, db, experience, keys := setupPayV2Test(t)
+	_, response := postPayV2Order(router, experience.ID)
+	outOrderNo := response["out_order_no"].(string)
+	paid := helpers.TradePaymentMsg{Status: "SUCCESS", OrderID: "ot7053123", OutOrderNo: outOrderNo, TotalAmount: 990}
+
+	// Signed by someone other than the platform
+	w := postPayV2Callback(router, keys.app, paid)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	// Amount does not match the price
+	wrongAmount := paid
+	wrongAmount.TotalAmount = 1
+	w = postPayV2Callback(router, keys.platform, wrongAmount)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	// Correctly signed, but captured more than 5 minutes ago
+	w = postPayV2CallbackAt(router, keys.platform, paid, time.Now().Add(-6*time.Minute))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	w = postPayV2Callback(router, keys.platform, paid)
+	assert.Equal(t, http.StatusOK, w.Code)
+	var order models.Order
+	db.Where("out_order_no = ?", outOrderNo).First(&order)
+	assert.Equal(t, models.OrderStatusPaid, order.Status)
+	assert.Equal(t, "ot7053123", order.OrderNo)
+
+	// Replays are acknowledged
+	w = postPayV2Callback(router, keys.platform, paid)
+	assert.Equal(t, http.StatusOK, w.Code)
+}
+
+func TestPayDouOrderCallback_Cancel(t *testing.T) {
+	router, db, experience, keys := setupPayV2Test(t)
+	_, response := postPayV2Order(router, experience.ID)
+	outOrderNo := response["out_order_no"].(string)
+
+	w := postPayV2Callback(router, keys.platform, helpers.TradePaymentMsg{Status: "CANCEL", OutOrderNo: outOrderNo, TotalAmount: 990})
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	var order models.Order
+	db.Where("out_order_no = ?", outOrderNo).First(&order)
+	assert.Equal(t, models.OrderStatusCancelled, order.Status)
+}
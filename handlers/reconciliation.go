@@ -0,0 +1,125 @@
+package handlers
+
+import (
+	"encoding/csv"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"learning-api/jobs"
+	"learning-api/models"
+
+	"github.com/gin-gonic/gin"
+)
+
+// reconcileBillFunc reconciles the ecpay bill of a day; tests replace it to skip the download
+var reconcileBillFunc = func(date time.Time) (*models.BillReconciliation, error) {
+	return jobs.NewBillReconciler().Reconcile(date)
+}
+
+// ReconcileBillRequest is the body of POST /admin/reconciliations
+type ReconcileBillRequest struct {
+	BillDate string `json:"bill_date" binding:"required"` // 2006-01-02 in Beijing time
+}
+
+// ListBillReconciliations handles GET /admin/reconciliations. It pages through the daily bill
+// reports, latest day first, without their issues.
+func ListBillReconciliations(c *gin.Context) {
+	page, pageSize, ok := pageParams(c)
+	if !ok {
+		return
+	}
+	reports, total, err := models.FindBillReconciliations((page-1)*pageSize, pageSize)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"reconciliations": reports,
+		"page":            page,
+		"page_size":       pageSize,
+		"total":           total,
+	})
+}
+
+// ReconcileBill handles POST /admin/reconciliations. It downloads the bill of bill_date now and
+// replaces the day's report, e.g. after Douyin republished a bill.
+func ReconcileBill(c *gin.Context) {
+	var req ReconcileBillRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	date, err := jobs.ParseBillDate(req.BillDate)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "bill_date must be YYYY-MM-DD"})
+		return
+	}
+	if !date.Before(time.Now()) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "bill_date must be a past day"})
+		return
+	}
+
+	report, err := reconcileBillFunc(date)
+	if err != nil {
+		c.JSON(http.StatusBadGateway, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, report)
+}
+
+// GetBillReconciliation handles GET /admin/reconciliations/:date. It returns the day's report with
+// its issues; ?format=csv downloads the issues as a spreadsheet.
+func GetBillReconciliation(c *gin.Context) {
+	date, err := jobs.ParseBillDate(c.Param("date"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "date must be YYYY-MM-DD"})
+		return
+	}
+	report, err := models.FindBillReconciliation(date.Format(jobs.BillDateLayout))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if report == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "reconciliation not found"})
+		return
+	}
+
+	if c.Query("format") == "csv" {
+		filename := "reconciliation_" + date.Format("20060102") + ".csv"
+		c.Header("Content-Type", "text/csv; charset=utf-8")
+		c.Header("Content-Disposition", `attachment; filename="`+filename+`"`)
+		c.Status(http.StatusOK)
+		writeReconciliationCSV(c, report.Items)
+		return
+	}
+	c.JSON(http.StatusOK, report)
+}
+
+func writeReconciliationCSV(c *gin.Context, items []models.BillReconciliationItem) {
+	// a byte order mark lets spreadsheet apps read the Chinese statuses as UTF-8
+	c.Writer.WriteString("\xEF\xBB\xBF")
+	w := csv.NewWriter(c.Writer)
+	w.Write([]string{"kind", "out_order_no", "order_id", "bill_amount", "local_amount", "bill_status", "local_status"})
+	for _, item := range items {
+		orderID := ""
+		if item.OrderID != nil {
+			orderID = strconv.FormatUint(uint64(*item.OrderID), 10)
+		}
+		w.Write([]string{
+			string(item.Kind),
+			item.OutOrderNo,
+			orderID,
+			strconv.Itoa(item.BillAmount),
+			strconv.Itoa(item.LocalAmount),
+			item.BillStatus,
+			item.LocalStatus,
+		})
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		fmt.Println("write reconciliation csv failed:", err)
+	}
+}
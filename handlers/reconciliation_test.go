@@ -0,0 +1,89 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"learning-api/models"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBillReconciliations(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	db := models.InitTestDB()
+	models.SetDB(db)
+
+	var reconciled []time.Time
+	original := reconcileBillFunc
+	defer func() { reconcileBillFunc = original }()
+	reconcileBillFunc = func(date time.Time) (*models.BillReconciliation, error) {
+		reconciled = append(reconciled, date)
+		if date.Day() == 2 {
+			return nil, errors.New("bill not ready")
+		}
+		return models.ReconcileBill(date.Format("2006-01-02"), date, date.AddDate(0, 0, 1), []models.BillLine{
+			{OutOrderNo: "OUT_GHOST", Amount: 990, Paid: true, Status: "支付成功"},
+		})
+	}
+
+	router := gin.New()
+	router.GET("/admin/reconciliations", ListBillReconciliations)
+	router.POST("/admin/reconciliations", ReconcileBill)
+	router.GET("/admin/reconciliations/:date", GetBillReconciliation)
+	serve := func(method, path, body string) (*httptest.ResponseRecorder, map[string]interface{}) {
+		req, _ := http.NewRequest(method, path, bytes.NewBufferString(body))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		var response map[string]interface{}
+		json.Unmarshal(w.Body.Bytes(), &response)
+		return w, response
+	}
+
+	w, _ := serve("POST", "/admin/reconciliations", `{"bill_date":"06/01/2026"}`)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	w, _ = serve("POST", "/admin/reconciliations", `{"bill_date":"`+time.Now().AddDate(0, 0, 1).Format("2006-01-02")+`"}`)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Empty(t, reconciled)
+
+	w, response := serve("POST", "/admin/reconciliations", `{"bill_date":"2026-06-01"}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "2026-06-01", response["bill_date"])
+	assert.Equal(t, float64(1), response["issues"])
+
+	w, response = serve("POST", "/admin/reconciliations", `{"bill_date":"2026-06-02"}`)
+	assert.Equal(t, http.StatusBadGateway, w.Code)
+	assert.Equal(t, "bill not ready", response["error"])
+
+	w, response = serve("GET", "/admin/reconciliations", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, float64(1), response["total"])
+	report := response["reconciliations"].([]interface{})[0].(map[string]interface{})
+	assert.Nil(t, report["items"])
+
+	w, response = serve("GET", "/admin/reconciliations/2026-06-01", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	item := response["items"].([]interface{})[0].(map[string]interface{})
+	assert.Equal(t, "missing_local", item["kind"])
+	assert.Equal(t, "OUT_GHOST", item["out_order_no"])
+
+	w, _ = serve("GET", "/admin/reconciliations/2026-06-01?format=csv", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, `attachment; filename="reconciliation_20260601.csv"`, w.Header().Get("Content-Disposition"))
+	rows := strings.Split(strings.TrimSpace(strings.TrimPrefix(w.Body.String(), "\xEF\xBB\xBF")), "\n")
+	assert.Equal(t, "kind,out_order_no,order_id,bill_amount,local_amount,bill_status,local_status", rows[0])
+	assert.Equal(t, "missing_local,OUT_GHOST,,990,0,支付成功,", rows[1])
+
+	w, _ = serve("GET", "/admin/reconciliations/2026-05-01", "")
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	w, _ = serve("GET", "/admin/reconciliations/yesterday", "")
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
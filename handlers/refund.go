@@ -0,0 +1,147 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"learning-api/models"
+	"learning-api/payment"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+// RefundOrderRequest is the input struct for /orders/:id/refund
+// Amount defaults to everything that is still refundable
+type RefundOrderRequest struct {
+	Amount int    `json:"amount"`
+	Reason string `json:"reason"`
+}
+
+const maxReasonLength = 100
+
+// RefundOrder handles POST /orders/:id/refund for admins and support staff
+func RefundOrder(c *gin.Context) {
+	db := models.GetDB()
+
+	idStr := c.Param("id")
+	orderID, err := strconv.Atoi(idStr)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid order id"})
+		return
+	}
+
+	currentUser, exists := c.Get("currentUser")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return
+	}
+	operator := currentUser.(models.User)
+
+	var req RefundOrderRequest
+	if err := c.ShouldBindJSON(&req); err != nil && !errors.Is(err, io.EOF) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var order models.Order
+	if err := db.First(&order, orderID).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "order not found"})
+		return
+	}
+	if !order.IsSettled() {
+		c.JSON(http.StatusConflict, gin.H{"error": "order is " + order.Status.String() + " and cannot be refunded"})
+		return
+	}
+
+	refundable, err := order.RefundableAmount()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	amount := req.Amount
+	if amount == 0 {
+		amount = refundable
+	}
+	if amount <= 0 || amount > refundable {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("refund amount must be between 1 and %d", refundable)})
+		return
+	}
+
+	gateway, err := paymentGatewayFunc(order.Gateway)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	refund := models.Refund{
+		OrderID:     order.ID,
+		OutRefundNo: randomOrderNo(),
+		Amount:      amount,
+		Reason:      truncateRunes(req.Reason, maxReasonLength),
+		OperatorID:  operator.ID,
+	}
+	err = refund.CreateWithGatewayRefund(func(r *models.Refund) (string, error) {
+		return gateway.Refund(payment.RefundRequest{
+			OutOrderNo:  order.OutOrderNo,
+			OrderID:     order.OrderNo,
+			OutRefundNo: r.OutRefundNo,
+			Amount:      r.Amount,
+			Reason:      r.Reason,
+			EntryParams: orderEntryParams(&order),
+		})
+	})
+	if errors.Is(err, models.ErrRefundExceedsRefundable) {
+		// Another refund of the order was requested since the amount above was read
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusBadGateway, gin.H{"error": err.Error()})
+		return
+	}
+
+	fmt.Println("refund", refund.OutRefundNo, "of", refund.Amount, "for order", order.OutOrderNo, "requested by user", operator.ID)
+	c.JSON(http.StatusOK, refund)
+}
+
+// RefundCallback handles POST /pay/refund/callback, the ecpay refund notification
+func RefundCallback(c *gin.Context) {
+	handleNotification(c, payment.GatewayEcpay, "refund callback", payment.NotificationRefund)
+}
+
+func applyRefundNotification(c *gin.Context, label string, n *payment.Notification) {
+	refund, err := models.FindRefundByOutRefundNo(n.OutNo)
+	if err != nil {
+		fmt.Println(label, "failed: load refund", n.OutNo, "error:", err)
+		callbackReply(c, http.StatusInternalServerError, 1, "internal error")
+		return
+	}
+	if refund == nil {
+		fmt.Println(label, "rejected: unknown out_refund_no:", n.OutNo)
+		callbackReply(c, http.StatusBadRequest, 1, "refund not found")
+		return
+	}
+
+	succeeded := n.Status == payment.StatusSuccess
+	if succeeded && n.Amount != refund.Amount {
+		fmt.Println(label, "rejected: refund", n.OutNo, "amount", n.Amount, "does not match", refund.Amount)
+		callbackReply(c, http.StatusBadRequest, 1, "amount mismatch")
+		return
+	}
+
+	changed, err := refund.Complete(succeeded, models.OrderSourceCallback)
+	if err != nil {
+		fmt.Println(label, "failed: complete refund", n.OutNo, "error:", err)
+		callbackReply(c, http.StatusInternalServerError, 1, "internal error")
+		return
+	}
+	if !changed {
+		fmt.Println(label, "replay ignored: refund", n.OutNo, "is already", refund.Status.String())
+		callbackReply(c, http.StatusOK, 0, "success")
+		return
+	}
+
+	fmt.Println(label+": refund", n.OutNo, "is", refund.Status.String(), n.Message)
+	callbackReply(c, http.StatusOK, 0, "success")
+}
@@ -0,0 +1,220 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"learning-api/helpers"
+	"learning-api/models"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"gorm.io/gorm"
+)
+
+func setupRefundTest(t *testing.T) (*gin.Engine, *gorm.DB, models.Experience, models.Order, *fakeEcpayGateway) {
+	t.Setenv("CALLBACK_TOKEN", testCallbackToken)
+	gin.SetMode(gin.TestMode)
+	db := models.InitTestDB()
+	db.AutoMigrate(&models.Topic{}, &models.Experience{})
+	models.SetDB(db)
+
+	admin := models.User{OpenID: "admin_user", Role: models.RoleAdmin}
+	db.Create(&admin)
+	buyer := models.User{OpenID: "buyer"}
+	db.Create(&buyer)
+	experience := models.Experience{TopicID: 1, UserID: buyer.ID}
+	db.Create(&experience)
+	order := models.Order{
+		UserID:       buyer.ID,
+		ExperienceID: &experience.ID,
+		Price:        1000,
+		Status:       models.OrderStatusPaid,
+		OrderNo:      "DY_REFUND_001",
+		OutOrderNo:   "OUT_REFUND_001",
+	}
+	db.Create(&order)
+	order.SyncEntitlement()
+
+	gateway := newFakeEcpayGateway(t)
+
+	r := gin.New()
+	r.Use(func(c *gin.Context) {
+		c.Set("currentUser", admin)
+		c.Next()
+	})
+	r.POST("/orders/:id/refund", RefundOrder)
+	r.POST("/pay/refund/callback", RefundCallback)
+	return r, db, experience, order, gateway
+}
+
+type refundResponse struct {
+	ID          uint   `json:"id"`
+	OutRefundNo string `json:"out_refund_no"`
+	Amount      int    `json:"amount"`
+	Status      string `json:"status"`
+}
+
+func postRefund(r *gin.Engine, orderID uint, body interface{}) (*httptest.ResponseRecorder, refundResponse) {
+	jsonBody, _ := json.Marshal(body)
+	req, _ := http.NewRequest("POST", fmt.Sprintf("/orders/%d/refund", orderID), bytes.NewBuffer(jsonBody))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	var refund refundResponse
+	json.Unmarshal(w.Body.Bytes(), &refund)
+	return w, refund
+}
+
+func postRefundCallback(r *gin.Engine, msg helpers.EcpayRefundMsg) *httptest.ResponseRecorder {
+	msgBytes, _ := json.Marshal(msg)
+	body := helpers.EcpayCallbackRequest{
+		Timestamp: json.Number(strconv.FormatInt(time.Now().Unix(), 10)),
+		Nonce:     "9999",
+		Msg:       string(msgBytes),
+		Type:      "refund",
+	}
+	body.MsgSignature = helpers.CallbackSign([]string{testCallbackToken, body.Timestamp.String(), body.Nonce, body.Msg})
+	jsonBody, _ := json.Marshal(body)
+	req, _ := http.NewRequest("POST", "/pay/refund/callback", bytes.NewBuffer(jsonBody))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+func paidExperience(db *gorm.DB, id uint) bool {
+	var experience models.Experience
+	db.Preload("Order", models.LatestOrder).First(&experience, id)
+	return experience.Paid()
+}
+
+func TestRefundOrder_PartialThenFull(t *testing.T) {
+	r, db, experience, order, _ := setupRefundTest(t)
+
+	// Partial refund keeps the unlock
+	w, partial := postRefund(r, order.ID, RefundOrderRequest{Amount: 400, Reason: "goodwill"})
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, 400, partial.Amount)
+	assert.Equal(t, "pending", partial.Status)
+
+	// The pending refund holds its amount, so more than the rest cannot be requested
+	w, _ = postRefund(r, order.ID, RefundOrderRequest{Amount: 700})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	w = postRefundCallback(r, helpers.EcpayRefundMsg{CpRefundNo: partial.OutRefundNo, Status: "SUCCESS", RefundAmount: 400})
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	var updated models.Order
+	db.First(&updated, order.ID)
+	assert.Equal(t, models.OrderStatusPartiallyRefunded, updated.Status)
+	assert.Equal(t, 400, updated.RefundedAmount)
+	assert.True(t, paidExperience(db, experience.ID))
+
+	// Refunding the rest revokes the unlock
+	w, rest := postRefund(r, order.ID, nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, 600, rest.Amount)
+
+	w = postRefundCallback(r, helpers.EcpayRefundMsg{CpRefundNo: rest.OutRefundNo, Status: "SUCCESS", RefundAmount: 600})
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	db.First(&updated, order.ID)
+	assert.Equal(t, models.OrderStatusRefunded, updated.Status)
+	assert.Equal(t, 1000, updated.RefundedAmount)
+	assert.False(t, paidExperience(db, experience.ID))
+
+	// Replayed callback is acknowledged without refunding twice
+	w = postRefundCallback(r, helpers.EcpayRefundMsg{CpRefundNo: rest.OutRefundNo, Status: "SUCCESS", RefundAmount: 600})
+	assert.Equal(t, http.StatusOK, w.Code)
+	db.First(&updated, order.ID)
+	assert.Equal(t, 1000, updated.RefundedAmount)
+
+	// Nothing left to refund
+	w, _ = postRefund(r, order.ID, nil)
+	assert.Equal(t, http.StatusConflict, w.Code)
+}
+
+func TestRefundOrder_OverlappingRefunds(t *testing.T) {
+	r, db, experience, order, _ := setupRefundTest(t)
+
+	// Both refunds are open before either callback lands
+	_, first := postRefund(r, order.ID, RefundOrderRequest{Amount: 400})
+	_, second := postRefund(r, order.ID, nil)
+	assert.Equal(t, 600, second.Amount)
+
+	w := postRefundCallback(r, helpers.EcpayRefundMsg{CpRefundNo: second.OutRefundNo, Status: "SUCCESS", RefundAmount: 600})
+	assert.Equal(t, http.StatusOK, w.Code)
+	w = postRefundCallback(r, helpers.EcpayRefundMsg{CpRefundNo: first.OutRefundNo, Status: "SUCCESS", RefundAmount: 400})
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	var updated models.Order
+	db.First(&updated, order.ID)
+	assert.Equal(t, 1000, updated.RefundedAmount, "each refund adds its own amount")
+	assert.Equal(t, models.OrderStatusRefunded, updated.Status)
+	assert.False(t, paidExperience(db, experience.ID))
+
+	histories, _ := models.FindOrderStatusHistories(order.ID)
+	assert.Len(t, histories, 2)
+	assert.Equal(t, models.OrderStatusPartiallyRefunded, histories[0].ToStatus)
+	assert.Equal(t, models.OrderStatusRefunded, histories[1].ToStatus)
+}
+
+func TestRefundOrder_FailedRefundReleasesAmount(t *testing.T) {
+	r, db, _, order, _ := setupRefundTest(t)
+
+	w, refund := postRefund(r, order.ID, nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	w = postRefundCallback(r, helpers.EcpayRefundMsg{CpRefundNo: refund.OutRefundNo, Status: "FAIL"})
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	var stored models.Refund
+	db.First(&stored, refund.ID)
+	assert.Equal(t, models.RefundStatusFailed, stored.Status)
+
+	var updated models.Order
+	db.First(&updated, order.ID)
+	assert.Equal(t, models.OrderStatusPaid, updated.Status)
+
+	w, _ = postRefund(r, order.ID, nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+}
+
+func TestRefundOrder_GatewayRejects(t *testing.T) {
+	r, db, _, order, gateway := setupRefundTest(t)
+	gateway.reply(nil, &helpers.DouyinRefundResponse{ErrNo: 4, ErrTips: "order not settled"})
+
+	w, _ := postRefund(r, order.ID, nil)
+	assert.Equal(t, http.StatusBadGateway, w.Code)
+
+	var count int64
+	db.Model(&models.Refund{}).Count(&count)
+	assert.Equal(t, int64(0), count)
+}
+
+func TestRefundOrder_UnpaidOrder(t *testing.T) {
+	r, db, _, order, _ := setupRefundTest(t)
+	db.Model(&models.Order{}).Where("id = ?", order.ID).Update("status", models.OrderStatusPending)
+
+	w, _ := postRefund(r, order.ID, nil)
+	assert.Equal(t, http.StatusConflict, w.Code)
+}
+
+func TestRefundCallback_InvalidSignature(t *testing.T) {
+	r, _, _, _, _ := setupRefundTest(t)
+
+	body := helpers.EcpayCallbackRequest{Timestamp: "1", Nonce: "1", Msg: "{}", Type: "refund", MsgSignature: "bad"}
+	jsonBody, _ := json.Marshal(body)
+	req, _ := http.NewRequest("POST", "/pay/refund/callback", bytes.NewBuffer(jsonBody))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
@@ -0,0 +1,107 @@
+package handlers
+
+import (
+	"encoding/csv"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+	_ "time/tzdata" // report timezones must resolve on hosts without a zoneinfo database
+
+	"learning-api/models"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	defaultReportTimezone = "Asia/Shanghai"
+	defaultReportDays     = 30
+	maxReportDays         = 366
+)
+
+// GetRevenueReport handles GET /admin/reports/revenue. It aggregates the orders created between
+// the from and to dates (inclusive, YYYY-MM-DD in tz) by group_by and answers JSON, or a CSV
+// download with format=csv.
+func GetRevenueReport(c *gin.Context) {
+	groupBy := c.DefaultQuery("group_by", models.ReportGroupByDay)
+	if groupBy != models.ReportGroupByDay && groupBy != models.ReportGroupByTopic && groupBy != models.ReportGroupByStatus {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "group_by must be day, topic or status"})
+		return
+	}
+	timezone := c.DefaultQuery("tz", defaultReportTimezone)
+	loc, err := time.LoadLocation(timezone)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid tz: " + timezone})
+		return
+	}
+
+	today := time.Now().In(loc).Format("2006-01-02")
+	to, err := time.ParseInLocation("2006-01-02", c.DefaultQuery("to", today), loc)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "to must be a date like 2006-01-02"})
+		return
+	}
+	from := to.AddDate(0, 0, 1-defaultReportDays)
+	if c.Query("from") != "" {
+		if from, err = time.ParseInLocation("2006-01-02", c.Query("from"), loc); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "from must be a date like 2006-01-02"})
+			return
+		}
+	}
+	end := to.AddDate(0, 0, 1) // to is inclusive
+	if !from.Before(end) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "from must not be after to"})
+		return
+	}
+	if end.After(from.AddDate(0, 0, maxReportDays)) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "the range must not exceed " + strconv.Itoa(maxReportDays) + " days"})
+		return
+	}
+
+	rows, total, err := models.RevenueReport(from, end, groupBy)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	if c.Query("format") == "csv" {
+		filename := "revenue_" + groupBy + "_" + from.Format("20060102") + "_" + to.Format("20060102") + ".csv"
+		c.Header("Content-Type", "text/csv; charset=utf-8")
+		c.Header("Content-Disposition", `attachment; filename="`+filename+`"`)
+		c.Status(http.StatusOK)
+		writeRevenueCSV(c, groupBy, append(rows, total))
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"group_by": groupBy,
+		"from":     from.Format("2006-01-02"),
+		"to":       to.Format("2006-01-02"),
+		"timezone": timezone,
+		"rows":     rows,
+		"total":    total,
+	})
+}
+
+// writeRevenueCSV writes the rows with a header line. Amounts stay in fen like everywhere else.
+func writeRevenueCSV(c *gin.Context, groupBy string, rows []models.RevenueRow) {
+	// a byte order mark lets spreadsheet apps read the Chinese names as UTF-8
+	c.Writer.WriteString("\xEF\xBB\xBF")
+	w := csv.NewWriter(c.Writer)
+	w.Write([]string{groupBy, "label", "orders", "paid_orders", "refunded_orders", "gross", "refunded", "net"})
+	for _, row := range rows {
+		w.Write([]string{
+			row.Key,
+			row.Label,
+			strconv.Itoa(row.Orders),
+			strconv.Itoa(row.PaidOrders),
+			strconv.Itoa(row.RefundedOrders),
+			strconv.Itoa(row.Gross),
+			strconv.Itoa(row.Refunded),
+			strconv.Itoa(row.Net),
+		})
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		fmt.Println("write revenue csv failed:", err)
+	}
+}
@@ -0,0 +1,74 @@
+package handlers
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"learning-api/models"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetRevenueReport(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	db := models.InitTestDB()
+	db.AutoMigrate(&models.Topic{}, &models.Experience{})
+	models.SetDB(db)
+
+	topic := models.Topic{Name: "性格测评", Price: 990}
+	db.Create(&topic)
+	experience := models.Experience{TopicID: topic.ID, UserID: 1}
+	db.Create(&experience)
+	shanghai, _ := time.LoadLocation("Asia/Shanghai")
+	db.Create(&[]models.Order{
+		{UserID: 1, ExperienceID: &experience.ID, Price: 990, Status: models.OrderStatusPaid, OrderNo: "DY_1", CreatedAt: time.Date(2026, 6, 1, 7, 0, 0, 0, shanghai).Local()},
+		{UserID: 1, ExperienceID: &experience.ID, Price: 990, Status: models.OrderStatusRefunded, RefundedAmount: 990, OrderNo: "DY_2", CreatedAt: time.Date(2026, 6, 2, 20, 0, 0, 0, shanghai).Local()},
+	})
+
+	router := gin.New()
+	router.GET("/admin/reports/revenue", GetRevenueReport)
+	serve := func(query string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("GET", "/admin/reports/revenue?"+query, nil)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	w := serve("from=2026-06-01&to=2026-06-02")
+	assert.Equal(t, http.StatusOK, w.Code)
+	var report struct {
+		Rows  []models.RevenueRow `json:"rows"`
+		Total models.RevenueRow   `json:"total"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &report)
+	assert.Len(t, report.Rows, 2)
+	assert.Equal(t, 990, report.Total.Net)
+	assert.Equal(t, 990, report.Total.Refunded)
+
+	// 07:00 in Shanghai is still May 31st in New York
+	w = serve("from=2026-06-01&to=2026-06-02&tz=America/New_York")
+	json.Unmarshal(w.Body.Bytes(), &report)
+	assert.Equal(t, 1, report.Total.Orders)
+
+	w = serve("group_by=topic&from=2026-06-01&to=2026-06-02&format=csv")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Header().Get("Content-Disposition"), "revenue_topic_20260601_20260602.csv")
+	records, err := csv.NewReader(strings.NewReader(strings.TrimPrefix(w.Body.String(), "\xEF\xBB\xBF"))).ReadAll()
+	assert.NoError(t, err)
+	assert.Equal(t, [][]string{
+		{"topic", "label", "orders", "paid_orders", "refunded_orders", "gross", "refunded", "net"},
+		{"topic:1", "性格测评", "2", "2", "1", "1980", "990", "990"},
+		{"total", "total", "2", "2", "1", "1980", "990", "990"},
+	}, records)
+
+	assert.Equal(t, http.StatusBadRequest, serve("group_by=week").Code)
+	assert.Equal(t, http.StatusBadRequest, serve("tz=Mars/Olympus").Code)
+	assert.Equal(t, http.StatusBadRequest, serve("from=2026-06-03&to=2026-06-02").Code)
+	assert.Equal(t, http.StatusBadRequest, serve("from=2025-01-01&to=2026-06-02").Code)
+}
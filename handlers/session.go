@@ -0,0 +1,54 @@
+package handlers
+
+import (
+	"net/http"
+	"strconv"
+
+	"learning-api/models"
+
+	"github.com/gin-gonic/gin"
+)
+
+// GetMySessions handles GET /me/sessions. It lists the devices the user is signed in on, most
+// recently used first.
+func GetMySessions(c *gin.Context) {
+	user, claims, ok := currentToken(c)
+	if !ok {
+		return
+	}
+	sessions, err := models.FindUserSessions(user.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"sessions": models.ToSessionResponses(sessions, claims.JTI)})
+}
+
+// DeleteMySession handles DELETE /me/sessions/:id. It signs the user out on that device; its
+// access token is rejected from then on and its refresh token can no longer be exchanged.
+func DeleteMySession(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid session id"})
+		return
+	}
+	user, _, ok := currentToken(c)
+	if !ok {
+		return
+	}
+
+	session, err := models.FindUserSession(user.ID, uint(id))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if session == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "session not found"})
+		return
+	}
+	if err := session.RevokeFamily(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
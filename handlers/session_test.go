@@ -0,0 +1,79 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"learning-api/models"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMySessions(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	db := models.InitTestDB()
+	models.SetDB(db)
+
+	user := models.User{OpenID: "sessions_openid"}
+	db.Create(&user)
+	other := models.User{OpenID: "other_openid"}
+	db.Create(&other)
+	newSession := func(userID uint, device string) *models.Token {
+		token := models.NewToken()
+		token.UserID = userID
+		token.DeviceName = device
+		assert.NoError(t, token.GenTokenWithDate())
+		db.Create(token)
+		return token
+	}
+	phone := newSession(user.ID, "iPhone 15")
+	pc := newSession(user.ID, "Douyin PC")
+	othersPhone := newSession(other.ID, "Pixel 8")
+
+	router := gin.New()
+	router.Use(func(c *gin.Context) {
+		c.Set("currentUser", user)
+		c.Set("currentToken", models.AccessClaims{UserID: user.ID, JTI: phone.AccessJTI, ExpiresAt: time.Now().Add(time.Hour)})
+	})
+	router.GET("/me/sessions", GetMySessions)
+	router.DELETE("/me/sessions/:id", DeleteMySession)
+	serve := func(method, path string) (*httptest.ResponseRecorder, map[string]interface{}) {
+		req, _ := http.NewRequest(method, path, nil)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		var response map[string]interface{}
+		json.Unmarshal(w.Body.Bytes(), &response)
+		return w, response
+	}
+
+	w, response := serve("GET", "/me/sessions")
+	assert.Equal(t, http.StatusOK, w.Code)
+	sessions := response["sessions"].([]interface{})
+	assert.Len(t, sessions, 2)
+	current := map[string]bool{}
+	for _, s := range sessions {
+		session := s.(map[string]interface{})
+		current[session["device_name"].(string)] = session["current"].(bool)
+	}
+	assert.Equal(t, map[string]bool{"iPhone 15": true, "Douyin PC": false}, current)
+
+	w, _ = serve("DELETE", "/me/sessions/"+strconv.FormatUint(uint64(othersPhone.ID), 10))
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	w, _ = serve("DELETE", "/me/sessions/abc")
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	w, _ = serve("DELETE", "/me/sessions/"+strconv.FormatUint(uint64(pc.ID), 10))
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	revoked, _ := models.IsAccessTokenRevoked(pc.AccessJTI)
+	assert.True(t, revoked)
+	revoked, _ = models.IsAccessTokenRevoked(othersPhone.AccessJTI)
+	assert.False(t, revoked)
+
+	_, response = serve("GET", "/me/sessions")
+	assert.Len(t, response["sessions"].([]interface{}), 1)
+}
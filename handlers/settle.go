@@ -0,0 +1,85 @@
+package handlers
+
+import (
+	"fmt"
+	"learning-api/models"
+	"learning-api/payment"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ConfirmExperienceDelivery handles POST /experiences/:id/confirm, which the client calls once it
+// has shown the buyer the results of a paid experience. The order moves to confirmed and the order
+// reconciler starts its settle.
+func ConfirmExperienceDelivery(c *gin.Context) {
+	experienceID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid experience id"})
+		return
+	}
+	currentUser, exists := c.Get("currentUser")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return
+	}
+	user := currentUser.(models.User)
+
+	var experience models.Experience
+	err = models.GetDB().Preload("Order", models.LatestOrder).First(&experience, experienceID).Error
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "experience not found"})
+		return
+	}
+	if experience.UserID != user.ID {
+		c.JSON(http.StatusForbidden, gin.H{"error": "forbidden: not your experience"})
+		return
+	}
+
+	order := experience.Order
+	if order == nil || !order.IsSettled() {
+		c.JSON(http.StatusConflict, gin.H{"error": "order is not paid"})
+		return
+	}
+	if _, err := order.ConfirmDelivery(models.OrderSourceUser); err != nil {
+		fmt.Println("confirm delivery: order", order.OutOrderNo, "error:", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to confirm order"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"order": order})
+}
+
+// SettleCallback handles POST /pay/settle/callback, the ecpay settle notification
+func SettleCallback(c *gin.Context) {
+	handleNotification(c, payment.GatewayEcpay, "settle callback", payment.NotificationSettle)
+}
+
+func applySettleNotification(c *gin.Context, label string, n *payment.Notification) {
+	order, err := models.FindOrderByOutSettleNo(n.OutNo)
+	if err != nil {
+		fmt.Println(label, "failed: load order", n.OutNo, "error:", err)
+		callbackReply(c, http.StatusInternalServerError, 1, "internal error")
+		return
+	}
+	if order == nil {
+		fmt.Println(label, "rejected: unknown out_settle_no:", n.OutNo)
+		callbackReply(c, http.StatusBadRequest, 1, "order not found")
+		return
+	}
+
+	changed, err := order.CompleteSettle(n.Status == payment.StatusSuccess)
+	if err != nil {
+		fmt.Println(label, "failed: complete settle", n.OutNo, "error:", err)
+		callbackReply(c, http.StatusInternalServerError, 1, "internal error")
+		return
+	}
+	if !changed {
+		fmt.Println(label, "replay ignored: order", order.OutOrderNo, "settle is already", order.SettleStatus.String())
+		callbackReply(c, http.StatusOK, 0, "success")
+		return
+	}
+
+	fmt.Println(label+": order", order.OutOrderNo, "settle is", order.SettleStatus.String(), n.Message)
+	callbackReply(c, http.StatusOK, 0, "success")
+}
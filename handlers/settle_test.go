@@ -0,0 +1,174 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"learning-api/helpers"
+	"learning-api/models"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"gorm.io/gorm"
+)
+
+func setupSettleTest(t *testing.T) (*gin.Engine, *gorm.DB, *models.Order) {
+	t.Setenv("CALLBACK_TOKEN", testCallbackToken)
+	gin.SetMode(gin.TestMode)
+	db := models.InitTestDB()
+	db.AutoMigrate(&models.Topic{}, &models.Experience{})
+	models.SetDB(db)
+
+	user := models.User{OpenID: "settle_user"}
+	db.Create(&user)
+	experience := models.Experience{TopicID: 1, UserID: user.ID}
+	db.Create(&experience)
+	order := &models.Order{
+		UserID:       user.ID,
+		ExperienceID: &experience.ID,
+		Price:        990,
+		Status:       models.OrderStatusPaid,
+		OrderNo:      "N71016888186626816",
+		OutOrderNo:   "out_order_no_1",
+	}
+	db.Create(order)
+
+	r := gin.New()
+	r.POST("/experiences/:id/confirm", func(c *gin.Context) {
+		c.Set("currentUser", user)
+		ConfirmExperienceDelivery(c)
+	})
+	r.POST("/pay/settle/callback", SettleCallback)
+	return r, db, order
+}
+
+func postConfirm(r *gin.Engine, experienceID uint) *httptest.ResponseRecorder {
+	req, _ := http.NewRequest("POST", "/experiences/"+strconv.FormatUint(uint64(experienceID), 10)+"/confirm", nil)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+// settleOrder starts the settle of the order as the order reconciler does
+func settleOrder(t *testing.T, db *gorm.DB, id uint, settle func(o *models.Order) (string, error)) {
+	var order models.Order
+	db.First(&order, id)
+	_, err := order.Settle(time.Now(), settle)
+	if err != nil {
+		t.Log("settle:", err)
+	}
+}
+
+func postSettleCallback(r *gin.Engine, token string, msg helpers.EcpaySettleMsg) *httptest.ResponseRecorder {
+	msgBytes, _ := json.Marshal(msg)
+	body := helpers.EcpayCallbackRequest{
+		Timestamp: json.Number(strconv.FormatInt(time.Now().Unix(), 10)),
+		Nonce:     "9999",
+		Msg:       string(msgBytes),
+		Type:      "settle",
+	}
+	body.MsgSignature = helpers.CallbackSign([]string{token, body.Timestamp.String(), body.Nonce, body.Msg})
+	jsonBody, _ := json.Marshal(body)
+	req, _ := http.NewRequest("POST", "/pay/settle/callback", bytes.NewBuffer(jsonBody))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+func TestConfirmExperienceDelivery_ThenSettle(t *testing.T) {
+	r, db, order := setupSettleTest(t)
+
+	w := postConfirm(r, *order.ExperienceID)
+	assert.Equal(t, http.StatusOK, w.Code)
+	var updated models.Order
+	db.First(&updated, order.ID)
+	assert.Equal(t, models.OrderStatusConfirmed, updated.Status)
+	assert.Equal(t, models.SettleStatusNone, updated.SettleStatus, "the settle is left to the reconciler")
+
+	// Confirming again is acknowledged without another transition
+	w = postConfirm(r, *order.ExperienceID)
+	assert.Equal(t, http.StatusOK, w.Code)
+	histories, _ := models.FindOrderStatusHistories(order.ID)
+	assert.Len(t, histories, 1)
+	assert.Equal(t, "results delivered", histories[0].Note)
+
+	var settledAmount int
+	settleOrder(t, db, order.ID, func(o *models.Order) (string, error) {
+		settledAmount = o.Price - o.RefundedAmount
+		return "settle_no_1", nil
+	})
+	db.First(&updated, order.ID)
+	assert.Equal(t, models.SettleStatusPending, updated.SettleStatus)
+	assert.Equal(t, "Sout_order_no_1", updated.OutSettleNo)
+	assert.Equal(t, "settle_no_1", updated.SettleNo)
+	assert.Equal(t, 990, settledAmount)
+
+	w = postSettleCallback(r, testCallbackToken, helpers.EcpaySettleMsg{CpSettleNo: updated.OutSettleNo, Status: "SUCCESS"})
+	assert.Equal(t, http.StatusOK, w.Code)
+	db.First(&updated, order.ID)
+	assert.Equal(t, models.SettleStatusSucceeded, updated.SettleStatus)
+	assert.NotNil(t, updated.SettledAt)
+
+	// A replayed callback is acknowledged without changing anything
+	w = postSettleCallback(r, testCallbackToken, helpers.EcpaySettleMsg{CpSettleNo: updated.OutSettleNo, Status: "FAIL"})
+	assert.Equal(t, http.StatusOK, w.Code)
+	db.First(&updated, order.ID)
+	assert.Equal(t, models.SettleStatusSucceeded, updated.SettleStatus)
+}
+
+func TestConfirmExperienceDelivery_Unpaid(t *testing.T) {
+	r, db, order := setupSettleTest(t)
+	db.Model(order).Update("status", models.OrderStatusPending)
+
+	w := postConfirm(r, *order.ExperienceID)
+	assert.Equal(t, http.StatusConflict, w.Code)
+
+	w = postConfirm(r, 999)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func TestSettle_GatewayRejects(t *testing.T) {
+	r, db, order := setupSettleTest(t)
+	postConfirm(r, *order.ExperienceID)
+
+	settleOrder(t, db, order.ID, func(o *models.Order) (string, error) {
+		return "", errors.New("settle rejected: 1 too early")
+	})
+
+	// The order stays confirmed and the settle can be started again
+	var updated models.Order
+	db.First(&updated, order.ID)
+	assert.Equal(t, models.OrderStatusConfirmed, updated.Status)
+	assert.Equal(t, models.SettleStatusNone, updated.SettleStatus)
+	assert.Equal(t, "", updated.OutSettleNo)
+}
+
+func TestSettleCallback_FailedSettle(t *testing.T) {
+	r, db, order := setupSettleTest(t)
+	postConfirm(r, *order.ExperienceID)
+	settleOrder(t, db, order.ID, func(o *models.Order) (string, error) { return "settle_no_1", nil })
+
+	w := postSettleCallback(r, testCallbackToken, helpers.EcpaySettleMsg{CpSettleNo: "Sout_order_no_1", Status: "FAIL", Message: "merchant frozen"})
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	var updated models.Order
+	db.First(&updated, order.ID)
+	assert.Equal(t, models.SettleStatusFailed, updated.SettleStatus)
+	assert.Nil(t, updated.SettledAt)
+}
+
+func TestSettleCallback_Rejected(t *testing.T) {
+	r, _, _ := setupSettleTest(t)
+
+	w := postSettleCallback(r, "wrong_token", helpers.EcpaySettleMsg{CpSettleNo: "Sout_order_no_1", Status: "SUCCESS"})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	w = postSettleCallback(r, testCallbackToken, helpers.EcpaySettleMsg{CpSettleNo: "unknown", Status: "SUCCESS"})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
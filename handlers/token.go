@@ -1,6 +1,7 @@
 package handlers
 
 import (
+	"errors"
 	"learning-api/helpers"
 	"learning-api/models"
 	"net/http"
@@ -16,6 +17,9 @@ var newDouyinClientFunc = helpers.NewDouyinClient
 
 type TokenRequest struct {
 	Code string `json:"code" binding:"required"`
+	// optional, shown in the user's session list
+	DeviceName string `json:"device_name"`
+	Platform   string `json:"platform"`
 }
 
 // RefreshTokenRequest represents the expected request body for /refresh-token
@@ -33,7 +37,12 @@ func PostToken(c *gin.Context) {
 	}
 
 	client := newDouyinClientFunc()
-	result, err := client.Jscode2session(req.Code, "")
+	result, err := client.Jscode2session(req.Code, "", models.DeviceInfo{
+		Name:      req.DeviceName,
+		Platform:  req.Platform,
+		UserAgent: c.Request.UserAgent(),
+		IP:        c.ClientIP(),
+	})
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate token"})
 		return
@@ -44,7 +53,8 @@ func PostToken(c *gin.Context) {
 
 }
 
-// PostRefreshToken handles POST /refresh-token
+// PostRefreshToken handles POST /refresh-token. The presented pair is exchanged for a new one and
+// stops working; presenting it again revokes every token of its login.
 func PostRefreshToken(c *gin.Context) {
 	var req RefreshTokenRequest
 	if err := c.ShouldBindJSON(&req); err != nil {
@@ -60,6 +70,11 @@ func PostRefreshToken(c *gin.Context) {
 		return
 	}
 
+	if token.RevokedAt != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Refresh token revoked"})
+		return
+	}
+
 	// Check if refresh token is expired
 	expirationTime := token.CreatedAt.Add(time.Duration(token.RefreshTokenExpiresIn) * time.Second)
 	if expirationTime.Before(time.Now()) {
@@ -69,6 +84,10 @@ func PostRefreshToken(c *gin.Context) {
 
 	// Generate new token
 	newToken, err := token.RefreshToNewToken()
+	if errors.Is(err, models.ErrRefreshTokenReused) {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Refresh token reused"})
+		return
+	}
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to refresh token"})
 		return
@@ -77,3 +96,46 @@ func PostRefreshToken(c *gin.Context) {
 	// Return new token
 	c.JSON(http.StatusOK, newToken)
 }
+
+// currentToken returns the user and access token of the request. On failure it has already replied.
+func currentToken(c *gin.Context) (models.User, models.AccessClaims, bool) {
+	currentUser, exists := c.Get("currentUser")
+	claims, hasClaims := c.Get("currentToken")
+	if !exists || !hasClaims {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return models.User{}, models.AccessClaims{}, false
+	}
+	return currentUser.(models.User), claims.(models.AccessClaims), true
+}
+
+// PostLogout handles POST /logout. It revokes the token pair the request was made with; other
+// logins of the user stay signed in.
+func PostLogout(c *gin.Context) {
+	user, claims, ok := currentToken(c)
+	if !ok {
+		return
+	}
+	if err := models.RevokeAccessToken(user.ID, claims.JTI, claims.ExpiresAt); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to log out"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"revoked": 1})
+}
+
+// PostLogoutAll handles POST /logout-all. It revokes every token pair of the user.
+func PostLogoutAll(c *gin.Context) {
+	user, claims, ok := currentToken(c)
+	if !ok {
+		return
+	}
+	revoked, err := models.RevokeUserTokens(user.ID)
+	if err == nil {
+		// the request's own token too, should its pair no longer be stored
+		err = models.RevokeAccessToken(user.ID, claims.JTI, claims.ExpiresAt)
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to log out"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"revoked": revoked})
+}
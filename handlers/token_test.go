@@ -33,7 +33,7 @@ func setupTestDB() *gorm.DB {
 	if err != nil {
 		panic("failed to connect database")
 	}
-	db.AutoMigrate(&models.User{}, &models.Token{})
+	db.AutoMigrate(&models.User{}, &models.Token{}, &models.RevokedToken{})
 	return db
 }
 
@@ -160,7 +160,7 @@ func TestPostRefreshToken_ExpiredToken(t *testing.T) {
 // and returns a mock token for testing
 type mockHandlerDouyinClient struct{}
 
-func (m *mockHandlerDouyinClient) Jscode2session(code string, anonymousCode string) (*models.Token, error) {
+func (m *mockHandlerDouyinClient) Jscode2session(code string, anonymousCode string, device models.DeviceInfo) (*models.Token, error) {
 	return &models.Token{
 		AccessToken:  "mock_access_token",
 		RefreshToken: "mock_refresh_token",
@@ -169,3 +169,110 @@ func (m *mockHandlerDouyinClient) Jscode2session(code string, anonymousCode stri
 
 func ptrString(s string) *string { return &s }
 func ptrInt64(i int64) *int64    { return &i }
+
+func TestPostRefreshToken_RotationAndReuse(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	db := setupTestDB()
+	setModelsDB(db)
+	r := gin.New()
+	r.POST("/refresh-token", PostRefreshToken)
+	refresh := func(token *models.Token) (*httptest.ResponseRecorder, models.Token) {
+		body, _ := json.Marshal(map[string]string{"access_token": token.AccessToken, "refresh_token": token.RefreshToken})
+		req, _ := http.NewRequest("POST", "/refresh-token", bytes.NewBuffer(body))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		var responseToken models.Token
+		json.Unmarshal(w.Body.Bytes(), &responseToken)
+		return w, responseToken
+	}
+
+	login := models.NewToken()
+	if err := login.GenTokenWithDate(); err != nil {
+		t.Fatal("Failed to generate token:", err)
+	}
+	db.Create(login)
+
+	w, rotated := refresh(login)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", w.Code)
+	}
+
+	// The exchanged pair is presented again: the whole family is revoked
+	w, _ = refresh(login)
+	if w.Code != http.StatusUnauthorized || !bytes.Contains(w.Body.Bytes(), []byte("Refresh token reused")) {
+		t.Errorf("expected 401 reused, got %d %s", w.Code, w.Body.String())
+	}
+	w, _ = refresh(&rotated)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("expected the rotated token to be revoked with its family, got %d", w.Code)
+	}
+
+	var revoked int64
+	db.Model(&models.Token{}).Where("revoked_at IS NOT NULL").Count(&revoked)
+	if revoked != 2 {
+		t.Errorf("expected 2 revoked tokens, got %d", revoked)
+	}
+}
+
+func TestPostLogout(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	db := setupTestDB()
+	setModelsDB(db)
+
+	user := models.User{OpenID: "logout_openid"}
+	db.Create(&user)
+	var tokens []*models.Token
+	for i := 0; i < 3; i++ {
+		token := models.NewToken()
+		token.UserID = user.ID
+		if err := token.GenTokenWithDate(); err != nil {
+			t.Fatal("Failed to generate token:", err)
+		}
+		db.Create(token)
+		tokens = append(tokens, token)
+	}
+
+	r := gin.New()
+	authAs := func(token *models.Token) gin.HandlerFunc {
+		return func(c *gin.Context) {
+			c.Set("currentUser", user)
+			c.Set("currentToken", models.AccessClaims{UserID: user.ID, JTI: token.AccessJTI, ExpiresAt: time.Now().Add(time.Hour)})
+		}
+	}
+	r.POST("/logout", authAs(tokens[0]), PostLogout)
+	r.POST("/logout-all", authAs(tokens[1]), PostLogoutAll)
+	serve := func(path string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("POST", path, nil)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+	revoked := func(token *models.Token) bool {
+		isRevoked, err := models.IsAccessTokenRevoked(token.AccessJTI)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return isRevoked
+	}
+
+	if w := serve("/logout"); w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", w.Code)
+	}
+	if !revoked(tokens[0]) || revoked(tokens[1]) || revoked(tokens[2]) {
+		t.Error("logout should revoke only the current pair")
+	}
+	// The refresh token of a logged out pair can no longer be exchanged
+	db.First(tokens[0], tokens[0].ID)
+	if tokens[0].RevokedAt == nil {
+		t.Error("the logged out pair should be revoked")
+	}
+
+	w := serve("/logout-all")
+	if w.Code != http.StatusOK || !bytes.Contains(w.Body.Bytes(), []byte(`"revoked":2`)) {
+		t.Fatalf("expected 2 more revoked pairs, got %d %s", w.Code, w.Body.String())
+	}
+	if !revoked(tokens[1]) || !revoked(tokens[2]) {
+		t.Error("logout-all should revoke every pair of the user")
+	}
+}
@@ -7,18 +7,212 @@ import (
 	"crypto/sha256"
 	"crypto/x509"
 	"encoding/base64"
+	"encoding/pem"
+	"errors"
 	"fmt"
+	"learning-api/config"
 	"strings"
+	"time"
 )
 
-func GetByteAuthorization(privateKeyStr, data, appId, nonceStr, timestamp, keyVersion string) (string, error) {
-	var byteAuthorization string
-	// 读取私钥
-	key, err := base64.StdEncoding.DecodeString(strings.ReplaceAll(privateKeyStr, "\n", ""))
+// TradeOrderData is the data passed to tt.requestOrder of the Douyin trade system v2
+type TradeOrderData struct {
+	SkuList          []TradeSku       `json:"skuList"`
+	OutOrderNo       string           `json:"outOrderNo"`
+	TotalAmount      int              `json:"totalAmount"`
+	PayExpireSeconds int              `json:"payExpireSeconds"`
+	OrderEntrySchema TradeEntrySchema `json:"orderEntrySchema"`
+	PayNotifyURL     string           `json:"payNotifyUrl"`
+	CpExtra          string           `json:"cpExtra,omitempty"`
+}
+
+// TradeSku is one item of TradeOrderData.SkuList
+type TradeSku struct {
+	SkuID      string   `json:"skuId"`
+	Price      int      `json:"price"`
+	Quantity   int      `json:"quantity"`
+	Title      string   `json:"title"`
+	ImageList  []string `json:"imageList"`
+	Type       int      `json:"type"`
+	TagGroupID string   `json:"tagGroupId"`
+}
+
+// TradeEntrySchema is the mini program page the Douyin order center links back to
+type TradeEntrySchema struct {
+	Path   string `json:"path"`
+	Params string `json:"params"`
+}
+
+// TradeNotification is the body the trade system v2 posts to payNotifyUrl
+type TradeNotification struct {
+	Version string `json:"version"`
+	Msg     string `json:"msg"`
+	Type    string `json:"type"`
+}
+
+// TradePaymentMsg is the payment result carried as a JSON string in TradeNotification.Msg
+type TradePaymentMsg struct {
+	AppID          string `json:"app_id"`
+	Status         string `json:"status"`
+	OrderID        string `json:"order_id"`
+	CpExtra        string `json:"cp_extra"`
+	Message        string `json:"message"`
+	EventTime      int64  `json:"event_time"`
+	OutOrderNo     string `json:"out_order_no"`
+	TotalAmount    int    `json:"total_amount"`
+	DiscountAmount int    `json:"discount_amount"`
+	PayChannel     int    `json:"pay_channel"`
+	ChannelPayID   string `json:"channel_pay_id"`
+	MerchantUID    string `json:"merchant_uid"`
+}
+
+// trade system v2 payment notification status values
+const (
+	TradeStatusSuccess = "SUCCESS"
+	TradeStatusCancel  = "CANCEL"
+)
+
+// TradeSkuTypeContent is the sku type of paid content
+const TradeSkuTypeContent = 301
+
+// TradeQueryOrderResponse is the response of the trade system v2 order query API
+type TradeQueryOrderResponse struct {
+	ErrNo  int    `json:"err_no"`
+	ErrMsg string `json:"err_msg"`
+	Data   struct {
+		OrderID     string `json:"order_id"`
+		OutOrderNo  string `json:"out_order_no"`
+		PayStatus   string `json:"pay_status"`
+		TotalAmount int    `json:"total_amount"`
+		PayTime     string `json:"pay_time"`
+	} `json:"data"`
+}
+
+// trade system v2 query pay_status values, besides TradeStatusSuccess
+const (
+	TradeStatusProcess = "PROCESS"
+	TradeStatusFail    = "FAIL"
+	TradeStatusTimeout = "TIMEOUT"
+)
+
+// TradeRefundRequest is the request of the trade system v2 refund API
+type TradeRefundRequest struct {
+	OrderID           string              `json:"order_id"`
+	OutRefundNo       string              `json:"out_refund_no"`
+	CpExtra           string              `json:"cp_extra,omitempty"`
+	OrderEntrySchema  TradeEntrySchema    `json:"order_entry_schema"`
+	RefundReason      []TradeRefundReason `json:"refund_reason"`
+	RefundTotalAmount int                 `json:"refund_total_amount"`
+	NotifyURL         string              `json:"notify_url"`
+}
+
+// TradeRefundReason is one entry of TradeRefundRequest.RefundReason
+type TradeRefundReason struct {
+	Code int    `json:"code"`
+	Text string `json:"text"`
+}
+
+// TradeRefundReasonOther is the refund reason code for a free text reason
+const TradeRefundReasonOther = 999
+
+// TradeRefundResponse is the response of the trade system v2 refund API
+type TradeRefundResponse struct {
+	ErrNo  int    `json:"err_no"`
+	ErrMsg string `json:"err_msg"`
+	Data   struct {
+		RefundID string `json:"refund_id"`
+	} `json:"data"`
+}
+
+// TradeRefundMsg is the refund result carried as a JSON string in TradeNotification.Msg
+type TradeRefundMsg struct {
+	AppID        string `json:"app_id"`
+	Status       string `json:"status"`
+	OrderID      string `json:"order_id"`
+	CpExtra      string `json:"cp_extra"`
+	Message      string `json:"message"`
+	EventTime    int64  `json:"event_time"`
+	RefundID     string `json:"refund_id"`
+	OutRefundNo  string `json:"out_refund_no"`
+	RefundAmount int    `json:"refund_total_amount"`
+}
+
+// TradeAccessToken returns the client_token sent as access-token to the trade system v2,
+// replaced by tests
+var TradeAccessToken = clientToken
+
+// clientTokenResponse is the oauth/client_token response
+type clientTokenResponse struct {
+	Data struct {
+		AccessToken string `json:"access_token"`
+		Description string `json:"description"`
+		ErrorCode   int    `json:"error_code"`
+		ExpiresIn   int    `json:"expires_in"`
+	} `json:"data"`
+	Message string `json:"message"`
+}
+
+func clientToken() (string, error) {
+	cfg := config.LoadConfig()
+	client, err := DouyinHTTP()
 	if err != nil {
 		return "", err
 	}
-	privateKey, err := x509.ParsePKCS1PrivateKey(key)
+	var resp clientTokenResponse
+	err = client.PostJSON(DouyinCall{
+		URL:        cfg.Payment.TradeBaseURL + "/oauth/client_token/",
+		Body:       map[string]string{"client_key": cfg.ClientKey, "client_secret": cfg.ClientSecret, "grant_type": "client_credential"},
+		Idempotent: true,
+	}, &resp)
+	if err != nil {
+		return "", err
+	}
+	if resp.Data.ErrorCode != 0 {
+		return "", fmt.Errorf("client_token failed: error_code %d, description %s", resp.Data.ErrorCode, resp.Data.Description)
+	}
+	return resp.Data.AccessToken, nil
+}
+
+// QueryTradeOrder asks the trade system v2 for the payment state of an order
+func QueryTradeOrder(outOrderNo string) (*TradeQueryOrderResponse, error) {
+	var resp TradeQueryOrderResponse
+	if err := postTrade("/api/trade_basic/v1/developer/order_query/", map[string]string{"out_order_no": outOrderNo}, &resp, true); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// CreateTradeRefund asks the trade system v2 to refund part or all of a paid order
+func CreateTradeRefund(refund TradeRefundRequest) (*TradeRefundResponse, error) {
+	var resp TradeRefundResponse
+	if err := postTrade("/api/trade_basic/v1/developer/refund_create/", refund, &resp, false); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// postTrade posts to a path under the configured trade_base_url with the client token and decodes the JSON response into out
+func postTrade(path string, payload interface{}, out interface{}, idempotent bool) error {
+	token, err := TradeAccessToken()
+	if err != nil {
+		return fmt.Errorf("get client token: %w", err)
+	}
+	client, err := DouyinHTTP()
+	if err != nil {
+		return err
+	}
+	return client.PostJSON(DouyinCall{
+		URL:        config.LoadConfig().Payment.TradeBaseURL + path,
+		Header:     map[string]string{"access-token": token},
+		Body:       payload,
+		Idempotent: idempotent,
+	}, out)
+}
+
+func GetByteAuthorization(privateKeyStr, data, appId, nonceStr, timestamp, keyVersion string) (string, error) {
+	var byteAuthorization string
+	// 读取私钥
+	privateKey, err := parseRSAPrivateKey(privateKeyStr)
 	if err != nil {
 		return "", err
 	}
@@ -32,6 +226,27 @@ func GetByteAuthorization(privateKeyStr, data, appId, nonceStr, timestamp, keyVe
 	return byteAuthorization, nil
 }
 
+// VerifyTradeNotification checks the Byte-Signature header of a trade system v2 notification
+// against the platform public key
+func VerifyTradeNotification(publicKeyStr, timestamp, nonce, body, signature string) error {
+	publicKey, err := parseRSAPublicKey(publicKeyStr)
+	if err != nil {
+		return err
+	}
+	signBytes, err := base64.StdEncoding.DecodeString(signature)
+	if err != nil {
+		return err
+	}
+	digest := sha256.Sum256([]byte(timestamp + "\n" + nonce + "\n" + body + "\n"))
+	return rsa.VerifyPKCS1v15(publicKey, crypto.SHA256, digest[:], signBytes)
+}
+
+// CheckTradeNotificationTimestamp reports an error unless the Byte-Timestamp of a trade system v2
+// notification, in Unix seconds, is within CallbackMaxSkew of now
+func CheckTradeNotificationTimestamp(timestamp string, now time.Time) error {
+	return checkCallbackTimestamp(timestamp, now)
+}
+
 func getSignature(method, url, timestamp, nonce, data string, privateKey *rsa.PrivateKey) (string, error) {
 	fmt.Printf("method:%s\n url:%s\n timestamp:%s\n nonce:%s\n data:%s", method, url, timestamp, nonce, data)
 	targetStr := method + "\n" + url + "\n" + timestamp + "\n" + nonce + "\n" + data + "\n"
@@ -48,6 +263,58 @@ func getSignature(method, url, timestamp, nonce, data string, privateKey *rsa.Pr
 	return sign, nil
 }
 
+// decodeKey accepts a PEM block or the bare base64 body of one, as copied from the platform console
+func decodeKey(keyStr string) ([]byte, error) {
+	keyStr = strings.TrimSpace(keyStr)
+	if keyStr == "" {
+		return nil, errors.New("key is not configured")
+	}
+	if block, _ := pem.Decode([]byte(keyStr)); block != nil {
+		return block.Bytes, nil
+	}
+	return base64.StdEncoding.DecodeString(strings.ReplaceAll(keyStr, "\n", ""))
+}
+
+// parseRSAPrivateKey reads a PKCS#1 or PKCS#8 RSA private key
+func parseRSAPrivateKey(keyStr string) (*rsa.PrivateKey, error) {
+	der, err := decodeKey(keyStr)
+	if err != nil {
+		return nil, err
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(der); err == nil {
+		return key, nil
+	}
+	key, err := x509.ParsePKCS8PrivateKey(der)
+	if err != nil {
+		return nil, err
+	}
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("private key is not an RSA key")
+	}
+	return rsaKey, nil
+}
+
+// parseRSAPublicKey reads a PKIX or PKCS#1 RSA public key
+func parseRSAPublicKey(keyStr string) (*rsa.PublicKey, error) {
+	der, err := decodeKey(keyStr)
+	if err != nil {
+		return nil, err
+	}
+	if key, err := x509.ParsePKCS1PublicKey(der); err == nil {
+		return key, nil
+	}
+	key, err := x509.ParsePKIXPublicKey(der)
+	if err != nil {
+		return nil, err
+	}
+	rsaKey, ok := key.(*rsa.PublicKey)
+	if !ok {
+		return nil, errors.New("public key is not an RSA key")
+	}
+	return rsaKey, nil
+}
+
 func RandStr(length int) string {
 	b := make([]byte, length)
 	_, err := rand.Read(b)
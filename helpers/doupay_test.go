@@ -0,0 +1,59 @@
+package helpers
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseRSAPrivateKey_Formats(t *testing.T) {
+	key, _ := rsa.GenerateKey(rand.Reader, 2048)
+	pkcs1 := x509.MarshalPKCS1PrivateKey(key)
+	pkcs8, _ := x509.MarshalPKCS8PrivateKey(key)
+
+	for name, keyStr := range map[string]string{
+		"pkcs1 pem":    string(pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: pkcs1})),
+		"pkcs8 pem":    string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: pkcs8})),
+		"pkcs1 base64": base64.StdEncoding.EncodeToString(pkcs1),
+	} {
+		parsed, err := parseRSAPrivateKey(keyStr)
+		assert.NoError(t, err, name)
+		assert.True(t, key.Equal(parsed), name)
+	}
+
+	_, err := parseRSAPrivateKey("")
+	assert.Error(t, err)
+}
+
+func TestVerifyTradeNotification(t *testing.T) {
+	key, _ := rsa.GenerateKey(rand.Reader, 2048)
+	public, _ := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	publicKey := base64.StdEncoding.EncodeToString(public)
+
+	body := `{"version":"2.0","msg":"{}","type":"payment"}`
+	digest := sha256.Sum256([]byte("1698000000\nnonce\n" + body + "\n"))
+	signBytes, _ := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	signature := base64.StdEncoding.EncodeToString(signBytes)
+
+	assert.NoError(t, VerifyTradeNotification(publicKey, "1698000000", "nonce", body, signature))
+	assert.Error(t, VerifyTradeNotification(publicKey, "1698000001", "nonce", body, signature))
+	assert.Error(t, VerifyTradeNotification(publicKey, "1698000000", "nonce", body+" ", signature))
+}
+
+func TestCheckTradeNotificationTimestamp(t *testing.T) {
+	now := time.Unix(1698000000, 0)
+
+	assert.NoError(t, CheckTradeNotificationTimestamp("1697999701", now), "4m59s ago")
+	assert.NoError(t, CheckTradeNotificationTimestamp("1698000299", now), "4m59s ahead")
+	assert.Error(t, CheckTradeNotificationTimestamp("1697999699", now), "5m1s ago")
+	assert.Error(t, CheckTradeNotificationTimestamp("1698000301", now), "5m1s ahead")
+	assert.Error(t, CheckTradeNotificationTimestamp("", now))
+}
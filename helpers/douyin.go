@@ -5,13 +5,12 @@ import (
 	"learning-api/config"
 	"learning-api/models"
 
-	credential "github.com/bytedance/douyin-openapi-credential-go/client"
 	openApiSdkClient "github.com/bytedance/douyin-openapi-sdk-go/client"
 )
 
 type ThirdPartyClient interface {
 	// You can add fields like baseURL, http.Client, etc.
-	Jscode2session(code string, anonymousCode string) (*models.Token, error)
+	Jscode2session(code string, anonymousCode string, device models.DeviceInfo) (*models.Token, error)
 }
 
 type DouyinClient struct {
@@ -26,54 +25,40 @@ func NewDouyinClient() ThirdPartyClient {
 	return &DouyinClient{}
 }
 
-func GenerateSdkClient() (sdkClient *openApiSdkClient.Client, error error) {
-	config := fetchConfig()
-	clintKey := config.ClientKey
-	clientSecret := config.ClientSecret
-	opt := new(credential.Config).
-		SetClientKey(clintKey).
-		SetClientSecret(clientSecret)
-
-	return openApiSdkClient.NewClient(opt)
-}
-
-func (d *DouyinClient) Jscode2session(code string, anonymousCode string) (*models.Token, error) {
-	fmt.Println("start to call douyin sdk jscode2session with code")
-	sdkClient, err := GenerateSdkClient()
-
+func (d *DouyinClient) Jscode2session(code string, anonymousCode string, device models.DeviceInfo) (*models.Token, error) {
+	client, err := DouyinHTTP()
 	if err != nil {
-		fmt.Println("generate sdk client error:", err)
-		// Handle the error appropriately, maybe return a custom error or nil
+		fmt.Println("douyin http client error:", err)
 		return nil, err
 	}
 	config := fetchConfig()
-	fmt.Println("app id:", config.AppID, " app secret: ", config.AppSecret)
-
-	fmt.Println("code:", code, " anonymous code: ", anonymousCode)
-	sdkRequest := constructSessionRequest(code, anonymousCode, config.AppID, config.AppSecret)
-
-	// sdk调用
-	sdkResponse, err := sdkClient.V2Jscode2session(sdkRequest)
-	if err != nil || sdkResponse == nil || sdkResponse.ErrNo == nil || *sdkResponse.ErrNo != 0 {
 
-		fmt.Println("sdk call err:", err, " response:")
+	// a login code can only be exchanged once, so the call is not retried
+	var sessionResponse openApiSdkClient.V2Jscode2sessionResponse
+	err = client.PostJSON(DouyinCall{
+		URL:  config.DouyinHTTP.LoginBaseURL + "/api/apps/v2/jscode2session",
+		Body: map[string]string{"appid": config.AppID, "secret": config.AppSecret, "code": code, "anonymous_code": anonymousCode},
+	}, &sessionResponse)
+	if err != nil {
+		fmt.Println("jscode2session call err:", err)
 		return nil, err
 	}
+	if sessionResponse.ErrNo == nil || *sessionResponse.ErrNo != 0 || sessionResponse.Data == nil {
+		var errNo int64
+		var errTips string
+		if sessionResponse.ErrNo != nil {
+			errNo = *sessionResponse.ErrNo
+		}
+		if sessionResponse.ErrTips != nil {
+			errTips = *sessionResponse.ErrTips
+		}
+		return nil, fmt.Errorf("jscode2session failed: err_no %d, err_tips %s", errNo, errTips)
+	}
 
-	token, err := models.FindOrCreateUserToken(sdkResponse.Data)
+	token, err := models.FindOrCreateUserToken(sessionResponse.Data, device)
 	if err != nil {
 		fmt.Println("Error finding or creating user token:", err)
 		return nil, err
 	}
 	return token, nil
 }
-
-func constructSessionRequest(code string, anonymousCode string, appid string, secret string) *openApiSdkClient.V2Jscode2sessionRequest {
-	sdkRequest := &openApiSdkClient.V2Jscode2sessionRequest{}
-
-	sdkRequest.SetAppid(appid)
-	sdkRequest.SetCode(code)
-	sdkRequest.SetSecret(secret)
-
-	return sdkRequest
-}
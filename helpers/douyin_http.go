@@ -0,0 +1,259 @@
+package helpers
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"learning-api/config"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+)
+
+// ErrCircuitOpen is returned without calling Douyin while a host's circuit is open
+var ErrCircuitOpen = errors.New("douyin api circuit open")
+
+// DouyinCall is one JSON POST to a Douyin API, or a GET when Method says so
+type DouyinCall struct {
+	Method string // POST when empty; a GET sends no body
+	URL    string
+	Header map[string]string
+	Body   interface{}
+	// Idempotent calls are retried on network errors, 429 and 5xx responses
+	Idempotent bool
+}
+
+// DouyinHTTPClient is the client every Douyin API call goes through. It verifies TLS against the
+// configured CA bundle, bounds each attempt with a timeout, retries idempotent calls with backoff
+// and stops calling a host for a while after repeated failures.
+type DouyinHTTPClient struct {
+	client          *http.Client
+	maxRetries      int
+	retryBackoff    time.Duration
+	breakerFailures int
+	breakerCooldown time.Duration
+
+	mu       sync.Mutex
+	breakers map[string]*circuitBreaker
+}
+
+// circuitBreaker counts consecutive failures against one host
+type circuitBreaker struct {
+	failures  int
+	openUntil time.Time
+}
+
+var (
+	douyinHTTPOnce   sync.Once
+	douyinHTTPClient *DouyinHTTPClient
+	douyinHTTPErr    error
+)
+
+// DouyinHTTP returns the shared client, built from config on first use
+func DouyinHTTP() (*DouyinHTTPClient, error) {
+	douyinHTTPOnce.Do(func() {
+		douyinHTTPClient, douyinHTTPErr = NewDouyinHTTPClient(config.LoadConfig().DouyinHTTP)
+	})
+	return douyinHTTPClient, douyinHTTPErr
+}
+
+// NewDouyinHTTPClient builds a client from cfg. Every file in ca_bundle must hold at least one
+// PEM certificate.
+func NewDouyinHTTPClient(cfg config.DouyinHTTPConfig) (*DouyinHTTPClient, error) {
+	roots, err := x509.SystemCertPool()
+	if err != nil {
+		roots = x509.NewCertPool()
+	}
+	for _, path := range cfg.CABundle {
+		pem, err := readCABundle(path)
+		if err != nil {
+			return nil, err
+		}
+		if !roots.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("ca bundle %s has no PEM certificates", path)
+		}
+	}
+
+	timeout := time.Duration(cfg.Timeout) * time.Second
+	if timeout <= 0 {
+		timeout = 10 * time.Second
+	}
+	tr := &http.Transport{
+		Proxy:               http.ProxyFromEnvironment,
+		TLSClientConfig:     &tls.Config{RootCAs: roots, MinVersion: tls.VersionTLS12},
+		TLSHandshakeTimeout: timeout,
+		MaxIdleConnsPerHost: 10,
+		IdleConnTimeout:     90 * time.Second,
+	}
+	return &DouyinHTTPClient{
+		client:          &http.Client{Transport: tr, Timeout: timeout},
+		maxRetries:      cfg.MaxRetries,
+		retryBackoff:    time.Duration(cfg.RetryBackoff) * time.Millisecond,
+		breakerFailures: cfg.BreakerFailures,
+		breakerCooldown: time.Duration(cfg.BreakerCooldown) * time.Second,
+		breakers:        map[string]*circuitBreaker{},
+	}, nil
+}
+
+// readCABundle reads path, falling back to the parent directory like config.LoadConfig does
+func readCABundle(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		data, err = os.ReadFile("../" + path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read ca bundle %s: %w", path, err)
+		}
+	}
+	return data, nil
+}
+
+// PostJSON posts call.Body as JSON and decodes the JSON response into out
+func (c *DouyinHTTPClient) PostJSON(call DouyinCall, out interface{}) error {
+	status, body, err := c.send(call)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(body, out); err != nil {
+		return fmt.Errorf("unexpected %s response (HTTP %d): %s", urlPath(call.URL), status, string(body))
+	}
+	return nil
+}
+
+// Download sends the call and returns the raw body of a 200 response, e.g. a bill file
+func (c *DouyinHTTPClient) Download(call DouyinCall) ([]byte, error) {
+	status, body, err := c.send(call)
+	if err != nil {
+		return nil, err
+	}
+	if status != http.StatusOK {
+		return nil, fmt.Errorf("unexpected %s response (HTTP %d): %s", urlPath(call.URL), status, string(body))
+	}
+	return body, nil
+}
+
+func urlPath(rawURL string) string {
+	if target, err := url.Parse(rawURL); err == nil {
+		return target.Path
+	}
+	return rawURL
+}
+
+// send makes the call through the circuit breaker, retrying idempotent calls, and returns the
+// status and body of the last attempt
+func (c *DouyinHTTPClient) send(call DouyinCall) (int, []byte, error) {
+	target, err := url.Parse(call.URL)
+	if err != nil {
+		return 0, nil, err
+	}
+	var jsonBody []byte
+	if call.Method != http.MethodGet {
+		if jsonBody, err = json.Marshal(call.Body); err != nil {
+			return 0, nil, err
+		}
+	}
+
+	attempts := 1
+	if call.Idempotent {
+		attempts += c.maxRetries
+	}
+	var status int
+	var body []byte
+	for attempt := 0; attempt < attempts; attempt++ {
+		if attempt > 0 {
+			backoff := c.retryBackoff << (attempt - 1)
+			fmt.Println("Retrying", target.Path, "in", backoff, "after:", err)
+			time.Sleep(backoff)
+		}
+		if !c.allow(target.Host) {
+			return 0, nil, fmt.Errorf("%w: %s", ErrCircuitOpen, target.Host)
+		}
+		status, body, err = c.do(call, jsonBody)
+		failed := err != nil || status >= http.StatusInternalServerError
+		c.record(target.Host, failed)
+		if err == nil && (status >= http.StatusInternalServerError || status == http.StatusTooManyRequests) {
+			err = fmt.Errorf("HTTP %d", status)
+		}
+		if err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return 0, nil, fmt.Errorf("%s failed: %w", target.Path, err)
+	}
+	return status, body, nil
+}
+
+func (c *DouyinHTTPClient) do(call DouyinCall, jsonBody []byte) (int, []byte, error) {
+	method := call.Method
+	if method == "" {
+		method = http.MethodPost
+	}
+	req, err := http.NewRequest(method, call.URL, bytes.NewReader(jsonBody))
+	if err != nil {
+		return 0, nil, err
+	}
+	if jsonBody != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	for k, v := range call.Header {
+		req.Header.Set(k, v)
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return 0, nil, err
+	}
+	return resp.StatusCode, body, nil
+}
+
+// allow reports whether host may be called. Once the cooldown is over a single trial call is let
+// through, and the circuit stays open for everyone else until it reports back.
+func (c *DouyinHTTPClient) allow(host string) bool {
+	if c.breakerFailures <= 0 {
+		return true
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	breaker := c.breakers[host]
+	if breaker == nil || breaker.failures < c.breakerFailures {
+		return true
+	}
+	now := time.Now()
+	if now.Before(breaker.openUntil) {
+		return false
+	}
+	breaker.openUntil = now.Add(c.breakerCooldown)
+	return true
+}
+
+func (c *DouyinHTTPClient) record(host string, failed bool) {
+	if c.breakerFailures <= 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	breaker := c.breakers[host]
+	if breaker == nil {
+		breaker = &circuitBreaker{}
+		c.breakers[host] = breaker
+	}
+	if !failed {
+		breaker.failures = 0
+		return
+	}
+	breaker.failures++
+	if breaker.failures == c.breakerFailures {
+		fmt.Println("Douyin API circuit open for", host, "after", breaker.failures, "failures")
+		breaker.openUntil = time.Now().Add(c.breakerCooldown)
+	}
+}
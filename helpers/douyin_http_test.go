@@ -0,0 +1,96 @@
+package helpers
+
+import (
+	"errors"
+	"learning-api/config"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewDouyinHTTPClient_CABundle(t *testing.T) {
+	_, err := NewDouyinHTTPClient(config.DouyinHTTPConfig{CABundle: []string{"douyin-chain.pem"}})
+	assert.NoError(t, err)
+
+	_, err = NewDouyinHTTPClient(config.DouyinHTTPConfig{CABundle: []string{"missing.pem"}})
+	assert.Error(t, err)
+
+	// DigiCertGlobalRootCA.crt in the repo is not a PEM certificate
+	_, err = NewDouyinHTTPClient(config.DouyinHTTPConfig{CABundle: []string{"DigiCertGlobalRootCA.crt"}})
+	assert.ErrorContains(t, err, "no PEM certificates")
+}
+
+func TestDouyinHTTPClient_VerifiesTLS(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{}`))
+	}))
+	defer server.Close()
+
+	client, err := NewDouyinHTTPClient(config.DouyinHTTPConfig{CABundle: []string{"douyin-chain.pem"}})
+	assert.NoError(t, err)
+	var out map[string]interface{}
+	err = client.PostJSON(DouyinCall{URL: server.URL + "/query_order", Body: map[string]string{}}, &out)
+	assert.ErrorContains(t, err, "certificate")
+}
+
+func TestDouyinHTTPClient_RetriesIdempotentCalls(t *testing.T) {
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/query_order" {
+			assert.Equal(t, "client_token", r.Header.Get("access-token"))
+		}
+		if atomic.AddInt32(&calls, 1) < 3 {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		w.Write([]byte(`{"err_no":0}`))
+	}))
+	defer server.Close()
+	client, _ := NewDouyinHTTPClient(config.DouyinHTTPConfig{MaxRetries: 2, RetryBackoff: 1})
+
+	var out struct {
+		ErrNo int `json:"err_no"`
+	}
+	err := client.PostJSON(DouyinCall{URL: server.URL + "/query_order", Header: map[string]string{"access-token": "client_token"}, Idempotent: true}, &out)
+	assert.NoError(t, err)
+	assert.Equal(t, int32(3), atomic.LoadInt32(&calls))
+
+	// calls that create something are sent once
+	atomic.StoreInt32(&calls, 0)
+	err = client.PostJSON(DouyinCall{URL: server.URL + "/create_order"}, &out)
+	assert.ErrorContains(t, err, "HTTP 502")
+	assert.Equal(t, int32(1), atomic.LoadInt32(&calls))
+}
+
+func TestDouyinHTTPClient_CircuitBreaker(t *testing.T) {
+	var calls int32
+	healthy := int32(0)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		if atomic.LoadInt32(&healthy) == 0 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Write([]byte(`{}`))
+	}))
+	defer server.Close()
+	client, _ := NewDouyinHTTPClient(config.DouyinHTTPConfig{BreakerFailures: 2, BreakerCooldown: 60})
+
+	var out map[string]interface{}
+	for i := 0; i < 2; i++ {
+		assert.Error(t, client.PostJSON(DouyinCall{URL: server.URL + "/query_order"}, &out))
+	}
+	atomic.StoreInt32(&healthy, 1)
+	err := client.PostJSON(DouyinCall{URL: server.URL + "/query_order"}, &out)
+	assert.True(t, errors.Is(err, ErrCircuitOpen))
+	assert.Equal(t, int32(2), atomic.LoadInt32(&calls))
+
+	// after the cooldown a trial call goes through and closes the circuit again
+	client.breakers[server.Listener.Addr().String()].openUntil = time.Time{}
+	assert.NoError(t, client.PostJSON(DouyinCall{URL: server.URL + "/query_order"}, &out))
+	assert.NoError(t, client.PostJSON(DouyinCall{URL: server.URL + "/query_order"}, &out))
+}
@@ -0,0 +1,22 @@
+package helpers
+
+import (
+	"learning-api/models"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestJscode2session_RejectedCode(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"err_no":40018,"err_tips":"bad code","data":null}`))
+	}))
+	defer server.Close()
+	t.Setenv("DOUYIN_LOGIN_BASE_URL", server.URL)
+
+	token, err := NewDouyinClient().Jscode2session("used_code", "", models.DeviceInfo{})
+	assert.Nil(t, token)
+	assert.EqualError(t, err, "jscode2session failed: err_no 40018, err_tips bad code")
+}
@@ -0,0 +1,347 @@
+package helpers
+
+import (
+	"encoding/json"
+	"fmt"
+	"learning-api/config"
+	"strconv"
+	"time"
+)
+
+// DouyinOrderRequest is the struct for Douyin API
+type DouyinOrderRequest struct {
+	AppID       string `json:"app_id"`
+	OutOrderNo  string `json:"out_order_no"`
+	TotalAmount int    `json:"total_amount"`
+	Subject     string `json:"subject"`
+	Body        string `json:"body"`
+	CpExtra     string `json:"cp_extra,omitempty"`
+	ValidTime   int    `json:"valid_time"`
+	Sign        string `json:"sign"`
+	NotifyURL   string `json:"notify_url"`
+	StoreUid    string `json:"store_uid"`
+}
+
+// DouyinOrderResponse is the create_order response from Douyin API
+type DouyinOrderResponse struct {
+	ErrNo   int    `json:"err_no"`
+	ErrTips string `json:"err_tips"`
+	Data    struct {
+		OrderID    string `json:"order_id"`
+		OrderToken string `json:"order_token"`
+	} `json:"data"`
+}
+
+// DouyinQueryOrderRequest is the query_order request for Douyin API
+type DouyinQueryOrderRequest struct {
+	AppID      string `json:"app_id"`
+	OutOrderNo string `json:"out_order_no"`
+	Sign       string `json:"sign"`
+}
+
+// DouyinQueryOrderResponse is the query_order response from Douyin API
+type DouyinQueryOrderResponse struct {
+	ErrNo       int    `json:"err_no"`
+	ErrTips     string `json:"err_tips"`
+	OutOrderNo  string `json:"out_order_no"`
+	OrderID     string `json:"order_id"`
+	PaymentInfo struct {
+		TotalFee    int    `json:"total_fee"`
+		OrderStatus string `json:"order_status"`
+		PayTime     string `json:"pay_time"`
+		Way         int    `json:"way"`
+		ChannelNo   string `json:"channel_no"`
+		SellerUid   string `json:"seller_uid"`
+		ItemID      string `json:"item_id"`
+	} `json:"payment_info"`
+}
+
+// EcpayErrOrderNotFound is the query_order err_no for an out_order_no ecpay has no order for
+const EcpayErrOrderNotFound = 2008
+
+// ecpay order_status and callback status values
+const (
+	EcpayStatusProcessing = "PROCESSING"
+	EcpayStatusSuccess    = "SUCCESS"
+	EcpayStatusFail       = "FAIL"
+	EcpayStatusTimeout    = "TIMEOUT"
+)
+
+// DouyinRefundRequest is the create_refund request for Douyin API
+type DouyinRefundRequest struct {
+	AppID        string `json:"app_id"`
+	OutOrderNo   string `json:"out_order_no"`
+	OutRefundNo  string `json:"out_refund_no"`
+	Reason       string `json:"reason"`
+	RefundAmount int    `json:"refund_amount"`
+	NotifyURL    string `json:"notify_url"`
+	Sign         string `json:"sign"`
+}
+
+// DouyinRefundResponse is the create_refund response from Douyin API
+type DouyinRefundResponse struct {
+	ErrNo    int    `json:"err_no"`
+	ErrTips  string `json:"err_tips"`
+	RefundNo string `json:"refund_no"`
+}
+
+// DouyinSettleRequest is the settle request for Douyin API
+type DouyinSettleRequest struct {
+	AppID             string `json:"app_id"`
+	OutOrderNo        string `json:"out_order_no"`
+	OutSettleNo       string `json:"out_settle_no"`
+	SettleDesc        string `json:"settle_desc"`
+	CpExtra           string `json:"cp_extra,omitempty"`
+	NotifyURL         string `json:"notify_url"`
+	OtherSettleParams string `json:"other_settle_params,omitempty"`
+	Sign              string `json:"sign"`
+}
+
+// DouyinSettleParam is one entry of the other_settle_params JSON array
+type DouyinSettleParam struct {
+	MerchantUID string `json:"merchant_uid"`
+	Amount      int    `json:"amount"`
+}
+
+// DouyinSettleResponse is the settle response from Douyin API
+type DouyinSettleResponse struct {
+	ErrNo    int    `json:"err_no"`
+	ErrTips  string `json:"err_tips"`
+	SettleNo string `json:"settle_no"`
+}
+
+// EcpayCallbackRequest is the notification ecpay posts to notify_url
+type EcpayCallbackRequest struct {
+	Timestamp    json.Number `json:"timestamp"`
+	Nonce        string      `json:"nonce"`
+	Msg          string      `json:"msg"`
+	Type         string      `json:"type"`
+	MsgSignature string      `json:"msg_signature"`
+}
+
+// ecpay callback type values
+const (
+	EcpayCallbackPayment = "payment"
+	EcpayCallbackRefund  = "refund"
+	EcpayCallbackSettle  = "settle"
+)
+
+// EcpayPaymentMsg is the payment result carried as a JSON string in EcpayCallbackRequest.Msg
+type EcpayPaymentMsg struct {
+	AppID          string `json:"appid"`
+	CpOrderNo      string `json:"cp_orderno"`
+	CpExtra        string `json:"cp_extra"`
+	Way            string `json:"way"`
+	ChannelNo      string `json:"channel_no"`
+	PaymentOrderNo string `json:"payment_order_no"`
+	TotalAmount    int    `json:"total_amount"`
+	Status         string `json:"status"`
+	ItemID         string `json:"item_id"`
+	SellerUid      string `json:"seller_uid"`
+	PaidAt         int64  `json:"paid_at"`
+	OrderID        string `json:"order_id"`
+}
+
+// EcpayRefundMsg is the refund result carried as a JSON string in EcpayCallbackRequest.Msg
+type EcpayRefundMsg struct {
+	AppID        string `json:"appid"`
+	CpRefundNo   string `json:"cp_refundno"`
+	CpExtra      string `json:"cp_extra"`
+	Status       string `json:"status"`
+	RefundAmount int    `json:"refund_amount"`
+	IsAllSettled bool   `json:"is_all_settled"`
+	RefundedAt   int64  `json:"refunded_at"`
+	Message      string `json:"message"`
+	OrderID      string `json:"order_id"`
+	RefundNo     string `json:"refund_no"`
+}
+
+// EcpaySettleMsg is the settle result carried as a JSON string in EcpayCallbackRequest.Msg
+type EcpaySettleMsg struct {
+	AppID        string `json:"appid"`
+	CpSettleNo   string `json:"cp_settle_no"`
+	CpExtra      string `json:"cp_extra"`
+	Status       string `json:"status"`
+	Rake         int    `json:"rake"`
+	Commission   int    `json:"commission"`
+	SettleDetail string `json:"settle_detail"`
+	SettledAt    int64  `json:"settled_at"`
+	Message      string `json:"message"`
+	OrderID      string `json:"order_id"`
+}
+
+// VerifyEcpayCallback checks msg_signature against the callback token configured on the platform
+func VerifyEcpayCallback(req EcpayCallbackRequest, token string) bool {
+	if token == "" || req.MsgSignature == "" {
+		return false
+	}
+	var strArr []string
+	for _, v := range []string{token, req.Timestamp.String(), req.Nonce, req.Msg} {
+		if v != "" {
+			strArr = append(strArr, v)
+		}
+	}
+	return CallbackSign(strArr) == req.MsgSignature
+}
+
+// CallbackMaxSkew is how far the timestamp of an ecpay callback or a trade system v2 notification
+// may be from now. Older or newer notifications are rejected, so a captured one cannot be replayed
+// later.
+const CallbackMaxSkew = 5 * time.Minute
+
+// CheckEcpayCallbackTimestamp reports an error unless the callback timestamp, in Unix seconds, is
+// within CallbackMaxSkew of now
+func CheckEcpayCallbackTimestamp(req EcpayCallbackRequest, now time.Time) error {
+	return checkCallbackTimestamp(req.Timestamp.String(), now)
+}
+
+func checkCallbackTimestamp(timestamp string, now time.Time) error {
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid timestamp %q", timestamp)
+	}
+	skew := now.Sub(time.Unix(seconds, 0))
+	if skew > CallbackMaxSkew || skew < -CallbackMaxSkew {
+		return fmt.Errorf("timestamp %s is %s off", timestamp, skew.Round(time.Second))
+	}
+	return nil
+}
+
+// CreateEcpayOrder signs the order and sends it to the ecpay create_order API
+func CreateEcpayOrder(order DouyinOrderRequest) (*DouyinOrderResponse, error) {
+	// Prepare sign params (as map)
+	signParams := map[string]interface{}{
+		"app_id":       order.AppID,
+		"out_order_no": order.OutOrderNo,
+		"total_amount": order.TotalAmount,
+		"subject":      order.Subject,
+		"body":         order.Body,
+		"cp_extra":     order.CpExtra,
+		"valid_time":   order.ValidTime,
+		"notify_url":   order.NotifyURL,
+	}
+	order.Sign = RequestSign(signParams)
+
+	var douyinResponse DouyinOrderResponse
+	if err := postEcpay("/create_order", order, &douyinResponse, false); err != nil {
+		return nil, err
+	}
+	return &douyinResponse, nil
+}
+
+// QueryEcpayOrder asks the ecpay query_order API for the payment state of an order
+func QueryEcpayOrder(outOrderNo string) (*DouyinQueryOrderResponse, error) {
+	cfg := config.LoadConfig()
+	query := DouyinQueryOrderRequest{
+		AppID:      cfg.AppID,
+		OutOrderNo: outOrderNo,
+	}
+	query.Sign = RequestSign(map[string]interface{}{
+		"app_id":       query.AppID,
+		"out_order_no": query.OutOrderNo,
+	})
+
+	var douyinResponse DouyinQueryOrderResponse
+	if err := postEcpay("/query_order", query, &douyinResponse, true); err != nil {
+		return nil, err
+	}
+	return &douyinResponse, nil
+}
+
+// postEcpay posts a signed request to a path under the configured ecpay base_url and decodes the JSON response into out.
+// Only queries are idempotent; create and refund calls are sent once.
+func postEcpay(path string, payload interface{}, out interface{}, idempotent bool) error {
+	client, err := DouyinHTTP()
+	if err != nil {
+		return err
+	}
+	return client.PostJSON(DouyinCall{
+		URL:        config.LoadConfig().Payment.BaseURL + path,
+		Body:       payload,
+		Idempotent: idempotent,
+	}, out)
+}
+
+// CreateEcpayRefund signs the refund and sends it to the ecpay create_refund API
+func CreateEcpayRefund(refund DouyinRefundRequest) (*DouyinRefundResponse, error) {
+	refund.Sign = RequestSign(map[string]interface{}{
+		"app_id":        refund.AppID,
+		"out_order_no":  refund.OutOrderNo,
+		"out_refund_no": refund.OutRefundNo,
+		"reason":        refund.Reason,
+		"refund_amount": refund.RefundAmount,
+		"notify_url":    refund.NotifyURL,
+	})
+
+	var douyinResponse DouyinRefundResponse
+	if err := postEcpay("/create_refund", refund, &douyinResponse, false); err != nil {
+		return nil, err
+	}
+	return &douyinResponse, nil
+}
+
+// CreateEcpaySettle signs the settle and sends it to the ecpay settle API.
+// other_settle_params is sent but, as ecpay requires, left out of the signature by RequestSign.
+func CreateEcpaySettle(settle DouyinSettleRequest) (*DouyinSettleResponse, error) {
+	settle.Sign = RequestSign(map[string]interface{}{
+		"app_id":          settle.AppID,
+		"out_order_no":    settle.OutOrderNo,
+		"out_settle_no":   settle.OutSettleNo,
+		"settle_desc":     settle.SettleDesc,
+		"cp_extra":        settle.CpExtra,
+		"notify_url":      settle.NotifyURL,
+		OtherSettleParams: settle.OtherSettleParams,
+	})
+
+	var douyinResponse DouyinSettleResponse
+	if err := postEcpay("/settle", settle, &douyinResponse, false); err != nil {
+		return nil, err
+	}
+	return &douyinResponse, nil
+}
+
+// BuildOtherSettleParams builds the other_settle_params JSON for the configured settle parties,
+// each getting its percentage of amount. It returns "" when there are no other parties.
+func BuildOtherSettleParams(parties []config.SettleParty, amount int) (string, error) {
+	var params []DouyinSettleParam
+	for _, party := range parties {
+		share := amount * party.Percent / 100
+		if share <= 0 {
+			continue
+		}
+		params = append(params, DouyinSettleParam{MerchantUID: party.MerchantUID, Amount: share})
+	}
+	if len(params) == 0 {
+		return "", nil
+	}
+	data, err := json.Marshal(params)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+// SettleEcpayOrder asks ecpay to settle a paid order, sharing amount with the configured settle
+// parties, and returns the ecpay settle_no
+func SettleEcpayOrder(outOrderNo string, outSettleNo string, amount int) (string, error) {
+	cfg := config.LoadConfig()
+	otherSettleParams, err := BuildOtherSettleParams(cfg.SettleParties, amount)
+	if err != nil {
+		return "", err
+	}
+	resp, err := CreateEcpaySettle(DouyinSettleRequest{
+		AppID:             cfg.AppID,
+		OutOrderNo:        outOrderNo,
+		OutSettleNo:       outSettleNo,
+		SettleDesc:        "results delivered",
+		NotifyURL:         cfg.Payment.CallbackURL("/pay/settle/callback"),
+		OtherSettleParams: otherSettleParams,
+	})
+	if err != nil {
+		return "", err
+	}
+	if resp.ErrNo != 0 {
+		return "", fmt.Errorf("settle rejected: %d %s", resp.ErrNo, resp.ErrTips)
+	}
+	return resp.SettleNo, nil
+}
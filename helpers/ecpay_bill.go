@@ -0,0 +1,175 @@
+package helpers
+
+import (
+	"bytes"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"learning-api/config"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// EcpayBillTypePayment is the bill_type of the bill listing the payments of a day
+const EcpayBillTypePayment = "payment"
+
+// EcpayBillLine is one order of an ecpay bill. Amount is in fen.
+type EcpayBillLine struct {
+	OutOrderNo string
+	OrderID    string
+	Amount     int
+	Status     string
+}
+
+// Paid reports whether the bill says the payment went through. Payment bills only list
+// successful payments, so a line without a status counts as paid.
+func (l EcpayBillLine) Paid() bool {
+	switch strings.ToUpper(l.Status) {
+	case "", EcpayStatusSuccess, "支付成功", "已支付", "成功":
+		return true
+	default:
+		return false
+	}
+}
+
+// billColumns lists the header names a bill column is known under
+var billColumns = map[string][]string{
+	"out_order_no": {"out_order_no", "cp_orderno", "开发者订单号", "开发者侧订单号", "商户订单号"},
+	"order_id":     {"order_id", "订单号", "抖音订单号", "平台订单号"},
+	"amount":       {"total_amount", "订单金额", "支付金额", "交易金额"},
+	"status":       {"status", "order_status", "支付状态", "订单状态", "交易状态"},
+}
+
+// DownloadEcpayBill downloads the payment bill of the given day (in Beijing time) and parses it.
+// Downloading is read only, so the call is retried.
+func DownloadEcpayBill(date time.Time) ([]EcpayBillLine, error) {
+	cfg := config.LoadConfig()
+	billDate := date.Format("20060102")
+	params := url.Values{}
+	params.Set("app_id", cfg.AppID)
+	params.Set("bill_date", billDate)
+	params.Set("bill_type", EcpayBillTypePayment)
+	params.Set("sign", RequestSign(map[string]interface{}{
+		"app_id":    cfg.AppID,
+		"bill_date": billDate,
+		"bill_type": EcpayBillTypePayment,
+	}))
+
+	client, err := DouyinHTTP()
+	if err != nil {
+		return nil, err
+	}
+	data, err := client.Download(DouyinCall{
+		Method:     "GET",
+		URL:        cfg.Payment.BillURL + "?" + params.Encode(),
+		Idempotent: true,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ParseEcpayBill(data)
+}
+
+// ParseEcpayBill reads a bill CSV. Title lines before the header and summary lines after the
+// orders are skipped; amounts are in yuan with up to two decimals.
+func ParseEcpayBill(data []byte) ([]EcpayBillLine, error) {
+	data = bytes.TrimPrefix(data, []byte("\xEF\xBB\xBF"))
+	// the bill is not a JSON error response
+	if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] == '{' {
+		return nil, fmt.Errorf("bill download failed: %s", string(trimmed))
+	}
+	r := csv.NewReader(bytes.NewReader(data))
+	r.FieldsPerRecord = -1
+	r.LazyQuotes = true
+
+	var columns map[string]int
+	var lines []EcpayBillLine
+	for {
+		record, err := r.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		for i := range record {
+			record[i] = billCell(record[i])
+		}
+		if columns == nil {
+			columns = billHeader(record)
+			continue
+		}
+
+		outOrderNo := billField(record, columns, "out_order_no")
+		if outOrderNo == "" || strings.HasPrefix(outOrderNo, "#") || strings.HasPrefix(outOrderNo, "总") {
+			continue
+		}
+		amount, err := parseYuan(billField(record, columns, "amount"))
+		if err != nil {
+			return nil, fmt.Errorf("bill line %s: %w", outOrderNo, err)
+		}
+		lines = append(lines, EcpayBillLine{
+			OutOrderNo: outOrderNo,
+			OrderID:    billField(record, columns, "order_id"),
+			Amount:     amount,
+			Status:     billField(record, columns, "status"),
+		})
+	}
+	if columns == nil {
+		return nil, errors.New("bill has no header with an out_order_no and an amount column")
+	}
+	return lines, nil
+}
+
+// billHeader maps the known columns to their index, or returns nil when record is not the header
+func billHeader(record []string) map[string]int {
+	columns := map[string]int{}
+	for i, name := range record {
+		for column, aliases := range billColumns {
+			for _, alias := range aliases {
+				if strings.EqualFold(name, alias) {
+					if _, seen := columns[column]; !seen {
+						columns[column] = i
+					}
+				}
+			}
+		}
+	}
+	_, hasOrder := columns["out_order_no"]
+	_, hasAmount := columns["amount"]
+	if !hasOrder || !hasAmount {
+		return nil
+	}
+	return columns
+}
+
+func billField(record []string, columns map[string]int, column string) string {
+	i, ok := columns[column]
+	if !ok || i >= len(record) {
+		return ""
+	}
+	return record[i]
+}
+
+// billCell strips the backtick or tab bills put in front of numbers so spreadsheets keep them as text
+func billCell(cell string) string {
+	return strings.TrimSpace(strings.TrimLeft(strings.TrimSpace(cell), "`'\t"))
+}
+
+// parseYuan converts an amount like 9.9 or 9.90 to fen
+func parseYuan(value string) (int, error) {
+	value = strings.ReplaceAll(value, ",", "")
+	yuan, fen, _ := strings.Cut(value, ".")
+	if len(fen) > 2 {
+		return 0, fmt.Errorf("invalid amount %q", value)
+	}
+	fen += strings.Repeat("0", 2-len(fen))
+	amount, err := strconv.Atoi(yuan + fen)
+	if err != nil {
+		return 0, fmt.Errorf("invalid amount %q", value)
+	}
+	return amount, nil
+}
@@ -0,0 +1,39 @@
+package helpers
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseEcpayBill(t *testing.T) {
+	data := "\xEF\xBB\xBF担保支付账单,2026-06-01\n" +
+		"开发者侧订单号,抖音订单号,订单金额,支付状态\n" +
+		"`OUT_1,`N7001,9.9,支付成功\n" +
+		"`OUT_2,`N7002,19.90,\n" +
+		"`OUT_3,`N7003,1,REFUND\n" +
+		"总计,,30.80,\n"
+
+	lines, err := ParseEcpayBill([]byte(data))
+	assert.NoError(t, err)
+	assert.Equal(t, []EcpayBillLine{
+		{OutOrderNo: "OUT_1", OrderID: "N7001", Amount: 990, Status: "支付成功"},
+		{OutOrderNo: "OUT_2", OrderID: "N7002", Amount: 1990},
+		{OutOrderNo: "OUT_3", OrderID: "N7003", Amount: 100, Status: "REFUND"},
+	}, lines)
+	assert.True(t, lines[0].Paid())
+	assert.True(t, lines[1].Paid())
+	assert.False(t, lines[2].Paid())
+
+	// An empty bill still has its header
+	lines, err = ParseEcpayBill([]byte("out_order_no,total_amount\n"))
+	assert.NoError(t, err)
+	assert.Empty(t, lines)
+
+	_, err = ParseEcpayBill([]byte(`{"err_no":2008,"err_tips":"bill not ready"}`))
+	assert.ErrorContains(t, err, "bill not ready")
+	_, err = ParseEcpayBill([]byte("out_order_no,total_amount\nOUT_1,9.999\n"))
+	assert.ErrorContains(t, err, "invalid amount")
+	_, err = ParseEcpayBill([]byte("a,b\n1,2\n"))
+	assert.Error(t, err)
+}
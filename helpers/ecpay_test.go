@@ -0,0 +1,69 @@
+package helpers
+
+import (
+	"encoding/json"
+	"learning-api/config"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBuildOtherSettleParams(t *testing.T) {
+	params, err := BuildOtherSettleParams(nil, 990)
+	assert.NoError(t, err)
+	assert.Equal(t, "", params)
+
+	parties := []config.SettleParty{
+		{MerchantUID: "merchant_a", Percent: 10},
+		{MerchantUID: "merchant_b", Percent: 0},
+	}
+	params, err = BuildOtherSettleParams(parties, 990)
+	assert.NoError(t, err)
+	assert.Equal(t, `[{"merchant_uid":"merchant_a","amount":99}]`, params)
+}
+
+func TestCreateEcpaySettle_SignSkipsOtherSettleParams(t *testing.T) {
+	var received DouyinSettleRequest
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&received)
+		w.Write([]byte(`{"err_no":0,"err_tips":"","settle_no":"settle_no_1"}`))
+	}))
+	defer server.Close()
+	t.Setenv("ECPAY_BASE_URL", server.URL)
+
+	settle := DouyinSettleRequest{
+		AppID:       "tt_app",
+		OutOrderNo:  "out_order_no_1",
+		OutSettleNo: "Sout_order_no_1",
+		SettleDesc:  "results delivered",
+		NotifyURL:   "https://example.com/pay/settle/callback",
+	}
+	withoutParties, err := CreateEcpaySettle(settle)
+	assert.NoError(t, err)
+	assert.Equal(t, "settle_no_1", withoutParties.SettleNo)
+	signWithoutParties := received.Sign
+
+	settle.OtherSettleParams = `[{"merchant_uid":"merchant_a","amount":99}]`
+	_, err = CreateEcpaySettle(settle)
+	assert.NoError(t, err)
+	assert.Equal(t, settle.OtherSettleParams, received.OtherSettleParams)
+	assert.Equal(t, signWithoutParties, received.Sign)
+}
+
+func TestCheckEcpayCallbackTimestamp(t *testing.T) {
+	now := time.Unix(1652675265, 0)
+	at := func(value string) EcpayCallbackRequest {
+		return EcpayCallbackRequest{Timestamp: json.Number(value)}
+	}
+
+	assert.NoError(t, CheckEcpayCallbackTimestamp(at("1652675265"), now))
+	assert.NoError(t, CheckEcpayCallbackTimestamp(at("1652674966"), now), "4m59s ago")
+	assert.NoError(t, CheckEcpayCallbackTimestamp(at("1652675564"), now), "4m59s ahead")
+	assert.Error(t, CheckEcpayCallbackTimestamp(at("1652674964"), now), "5m1s ago")
+	assert.Error(t, CheckEcpayCallbackTimestamp(at("1652675566"), now), "5m1s ahead")
+	assert.Error(t, CheckEcpayCallbackTimestamp(at(""), now))
+	assert.Error(t, CheckEcpayCallbackTimestamp(at("yesterday"), now))
+}
@@ -0,0 +1,87 @@
+package helpers
+
+import (
+	"fmt"
+	"learning-api/config"
+)
+
+// OrderSyncRequest is the request of the order sync (订单同步) API, which lists an ecpay order in
+// the user's Douyin order center
+type OrderSyncRequest struct {
+	AccessToken string `json:"access_token"`
+	AppName     string `json:"app_name"`
+	OpenID      string `json:"open_id"`
+	OrderDetail string `json:"order_detail"` // OrderSyncDetail as a JSON string
+	OrderStatus int    `json:"order_status"`
+	OrderType   int    `json:"order_type"`
+	UpdateTime  int64  `json:"update_time"` // milliseconds; Douyin keeps the latest update of an order
+	Extra       string `json:"extra,omitempty"`
+}
+
+// OrderSyncDetail describes the order as the order center shows it
+type OrderSyncDetail struct {
+	OrderID    string          `json:"order_id"`
+	CreateTime int64           `json:"create_time"` // milliseconds
+	Status     string          `json:"status"`      // status text shown to the user
+	Amount     int             `json:"amount"`
+	TotalPrice int             `json:"total_price"`
+	DetailURL  string          `json:"detail_url"` // mini program page the order links back to
+	ItemList   []OrderSyncItem `json:"item_list"`
+}
+
+// OrderSyncItem is one item of OrderSyncDetail.ItemList
+type OrderSyncItem struct {
+	ItemCode string `json:"item_code"`
+	Img      string `json:"img"`
+	Title    string `json:"title"`
+	SubTitle string `json:"sub_title,omitempty"`
+	Amount   int    `json:"amount"`
+	Price    int    `json:"price"`
+}
+
+// OrderSyncResponse is the response of the order sync API
+type OrderSyncResponse struct {
+	ErrCode int    `json:"err_code"`
+	ErrMsg  string `json:"err_msg"`
+	Body    string `json:"body"`
+}
+
+// order_status values of a normal (order_type 0) order
+const (
+	OrderSyncStatusUnpaid    = 0
+	OrderSyncStatusPaid      = 1
+	OrderSyncStatusCancelled = 2
+	OrderSyncStatusCompleted = 4
+	OrderSyncStatusRefunded  = 6
+)
+
+// PushOrderSync sends the state of one order to the order sync API with the app's client_token.
+// Pushing the same state twice is harmless, so the call is retried.
+func PushOrderSync(req OrderSyncRequest) error {
+	token, err := TradeAccessToken()
+	if err != nil {
+		return fmt.Errorf("get client token: %w", err)
+	}
+	req.AccessToken = token
+	if req.AppName == "" {
+		req.AppName = "douyin"
+	}
+
+	client, err := DouyinHTTP()
+	if err != nil {
+		return err
+	}
+	var resp OrderSyncResponse
+	err = client.PostJSON(DouyinCall{
+		URL:        config.LoadConfig().Payment.OrderSyncURL,
+		Body:       req,
+		Idempotent: true,
+	}, &resp)
+	if err != nil {
+		return err
+	}
+	if resp.ErrCode != 0 {
+		return fmt.Errorf("order sync rejected: %d %s", resp.ErrCode, resp.ErrMsg)
+	}
+	return nil
+}
@@ -0,0 +1,128 @@
+package jobs
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"learning-api/helpers"
+	"learning-api/models"
+	"os"
+	"time"
+)
+
+// BillReconcilerJobName is the job lock name of the daily bill reconciler
+const BillReconcilerJobName = "bill_reconciler"
+
+// BillDateLayout is how a bill day is written in reports and URLs
+const BillDateLayout = "2006-01-02"
+
+// beijing is the time zone ecpay bills are cut in. China has no daylight saving time.
+var beijing = time.FixedZone("Asia/Shanghai", 8*60*60)
+
+// BillReconciler downloads the ecpay payment bill of the previous day and matches it against
+// local orders. Douyin publishes a bill some hours after the day ends, so the reconciler checks
+// every Interval until the day has a successful report.
+type BillReconciler struct {
+	Interval     time.Duration // time between runs
+	LeaseTTL     time.Duration // how long a run holds the job lock; longer than a run takes
+	Owner        string
+	DownloadBill func(date time.Time) ([]helpers.EcpayBillLine, error)
+	Now          func() time.Time
+}
+
+// NewBillReconciler returns a reconciler with the default schedule, owned by this process
+func NewBillReconciler() *BillReconciler {
+	hostname, _ := os.Hostname()
+	return &BillReconciler{
+		Interval:     time.Hour,
+		LeaseTTL:     30 * time.Minute,
+		Owner:        fmt.Sprintf("%s-%d", hostname, os.Getpid()),
+		DownloadBill: helpers.DownloadEcpayBill,
+		Now:          time.Now,
+	}
+}
+
+// Start runs the reconciler every Interval until ctx is cancelled
+func (r *BillReconciler) Start(ctx context.Context) {
+	ticker := time.NewTicker(r.Interval)
+	defer ticker.Stop()
+	for {
+		if _, _, err := r.RunOnce(); err != nil {
+			fmt.Println("bill reconciler failed:", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// RunOnce reconciles yesterday's bill if this replica wins the job lock and the day has no
+// successful report yet. It returns false when another replica is running the job; the report
+// is nil when there was nothing to do.
+func (r *BillReconciler) RunOnce() (bool, *models.BillReconciliation, error) {
+	acquired, err := models.AcquireJobLock(BillReconcilerJobName, r.Owner, r.LeaseTTL)
+	if err != nil || !acquired {
+		return false, nil, err
+	}
+
+	report, runErr := r.reconcileYesterday()
+	summary := []byte("{}")
+	if report != nil {
+		summary, _ = json.Marshal(models.BillReconciliation{
+			BillDate:  report.BillDate,
+			BillLines: report.BillLines,
+			Matched:   report.Matched,
+			Issues:    report.Issues,
+		})
+	}
+	if err := models.FinishJobRun(BillReconcilerJobName, r.Owner, string(summary), runErr); err != nil {
+		fmt.Println("bill reconciler: record run failed:", err)
+	}
+	return true, report, runErr
+}
+
+func (r *BillReconciler) reconcileYesterday() (*models.BillReconciliation, error) {
+	yesterday := r.Now().In(beijing).AddDate(0, 0, -1)
+	existing, err := models.FindBillReconciliation(yesterday.Format(BillDateLayout))
+	if err != nil {
+		return nil, err
+	}
+	if existing != nil && existing.Error == "" {
+		return nil, nil
+	}
+	return r.Reconcile(yesterday)
+}
+
+// Reconcile downloads the bill of the given day in Beijing time and stores its report,
+// replacing an earlier one. A failed download is recorded on the day's report.
+func (r *BillReconciler) Reconcile(date time.Time) (*models.BillReconciliation, error) {
+	y, m, d := date.In(beijing).Date()
+	from := time.Date(y, m, d, 0, 0, 0, 0, beijing)
+	billDate := from.Format(BillDateLayout)
+
+	billLines, err := r.DownloadBill(from)
+	if err != nil {
+		if recordErr := models.RecordBillReconciliationFailure(billDate, err); recordErr != nil {
+			fmt.Println("bill reconciler: record failure failed:", recordErr)
+		}
+		return nil, fmt.Errorf("download bill %s: %w", billDate, err)
+	}
+
+	lines := make([]models.BillLine, 0, len(billLines))
+	for _, l := range billLines {
+		lines = append(lines, models.BillLine{
+			OutOrderNo: l.OutOrderNo,
+			Amount:     l.Amount,
+			Paid:       l.Paid(),
+			Status:     l.Status,
+		})
+	}
+	return models.ReconcileBill(billDate, from, from.AddDate(0, 0, 1), lines)
+}
+
+// ParseBillDate reads a bill day written as 2006-01-02 in Beijing time
+func ParseBillDate(value string) (time.Time, error) {
+	return time.ParseInLocation(BillDateLayout, value, beijing)
+}
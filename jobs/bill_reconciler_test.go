@@ -0,0 +1,110 @@
+package jobs
+
+import (
+	"errors"
+	"learning-api/helpers"
+	"learning-api/models"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBillReconcilerRunOnce(t *testing.T) {
+	db := models.InitTestDB()
+	models.SetDB(db)
+
+	experienceID := uint(1)
+	pay := func(outOrderNo string, price int, paidAt time.Time) models.Order {
+		order := models.Order{UserID: 1, ExperienceID: &experienceID, Price: price, Status: models.OrderStatusPending, OrderNo: outOrderNo, OutOrderNo: outOrderNo}
+		db.Create(&order)
+		assert.NoError(t, order.Transition(models.OrderStatusPaid, models.OrderSourceCallback, "", nil))
+		db.Model(&models.OrderStatusHistory{}).Where("order_id = ?", order.ID).Update("created_at", paidAt.Local())
+		return order
+	}
+	day := time.Date(2026, 6, 1, 0, 0, 0, 0, beijing)
+	pay("OUT_OK", 990, day.Add(10*time.Hour))
+	pay("OUT_AMOUNT", 1990, day.Add(11*time.Hour))
+	pay("OUT_UNBILLED", 990, day.Add(23*time.Hour+59*time.Minute))
+	pay("OUT_NEXT_DAY", 990, day.Add(24*time.Hour))
+	refunded := pay("OUT_REFUNDED", 990, day.Add(12*time.Hour))
+	assert.NoError(t, refunded.Transition(models.OrderStatusRefunded, models.OrderSourceCallback, "", nil))
+	// the payment callback never arrived
+	db.Create(&models.Order{UserID: 1, ExperienceID: &experienceID, Price: 990, Status: models.OrderStatusPending, OrderNo: "OUT_PENDING", OutOrderNo: "OUT_PENDING"})
+
+	var downloaded []time.Time
+	var downloadErr error
+	reconciler := &BillReconciler{
+		Interval: time.Hour,
+		LeaseTTL: 30 * time.Minute,
+		Owner:    "test-replica",
+		Now:      func() time.Time { return day.Add(30 * time.Hour) },
+		DownloadBill: func(date time.Time) ([]helpers.EcpayBillLine, error) {
+			downloaded = append(downloaded, date)
+			if downloadErr != nil {
+				return nil, downloadErr
+			}
+			return []helpers.EcpayBillLine{
+				{OutOrderNo: "OUT_OK", Amount: 990},
+				{OutOrderNo: "OUT_AMOUNT", Amount: 990},
+				{OutOrderNo: "OUT_REFUNDED", Amount: 990, Status: "SUCCESS"},
+				{OutOrderNo: "OUT_PENDING", Amount: 990, Status: "SUCCESS"},
+				{OutOrderNo: "OUT_GHOST", Amount: 500},
+			}, nil
+		},
+	}
+
+	// A bill that is not published yet is recorded and retried on the next run
+	downloadErr = errors.New("bill not ready")
+	ran, _, err := reconciler.RunOnce()
+	assert.True(t, ran)
+	assert.ErrorContains(t, err, "bill not ready")
+	failed, _ := models.FindBillReconciliation("2026-06-01")
+	assert.Equal(t, "bill not ready", failed.Error)
+
+	downloadErr = nil
+	_, report, err := reconciler.RunOnce()
+	assert.NoError(t, err)
+	assert.Equal(t, "2026-06-01", report.BillDate)
+	assert.True(t, downloaded[len(downloaded)-1].Equal(day))
+	assert.Equal(t, 5, report.BillLines)
+	assert.Equal(t, 4, report.LocalOrders)
+	assert.Equal(t, 2, report.Matched) // a refunded order was still paid that day
+	kinds := map[string]models.BillIssueKind{}
+	for _, item := range report.Items {
+		kinds[item.OutOrderNo] = item.Kind
+	}
+	assert.Equal(t, map[string]models.BillIssueKind{
+		"OUT_AMOUNT":   models.BillIssueAmountMismatch,
+		"OUT_PENDING":  models.BillIssueStatusMismatch,
+		"OUT_GHOST":    models.BillIssueMissingLocal,
+		"OUT_UNBILLED": models.BillIssueMissingRemote,
+	}, kinds)
+	assert.Equal(t, 4, report.Issues)
+
+	stored, _ := models.FindBillReconciliation("2026-06-01")
+	assert.Empty(t, stored.Error)
+	assert.Len(t, stored.Items, 4)
+
+	// A reconciled day is not downloaded again, and a later failure keeps its report
+	calls := len(downloaded)
+	_, report, err = reconciler.RunOnce()
+	assert.NoError(t, err)
+	assert.Nil(t, report)
+	assert.Len(t, downloaded, calls)
+
+	downloadErr = errors.New("timeout")
+	_, err = reconciler.Reconcile(day)
+	assert.Error(t, err)
+	stored, _ = models.FindBillReconciliation("2026-06-01")
+	assert.Empty(t, stored.Error)
+	assert.Len(t, stored.Items, 4)
+
+	// Re-running a day replaces its report
+	downloadErr = nil
+	_, err = reconciler.Reconcile(day)
+	assert.NoError(t, err)
+	var count int64
+	db.Model(&models.BillReconciliationItem{}).Count(&count)
+	assert.Equal(t, int64(4), count)
+}
@@ -0,0 +1,206 @@
+package jobs
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"learning-api/config"
+	"learning-api/helpers"
+	"learning-api/models"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+)
+
+// OrderSyncJobName is the job lock name of the Douyin order syncer
+const OrderSyncJobName = "order_sync"
+
+// OrderSyncResult counts what one syncer run did
+type OrderSyncResult struct {
+	Checked  int `json:"checked"`
+	Synced   int `json:"synced"`
+	Retrying int `json:"retrying"`
+	GaveUp   int `json:"gave_up"`
+}
+
+// OrderSyncer pushes queued order status changes to the Douyin order center. A failed push is
+// retried with a doubling backoff until MaxAttempts, then left failed for an admin to requeue.
+type OrderSyncer struct {
+	Interval     time.Duration // time between runs
+	LeaseTTL     time.Duration // how long a run holds the job lock; longer than a run takes
+	RetryBackoff time.Duration // wait before the first retry
+	MaxBackoff   time.Duration
+	MaxAttempts  int
+	BatchSize    int
+	Owner        string
+	Push         func(req helpers.OrderSyncRequest) error
+}
+
+// NewOrderSyncer returns a syncer with the default schedule, owned by this process
+func NewOrderSyncer() *OrderSyncer {
+	hostname, _ := os.Hostname()
+	return &OrderSyncer{
+		Interval:     30 * time.Second,
+		LeaseTTL:     30 * time.Minute,
+		RetryBackoff: time.Minute,
+		MaxBackoff:   6 * time.Hour,
+		MaxAttempts:  10,
+		BatchSize:    100,
+		Owner:        fmt.Sprintf("%s-%d", hostname, os.Getpid()),
+		Push:         helpers.PushOrderSync,
+	}
+}
+
+// Start runs the syncer every Interval until ctx is cancelled
+func (s *OrderSyncer) Start(ctx context.Context) {
+	ticker := time.NewTicker(s.Interval)
+	defer ticker.Stop()
+	for {
+		if _, _, err := s.RunOnce(); err != nil {
+			fmt.Println("order syncer failed:", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// RunOnce pushes one batch of due tasks if this replica wins the job lock.
+// It returns false when another replica is running the job.
+func (s *OrderSyncer) RunOnce() (bool, *OrderSyncResult, error) {
+	acquired, err := models.AcquireJobLock(OrderSyncJobName, s.Owner, s.LeaseTTL)
+	if err != nil || !acquired {
+		return false, nil, err
+	}
+
+	result, runErr := s.sync()
+	summary, _ := json.Marshal(result)
+	if err := models.FinishJobRun(OrderSyncJobName, s.Owner, string(summary), runErr); err != nil {
+		fmt.Println("order syncer: record run failed:", err)
+	}
+	return true, result, runErr
+}
+
+func (s *OrderSyncer) sync() (*OrderSyncResult, error) {
+	result := &OrderSyncResult{}
+	tasks, err := models.FindDueOrderSyncTasks(time.Now(), s.BatchSize)
+	if err != nil {
+		return result, err
+	}
+
+	for i := range tasks {
+		task := &tasks[i]
+		result.Checked++
+		pushErr := s.push(task)
+		if pushErr == nil {
+			synced, err := task.MarkSynced()
+			if err != nil {
+				return result, err
+			}
+			if synced {
+				result.Synced++
+			}
+			continue
+		}
+
+		fmt.Println("order syncer: order", task.OutOrderNo, "error:", pushErr)
+		giveUp := task.Attempts+1 >= s.MaxAttempts
+		if err := task.MarkAttemptFailed(pushErr, time.Now().Add(s.backoff(task.Attempts)), giveUp); err != nil {
+			return result, err
+		}
+		if giveUp {
+			result.GaveUp++
+		} else {
+			result.Retrying++
+		}
+	}
+	return result, nil
+}
+
+// backoff is the wait after the given number of earlier failed attempts
+func (s *OrderSyncer) backoff(attempts int) time.Duration {
+	wait := s.RetryBackoff
+	for i := 0; i < attempts && wait < s.MaxBackoff; i++ {
+		wait *= 2
+	}
+	if wait > s.MaxBackoff {
+		wait = s.MaxBackoff
+	}
+	return wait
+}
+
+func (s *OrderSyncer) push(task *models.OrderSyncTask) error {
+	order, err := models.FindOrderForSync(task.OrderID)
+	if err != nil {
+		return err
+	}
+	if order == nil {
+		return errors.New("order not found")
+	}
+	product, err := order.Product()
+	if err != nil {
+		return err
+	}
+	code, text := orderSyncStatus(order.Status)
+	detail, err := json.Marshal(helpers.OrderSyncDetail{
+		OrderID:    order.OutOrderNo,
+		CreateTime: order.CreatedAt.UnixMilli(),
+		Status:     text,
+		Amount:     1,
+		TotalPrice: order.Price,
+		DetailURL:  orderDetailURL(order),
+		ItemList: []helpers.OrderSyncItem{{
+			ItemCode: product.Code,
+			Img:      product.ImageURL,
+			Title:    product.Title,
+			Amount:   1,
+			Price:    order.Price,
+		}},
+	})
+	if err != nil {
+		return err
+	}
+	return s.Push(helpers.OrderSyncRequest{
+		OpenID:      order.User.OpenID,
+		OrderDetail: string(detail),
+		OrderStatus: code,
+		UpdateTime:  order.UpdatedAt.UnixMilli(),
+	})
+}
+
+// orderSyncStatus maps an order status to the order center's status code and the text shown with it
+func orderSyncStatus(status models.OrderStatus) (int, string) {
+	switch status {
+	case models.OrderStatusPaid:
+		return helpers.OrderSyncStatusPaid, "已支付"
+	case models.OrderStatusPartiallyRefunded:
+		return helpers.OrderSyncStatusPaid, "部分退款"
+	case models.OrderStatusConfirmed:
+		return helpers.OrderSyncStatusCompleted, "已完成"
+	case models.OrderStatusRefunded:
+		return helpers.OrderSyncStatusRefunded, "已退款"
+	case models.OrderStatusCancelled, models.OrderStatusExpired, models.OrderStatusFailed:
+		return helpers.OrderSyncStatusCancelled, "已取消"
+	default:
+		return helpers.OrderSyncStatusUnpaid, "待支付"
+	}
+}
+
+// orderDetailURL is the mini program page the order links back to, with the same params the
+// payment gateways get
+func orderDetailURL(order *models.Order) string {
+	params := url.Values{}
+	switch {
+	case order.ExperienceID != nil:
+		params.Set("id", strconv.FormatUint(uint64(*order.ExperienceID), 10))
+	case order.BundleID != nil:
+		params.Set("bundle", strconv.FormatUint(uint64(*order.BundleID), 10))
+	default:
+		params.Set("plan", order.PlanCode)
+	}
+	return config.LoadConfig().TradeEntryPath + "?" + params.Encode()
+}
@@ -0,0 +1,142 @@
+package jobs
+
+import (
+	"encoding/json"
+	"errors"
+	"learning-api/helpers"
+	"learning-api/models"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOrderSyncerRunOnce(t *testing.T) {
+	db := models.InitTestDB()
+	db.AutoMigrate(&models.Experience{}, &models.Topic{})
+	models.SetDB(db)
+
+	user := models.User{OpenID: "open_sync"}
+	db.Create(&user)
+	topic := models.Topic{Name: "性格测评", CoverURL: "https://example.com/cover.png"}
+	db.Create(&topic)
+	experience := models.Experience{TopicID: topic.ID, UserID: user.ID}
+	db.Create(&experience)
+
+	var pushed []helpers.OrderSyncRequest
+	var pushErr error
+	syncer := &OrderSyncer{
+		Interval:     time.Minute,
+		LeaseTTL:     30 * time.Minute,
+		RetryBackoff: time.Minute,
+		MaxBackoff:   time.Hour,
+		MaxAttempts:  2,
+		BatchSize:    10,
+		Owner:        "test-replica",
+		Push: func(req helpers.OrderSyncRequest) error {
+			pushed = append(pushed, req)
+			return pushErr
+		},
+	}
+
+	order := models.Order{UserID: user.ID, ExperienceID: &experience.ID, Price: 990, Status: models.OrderStatusPending, OrderNo: "OUT_SYNC", OutOrderNo: "OUT_SYNC"}
+	db.Create(&order)
+	free := models.Order{UserID: user.ID, ExperienceID: &experience.ID, Gateway: models.OrderGatewayCoupon, Status: models.OrderStatusCreated, OrderNo: "OUT_FREE", OutOrderNo: "OUT_FREE"}
+	db.Create(&free)
+	assert.NoError(t, free.Transition(models.OrderStatusPaid, models.OrderSourceUser, "", nil))
+	assert.NoError(t, order.Transition(models.OrderStatusPaid, models.OrderSourceCallback, "", nil))
+
+	// Only the ecpay order is queued, and its push describes the paid topic
+	ran, result, err := syncer.RunOnce()
+	assert.True(t, ran)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, result.Synced)
+	assert.Len(t, pushed, 1)
+	assert.Equal(t, "open_sync", pushed[0].OpenID)
+	assert.Equal(t, helpers.OrderSyncStatusPaid, pushed[0].OrderStatus)
+	var detail helpers.OrderSyncDetail
+	assert.NoError(t, json.Unmarshal([]byte(pushed[0].OrderDetail), &detail))
+	assert.Equal(t, "OUT_SYNC", detail.OrderID)
+	assert.Equal(t, 990, detail.TotalPrice)
+	assert.Equal(t, "性格测评", detail.ItemList[0].Title)
+	assert.Equal(t, "https://example.com/cover.png", detail.ItemList[0].Img)
+	assert.Contains(t, detail.DetailURL, "?id=")
+
+	// Nothing is due until the status changes again
+	_, result, _ = syncer.RunOnce()
+	assert.Equal(t, 0, result.Checked)
+
+	// A failed push is retried after the backoff, then given up
+	pushErr = errors.New("connection refused")
+	assert.NoError(t, order.Transition(models.OrderStatusRefunded, models.OrderSourceCallback, "", nil))
+	_, result, _ = syncer.RunOnce()
+	assert.Equal(t, 1, result.Retrying)
+	var task models.OrderSyncTask
+	db.Where("order_id = ?", order.ID).First(&task)
+	assert.Equal(t, models.OrderSyncPending, task.State)
+	assert.Equal(t, 1, task.Attempts)
+	assert.Equal(t, "connection refused", task.LastError)
+	assert.WithinDuration(t, time.Now().Add(time.Minute), task.NextAttemptAt, 5*time.Second)
+
+	db.Model(&task).Update("next_attempt_at", time.Now())
+	_, result, _ = syncer.RunOnce()
+	assert.Equal(t, 1, result.GaveUp)
+	db.First(&task, task.ID)
+	assert.Equal(t, models.OrderSyncFailed, task.State)
+
+	// A requeued task is pushed again with the order as it is now
+	pushErr = nil
+	_, err = models.RequeueOrderSyncTask(task.ID)
+	assert.NoError(t, err)
+	_, result, _ = syncer.RunOnce()
+	assert.Equal(t, 1, result.Synced)
+	assert.Equal(t, helpers.OrderSyncStatusRefunded, pushed[len(pushed)-1].OrderStatus)
+	db.First(&task, task.ID)
+	assert.Equal(t, models.OrderSyncSucceeded, task.State)
+
+	// A push that raced a newer status change leaves the task pending for it
+	stale := task
+	_, err = models.RequeueOrderSyncTask(task.ID)
+	assert.NoError(t, err)
+	synced, err := stale.MarkSynced()
+	assert.NoError(t, err)
+	assert.False(t, synced)
+}
+
+func TestOrderSyncerBackoff(t *testing.T) {
+	syncer := &OrderSyncer{RetryBackoff: time.Minute, MaxBackoff: 10 * time.Minute}
+	assert.Equal(t, time.Minute, syncer.backoff(0))
+	assert.Equal(t, 4*time.Minute, syncer.backoff(2))
+	assert.Equal(t, 10*time.Minute, syncer.backoff(8))
+}
+
+func TestOrderSyncerLeaseOutlastsInterval(t *testing.T) {
+	db := models.InitTestDB()
+	db.AutoMigrate(&models.Experience{}, &models.Topic{})
+	models.SetDB(db)
+
+	user := models.User{OpenID: "open_lease"}
+	db.Create(&user)
+	experienceID := uint(1)
+	order := models.Order{UserID: user.ID, ExperienceID: &experienceID, Price: 990, Status: models.OrderStatusPending, OrderNo: "OUT_LEASE", OutOrderNo: "OUT_LEASE"}
+	db.Create(&order)
+	assert.NoError(t, order.Transition(models.OrderStatusPaid, models.OrderSourceCallback, "", nil))
+
+	syncer := &OrderSyncer{Interval: 30 * time.Second, LeaseTTL: 30 * time.Minute, MaxAttempts: 2, BatchSize: 10, Owner: "test-replica"}
+	var lockedUntil time.Time
+	syncer.Push = func(req helpers.OrderSyncRequest) error {
+		lock, _ := models.FindJobLock(OrderSyncJobName)
+		lockedUntil = lock.LockedUntil
+		return nil
+	}
+
+	started := time.Now()
+	ran, result, err := syncer.RunOnce()
+
+	assert.True(t, ran)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, result.Synced)
+	// A batch that takes longer than Interval keeps the lease, so no other replica pushes the same tasks
+	assert.True(t, lockedUntil.After(started.Add(syncer.Interval)))
+	assert.False(t, lockedUntil.After(time.Now().Add(syncer.LeaseTTL)))
+}
@@ -0,0 +1,232 @@
+package jobs
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"learning-api/config"
+	"learning-api/helpers"
+	"learning-api/models"
+	"learning-api/payment"
+	"os"
+	"time"
+)
+
+// ReconcilerJobName is the job lock name of the order reconciler
+const ReconcilerJobName = "order_reconciler"
+
+// ReconcileResult counts what one reconciler run did
+type ReconcileResult struct {
+	Checked   int `json:"checked"`
+	Paid      int `json:"paid"`
+	Expired   int `json:"expired"`
+	Failed    int `json:"failed"`
+	Cancelled int `json:"cancelled"`
+	Unchanged int `json:"unchanged"`
+	Confirmed int `json:"confirmed"`
+	Settled   int `json:"settled"`
+	Errors    int `json:"errors"`
+}
+
+// Reconciler asks each order's payment gateway about orders still created or pending,
+// catching up on lost payment callbacks and expiring orders nobody paid. It also confirms paid
+// bundle and membership orders and starts the settle of confirmed orders, retrying settles that
+// failed or never reached the gateway.
+type Reconciler struct {
+	Interval         time.Duration // time between runs
+	LeaseTTL         time.Duration // how long a run holds the job lock; longer than a run takes
+	GracePeriod      time.Duration // orders younger than this are left to the callback
+	ExpireAfter      time.Duration // orders unknown to their gateway are expired once this old
+	SettleRetryAfter time.Duration // time before a failed or lost settle is attempted again
+	BatchSize        int
+	Owner            string
+	Gateway          func(name string) (payment.PaymentGateway, error)
+	SettleOrder      func(outOrderNo string, outSettleNo string, amount int) (string, error)
+}
+
+// NewReconciler returns a reconciler with the default schedule, owned by this process
+func NewReconciler() *Reconciler {
+	hostname, _ := os.Hostname()
+	// Orders can be paid for the ecpay valid_time or the trade system v2 pay window, whichever is longer
+	payWindow := config.LoadConfig().Payment.ValidTime
+	if payWindow < payment.TradeOrderExpireSeconds {
+		payWindow = payment.TradeOrderExpireSeconds
+	}
+	return &Reconciler{
+		Interval:         time.Minute,
+		LeaseTTL:         10 * time.Minute,
+		GracePeriod:      time.Minute,
+		ExpireAfter:      time.Duration(payWindow)*time.Second + 5*time.Minute,
+		SettleRetryAfter: time.Hour,
+		BatchSize:        100,
+		Owner:            fmt.Sprintf("%s-%d", hostname, os.Getpid()),
+		Gateway:          payment.New,
+		SettleOrder:      helpers.SettleEcpayOrder,
+	}
+}
+
+// Start runs the reconciler every Interval until ctx is cancelled
+func (r *Reconciler) Start(ctx context.Context) {
+	ticker := time.NewTicker(r.Interval)
+	defer ticker.Stop()
+	for {
+		if _, _, err := r.RunOnce(); err != nil {
+			fmt.Println("order reconciler failed:", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// RunOnce reconciles one batch of open orders if this replica wins the job lock.
+// It returns false when another replica is running the job.
+func (r *Reconciler) RunOnce() (bool, *ReconcileResult, error) {
+	acquired, err := models.AcquireJobLock(ReconcilerJobName, r.Owner, r.LeaseTTL)
+	if err != nil || !acquired {
+		return false, nil, err
+	}
+
+	result, runErr := r.reconcile()
+	summary, _ := json.Marshal(result)
+	if err := models.FinishJobRun(ReconcilerJobName, r.Owner, string(summary), runErr); err != nil {
+		fmt.Println("order reconciler: record run failed:", err)
+	}
+	return true, result, runErr
+}
+
+func (r *Reconciler) reconcile() (*ReconcileResult, error) {
+	result := &ReconcileResult{}
+	orders, err := models.FindOpenOrders(time.Now().Add(-r.GracePeriod), r.BatchSize)
+	if err != nil {
+		return result, err
+	}
+
+	checked := make([]uint, 0, len(orders))
+	for i := range orders {
+		order := &orders[i]
+		result.Checked++
+		if err := r.reconcileOrder(order, result); err != nil {
+			result.Errors++
+			fmt.Println("order reconciler: order", order.OutOrderNo, "error:", err)
+		}
+		checked = append(checked, order.ID)
+	}
+	if err := models.MarkOrdersChecked(checked, time.Now()); err != nil {
+		return result, err
+	}
+
+	prepaid, err := models.FindUnconfirmedPrepaidOrders(r.BatchSize)
+	if err != nil {
+		return result, err
+	}
+	for i := range prepaid {
+		order := &prepaid[i]
+		result.Checked++
+		confirmed, err := order.ConfirmDelivery(models.OrderSourceReconciler)
+		if err != nil {
+			result.Errors++
+			fmt.Println("order reconciler: confirm order", order.OutOrderNo, "error:", err)
+		} else if confirmed {
+			result.Confirmed++
+		} else {
+			result.Unchanged++
+		}
+	}
+
+	retryBefore := time.Now().Add(-r.SettleRetryAfter)
+	unsettled, err := models.FindUnsettledOrders(retryBefore, r.BatchSize)
+	if err != nil {
+		return result, err
+	}
+	for i := range unsettled {
+		order := &unsettled[i]
+		result.Checked++
+		started, err := order.Settle(retryBefore, func(o *models.Order) (string, error) {
+			return r.SettleOrder(o.OutOrderNo, o.OutSettleNo, o.Price-o.RefundedAmount)
+		})
+		if err != nil {
+			result.Errors++
+			fmt.Println("order reconciler: settle order", order.OutOrderNo, "error:", err)
+		} else if started {
+			result.Settled++
+		} else {
+			result.Unchanged++
+		}
+	}
+
+	if result.Errors > 0 {
+		return result, fmt.Errorf("%d of %d orders failed to reconcile", result.Errors, result.Checked)
+	}
+	return result, nil
+}
+
+func (r *Reconciler) reconcileOrder(order *models.Order, result *ReconcileResult) error {
+	gateway, err := r.Gateway(order.Gateway)
+	if err != nil {
+		return err
+	}
+	queried, err := gateway.QueryOrder(order.OutOrderNo)
+	if err != nil {
+		return err
+	}
+
+	if !queried.Found {
+		// The gateway has no record, e.g. the order was never sent to it
+		if time.Since(order.CreatedAt) < r.ExpireAfter {
+			result.Unchanged++
+			return nil
+		}
+		return r.moveOrder(order, models.OrderStatusExpired, queried.Message, result)
+	}
+
+	switch queried.Status {
+	case payment.StatusSuccess:
+		if queried.Amount != order.Price {
+			return fmt.Errorf("paid amount %d does not match price %d", queried.Amount, order.Price)
+		}
+		marked, err := order.MarkPaid(queried.OrderID, models.OrderSourceReconciler)
+		if err != nil {
+			return err
+		}
+		if marked {
+			result.Paid++
+		} else {
+			result.Unchanged++
+		}
+		return nil
+	case payment.StatusExpired:
+		return r.moveOrder(order, models.OrderStatusExpired, queried.Message, result)
+	case payment.StatusFailed:
+		return r.moveOrder(order, models.OrderStatusFailed, queried.Message, result)
+	case payment.StatusCancelled:
+		return r.moveOrder(order, models.OrderStatusCancelled, queried.Message, result)
+	default:
+		result.Unchanged++
+		return nil
+	}
+}
+
+func (r *Reconciler) moveOrder(order *models.Order, next models.OrderStatus, note string, result *ReconcileResult) error {
+	err := order.Transition(next, models.OrderSourceReconciler, note, nil)
+	if errors.Is(err, models.ErrOrderStatusChanged) {
+		// A callback got there first
+		result.Unchanged++
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	switch next {
+	case models.OrderStatusFailed:
+		result.Failed++
+	case models.OrderStatusCancelled:
+		result.Cancelled++
+	default:
+		result.Expired++
+	}
+	return nil
+}
@@ -0,0 +1,263 @@
+package jobs
+
+import (
+	"errors"
+	"learning-api/models"
+	"learning-api/payment"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"gorm.io/gorm"
+)
+
+func setupReconcilerTest(t *testing.T) (*gorm.DB, *Reconciler, *payment.Fake) {
+	db := models.InitTestDB()
+	models.SetDB(db)
+
+	ecpay := payment.NewFake(payment.GatewayEcpay)
+	ecpay.FailOrder("GATEWAY_DOWN", errors.New("connection refused"))
+	tradeV2 := payment.NewFake(payment.GatewayTradeV2)
+	reconciler := &Reconciler{
+		Interval:    time.Minute,
+		LeaseTTL:    10 * time.Minute,
+		GracePeriod: time.Minute,
+		ExpireAfter: 10 * time.Minute,
+		BatchSize:   10,
+		Owner:       "test-replica",
+		Gateway: func(name string) (payment.PaymentGateway, error) {
+			if name == payment.GatewayTradeV2 {
+				return tradeV2, nil
+			}
+			return ecpay, nil
+		},
+		SettleOrder: func(outOrderNo, outSettleNo string, amount int) (string, error) {
+			if outOrderNo == "GATEWAY_DOWN" {
+				return "", errors.New("connection refused")
+			}
+			return "SETTLE_" + outOrderNo, nil
+		},
+	}
+	return db, reconciler, ecpay
+}
+
+// createOpenOrder creates a pending order that was created age ago
+func createOpenOrder(db *gorm.DB, outOrderNo string, age time.Duration) models.Order {
+	experienceID := uint(1)
+	order := models.Order{
+		UserID:       1,
+		ExperienceID: &experienceID,
+		Price:        990,
+		Status:       models.OrderStatusPending,
+		OrderNo:      outOrderNo,
+		OutOrderNo:   outOrderNo,
+	}
+	db.Create(&order)
+	db.Model(&order).UpdateColumn("created_at", time.Now().Add(-age))
+	return order
+}
+
+func gatewayOrder(orderID string, status payment.Status, amount int) payment.QueryResult {
+	return payment.QueryResult{Found: true, Status: status, OrderID: orderID, Amount: amount}
+}
+
+func orderStatus(db *gorm.DB, id uint) models.OrderStatus {
+	var order models.Order
+	db.First(&order, id)
+	return order.Status
+}
+
+func TestReconcilerRunOnce(t *testing.T) {
+	db, reconciler, gateway := setupReconcilerTest(t)
+
+	paid := createOpenOrder(db, "OUT_PAID", 5*time.Minute)
+	gateway.SetOrder("OUT_PAID", gatewayOrder("DY_PAID", payment.StatusSuccess, 990))
+	timedOut := createOpenOrder(db, "OUT_TIMEOUT", 5*time.Minute)
+	gateway.SetOrder("OUT_TIMEOUT", gatewayOrder("DY_TIMEOUT", payment.StatusExpired, 990))
+	failed := createOpenOrder(db, "OUT_FAIL", 5*time.Minute)
+	gateway.SetOrder("OUT_FAIL", gatewayOrder("DY_FAIL", payment.StatusFailed, 990))
+	processing := createOpenOrder(db, "OUT_PROCESSING", 5*time.Minute)
+	gateway.SetOrder("OUT_PROCESSING", gatewayOrder("DY_PROCESSING", payment.StatusProcessing, 990))
+	wrongAmount := createOpenOrder(db, "OUT_WRONG_AMOUNT", 5*time.Minute)
+	gateway.SetOrder("OUT_WRONG_AMOUNT", gatewayOrder("DY_WRONG_AMOUNT", payment.StatusSuccess, 1))
+	abandoned := createOpenOrder(db, "OUT_ABANDONED", time.Hour)
+	unknownRecent := createOpenOrder(db, "OUT_UNKNOWN_RECENT", 5*time.Minute)
+	fresh := createOpenOrder(db, "OUT_FRESH", 0)
+	gateway.SetOrder("OUT_FRESH", gatewayOrder("DY_FRESH", payment.StatusSuccess, 990))
+
+	ran, result, err := reconciler.RunOnce()
+
+	assert.True(t, ran)
+	assert.Error(t, err, "the amount mismatch should be reported")
+	assert.Equal(t, ReconcileResult{Checked: 7, Paid: 1, Expired: 2, Failed: 1, Unchanged: 2, Errors: 1}, *result)
+
+	assert.Equal(t, models.OrderStatusPaid, orderStatus(db, paid.ID))
+	assert.Equal(t, models.OrderStatusExpired, orderStatus(db, timedOut.ID))
+	assert.Equal(t, models.OrderStatusFailed, orderStatus(db, failed.ID))
+	assert.Equal(t, models.OrderStatusPending, orderStatus(db, processing.ID))
+	assert.Equal(t, models.OrderStatusPending, orderStatus(db, wrongAmount.ID))
+	assert.Equal(t, models.OrderStatusExpired, orderStatus(db, abandoned.ID))
+	assert.Equal(t, models.OrderStatusPending, orderStatus(db, unknownRecent.ID))
+	assert.Equal(t, models.OrderStatusPending, orderStatus(db, fresh.ID), "orders inside the grace period are left to the callback")
+
+	var dbPaid models.Order
+	db.First(&dbPaid, paid.ID)
+	assert.Equal(t, "DY_PAID", dbPaid.OrderNo)
+	histories, _ := models.FindOrderStatusHistories(paid.ID)
+	assert.Equal(t, models.OrderSourceReconciler, histories[len(histories)-1].Source)
+
+	// Last run status is recorded for the admin endpoint
+	lock, _ := models.FindJobLock(ReconcilerJobName)
+	assert.NotNil(t, lock.LastFinishedAt)
+	assert.Contains(t, lock.LastResult, `"paid":1`)
+	assert.Contains(t, lock.LastError, "1 of 7")
+}
+
+func TestReconcilerGatewayError(t *testing.T) {
+	db, reconciler, _ := setupReconcilerTest(t)
+	order := createOpenOrder(db, "GATEWAY_DOWN", time.Hour)
+
+	ran, result, err := reconciler.RunOnce()
+
+	assert.True(t, ran)
+	assert.Error(t, err)
+	assert.Equal(t, 1, result.Errors)
+	assert.Equal(t, models.OrderStatusPending, orderStatus(db, order.ID), "an unreachable gateway must not expire orders")
+}
+
+func TestReconcilerChecksLeastRecentlyCheckedOrdersFirst(t *testing.T) {
+	db, reconciler, gateway := setupReconcilerTest(t)
+	reconciler.BatchSize = 2
+	// The two oldest orders keep failing
+	createOpenOrder(db, "GATEWAY_DOWN", 3*time.Hour)
+	wrongAmount := createOpenOrder(db, "OUT_WRONG_AMOUNT", 2*time.Hour)
+	gateway.SetOrder("OUT_WRONG_AMOUNT", gatewayOrder("DY_WRONG_AMOUNT", payment.StatusSuccess, 1))
+	newer := createOpenOrder(db, "OUT_PAID", time.Hour)
+	gateway.SetOrder("OUT_PAID", gatewayOrder("DY_PAID", payment.StatusSuccess, 990))
+
+	_, result, _ := reconciler.RunOnce()
+	assert.Equal(t, 2, result.Errors)
+	assert.Equal(t, models.OrderStatusPending, orderStatus(db, newer.ID))
+
+	_, result, _ = reconciler.RunOnce()
+	assert.Equal(t, 1, result.Paid, "the failing orders go to the back of the queue")
+	assert.Equal(t, models.OrderStatusPaid, orderStatus(db, newer.ID))
+	assert.Equal(t, models.OrderStatusPending, orderStatus(db, wrongAmount.ID))
+}
+
+func TestReconcilerLeaseOutlastsInterval(t *testing.T) {
+	db, reconciler, _ := setupReconcilerTest(t)
+	createOpenOrder(db, "OUT_SLOW", time.Hour)
+	gateway := reconciler.Gateway
+	var lockedUntil time.Time
+	reconciler.Gateway = func(name string) (payment.PaymentGateway, error) {
+		lock, _ := models.FindJobLock(ReconcilerJobName)
+		lockedUntil = lock.LockedUntil
+		return gateway(name)
+	}
+
+	started := time.Now()
+	reconciler.RunOnce()
+
+	// A run that takes longer than Interval keeps the lease, so no other replica joins it
+	assert.True(t, lockedUntil.After(started.Add(reconciler.Interval)))
+	assert.False(t, lockedUntil.After(time.Now().Add(reconciler.LeaseTTL)))
+}
+
+func TestReconcilerSkipsWhenAnotherReplicaHoldsLock(t *testing.T) {
+	db, reconciler, gateway := setupReconcilerTest(t)
+	order := createOpenOrder(db, "OUT_PAID", 5*time.Minute)
+	gateway.SetOrder("OUT_PAID", gatewayOrder("DY_PAID", payment.StatusSuccess, 990))
+
+	acquired, _ := models.AcquireJobLock(ReconcilerJobName, "other-replica", time.Minute)
+	assert.True(t, acquired)
+
+	ran, result, err := reconciler.RunOnce()
+
+	assert.False(t, ran)
+	assert.Nil(t, result)
+	assert.NoError(t, err)
+	assert.Equal(t, models.OrderStatusPending, orderStatus(db, order.ID))
+}
+
+func TestReconcilerSettlesConfirmedOrders(t *testing.T) {
+	db, reconciler, _ := setupReconcilerTest(t)
+
+	confirmed := createOpenOrder(db, "OUT_CONFIRMED", time.Hour)
+	db.Model(&confirmed).Update("status", models.OrderStatusConfirmed)
+	unreachable := createOpenOrder(db, "GATEWAY_DOWN", time.Hour)
+	db.Model(&unreachable).Update("status", models.OrderStatusConfirmed)
+	alreadySettled := createOpenOrder(db, "OUT_SETTLED", time.Hour)
+	db.Model(&alreadySettled).Updates(map[string]interface{}{"status": models.OrderStatusConfirmed, "settle_status": models.SettleStatusSucceeded})
+
+	ran, result, err := reconciler.RunOnce()
+
+	assert.True(t, ran)
+	assert.Error(t, err)
+	assert.Equal(t, ReconcileResult{Checked: 2, Settled: 1, Errors: 1}, *result)
+
+	var dbOrder models.Order
+	db.First(&dbOrder, confirmed.ID)
+	assert.Equal(t, models.SettleStatusPending, dbOrder.SettleStatus)
+	assert.Equal(t, "SETTLE_OUT_CONFIRMED", dbOrder.SettleNo)
+	var dbUnreachable models.Order
+	db.First(&dbUnreachable, unreachable.ID)
+	assert.Equal(t, models.SettleStatusNone, dbUnreachable.SettleStatus, "a failed attempt is retried on the next run")
+}
+
+func TestReconcilerConfirmsPrepaidOrdersAndRetriesFailedSettles(t *testing.T) {
+	db, reconciler, _ := setupReconcilerTest(t)
+
+	bundleID := uint(1)
+	bundle := models.Order{UserID: 1, BundleID: &bundleID, Price: 1990, Status: models.OrderStatusPaid, OrderNo: "OUT_BUNDLE", OutOrderNo: "OUT_BUNDLE"}
+	db.Create(&bundle)
+	failed := createOpenOrder(db, "OUT_FAILED", time.Hour)
+	db.Model(&failed).Updates(map[string]interface{}{"status": models.OrderStatusConfirmed, "settle_status": models.SettleStatusFailed, "out_settle_no": "SOUT_FAILED"})
+	db.Model(&failed).UpdateColumn("updated_at", time.Now().Add(-2*time.Hour))
+	recentlyFailed := createOpenOrder(db, "OUT_RECENTLY_FAILED", time.Hour)
+	db.Model(&recentlyFailed).Updates(map[string]interface{}{"status": models.OrderStatusConfirmed, "settle_status": models.SettleStatusFailed})
+	reconciler.SettleRetryAfter = time.Hour
+
+	ran, result, err := reconciler.RunOnce()
+
+	assert.True(t, ran)
+	assert.NoError(t, err)
+	// The bundle order is confirmed and, as an ecpay order, settled in the same run
+	assert.Equal(t, ReconcileResult{Checked: 3, Confirmed: 1, Settled: 2}, *result)
+
+	var dbBundle models.Order
+	db.First(&dbBundle, bundle.ID)
+	assert.Equal(t, models.OrderStatusConfirmed, dbBundle.Status)
+	assert.Equal(t, models.SettleStatusPending, dbBundle.SettleStatus)
+	var dbFailed models.Order
+	db.First(&dbFailed, failed.ID)
+	assert.Equal(t, models.SettleStatusPending, dbFailed.SettleStatus)
+	assert.Equal(t, "SETTLE_OUT_FAILED", dbFailed.SettleNo)
+	var dbRecent models.Order
+	db.First(&dbRecent, recentlyFailed.ID)
+	assert.Equal(t, models.SettleStatusFailed, dbRecent.SettleStatus, "waits for SettleRetryAfter")
+}
+
+func TestReconcilerQueriesEachOrdersGateway(t *testing.T) {
+	db, reconciler, ecpay := setupReconcilerTest(t)
+	tradeV2, _ := reconciler.Gateway(payment.GatewayTradeV2)
+	tradeV2.(*payment.Fake).SetOrder("OUT_V2_CANCELLED", gatewayOrder("DY_V2_CANCELLED", payment.StatusCancelled, 990))
+	// The ecpay gateway knows an order with the same number, it must not be asked about trade v2 orders
+	ecpay.SetOrder("OUT_V2_CANCELLED", gatewayOrder("DY_ECPAY", payment.StatusSuccess, 990))
+
+	stale := createOpenOrder(db, "OUT_V2_STALE", time.Hour)
+	db.Model(&stale).Update("gateway", models.OrderGatewayTradeV2)
+	recent := createOpenOrder(db, "OUT_V2_RECENT", 5*time.Minute)
+	db.Model(&recent).Update("gateway", models.OrderGatewayTradeV2)
+	cancelled := createOpenOrder(db, "OUT_V2_CANCELLED", 5*time.Minute)
+	db.Model(&cancelled).Update("gateway", models.OrderGatewayTradeV2)
+
+	ran, result, err := reconciler.RunOnce()
+
+	assert.True(t, ran)
+	assert.NoError(t, err)
+	assert.Equal(t, ReconcileResult{Checked: 3, Expired: 1, Cancelled: 1, Unchanged: 1}, *result)
+	assert.Equal(t, models.OrderStatusExpired, orderStatus(db, stale.ID))
+	assert.Equal(t, models.OrderStatusPending, orderStatus(db, recent.ID))
+	assert.Equal(t, models.OrderStatusCancelled, orderStatus(db, cancelled.ID))
+}
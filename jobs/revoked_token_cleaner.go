@@ -0,0 +1,73 @@
+package jobs
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"learning-api/models"
+	"os"
+	"time"
+)
+
+// RevokedTokenCleanerJobName is the job lock name of the token denylist cleaner
+const RevokedTokenCleanerJobName = "revoked_token_cleaner"
+
+// RevokedTokenCleanerResult counts what one cleaner run did
+type RevokedTokenCleanerResult struct {
+	Purged                int64 `json:"purged"`
+	PurgedIdempotencyKeys int64 `json:"purged_idempotency_keys"`
+}
+
+// RevokedTokenCleaner drops denylisted access tokens once they have expired anyway, and expired
+// idempotency keys of all users
+type RevokedTokenCleaner struct {
+	Interval time.Duration // time between runs, also the lease TTL
+	Owner    string
+}
+
+// NewRevokedTokenCleaner returns a cleaner with the default schedule, owned by this process
+func NewRevokedTokenCleaner() *RevokedTokenCleaner {
+	hostname, _ := os.Hostname()
+	return &RevokedTokenCleaner{
+		Interval: time.Hour,
+		Owner:    fmt.Sprintf("%s-%d", hostname, os.Getpid()),
+	}
+}
+
+// Start runs the cleaner every Interval until ctx is cancelled
+func (r *RevokedTokenCleaner) Start(ctx context.Context) {
+	ticker := time.NewTicker(r.Interval)
+	defer ticker.Stop()
+	for {
+		if _, _, err := r.RunOnce(); err != nil {
+			fmt.Println("revoked token cleaner failed:", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// RunOnce purges the expired denylist entries and idempotency keys if this replica wins the job lock.
+// It returns false when another replica is running the job.
+func (r *RevokedTokenCleaner) RunOnce() (bool, *RevokedTokenCleanerResult, error) {
+	acquired, err := models.AcquireJobLock(RevokedTokenCleanerJobName, r.Owner, r.Interval)
+	if err != nil || !acquired {
+		return false, nil, err
+	}
+
+	result := &RevokedTokenCleanerResult{}
+	now := time.Now()
+	purged, runErr := models.PurgeExpiredRevokedTokens(now)
+	result.Purged = purged
+	if runErr == nil {
+		result.PurgedIdempotencyKeys, runErr = models.PurgeExpiredIdempotencyKeys(now)
+	}
+	summary, _ := json.Marshal(result)
+	if err := models.FinishJobRun(RevokedTokenCleanerJobName, r.Owner, string(summary), runErr); err != nil {
+		fmt.Println("revoked token cleaner: record run failed:", err)
+	}
+	return true, result, runErr
+}
@@ -0,0 +1,37 @@
+package jobs
+
+import (
+	"learning-api/models"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRevokedTokenCleanerRunOnce(t *testing.T) {
+	db := models.InitTestDB()
+	models.SetDB(db)
+
+	assert.NoError(t, models.RevokeAccessToken(1, "expired_jti", time.Now().Add(-time.Minute)))
+	assert.NoError(t, models.RevokeAccessToken(1, "live_jti", time.Now().Add(time.Hour)))
+	// Keys of users who never send another request are only dropped here
+	db.Create(&models.IdempotencyKey{UserID: 1, Key: "expired_key", RequestHash: "hash", ExpiresAt: time.Now().Add(-time.Minute)})
+	db.Create(&models.IdempotencyKey{UserID: 2, Key: "live_key", RequestHash: "hash", ExpiresAt: time.Now().Add(time.Hour)})
+
+	cleaner := &RevokedTokenCleaner{Interval: time.Hour, Owner: "test-replica"}
+	ran, result, err := cleaner.RunOnce()
+	assert.True(t, ran)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), result.Purged)
+	assert.Equal(t, int64(1), result.PurgedIdempotencyKeys)
+
+	var remaining []models.RevokedToken
+	db.Find(&remaining)
+	assert.Len(t, remaining, 1)
+	assert.Equal(t, "live_jti", remaining[0].JTI)
+
+	var keys []models.IdempotencyKey
+	db.Find(&keys)
+	assert.Len(t, keys, 1)
+	assert.Equal(t, "live_key", keys[0].Key)
+}
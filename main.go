@@ -1,8 +1,11 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"learning-api/config"
+	"learning-api/helpers"
+	"learning-api/jobs"
 	"learning-api/middlewares"
 	"learning-api/models"
 	"learning-api/routes"
@@ -25,6 +28,15 @@ func init() {
 
 func main() {
 	cfg := config.LoadConfig()
+	if err := cfg.Validate(); err != nil {
+		if cfg.Profile == "production" {
+			panic(err.Error())
+		}
+		fmt.Println("Warning:", err)
+	}
+	if _, err := helpers.DouyinHTTP(); err != nil {
+		panic("failed to set up the Douyin API client: " + err.Error())
+	}
 	if cfg.Profile == "dev" {
 		gin.SetMode(gin.DebugMode)
 	} else {
@@ -42,7 +54,18 @@ func main() {
 		panic("failed to connect database")
 	}
 	models.SetDB(db)
-	db.AutoMigrate(&models.Topic{}, &models.Question{}, &models.Answer{}, &models.User{}, &models.Token{}, &models.Experience{}, &models.Reply{}, &models.Order{})
+	db.AutoMigrate(&models.Topic{}, &models.Question{}, &models.Answer{}, &models.User{}, &models.Token{}, &models.Experience{}, &models.Reply{}, &models.Order{}, &models.OrderStatusHistory{}, &models.Refund{}, &models.JobLock{}, &models.IdempotencyKey{}, &models.Entitlement{}, &models.Membership{}, &models.Coupon{}, &models.Bundle{}, &models.OrderSyncTask{}, &models.BillReconciliation{}, &models.BillReconciliationItem{}, &models.RevokedToken{})
+	if n, err := models.BackfillOrderEntitlements(); err != nil {
+		fmt.Println("backfill order entitlements failed:", err)
+	} else if n > 0 {
+		fmt.Println("backfilled entitlements of", n, "paid orders")
+	}
+
+	// Every replica runs the reconciler, the job lock lets one of them work at a time
+	go jobs.NewReconciler().Start(context.Background())
+	go jobs.NewOrderSyncer().Start(context.Background())
+	go jobs.NewBillReconciler().Start(context.Background())
+	go jobs.NewRevokedTokenCleaner().Start(context.Background())
 
 	port := os.Getenv("PORT")
 	if port == "" {
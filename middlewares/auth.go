@@ -1,10 +1,12 @@
 package middlewares
 
 import (
+	"errors"
 	"fmt"
 	"learning-api/config"
 	"learning-api/models"
 	"net/http"
+	"strconv"
 	"strings"
 
 	"github.com/gin-gonic/gin"
@@ -15,7 +17,7 @@ func AuthMiddleware() gin.HandlerFunc {
 	return func(c *gin.Context) {
 
 		// skip the /refresh endpoint
-		if c.Request.URL.Path == "/refresh-token" || c.Request.URL.Path == "/login" || c.Request.URL.Path == "/token" || c.Request.URL.Path == "/health" || c.Request.URL.Path == "/ping" || c.Request.URL.Path == "/docs" || c.Request.URL.Path == "/pay/order" {
+		if c.Request.URL.Path == "/refresh-token" || c.Request.URL.Path == "/login" || c.Request.URL.Path == "/token" || c.Request.URL.Path == "/health" || c.Request.URL.Path == "/ping" || c.Request.URL.Path == "/docs" || c.Request.URL.Path == "/pay/callback" || c.Request.URL.Path == "/pay/refund/callback" || c.Request.URL.Path == "/pay/settle/callback" || c.Request.URL.Path == "/pay/v2/callback" || c.Request.URL.Path == "/pay/fake/callback" {
 			c.Next()
 			return
 		}
@@ -29,59 +31,93 @@ func AuthMiddleware() gin.HandlerFunc {
 
 		tokenString = strings.TrimPrefix(tokenString, "Bearer ")
 
-		if !validateToken(tokenString, c) {
+		claims, ok := validateToken(tokenString, c)
+		if !ok {
 			c.Abort()
 			return
 		}
 
-		user, _ := loadUserFromToken(tokenString)
+		user, err := loadUser(claims.UserID, claims.JTI)
+		if errors.Is(err, models.ErrTokenRevoked) {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "revoked token", "code": "4983"})
+			c.Abort()
+			return
+		}
+		if err != nil {
+			fmt.Println("load user failed:", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load user"})
+			c.Abort()
+			return
+		}
+		if user == nil {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "user not found", "code": "4984"})
+			c.Abort()
+			return
+		}
+
+		if err := models.TouchAccessToken(claims.JTI); err != nil {
+			fmt.Println("record last seen failed:", err)
+		}
 
-		c.Set("currentUser", user)
+		c.Set("currentUser", *user)
+		c.Set("currentToken", claims)
 		c.Next()
 	}
 }
 
-func validateToken(tokenString string, c *gin.Context) bool {
+// validateToken checks the signature, expiry, issuer and audience of the token and returns its
+// claims. On failure it has already replied.
+func validateToken(tokenString string, c *gin.Context) (models.AccessClaims, bool) {
 	parsedToken, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
 		return []byte(config.LoadConfig().ClientSecret), nil
-	})
+	},
+		jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}),
+		jwt.WithIssuer(models.JWTIssuer),
+		jwt.WithAudience(models.JWTAudience),
+		jwt.WithExpirationRequired(),
+	)
 
 	if err != nil || !parsedToken.Valid {
 		if strings.Contains(err.Error(), "token is expired") {
 			fmt.Println("err", err, "  error()", err.Error())
 			c.JSON(http.StatusUnauthorized, gin.H{"error": "expired token", "code": "4980"})
-			return false
+			return models.AccessClaims{}, false
 		}
 		fmt.Println("err", err, "  error()", err.Error())
 		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid token", "code": "4981"})
-		return false
+		return models.AccessClaims{}, false
 	}
 
 	claims, ok := parsedToken.Claims.(jwt.MapClaims)
-	// exp := int64(claims["exp"].(float64))
-	// if exp < time.Now().Unix() {
-	// 	c.JSON(http.StatusUnauthorized, gin.H{"error": "Expired token"})
-	// 	return false
-	// }
-
-	if !ok || claims["exp"] == nil || claims["iat"] == nil {
+	var userID uint64
+	var jti string
+	var exp *jwt.NumericDate
+	if ok {
+		sub, _ := claims.GetSubject()
+		userID, err = strconv.ParseUint(sub, 10, 64)
+		jti, _ = claims["jti"].(string)
+		exp, _ = claims.GetExpirationTime()
+	}
+	// tokens issued before sub and jti were added have to be refreshed; refresh tokens are only
+	// good for /refresh-token
+	if !ok || claims["iat"] == nil || err != nil || jti == "" || exp == nil || claims["typ"] != models.TokenTypeAccess {
 		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid token claims", "code": "4982"})
-		return false
+		return models.AccessClaims{}, false
 	}
 
-	return true
+	return models.AccessClaims{UserID: uint(userID), JTI: jti, ExpiresAt: exp.Time}, true
 }
 
-func loadUserFromToken(tokenString string) (models.User, error) {
-	var token models.Token
-	if err := models.GetDB().Where("access_token = ?", tokenString).First(&token).Error; err != nil {
-		return models.User{}, err
+// loadUser resolves the user of an access token through the auth cache. It returns nil when the
+// user no longer exists and models.ErrTokenRevoked when the token is denylisted.
+func loadUser(userID uint, jti string) (*models.User, error) {
+	revoked, err := models.IsAccessTokenRevoked(jti)
+	if err != nil {
+		return nil, err
 	}
-
-	var user models.User
-	if err := models.GetDB().Where("id = ?", token.UserID).First(&user).Error; err != nil {
-		return models.User{}, err
+	if revoked {
+		return nil, models.ErrTokenRevoked
 	}
 
-	return user, nil
+	return models.CachedUser(userID)
 }
@@ -1,14 +1,20 @@
 package middlewares_test
 
 import (
+	"learning-api/config"
+	"learning-api/handlers"
 	"learning-api/middlewares"
 	"net/http"
 	"net/http/httptest"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 
 	"learning-api/models"
 
 	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -24,14 +30,14 @@ func TestAuthMiddleware_ValidToken(t *testing.T) {
 	w := httptest.NewRecorder()
 	req, _ := http.NewRequest("GET", "/topics", nil)
 	user := models.User{OpenID: "test_openid", UnionID: "test_unionid", SessionKey: "test_sessionkey"}
+	models.GetDB().Create(&user)
 	token := models.NewToken()
+	token.UserID = user.ID // the token names its user in the sub claim
 	err := token.GenTokenWithDate()
 	if err != nil {
 		t.Fatal(err)
 	}
-	user.Tokens = []models.Token{*token}
-	models.GetDB().Create(&user)
-	models.GetDB().Save(&token)
+	models.GetDB().Create(token)
 
 	req.Header.Set("Authorization", "Bearer "+token.AccessToken) // Use generated valid token
 
@@ -94,3 +100,177 @@ func generateTestToken() (*models.Token, error) {
 	token.SetAccessTokenAndRefreshToken(accessTokenExpiresIn, refreshTokenExpiresIn)
 	return token, nil
 }
+
+func TestAuthMiddleware_RefreshedToken(t *testing.T) {
+	models.SetDB(models.InitTestDB())
+	router := gin.Default()
+	router.Use(middlewares.AuthMiddleware())
+	router.GET("/protected", func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{"message": "Access granted"})
+	})
+
+	user := models.User{OpenID: "test_openid", UnionID: "test_unionid", SessionKey: "test_sessionkey"}
+	models.GetDB().Create(&user)
+	token := models.NewToken()
+	token.UserID = user.ID
+	token.SetAccessTokenAndRefreshToken(7200, 31536000)
+	models.GetDB().Create(token)
+	_, err := token.RefreshToNewToken()
+	assert.NoError(t, err)
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/protected", nil)
+	req.Header.Set("Authorization", "Bearer "+token.AccessToken)
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	assert.Contains(t, w.Body.String(), "revoked token")
+}
+
+func TestAuthMiddleware_UserGone(t *testing.T) {
+	models.SetDB(models.InitTestDB())
+	router := gin.Default()
+	router.Use(middlewares.AuthMiddleware())
+	router.GET("/protected", func(c *gin.Context) {
+		user := c.MustGet("currentUser").(models.User)
+		c.JSON(http.StatusOK, gin.H{"role": user.Role})
+	})
+	serve := func(accessToken string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/protected", nil)
+		req.Header.Set("Authorization", "Bearer "+accessToken)
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	user := models.User{OpenID: "test_openid"}
+	models.GetDB().Create(&user)
+	token := models.NewToken()
+	token.UserID = user.ID
+	assert.NoError(t, token.GenTokenWithDate())
+	models.GetDB().Create(token)
+
+	w := serve(token.AccessToken)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), models.RoleUser)
+
+	// Saving the user drops it from the cache
+	user.Role = models.RoleAdmin
+	models.GetDB().Save(&user)
+	w = serve(token.AccessToken)
+	assert.Contains(t, w.Body.String(), models.RoleAdmin)
+
+	models.GetDB().Delete(&user)
+	w = serve(token.AccessToken)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	assert.Contains(t, w.Body.String(), "user not found")
+
+	// A token signed for another audience is rejected
+	other := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"sub": "1", "jti": token.AccessJTI, "iss": models.JWTIssuer, "aud": "other",
+		"exp": time.Now().Add(time.Hour).Unix(), "iat": time.Now().Unix(),
+	})
+	signed, _ := other.SignedString([]byte(config.LoadConfig().ClientSecret))
+	w = serve(signed)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	assert.Contains(t, w.Body.String(), "Invalid token")
+}
+
+func TestAuthMiddleware_RefreshTokenAsBearer(t *testing.T) {
+	models.SetDB(models.InitTestDB())
+	router := gin.Default()
+	router.Use(middlewares.AuthMiddleware())
+	router.GET("/protected", func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{"message": "Access granted"})
+	})
+
+	user := models.User{OpenID: "test_openid"}
+	models.GetDB().Create(&user)
+	token := models.NewToken()
+	token.UserID = user.ID
+	assert.NoError(t, token.GenTokenWithDate())
+	models.GetDB().Create(token)
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/protected", nil)
+	req.Header.Set("Authorization", "Bearer "+token.RefreshToken)
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	assert.Contains(t, w.Body.String(), "4982")
+}
+
+func TestAuthMiddleware_AfterLogoutAll(t *testing.T) {
+	models.SetDB(models.InitTestDB())
+	router := gin.Default()
+	router.Use(middlewares.AuthMiddleware())
+	router.GET("/protected", func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{"message": "Access granted"})
+	})
+	serve := func(bearer string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/protected", nil)
+		req.Header.Set("Authorization", "Bearer "+bearer)
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	user := models.User{OpenID: "test_openid"}
+	models.GetDB().Create(&user)
+	token := models.NewToken()
+	token.UserID = user.ID
+	assert.NoError(t, token.GenTokenWithDate())
+	models.GetDB().Create(token)
+	assert.Equal(t, http.StatusOK, serve(token.AccessToken).Code)
+
+	_, err := models.RevokeUserTokens(user.ID)
+	assert.NoError(t, err)
+
+	// Neither half of the pair gets in once the session is ended
+	assert.Equal(t, http.StatusUnauthorized, serve(token.AccessToken).Code)
+	assert.Equal(t, http.StatusUnauthorized, serve(token.RefreshToken).Code)
+}
+
+func TestAuthMiddleware_RevokedSession(t *testing.T) {
+	models.SetDB(models.InitTestDB())
+	router := gin.Default()
+	router.Use(middlewares.AuthMiddleware())
+	router.GET("/protected", func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{"message": "Access granted"})
+	})
+	router.DELETE("/me/sessions/:id", handlers.DeleteMySession)
+	router.POST("/refresh-token", handlers.PostRefreshToken)
+	serve := func(method, path, bearer, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		if bearer != "" {
+			req.Header.Set("Authorization", "Bearer "+bearer)
+		}
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	user := models.User{OpenID: "test_openid"}
+	models.GetDB().Create(&user)
+	var phone, pc *models.Token
+	for _, device := range []**models.Token{&phone, &pc} {
+		token := models.NewToken()
+		token.UserID = user.ID
+		assert.NoError(t, token.GenTokenWithDate())
+		models.GetDB().Create(token)
+		*device = token
+	}
+
+	// The phone signs the PC out
+	w := serve("DELETE", "/me/sessions/"+strconv.FormatUint(uint64(pc.ID), 10), phone.AccessToken, "")
+	assert.Equal(t, http.StatusNoContent, w.Code)
+
+	// The PC can use neither its access nor its refresh token any more
+	assert.Equal(t, http.StatusUnauthorized, serve("GET", "/protected", pc.AccessToken, "").Code)
+	assert.Equal(t, http.StatusUnauthorized, serve("GET", "/protected", pc.RefreshToken, "").Code)
+	w = serve("POST", "/refresh-token", "", `{"access_token":"`+pc.AccessToken+`","refresh_token":"`+pc.RefreshToken+`"}`)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	assert.Equal(t, http.StatusOK, serve("GET", "/protected", phone.AccessToken, "").Code)
+}
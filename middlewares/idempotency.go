@@ -0,0 +1,113 @@
+package middlewares
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"learning-api/models"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// IdempotencyKeyTTL is how long a stored response is replayed for retries with the same key
+const IdempotencyKeyTTL = 24 * time.Hour
+
+// maxIdempotencyKeyLength matches the idempotency_key column
+const maxIdempotencyKeyLength = 255
+
+// responseRecorder keeps a copy of the response body so it can be stored with the key
+type responseRecorder struct {
+	gin.ResponseWriter
+	body bytes.Buffer
+}
+
+func (w *responseRecorder) Write(b []byte) (int, error) {
+	w.body.Write(b)
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *responseRecorder) WriteString(s string) (int, error) {
+	w.body.WriteString(s)
+	return w.ResponseWriter.WriteString(s)
+}
+
+// Idempotency makes a request sent with an Idempotency-Key header run at most once per user.
+// A retry with the same key and body gets the stored response back, the same key with another
+// body gets 409, and so does a retry while the first request is still running. Server errors
+// are not stored, so the request can be retried with the same key. It must run after AuthMiddleware.
+func Idempotency() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		key := c.GetHeader("Idempotency-Key")
+		currentUser, exists := c.Get("currentUser")
+		if key == "" || !exists {
+			c.Next()
+			return
+		}
+		if len(key) > maxIdempotencyKeyLength {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Idempotency-Key must be at most %d characters", maxIdempotencyKeyLength)})
+			c.Abort()
+			return
+		}
+
+		var body []byte
+		if c.Request.Body != nil {
+			var err error
+			body, err = io.ReadAll(c.Request.Body)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "failed to read request body"})
+				c.Abort()
+				return
+			}
+			c.Request.Body = io.NopCloser(bytes.NewReader(body))
+		}
+		hash := sha256.Sum256([]byte(c.Request.Method + " " + c.Request.URL.Path + "\n" + string(body)))
+		requestHash := hex.EncodeToString(hash[:])
+
+		user := currentUser.(models.User)
+		stored, reserved, err := models.ReserveIdempotencyKey(user.ID, key, requestHash, IdempotencyKeyTTL)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check Idempotency-Key"})
+			c.Abort()
+			return
+		}
+		if !reserved {
+			switch {
+			case stored != nil && stored.RequestHash != requestHash:
+				c.JSON(http.StatusConflict, gin.H{"error": "Idempotency-Key was already used with a different request"})
+			case stored == nil || !stored.Completed():
+				c.JSON(http.StatusConflict, gin.H{"error": "A request with this Idempotency-Key is still in progress"})
+			default:
+				c.Header("Idempotent-Replayed", "true")
+				c.Data(stored.StatusCode, "application/json; charset=utf-8", []byte(stored.ResponseBody))
+			}
+			c.Abort()
+			return
+		}
+
+		recorder := &responseRecorder{ResponseWriter: c.Writer}
+		c.Writer = recorder
+		completed := false
+		defer func() {
+			// a panicking handler must not leave the key in progress until it expires
+			if !completed {
+				stored.Release()
+			}
+		}()
+
+		c.Next()
+
+		status := c.Writer.Status()
+		if status >= http.StatusInternalServerError {
+			return
+		}
+		if err := stored.Complete(status, recorder.body.String()); err != nil {
+			fmt.Println("idempotency: store response for key", key, "failed:", err)
+			return
+		}
+		completed = true
+	}
+}
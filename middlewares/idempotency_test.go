@@ -0,0 +1,86 @@
+package middlewares_test
+
+import (
+	"bytes"
+	"learning-api/middlewares"
+	"learning-api/models"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIdempotency(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	models.SetDB(models.InitTestDB())
+
+	runs := 0
+	status := http.StatusOK
+	router := gin.New()
+	router.Use(func(c *gin.Context) {
+		c.Set("currentUser", models.User{ID: 7})
+		c.Next()
+	})
+	router.POST("/experiences", middlewares.Idempotency(), func(c *gin.Context) {
+		runs++
+		c.JSON(status, gin.H{"run": runs})
+	})
+	serve := func(key string, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/experiences", bytes.NewBufferString(body))
+		if key != "" {
+			req.Header.Set("Idempotency-Key", key)
+		}
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	first := serve("key-1", `{"topic_id":1}`)
+	assert.Equal(t, http.StatusOK, first.Code)
+	assert.JSONEq(t, `{"run":1}`, first.Body.String())
+
+	// A retry replays the stored response without running the handler again
+	retry := serve("key-1", `{"topic_id":1}`)
+	assert.Equal(t, http.StatusOK, retry.Code)
+	assert.JSONEq(t, `{"run":1}`, retry.Body.String())
+	assert.Equal(t, "true", retry.Header().Get("Idempotent-Replayed"))
+	assert.Equal(t, 1, runs)
+
+	assert.Equal(t, http.StatusConflict, serve("key-1", `{"topic_id":2}`).Code)
+	assert.Equal(t, 1, runs)
+
+	// Without a key every request runs
+	serve("", `{"topic_id":1}`)
+	assert.Equal(t, 2, runs)
+
+	// Server errors are not stored, so the same key can be retried
+	status = http.StatusBadGateway
+	assert.Equal(t, http.StatusBadGateway, serve("key-2", `{"topic_id":1}`).Code)
+	status = http.StatusOK
+	assert.Equal(t, http.StatusOK, serve("key-2", `{"topic_id":1}`).Code)
+	assert.Equal(t, 4, runs)
+}
+
+func TestIdempotency_InProgress(t *testing.T) {
+	models.SetDB(models.InitTestDB())
+	_, reserved, err := models.ReserveIdempotencyKey(7, "key-1", "hash", middlewares.IdempotencyKeyTTL)
+	assert.NoError(t, err)
+	assert.True(t, reserved)
+
+	stored, reserved, err := models.ReserveIdempotencyKey(7, "key-1", "hash", middlewares.IdempotencyKeyTTL)
+	assert.NoError(t, err)
+	assert.False(t, reserved)
+	assert.False(t, stored.Completed())
+
+	// Keys are per user
+	_, reserved, _ = models.ReserveIdempotencyKey(8, "key-1", "hash", middlewares.IdempotencyKeyTTL)
+	assert.True(t, reserved)
+
+	// An expired key is given out again
+	_, reserved, _ = models.ReserveIdempotencyKey(9, "key-1", "hash", -1)
+	assert.True(t, reserved)
+	_, reserved, _ = models.ReserveIdempotencyKey(9, "key-1", "other", middlewares.IdempotencyKeyTTL)
+	assert.True(t, reserved)
+}
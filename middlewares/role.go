@@ -0,0 +1,28 @@
+package middlewares
+
+import (
+	"learning-api/models"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// RequireRole only lets users with one of the given roles through. It must run after AuthMiddleware.
+func RequireRole(roles ...string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		currentUser, exists := c.Get("currentUser")
+		if !exists {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+			c.Abort()
+			return
+		}
+
+		user := currentUser.(models.User)
+		if !user.HasRole(roles...) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "forbidden: insufficient role"})
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
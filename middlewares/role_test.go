@@ -0,0 +1,37 @@
+package middlewares_test
+
+import (
+	"learning-api/middlewares"
+	"learning-api/models"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRequireRole(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	serve := func(user *models.User) int {
+		router := gin.New()
+		router.Use(func(c *gin.Context) {
+			if user != nil {
+				c.Set("currentUser", *user)
+			}
+			c.Next()
+		})
+		router.POST("/orders/1/refund", middlewares.RequireRole(models.RoleAdmin, models.RoleSupport), func(c *gin.Context) {
+			c.JSON(http.StatusOK, gin.H{"message": "Access granted"})
+		})
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/orders/1/refund", nil)
+		router.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	assert.Equal(t, http.StatusOK, serve(&models.User{Role: models.RoleAdmin}))
+	assert.Equal(t, http.StatusOK, serve(&models.User{Role: models.RoleSupport}))
+	assert.Equal(t, http.StatusForbidden, serve(&models.User{Role: models.RoleUser}))
+	assert.Equal(t, http.StatusUnauthorized, serve(nil))
+}
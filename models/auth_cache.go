@@ -0,0 +1,110 @@
+package models
+
+import (
+	"sync"
+	"time"
+)
+
+// AuthCacheTTL bounds how long an authenticated request may see a user or a revocation as it was.
+// Changes made by this process drop the entry at once; other replicas see them within the TTL.
+var AuthCacheTTL = 30 * time.Second
+
+type cacheEntry[V any] struct {
+	value     V
+	expiresAt time.Time
+}
+
+// ttlCache is a small in-process cache whose entries expire after AuthCacheTTL
+type ttlCache[K comparable, V any] struct {
+	mu      sync.Mutex
+	entries map[K]cacheEntry[V]
+}
+
+func newTTLCache[K comparable, V any]() *ttlCache[K, V] {
+	return &ttlCache[K, V]{entries: map[K]cacheEntry[V]{}}
+}
+
+// get returns the cached value of key, or loads and caches it
+func (c *ttlCache[K, V]) get(key K, load func() (V, error)) (V, error) {
+	c.mu.Lock()
+	entry, ok := c.entries[key]
+	c.mu.Unlock()
+	if ok && time.Now().Before(entry.expiresAt) {
+		return entry.value, nil
+	}
+
+	value, err := load()
+	if err != nil {
+		return value, err
+	}
+	c.set(key, value)
+	return value, nil
+}
+
+func (c *ttlCache[K, V]) set(key K, value V) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries[key] = cacheEntry[V]{value: value, expiresAt: time.Now().Add(AuthCacheTTL)}
+}
+
+// deleteWhere drops the entries that match, and any expired ones
+func (c *ttlCache[K, V]) deleteWhere(match func(key K, value V) bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	for key, entry := range c.entries {
+		if now.After(entry.expiresAt) || match(key, entry.value) {
+			delete(c.entries, key)
+		}
+	}
+}
+
+func (c *ttlCache[K, V]) reset() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries = map[K]cacheEntry[V]{}
+}
+
+var (
+	userCache       = newTTLCache[uint, *User]()
+	revokedJTICache = newTTLCache[string, bool]() // whether an access token jti is denylisted
+	lastSeenCache   = newTTLCache[string, bool]() // access token jtis whose last_seen_at was just written
+)
+
+// resetAuthCache empties the caches, e.g. when the database is swapped
+func resetAuthCache() {
+	userCache.reset()
+	revokedJTICache.reset()
+	lastSeenCache.reset()
+}
+
+// CachedUser returns the user with the given ID, or nil if there is none
+func CachedUser(id uint) (*User, error) {
+	user, err := userCache.get(id, func() (*User, error) {
+		var users []User
+		if err := db.Where("id = ?", id).Limit(1).Find(&users).Error; err != nil {
+			return nil, err
+		}
+		if len(users) == 0 {
+			return nil, nil
+		}
+		return &users[0], nil
+	})
+	if user == nil || err != nil {
+		return nil, err
+	}
+	copied := *user
+	return &copied, nil
+}
+
+// ForgetCachedUser is the revocation hook for users: the next request reloads the user
+func ForgetCachedUser(id uint) {
+	userCache.deleteWhere(func(key uint, _ *User) bool { return key == id })
+}
+
+// markRevokedInCache is the revocation hook for access tokens: this process rejects them at once
+func markRevokedInCache(jtis []string) {
+	for _, jti := range jtis {
+		revokedJTICache.set(jti, true)
+	}
+}
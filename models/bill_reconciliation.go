@@ -0,0 +1,221 @@
+package models
+
+import (
+	"errors"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// BillIssueKind is what a bill reconciliation found wrong with one order
+type BillIssueKind string
+
+const (
+	BillIssueMissingLocal   BillIssueKind = "missing_local"   // the bill has a payment for an order we do not have
+	BillIssueMissingRemote  BillIssueKind = "missing_remote"  // an ecpay order was paid that day but is not on the bill
+	BillIssueAmountMismatch BillIssueKind = "amount_mismatch" // the bill amount differs from the order price
+	BillIssueStatusMismatch BillIssueKind = "status_mismatch" // the bill and the order disagree on whether it was paid
+)
+
+// BillLine is one order of a downloaded bill. Amount is in fen.
+type BillLine struct {
+	OutOrderNo string
+	Amount     int
+	Paid       bool
+	Status     string // as the bill spells it
+}
+
+// BillReconciliation is the stored report of matching one day's ecpay bill against local orders.
+// Re-running a day replaces its report. Error is set when the bill could not be reconciled.
+type BillReconciliation struct {
+	ID          uint                     `gorm:"primaryKey" json:"id"`
+	BillDate    string                   `gorm:"type:varchar(10);uniqueIndex" json:"bill_date"` // 2006-01-02 in Beijing time
+	BillLines   int                      `gorm:"not null;default:0" json:"bill_lines"`
+	BillAmount  int                      `gorm:"not null;default:0" json:"bill_amount"`
+	LocalOrders int                      `gorm:"not null;default:0" json:"local_orders"` // ecpay orders paid that day
+	LocalAmount int                      `gorm:"not null;default:0" json:"local_amount"`
+	Matched     int                      `gorm:"not null;default:0" json:"matched"` // bill lines found locally without issues
+	Issues      int                      `gorm:"not null;default:0" json:"issues"`
+	Error       string                   `gorm:"type:text" json:"error,omitempty"`
+	Items       []BillReconciliationItem `gorm:"foreignKey:ReconciliationID;constraint:OnUpdate:CASCADE,OnDelete:CASCADE;" json:"items,omitempty"`
+	CreatedAt   time.Time                `gorm:"autoCreateTime" json:"created_at"`
+	UpdatedAt   time.Time                `gorm:"autoUpdateTime" json:"updated_at"`
+}
+
+// TableName specifies the table name for the BillReconciliation model
+func (BillReconciliation) TableName() string {
+	return "bill_reconciliations"
+}
+
+// BillReconciliationItem is one issue of a report
+type BillReconciliationItem struct {
+	ID               uint          `gorm:"primaryKey" json:"id"`
+	ReconciliationID uint          `gorm:"not null;index" json:"reconciliation_id"`
+	Kind             BillIssueKind `gorm:"type:varchar(32);not null" json:"kind"`
+	OutOrderNo       string        `gorm:"type:varchar(100)" json:"out_order_no"`
+	OrderID          *uint         `json:"order_id"` // nil when the order is missing locally
+	BillAmount       int           `json:"bill_amount"`
+	LocalAmount      int           `json:"local_amount"`
+	BillStatus       string        `gorm:"type:varchar(32)" json:"bill_status"`
+	LocalStatus      string        `gorm:"type:varchar(32)" json:"local_status"`
+}
+
+// TableName specifies the table name for the BillReconciliationItem model
+func (BillReconciliationItem) TableName() string {
+	return "bill_reconciliation_items"
+}
+
+// ReconcileBill matches the bill of billDate, which covers [from, to), against local orders by
+// out_order_no and stores the report, replacing an earlier one of the same day
+func ReconcileBill(billDate string, from, to time.Time, lines []BillLine) (*BillReconciliation, error) {
+	report := &BillReconciliation{BillDate: billDate, BillLines: len(lines)}
+
+	outOrderNos := make([]string, 0, len(lines))
+	for _, line := range lines {
+		outOrderNos = append(outOrderNos, line.OutOrderNo)
+		report.BillAmount += line.Amount
+	}
+	byOutOrderNo := map[string]*Order{}
+	if len(outOrderNos) > 0 {
+		var orders []Order
+		if err := db.Where("out_order_no IN ?", outOrderNos).Order("id ASC").Find(&orders).Error; err != nil {
+			return nil, err
+		}
+		for i := range orders {
+			// an out_order_no can repeat across gateways; the bill only knows ecpay orders
+			if existing, ok := byOutOrderNo[orders[i].OutOrderNo]; !ok || existing.Gateway != OrderGatewayEcpay {
+				byOutOrderNo[orders[i].OutOrderNo] = &orders[i]
+			}
+		}
+	}
+
+	// ecpay orders that moved to paid during the day should all be on the bill
+	var paid []Order
+	err := db.Where("gateway = ? AND id IN (?)", OrderGatewayEcpay,
+		db.Model(&OrderStatusHistory{}).Select("order_id").
+			// timestamps are stored in server local time
+			Where("to_status = ? AND created_at >= ? AND created_at < ?", OrderStatusPaid, from.Local(), to.Local())).
+		Order("id ASC").
+		Find(&paid).Error
+	if err != nil {
+		return nil, err
+	}
+	report.LocalOrders = len(paid)
+
+	onBill := map[string]bool{}
+	for _, line := range lines {
+		onBill[line.OutOrderNo] = true
+		order := byOutOrderNo[line.OutOrderNo]
+		if order == nil {
+			report.Items = append(report.Items, BillReconciliationItem{
+				Kind:       BillIssueMissingLocal,
+				OutOrderNo: line.OutOrderNo,
+				BillAmount: line.Amount,
+				BillStatus: line.Status,
+			})
+			continue
+		}
+		item := BillReconciliationItem{
+			OutOrderNo:  line.OutOrderNo,
+			OrderID:     &order.ID,
+			BillAmount:  line.Amount,
+			LocalAmount: order.Price,
+			BillStatus:  line.Status,
+			LocalStatus: order.Status.String(),
+		}
+		matched := true
+		if line.Amount != order.Price {
+			item.Kind = BillIssueAmountMismatch
+			report.Items = append(report.Items, item)
+			matched = false
+		}
+		if line.Paid != order.Status.isCharged() {
+			item.Kind = BillIssueStatusMismatch
+			report.Items = append(report.Items, item)
+			matched = false
+		}
+		if matched {
+			report.Matched++
+		}
+	}
+	for i := range paid {
+		order := &paid[i]
+		report.LocalAmount += order.Price
+		if onBill[order.OutOrderNo] {
+			continue
+		}
+		report.Items = append(report.Items, BillReconciliationItem{
+			Kind:        BillIssueMissingRemote,
+			OutOrderNo:  order.OutOrderNo,
+			OrderID:     &order.ID,
+			LocalAmount: order.Price,
+			LocalStatus: order.Status.String(),
+		})
+	}
+	report.Issues = len(report.Items)
+
+	if err := saveBillReconciliation(report); err != nil {
+		return nil, err
+	}
+	return report, nil
+}
+
+// RecordBillReconciliationFailure stores that the bill of billDate could not be reconciled. A
+// successful report of the day is kept.
+func RecordBillReconciliationFailure(billDate string, runErr error) error {
+	existing, err := FindBillReconciliation(billDate)
+	if err != nil {
+		return err
+	}
+	if existing != nil && existing.Error == "" {
+		return nil
+	}
+	return saveBillReconciliation(&BillReconciliation{BillDate: billDate, Error: runErr.Error()})
+}
+
+// saveBillReconciliation replaces the stored report of the day with r
+func saveBillReconciliation(r *BillReconciliation) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		var ids []uint
+		if err := tx.Model(&BillReconciliation{}).Where("bill_date = ?", r.BillDate).Pluck("id", &ids).Error; err != nil {
+			return err
+		}
+		if len(ids) > 0 {
+			if err := tx.Where("reconciliation_id IN ?", ids).Delete(&BillReconciliationItem{}).Error; err != nil {
+				return err
+			}
+			if err := tx.Where("id IN ?", ids).Delete(&BillReconciliation{}).Error; err != nil {
+				return err
+			}
+		}
+		return tx.Create(r).Error
+	})
+}
+
+// FindBillReconciliation returns the report of a day with its issues, or nil if the day was
+// never reconciled
+func FindBillReconciliation(billDate string) (*BillReconciliation, error) {
+	var report BillReconciliation
+	result := db.Preload("Items", func(tx *gorm.DB) *gorm.DB {
+		return tx.Order("id ASC")
+	}).Where("bill_date = ?", billDate).First(&report)
+	if result.Error != nil {
+		if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+			return nil, nil // Day never reconciled
+		}
+		return nil, result.Error
+	}
+	return &report, nil
+}
+
+// FindBillReconciliations returns a page of reports without their issues, latest day first, with
+// the total count
+func FindBillReconciliations(offset, limit int) ([]BillReconciliation, int64, error) {
+	var total int64
+	if err := db.Model(&BillReconciliation{}).Count(&total).Error; err != nil {
+		return nil, 0, err
+	}
+	var reports []BillReconciliation
+	err := db.Order("bill_date DESC").Offset(offset).Limit(limit).Find(&reports).Error
+	return reports, total, err
+}
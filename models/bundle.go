@@ -0,0 +1,113 @@
+package models
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Bundle is a curated pack of topics sold at one price. Buying it unlocks the topics it contains
+// at the time of payment; with IncludeFutureTopics set, topics added later are unlocked for
+// earlier buyers too.
+type Bundle struct {
+	ID                  uint      `gorm:"primaryKey" json:"id"`
+	Name                string    `gorm:"type:varchar(128);not null" json:"name"`
+	Description         string    `json:"description"`
+	CoverURL            string    `gorm:"type:varchar(1000)" json:"cover_url"`
+	Price               int       `gorm:"not null;default:0" json:"price"` // in fen
+	IncludeFutureTopics bool      `gorm:"not null;default:false" json:"include_future_topics"`
+	OnSale              bool      `gorm:"not null;default:false" json:"on_sale"`
+	Topics              []Topic   `gorm:"many2many:bundle_topics;" json:"topics"`
+	CreatedAt           time.Time `gorm:"autoCreateTime" json:"created_at"`
+	UpdatedAt           time.Time `gorm:"autoUpdateTime" json:"updated_at"`
+}
+
+// TableName specifies the table name for the Bundle model
+func (Bundle) TableName() string {
+	return "bundles"
+}
+
+// bundleTopicIDs returns the topics a bundle contains
+func bundleTopicIDs(tx *gorm.DB, bundleID uint) ([]uint, error) {
+	var topicIDs []uint
+	err := tx.Table("bundle_topics").Where("bundle_id = ?", bundleID).Pluck("topic_id", &topicIDs).Error
+	return topicIDs, err
+}
+
+// syncBundleEntitlementsTx grants every topic of the bundle while the charge stands and revokes
+// them all once the order is fully refunded
+func (o *Order) syncBundleEntitlementsTx(tx *gorm.DB) error {
+	if o.IsRefunded() {
+		return RevokeEntitlementTx(tx, EntitlementSourceOrder, o.ID)
+	}
+	if !o.IsSettled() {
+		return nil
+	}
+	topicIDs, err := bundleTopicIDs(tx, *o.BundleID)
+	if err != nil {
+		return err
+	}
+	for _, topicID := range topicIDs {
+		if err := GrantEntitlementTx(tx, o.UserID, topicID, EntitlementSourceOrder, o.ID, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SetTopics replaces the topics of the bundle. When the bundle includes future topics, buyers
+// holding a paid order get the added topics; removing a topic never takes it away from them.
+func (b *Bundle) SetTopics(topicIDs []uint) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		before, err := bundleTopicIDs(tx, b.ID)
+		if err != nil {
+			return err
+		}
+		var topics []Topic
+		if len(topicIDs) > 0 {
+			if err := tx.Where("id IN ?", topicIDs).Find(&topics).Error; err != nil {
+				return err
+			}
+		}
+		if err := tx.Model(b).Association("Topics").Replace(topics); err != nil {
+			return err
+		}
+		if !b.IncludeFutureTopics {
+			return nil
+		}
+
+		contained := map[uint]bool{}
+		for _, id := range before {
+			contained[id] = true
+		}
+		var orders []Order
+		err = tx.Where("bundle_id = ? AND status IN ?", b.ID, []OrderStatus{OrderStatusPaid, OrderStatusConfirmed, OrderStatusPartiallyRefunded}).
+			Find(&orders).Error
+		if err != nil {
+			return err
+		}
+		for _, topic := range topics {
+			if contained[topic.ID] {
+				continue
+			}
+			for _, order := range orders {
+				if err := GrantEntitlementTx(tx, order.UserID, topic.ID, EntitlementSourceOrder, order.ID, nil); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+// HasOrders reports whether the bundle was ever ordered
+func (b *Bundle) HasOrders() (bool, error) {
+	var count int64
+	err := db.Model(&Order{}).Where("bundle_id = ?", b.ID).Count(&count).Error
+	return count > 0, err
+}
+
+// FindOpenBundleOrder returns the user's latest created or pending order for the bundle, if any
+func FindOpenBundleOrder(userID uint, bundleID uint) (*Order, error) {
+	return findOpenOrder(db.Where("user_id = ? AND bundle_id = ?", userID, bundleID))
+}
@@ -0,0 +1,52 @@
+package models
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBundleEntitlements(t *testing.T) {
+	SetDB(InitTestDB())
+	db.AutoMigrate(&Experience{}, &Topic{})
+
+	topics := []Topic{{Name: "A"}, {Name: "B"}, {Name: "C"}}
+	db.Create(&topics)
+	fixed := Bundle{Name: "Starter pack", Price: 1990, OnSale: true}
+	growing := Bundle{Name: "All new topics", Price: 2990, OnSale: true, IncludeFutureTopics: true}
+	db.Create(&fixed)
+	db.Create(&growing)
+	assert.NoError(t, fixed.SetTopics([]uint{topics[0].ID, topics[1].ID}))
+	assert.NoError(t, growing.SetTopics([]uint{topics[0].ID}))
+
+	pay := func(userID uint, bundle *Bundle) *Order {
+		order := Order{UserID: userID, BundleID: &bundle.ID, Price: bundle.Price, Status: OrderStatusPending,
+			OrderNo: "OUT_BUNDLE_" + bundle.Name, OutOrderNo: "OUT_BUNDLE_" + bundle.Name}
+		db.Create(&order)
+		assert.NoError(t, order.Transition(OrderStatusPaid, OrderSourceCallback, "", nil))
+		return &order
+	}
+	fixedOrder := pay(1, &fixed)
+	pay(2, &growing)
+
+	owned, err := EntitledTopicIDs(1)
+	assert.NoError(t, err)
+	assert.Equal(t, map[uint]bool{topics[0].ID: true, topics[1].ID: true}, owned)
+
+	// Topics added later reach earlier buyers only when the bundle includes future topics
+	assert.NoError(t, fixed.SetTopics([]uint{topics[0].ID, topics[1].ID, topics[2].ID}))
+	assert.NoError(t, growing.SetTopics([]uint{topics[1].ID, topics[2].ID}))
+	owned, _ = EntitledTopicIDs(1)
+	assert.False(t, owned[topics[2].ID])
+	owned, _ = EntitledTopicIDs(2)
+	assert.Equal(t, map[uint]bool{topics[0].ID: true, topics[1].ID: true, topics[2].ID: true}, owned, "a removed topic stays unlocked")
+
+	// A full refund takes every topic of the bundle away
+	assert.NoError(t, fixedOrder.Transition(OrderStatusRefunded, OrderSourceCallback, "", nil))
+	owned, _ = EntitledTopicIDs(1)
+	assert.Empty(t, owned)
+
+	ordered, err := fixed.HasOrders()
+	assert.NoError(t, err)
+	assert.True(t, ordered)
+}
@@ -0,0 +1,229 @@
+package models
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// CouponType is how a coupon lowers the price
+type CouponType string
+
+const (
+	CouponTypePercentOff CouponType = "percent_off" // Value percent off the price
+	CouponTypeFixedOff   CouponType = "fixed_off"   // Value fen off the price
+	CouponTypeFreeUnlock CouponType = "free_unlock" // the topic is unlocked without paying
+)
+
+// Reasons a coupon cannot be applied
+var (
+	ErrCouponNotFound      = errors.New("coupon not found")
+	ErrCouponNotStarted    = errors.New("coupon is not valid yet")
+	ErrCouponExpired       = errors.New("coupon has expired")
+	ErrCouponExhausted     = errors.New("coupon has been used up")
+	ErrCouponUserLimit     = errors.New("coupon already used the maximum number of times by this user")
+	ErrCouponNotApplicable = errors.New("coupon does not apply to this topic")
+)
+
+// Coupon is a promo code that lowers the price of a topic purchase. Every order created with the
+// coupon counts as one use until it is cancelled, expires or fails.
+type Coupon struct {
+	ID   uint       `gorm:"primaryKey" json:"id"`
+	Code string     `gorm:"type:varchar(64);not null;uniqueIndex" json:"code"` // stored upper case
+	Type CouponType `gorm:"type:varchar(20);not null" json:"type"`
+	// percent for percent_off, fen for fixed_off, unused for free_unlock
+	Value          int        `gorm:"not null;default:0" json:"value"`
+	TopicID        *uint      `gorm:"index" json:"topic_id"`                       // nil applies to every topic
+	MaxUses        int        `gorm:"not null;default:0" json:"max_uses"`          // 0 means unlimited
+	MaxUsesPerUser int        `gorm:"not null;default:0" json:"max_uses_per_user"` // 0 means unlimited
+	UsedCount      int        `gorm:"not null;default:0" json:"used_count"`
+	StartsAt       *time.Time `json:"starts_at"`
+	EndsAt         *time.Time `json:"ends_at"`
+	CreatedAt      time.Time  `gorm:"autoCreateTime" json:"created_at"`
+	UpdatedAt      time.Time  `gorm:"autoUpdateTime" json:"updated_at"`
+}
+
+// TableName specifies the table name for the Coupon model
+func (Coupon) TableName() string {
+	return "coupons"
+}
+
+// NormalizeCouponCode makes codes case-insensitive
+func NormalizeCouponCode(code string) string {
+	return strings.ToUpper(strings.TrimSpace(code))
+}
+
+// Validate reports a coupon definition that cannot be applied to any price
+func (c *Coupon) Validate() error {
+	if c.Code == "" {
+		return errors.New("code is required")
+	}
+	switch c.Type {
+	case CouponTypePercentOff:
+		if c.Value < 1 || c.Value > 100 {
+			return errors.New("percent_off value must be between 1 and 100")
+		}
+	case CouponTypeFixedOff:
+		if c.Value < 1 {
+			return errors.New("fixed_off value must be positive")
+		}
+	case CouponTypeFreeUnlock:
+	default:
+		return errors.New("type must be percent_off, fixed_off or free_unlock")
+	}
+	if c.MaxUses < 0 || c.MaxUsesPerUser < 0 {
+		return errors.New("usage limits must not be negative")
+	}
+	if c.StartsAt != nil && c.EndsAt != nil && !c.EndsAt.After(*c.StartsAt) {
+		return errors.New("ends_at must be after starts_at")
+	}
+	return nil
+}
+
+// Discount returns how much the coupon takes off price, never more than price
+func (c *Coupon) Discount(price int) int {
+	var discount int
+	switch c.Type {
+	case CouponTypePercentOff:
+		discount = price * c.Value / 100
+	case CouponTypeFixedOff:
+		discount = c.Value
+	case CouponTypeFreeUnlock:
+		discount = price
+	}
+	if discount > price {
+		return price
+	}
+	return discount
+}
+
+// Check reports why userID cannot use the coupon for topicID at the given time, or nil if it can
+func (c *Coupon) Check(userID uint, topicID uint, at time.Time) error {
+	if c.StartsAt != nil && at.Before(*c.StartsAt) {
+		return ErrCouponNotStarted
+	}
+	if c.EndsAt != nil && !at.Before(*c.EndsAt) {
+		return ErrCouponExpired
+	}
+	if c.TopicID != nil && *c.TopicID != topicID {
+		return ErrCouponNotApplicable
+	}
+	if c.MaxUses > 0 && c.UsedCount >= c.MaxUses {
+		return ErrCouponExhausted
+	}
+	if c.MaxUsesPerUser > 0 {
+		used, err := countUserCouponUses(db, userID, c.ID)
+		if err != nil {
+			return err
+		}
+		if used >= int64(c.MaxUsesPerUser) {
+			return ErrCouponUserLimit
+		}
+	}
+	return nil
+}
+
+// holdsCoupon reports whether an order in this status counts as a use of its coupon
+func (s OrderStatus) holdsCoupon() bool {
+	return s != OrderStatusCancelled && s != OrderStatusExpired && s != OrderStatusFailed
+}
+
+func countUserCouponUses(tx *gorm.DB, userID uint, couponID uint) (int64, error) {
+	var count int64
+	err := tx.Model(&Order{}).
+		Where("user_id = ? AND coupon_id = ? AND status NOT IN ?", userID, couponID,
+			[]OrderStatus{OrderStatusCancelled, OrderStatusExpired, OrderStatusFailed}).
+		Count(&count).Error
+	return count, err
+}
+
+// redeemCouponTx counts the just created order o as a use of its coupon. The total limit is
+// enforced by the update itself, so concurrent orders cannot overdraw the coupon. The coupon row is
+// locked first, so concurrent orders of one user are counted one after the other and each sees the
+// orders committed before it.
+func redeemCouponTx(tx *gorm.DB, o *Order) error {
+	var coupon Coupon
+	if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&coupon, *o.CouponID).Error; err != nil {
+		return err
+	}
+	result := tx.Model(&Coupon{}).
+		Where("id = ? AND (max_uses = 0 OR used_count < max_uses)", coupon.ID).
+		Update("used_count", gorm.Expr("used_count + 1"))
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrCouponExhausted
+	}
+	if coupon.MaxUsesPerUser > 0 {
+		// the order itself is already saved, so it is one of the uses counted
+		used, err := countUserCouponUses(tx, o.UserID, coupon.ID)
+		if err != nil {
+			return err
+		}
+		if used > int64(coupon.MaxUsesPerUser) {
+			return ErrCouponUserLimit
+		}
+	}
+	return nil
+}
+
+// syncCouponUseTx gives the use back when an order is cancelled, expires or fails, and takes it
+// again when a late payment lands on an expired order
+func (o *Order) syncCouponUseTx(tx *gorm.DB, from OrderStatus) error {
+	if o.CouponID == nil || from.holdsCoupon() == o.Status.holdsCoupon() {
+		return nil
+	}
+	delta := gorm.Expr("used_count + 1")
+	if !o.Status.holdsCoupon() {
+		delta = gorm.Expr("used_count - 1")
+	}
+	return tx.Model(&Coupon{}).Where("id = ?", *o.CouponID).Update("used_count", delta).Error
+}
+
+// FindCouponByCode looks up a coupon by code, ignoring case
+func FindCouponByCode(code string) (*Coupon, error) {
+	var coupon Coupon
+	result := db.Where("code = ?", NormalizeCouponCode(code)).First(&coupon)
+	if result.Error != nil {
+		if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+			return nil, nil
+		}
+		return nil, result.Error
+	}
+	return &coupon, nil
+}
+
+// ApplyCoupon sets the price of a new order from listPrice and the coupon, and records the
+// redemption on it. The use is counted when the order is created.
+func (o *Order) ApplyCoupon(coupon *Coupon, listPrice int) {
+	o.CouponID = &coupon.ID
+	o.CouponCode = coupon.Code
+	o.OriginalPrice = listPrice
+	o.Discount = coupon.Discount(listPrice)
+	o.Price = listPrice - o.Discount
+}
+
+// CreateFree saves an order the coupon covers in full and marks it paid, which unlocks the topic
+// without going through a payment gateway
+func (o *Order) CreateFree() error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		o.Status = OrderStatusCreated
+		o.Gateway = OrderGatewayCoupon
+		if o.OrderNo == "" {
+			o.OrderNo = o.OutOrderNo
+		}
+		if err := tx.Create(o).Error; err != nil {
+			return err
+		}
+		if o.CouponID != nil {
+			if err := redeemCouponTx(tx, o); err != nil {
+				return err
+			}
+		}
+		return o.TransitionTx(tx, OrderStatusPaid, OrderSourceUser, "covered by coupon "+o.CouponCode, nil)
+	})
+}
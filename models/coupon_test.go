@@ -0,0 +1,152 @@
+package models
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"gorm.io/gorm"
+)
+
+func TestCouponDiscount(t *testing.T) {
+	assert.Equal(t, 198, (&Coupon{Type: CouponTypePercentOff, Value: 20}).Discount(990))
+	assert.Equal(t, 300, (&Coupon{Type: CouponTypeFixedOff, Value: 300}).Discount(990))
+	assert.Equal(t, 990, (&Coupon{Type: CouponTypeFixedOff, Value: 5000}).Discount(990))
+	assert.Equal(t, 990, (&Coupon{Type: CouponTypeFreeUnlock}).Discount(990))
+
+	assert.NoError(t, (&Coupon{Code: "SPRING", Type: CouponTypePercentOff, Value: 100}).Validate())
+	assert.Error(t, (&Coupon{Code: "SPRING", Type: CouponTypePercentOff, Value: 101}).Validate())
+	assert.Error(t, (&Coupon{Code: "SPRING", Type: "buy_one_get_one"}).Validate())
+	now := time.Now()
+	assert.Error(t, (&Coupon{Code: "SPRING", Type: CouponTypeFreeUnlock, StartsAt: &now, EndsAt: &now}).Validate())
+}
+
+func TestCouponCheck(t *testing.T) {
+	SetDB(InitTestDB())
+	now := time.Now()
+	yesterday := now.Add(-24 * time.Hour)
+	tomorrow := now.Add(24 * time.Hour)
+	topicID := uint(5)
+
+	assert.ErrorIs(t, (&Coupon{StartsAt: &tomorrow}).Check(1, 5, now), ErrCouponNotStarted)
+	assert.ErrorIs(t, (&Coupon{EndsAt: &yesterday}).Check(1, 5, now), ErrCouponExpired)
+	assert.ErrorIs(t, (&Coupon{TopicID: &topicID}).Check(1, 6, now), ErrCouponNotApplicable)
+	assert.ErrorIs(t, (&Coupon{MaxUses: 2, UsedCount: 2}).Check(1, 5, now), ErrCouponExhausted)
+	assert.NoError(t, (&Coupon{TopicID: &topicID, StartsAt: &yesterday, EndsAt: &tomorrow}).Check(1, 5, now))
+}
+
+func TestCouponUses(t *testing.T) {
+	SetDB(InitTestDB())
+	db.AutoMigrate(&Experience{}, &Topic{})
+
+	coupon := Coupon{Code: "ONCE", Type: CouponTypePercentOff, Value: 50, MaxUses: 2, MaxUsesPerUser: 1}
+	db.Create(&coupon)
+	newOrder := func(userID uint, outOrderNo string) *Order {
+		order := &Order{UserID: userID, OutOrderNo: outOrderNo}
+		order.ApplyCoupon(&coupon, 990)
+		return order
+	}
+	created := func(o *Order) (string, string, error) { return "", "token", nil }
+
+	first := newOrder(1, "OUT_C1")
+	assert.NoError(t, first.CreateWithGatewayOrder(created))
+	assert.Equal(t, 495, first.Price)
+	assert.Equal(t, 495, first.Discount)
+	assert.Equal(t, 990, first.OriginalPrice)
+	assert.Equal(t, "ONCE", first.CouponCode)
+
+	// The same user cannot use it twice, and the failed order does not count
+	assert.ErrorIs(t, newOrder(1, "OUT_C2").CreateWithGatewayOrder(created), ErrCouponUserLimit)
+	assert.ErrorIs(t, coupon.Check(1, 5, time.Now()), ErrCouponUserLimit)
+	db.First(&coupon, coupon.ID)
+	assert.Equal(t, 1, coupon.UsedCount)
+
+	assert.NoError(t, newOrder(2, "OUT_C3").CreateWithGatewayOrder(created))
+	assert.ErrorIs(t, newOrder(3, "OUT_C4").CreateWithGatewayOrder(created), ErrCouponExhausted)
+
+	// An order that expires unpaid gives its use back, a late payment takes it again
+	assert.NoError(t, first.Transition(OrderStatusExpired, OrderSourceReconciler, "", nil))
+	db.First(&coupon, coupon.ID)
+	assert.Equal(t, 1, coupon.UsedCount)
+	assert.NoError(t, coupon.Check(1, 5, time.Now()))
+	assert.NoError(t, first.Transition(OrderStatusPaid, OrderSourceCallback, "", nil))
+	db.First(&coupon, coupon.ID)
+	assert.Equal(t, 2, coupon.UsedCount)
+}
+
+func TestRedeemCouponLocksCoupon(t *testing.T) {
+	SetDB(InitTestDB())
+
+	coupon := Coupon{Code: "LOCKED", Type: CouponTypeFixedOff, Value: 100, MaxUsesPerUser: 1}
+	db.Create(&coupon)
+
+	// SQLite has no row locks, so check that the coupon is read with FOR UPDATE before the count
+	var locked []string
+	db.Callback().Query().Before("gorm:query").Register("test:record_locking", func(tx *gorm.DB) {
+		if _, ok := tx.Statement.Clauses["FOR"]; ok {
+			locked = append(locked, tx.Statement.Table)
+		}
+	})
+	order := &Order{UserID: 1, OutOrderNo: "OUT_LOCKED"}
+	order.ApplyCoupon(&coupon, 990)
+	assert.NoError(t, order.CreateWithGatewayOrder(func(o *Order) (string, string, error) { return "", "token", nil }))
+	assert.Equal(t, []string{"coupons"}, locked)
+}
+
+func TestCouponOrderGatewayCallOutsideCouponLock(t *testing.T) {
+	SetDB(InitTestDB())
+
+	coupon := Coupon{Code: "CAMPAIGN", Type: CouponTypeFixedOff, Value: 100, MaxUsesPerUser: 1}
+	db.Create(&coupon)
+	newOrder := func(outOrderNo string) *Order {
+		order := &Order{UserID: 1, OutOrderNo: outOrderNo}
+		order.ApplyCoupon(&coupon, 990)
+		return order
+	}
+
+	// The order and its coupon use are committed before the gateway is called
+	var during Coupon
+	var saved int64
+	order := newOrder("OUT_CAMPAIGN_1")
+	err := order.CreateWithGatewayOrder(func(o *Order) (string, string, error) {
+		GetDB().First(&during, coupon.ID)
+		GetDB().Model(&Order{}).Where("out_order_no = ?", o.OutOrderNo).Count(&saved)
+		return "", "", errors.New("gateway down")
+	})
+	assert.Error(t, err)
+	assert.Equal(t, 1, during.UsedCount)
+	assert.Equal(t, int64(1), saved)
+
+	// A failed call removes the order and gives the use back
+	db.First(&coupon, coupon.ID)
+	assert.Equal(t, 0, coupon.UsedCount)
+	db.Model(&Order{}).Where("out_order_no = ?", order.OutOrderNo).Count(&saved)
+	assert.Equal(t, int64(0), saved)
+
+	retry := newOrder("OUT_CAMPAIGN_2")
+	assert.NoError(t, retry.CreateWithGatewayOrder(func(o *Order) (string, string, error) { return "DY_2", "token", nil }))
+	assert.Equal(t, OrderStatusPending, retry.Status)
+	db.First(&coupon, coupon.ID)
+	assert.Equal(t, 1, coupon.UsedCount)
+}
+
+func TestOrderCreateFree(t *testing.T) {
+	SetDB(InitTestDB())
+	db.AutoMigrate(&Experience{}, &Topic{})
+
+	experience := Experience{TopicID: 5, UserID: 1}
+	db.Create(&experience)
+	coupon := Coupon{Code: "FREE", Type: CouponTypeFreeUnlock}
+	db.Create(&coupon)
+
+	order := Order{UserID: 1, ExperienceID: &experience.ID, OutOrderNo: "OUT_FREE"}
+	order.ApplyCoupon(&coupon, 990)
+	assert.Equal(t, 0, order.Price)
+	assert.NoError(t, order.CreateFree())
+	assert.Equal(t, OrderStatusPaid, order.Status)
+	assert.Equal(t, OrderGatewayCoupon, order.Gateway)
+	assert.True(t, experience.IsPaid())
+	db.First(&coupon, coupon.ID)
+	assert.Equal(t, 1, coupon.UsedCount)
+}
@@ -0,0 +1,153 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// EntitlementSource identifies what granted an entitlement
+type EntitlementSource string
+
+const (
+	EntitlementSourceOrder EntitlementSource = "order" // a paid order for the topic
+	EntitlementSourceAdmin EntitlementSource = "admin" // granted by an admin or support
+)
+
+// Entitlement records that a user owns the full results of a topic, optionally until ExpiresAt.
+// Each source (e.g. one order) grants a topic at most once, though a bundle order grants several
+// topics; revoking keeps the row for history.
+type Entitlement struct {
+	ID        uint              `gorm:"primaryKey" json:"id"`
+	UserID    uint              `gorm:"not null;index:idx_entitlement_user_topic" json:"user_id"`
+	TopicID   uint              `gorm:"not null;index:idx_entitlement_user_topic;uniqueIndex:idx_entitlement_source_topic" json:"topic_id"`
+	Source    EntitlementSource `gorm:"type:varchar(20);not null;uniqueIndex:idx_entitlement_source_topic" json:"source"`
+	SourceID  uint              `gorm:"not null;uniqueIndex:idx_entitlement_source_topic" json:"source_id"`
+	ExpiresAt *time.Time        `json:"expires_at"` // nil means it never expires
+	RevokedAt *time.Time        `json:"revoked_at,omitempty"`
+	CreatedAt time.Time         `gorm:"autoCreateTime" json:"created_at"`
+	UpdatedAt time.Time         `gorm:"autoUpdateTime" json:"updated_at"`
+}
+
+// TableName specifies the table name for the Entitlement model
+func (Entitlement) TableName() string {
+	return "entitlements"
+}
+
+// IsActive reports whether the entitlement unlocks its topic at the given time
+func (e *Entitlement) IsActive(at time.Time) bool {
+	return e.RevokedAt == nil && (e.ExpiresAt == nil || e.ExpiresAt.After(at))
+}
+
+// activeEntitlements scopes a query to entitlements that unlock their topic at the given time
+func activeEntitlements(tx *gorm.DB, at time.Time) *gorm.DB {
+	return tx.Where("revoked_at IS NULL AND (expires_at IS NULL OR expires_at > ?)", at)
+}
+
+// GrantEntitlementTx grants userID the topic on behalf of source, or renews the grant the source
+// already made of it (clearing a revocation and replacing the expiry)
+func GrantEntitlementTx(tx *gorm.DB, userID uint, topicID uint, source EntitlementSource, sourceID uint, expiresAt *time.Time) error {
+	entitlement := Entitlement{UserID: userID, TopicID: topicID, Source: source, SourceID: sourceID, ExpiresAt: expiresAt}
+	return tx.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "source"}, {Name: "source_id"}, {Name: "topic_id"}},
+		DoUpdates: clause.Assignments(map[string]interface{}{"user_id": userID, "expires_at": expiresAt, "revoked_at": nil, "updated_at": time.Now()}),
+	}).Create(&entitlement).Error
+}
+
+// RevokeEntitlementTx revokes the entitlements granted by source, if any
+func RevokeEntitlementTx(tx *gorm.DB, source EntitlementSource, sourceID uint) error {
+	return tx.Model(&Entitlement{}).
+		Where("source = ? AND source_id = ? AND revoked_at IS NULL", source, sourceID).
+		Update("revoked_at", time.Now()).Error
+}
+
+// HasTopicEntitlement reports whether the user owns the topic right now
+func HasTopicEntitlement(userID uint, topicID uint) (bool, error) {
+	var count int64
+	err := activeEntitlements(db.Model(&Entitlement{}), time.Now()).
+		Where("user_id = ? AND topic_id = ?", userID, topicID).
+		Count(&count).Error
+	return count > 0, err
+}
+
+// EntitledTopicIDs returns the set of topics the user owns right now
+func EntitledTopicIDs(userID uint) (map[uint]bool, error) {
+	var topicIDs []uint
+	err := activeEntitlements(db.Model(&Entitlement{}), time.Now()).
+		Where("user_id = ?", userID).
+		Distinct().Pluck("topic_id", &topicIDs).Error
+	if err != nil {
+		return nil, err
+	}
+	owned := make(map[uint]bool, len(topicIDs))
+	for _, id := range topicIDs {
+		owned[id] = true
+	}
+	return owned, nil
+}
+
+// FindUserEntitlements returns the user's entitlements, active or not, newest first
+func FindUserEntitlements(userID uint) ([]Entitlement, error) {
+	var entitlements []Entitlement
+	err := db.Where("user_id = ?", userID).Order("id DESC").Find(&entitlements).Error
+	return entitlements, err
+}
+
+// syncAccessTx brings what the order unlocks, a topic, a bundle of topics or a membership period,
+// in line with its status
+func (o *Order) syncAccessTx(tx *gorm.DB) error {
+	switch {
+	case o.IsMembership():
+		return o.syncMembershipTx(tx)
+	case o.BundleID != nil:
+		return o.syncBundleEntitlementsTx(tx)
+	}
+	return o.syncEntitlementTx(tx)
+}
+
+// syncEntitlementTx grants the order's topic while the charge stands and revokes it once the
+// order is fully refunded
+func (o *Order) syncEntitlementTx(tx *gorm.DB) error {
+	if o.IsRefunded() {
+		return RevokeEntitlementTx(tx, EntitlementSourceOrder, o.ID)
+	}
+	if !o.IsSettled() || o.ExperienceID == nil {
+		return nil
+	}
+	var experience Experience
+	if err := tx.Select("id", "topic_id").First(&experience, *o.ExperienceID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			// the payment must still be recorded; there is just no topic to unlock
+			fmt.Println("entitlement skipped: order", o.ID, "experience", *o.ExperienceID, "not found")
+			return nil
+		}
+		return err
+	}
+	return GrantEntitlementTx(tx, o.UserID, experience.TopicID, EntitlementSourceOrder, o.ID, nil)
+}
+
+// SyncEntitlement brings the entitlement of the order in line with its status
+func (o *Order) SyncEntitlement() error {
+	return o.syncEntitlementTx(db)
+}
+
+// BackfillOrderEntitlements grants the entitlements of paid orders that predate entitlements.
+// It is safe to run on every start.
+func BackfillOrderEntitlements() (int, error) {
+	var orders []Order
+	err := db.Where("status IN ? AND experience_id IS NOT NULL", []OrderStatus{OrderStatusPaid, OrderStatusConfirmed, OrderStatusPartiallyRefunded}).
+		Where("id NOT IN (?)", db.Model(&Entitlement{}).Select("source_id").Where("source = ?", EntitlementSourceOrder)).
+		Find(&orders).Error
+	if err != nil {
+		return 0, err
+	}
+	for i := range orders {
+		if err := orders[i].SyncEntitlement(); err != nil {
+			return i, err
+		}
+	}
+	return len(orders), nil
+}
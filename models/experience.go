@@ -19,12 +19,30 @@ type Experience struct {
 	Topic     Topic     `json:"topic"`
 }
 
-// IsPaid returns true if there's an order with status paid or confirmed
+// IsPaid reports whether the user owns the experience's topic or has a running membership.
+// Ownership comes from entitlements, so paying for any attempt at a topic unlocks every attempt;
+// refunded, cancelled, expired and failed orders grant nothing.
 func (e *Experience) IsPaid() bool {
-	if e.Order != nil {
-		return e.Order.Status == OrderStatusPaid || e.Order.Status == OrderStatusConfirmed
+	owned, err := HasTopicEntitlement(e.UserID, e.TopicID)
+	if err != nil {
+		fmt.Println("check entitlement of experience", e.ID, "failed:", err)
+		return false
 	}
-	return false
+	if owned {
+		return true
+	}
+	member, err := HasActiveMembership(e.UserID)
+	if err != nil {
+		fmt.Println("check membership of experience", e.ID, "failed:", err)
+		return false
+	}
+	return member
+}
+
+// LatestOrder is a Preload("Order", ...) scope. An experience can have several orders once
+// earlier ones expire or fail, so only the latest order of each experience is loaded.
+func LatestOrder(db *gorm.DB) *gorm.DB {
+	return db.Where("orders.id = (SELECT MAX(latest.id) FROM orders latest WHERE latest.experience_id = orders.experience_id)")
 }
 
 // Paid returns the paid status as a virtual property for JSON serialization
@@ -99,12 +117,26 @@ type MyExperienceResponse struct {
 
 func ToMyExperienceResponses(experiences []Experience) []MyExperienceResponse {
 	resp := make([]MyExperienceResponse, 0, len(experiences))
+	// look up each user's topics and membership once instead of once per experience
+	owned := map[uint]map[uint]bool{}
+	members := map[uint]bool{}
 	for _, exp := range experiences {
+		topics, ok := owned[exp.UserID]
+		if !ok {
+			var err error
+			if topics, err = EntitledTopicIDs(exp.UserID); err != nil {
+				fmt.Println("load entitlements of user", exp.UserID, "failed:", err)
+			}
+			owned[exp.UserID] = topics
+			if members[exp.UserID], err = HasActiveMembership(exp.UserID); err != nil {
+				fmt.Println("check membership of user", exp.UserID, "failed:", err)
+			}
+		}
 		resp = append(resp, MyExperienceResponse{
 			ID:        exp.ID,
 			TopicID:   exp.TopicID,
 			UserID:    exp.UserID,
-			Paid:      exp.Paid(),
+			Paid:      topics[exp.TopicID] || members[exp.UserID],
 			CreatedAt: exp.CreatedAt,
 			UpdatedAt: exp.UpdatedAt,
 			Replies:   exp.Replies,
@@ -23,7 +23,7 @@ func ExampleExperiencePaidUsage(db *gorm.DB) {
 	// Create an order with "created" status
 	order := Order{
 		UserID:       1,
-		ExperienceID: experience.ID,
+		ExperienceID: &experience.ID,
 		Price:        1000,
 		Status:       OrderStatusCreated,
 		OrderNo:      "ORD001",
@@ -36,18 +36,17 @@ func ExampleExperiencePaidUsage(db *gorm.DB) {
 	db.Preload("Order").First(&exp2, experience.ID)
 	fmt.Printf("Experience paid status (created order): %t\n", exp2.Paid()) // false
 
-	// Update order status to "paid"
-	order.Status = OrderStatusPaid
-	db.Save(&order)
+	// Mark the order paid; the transition grants the user an entitlement to the topic
+	order.Transition(OrderStatusPending, OrderSourceUser, "", nil)
+	order.Transition(OrderStatusPaid, OrderSourceCallback, "", nil)
 
 	// Now experience is paid
 	var exp3 Experience
 	db.Preload("Order").First(&exp3, experience.ID)
 	fmt.Printf("Experience paid status (paid order): %t\n", exp3.Paid()) // true
 
-	// Update order status to "confirmed"
-	order.Status = OrderStatusConfirmed
-	db.Save(&order)
+	// Confirm the order
+	order.Transition(OrderStatusConfirmed, OrderSourceUser, "", nil)
 
 	// Experience is still paid (order status is "confirmed")
 	var exp4 Experience
@@ -60,4 +59,9 @@ func ExampleExperiencePaidUsage(db *gorm.DB) {
 	} else {
 		fmt.Printf("Experience has no order\n")
 	}
+
+	// Any other attempt at the topic is paid as well
+	retake := Experience{TopicID: 1, UserID: 1}
+	db.Create(&retake)
+	fmt.Printf("Retake paid status: %t\n", retake.Paid()) // true
 }
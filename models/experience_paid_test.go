@@ -2,12 +2,14 @@ package models
 
 import (
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
 
 func TestExperiencePaidVirtualProperty(t *testing.T) {
 	db := InitTestDB()
+	SetDB(db)
 
 	// Add models to test database migration
 	db.AutoMigrate(&Order{}, &Experience{}, &Topic{}, &User{})
@@ -33,73 +35,110 @@ func TestExperiencePaidVirtualProperty(t *testing.T) {
 	db.Create(&experience)
 
 	// Test 1: Experience without order should not be paid
-	var exp1 Experience
-	db.Preload("Order").First(&exp1, experience.ID)
-	assert.False(t, exp1.IsPaid())
-	assert.False(t, exp1.Paid())
+	assert.False(t, experience.IsPaid())
+	assert.False(t, experience.Paid())
 
 	// Test 2: Experience with created order should not be paid
 	order := Order{
 		UserID:       user.ID,
-		ExperienceID: experience.ID,
+		ExperienceID: &experience.ID,
 		Price:        1000,
 		Status:       OrderStatusCreated,
 		OrderNo:      "ORD20250624001",
 		OutOrderNo:   "OUT20250624001",
 	}
 	db.Create(&order)
-
-	var exp2 Experience
-	db.Preload("Order").First(&exp2, experience.ID)
-	assert.False(t, exp2.IsPaid())
-	assert.False(t, exp2.Paid())
+	assert.False(t, experience.IsPaid())
 
 	// Test 3: Experience with pending order should not be paid
-	order.Status = OrderStatusPending
-	db.Save(&order)
-
-	var exp3 Experience
-	db.Preload("Order").First(&exp3, experience.ID)
-	assert.False(t, exp3.IsPaid())
-	assert.False(t, exp3.Paid())
+	assert.NoError(t, order.Transition(OrderStatusPending, OrderSourceUser, "", nil))
+	assert.False(t, experience.IsPaid())
 
 	// Test 4: Experience with paid order should be paid
-	order.Status = OrderStatusPaid
-	db.Save(&order)
-
-	var exp4 Experience
-	db.Preload("Order").First(&exp4, experience.ID)
-	assert.True(t, exp4.IsPaid())
-	assert.True(t, exp4.Paid())
+	assert.NoError(t, order.Transition(OrderStatusPaid, OrderSourceCallback, "", nil))
+	assert.True(t, experience.IsPaid())
+	assert.True(t, experience.Paid())
 
 	// Test 5: Experience with confirmed order should be paid
-	order.Status = OrderStatusConfirmed
-	db.Save(&order)
+	assert.NoError(t, order.Transition(OrderStatusConfirmed, OrderSourceUser, "", nil))
+	assert.True(t, experience.IsPaid())
 
-	var exp5 Experience
-	db.Preload("Order").First(&exp5, experience.ID)
-	assert.True(t, exp5.IsPaid())
-	assert.True(t, exp5.Paid())
-
-	// Test 6: Create another experience with confirmed order
-	experience2 := Experience{
+	// Test 6: Another attempt at the paid topic is paid without an order of its own
+	retake := Experience{
 		TopicID: topic.ID,
 		UserID:  user.ID,
 	}
-	db.Create(&experience2)
-
-	confirmedOrder := Order{
-		UserID:       user.ID,
-		ExperienceID: experience2.ID,
-		Price:        1200,
-		Status:       OrderStatusConfirmed,
-		OrderNo:      "ORD20250624002",
-		OutOrderNo:   "OUT20250624002",
+	db.Create(&retake)
+	assert.True(t, retake.IsPaid())
+	resp := ToMyExperienceResponses([]Experience{experience, retake})
+	assert.True(t, resp[0].Paid)
+	assert.True(t, resp[1].Paid)
+
+	// Test 7: Other users and other topics are not unlocked
+	otherTopic := Topic{Name: "Other Topic"}
+	db.Create(&otherTopic)
+	assert.False(t, (&Experience{TopicID: otherTopic.ID, UserID: user.ID}).IsPaid())
+	assert.False(t, (&Experience{TopicID: topic.ID, UserID: user.ID + 1}).IsPaid())
+
+	// Test 8: A partial refund keeps access, a full refund takes it away from every attempt
+	assert.NoError(t, order.Transition(OrderStatusPartiallyRefunded, OrderSourceAdmin, "", nil))
+	assert.True(t, retake.IsPaid())
+	assert.NoError(t, order.Transition(OrderStatusRefunded, OrderSourceCallback, "", nil))
+	assert.False(t, experience.IsPaid())
+	assert.False(t, retake.IsPaid())
+
+	// Test 9: Cancelled, expired and failed orders never unlock the topic
+	for i, status := range []OrderStatus{OrderStatusCancelled, OrderStatusExpired, OrderStatusFailed} {
+		failed := Order{UserID: user.ID, ExperienceID: &retake.ID, Price: 1000, Status: OrderStatusPending,
+			OrderNo: "ORD_FAILED_" + status.String(), OutOrderNo: "OUT_FAILED_" + status.String()}
+		db.Create(&failed)
+		assert.NoError(t, failed.Transition(status, OrderSourceReconciler, "", nil), "case %d", i)
+		assert.False(t, retake.IsPaid(), "status %s should not be paid", status)
 	}
-	db.Create(&confirmedOrder)
+}
+
+func TestEntitlementExpiry(t *testing.T) {
+	SetDB(InitTestDB())
+	db.AutoMigrate(&Experience{}, &Topic{})
+
+	past := time.Now().Add(-time.Hour)
+	future := time.Now().Add(time.Hour)
+	assert.NoError(t, GrantEntitlementTx(db, 1, 10, EntitlementSourceAdmin, 1, &past))
+	assert.NoError(t, GrantEntitlementTx(db, 1, 20, EntitlementSourceAdmin, 2, &future))
+
+	owned, err := EntitledTopicIDs(1)
+	assert.NoError(t, err)
+	assert.Equal(t, map[uint]bool{20: true}, owned)
+
+	// Granting again from the same source renews the entitlement
+	assert.NoError(t, GrantEntitlementTx(db, 1, 10, EntitlementSourceAdmin, 1, nil))
+	ok, err := HasTopicEntitlement(1, 10)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	entitlements, _ := FindUserEntitlements(1)
+	assert.Len(t, entitlements, 2)
+
+	assert.NoError(t, RevokeEntitlementTx(db, EntitlementSourceAdmin, 1))
+	ok, _ = HasTopicEntitlement(1, 10)
+	assert.False(t, ok)
+}
 
-	var exp6 Experience
-	db.Preload("Order").First(&exp6, experience2.ID)
-	assert.True(t, exp6.IsPaid())
-	assert.True(t, exp6.Paid())
+func TestBackfillOrderEntitlements(t *testing.T) {
+	SetDB(InitTestDB())
+	db.AutoMigrate(&Experience{}, &Topic{})
+
+	experience := Experience{TopicID: 5, UserID: 1}
+	db.Create(&experience)
+	// Orders paid before entitlements existed were written without one
+	db.Create(&Order{UserID: 1, ExperienceID: &experience.ID, Price: 990, Status: OrderStatusConfirmed, OrderNo: "N1", OutOrderNo: "OUT_1"})
+	db.Create(&Order{UserID: 1, ExperienceID: &experience.ID, Price: 990, Status: OrderStatusExpired, OrderNo: "N2", OutOrderNo: "OUT_2"})
+
+	n, err := BackfillOrderEntitlements()
+	assert.NoError(t, err)
+	assert.Equal(t, 1, n)
+	assert.True(t, experience.IsPaid())
+
+	n, err = BackfillOrderEntitlements()
+	assert.NoError(t, err)
+	assert.Equal(t, 0, n)
 }
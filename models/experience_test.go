@@ -72,3 +72,31 @@ func TestMarkCheckedAnswers(t *testing.T) {
 	assert.True(t, e.Topic.Questions[1].Answers[0].Checked)  // ID 4
 	assert.False(t, e.Topic.Questions[1].Answers[1].Checked) // ID 5
 }
+
+func TestLatestOrder(t *testing.T) {
+	db := InitTestDB()
+	db.AutoMigrate(&Experience{})
+	SetDB(db)
+
+	first := Experience{TopicID: 1, UserID: 1}
+	second := Experience{TopicID: 2, UserID: 1}
+	db.Create(&first)
+	db.Create(&second)
+	orders := []Order{
+		{UserID: 1, ExperienceID: &first.ID, Status: OrderStatusExpired, OrderNo: "ORD_1", OutOrderNo: "OUT_1"},
+		{UserID: 1, ExperienceID: &second.ID, Status: OrderStatusPaid, OrderNo: "ORD_2", OutOrderNo: "OUT_2"},
+		{UserID: 1, ExperienceID: &first.ID, Status: OrderStatusPending, OrderNo: "ORD_3", OutOrderNo: "OUT_3"},
+	}
+	db.Create(&orders)
+
+	var experiences []Experience
+	err := db.Preload("Order", LatestOrder).Order("id ASC").Find(&experiences).Error
+	assert.NoError(t, err)
+	assert.Len(t, experiences, 2)
+	assert.Equal(t, orders[2].ID, experiences[0].Order.ID)
+	assert.Equal(t, orders[1].ID, experiences[1].Order.ID)
+
+	var experience Experience
+	db.Preload("Order", LatestOrder).First(&experience, first.ID)
+	assert.Equal(t, "OUT_3", experience.Order.OutOrderNo)
+}
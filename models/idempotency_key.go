@@ -0,0 +1,84 @@
+package models
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// IdempotencyKey remembers a request a user sent with an Idempotency-Key header and the response
+// it got, so a retry with the same key replays that response instead of running again.
+type IdempotencyKey struct {
+	ID     uint   `gorm:"primaryKey" json:"id"`
+	UserID uint   `gorm:"not null;uniqueIndex:idx_idempotency_user_key" json:"user_id"`
+	Key    string `gorm:"column:idempotency_key;type:varchar(255);not null;uniqueIndex:idx_idempotency_user_key" json:"key"`
+	// sha256 of the method, path and body the key was first used with
+	RequestHash string `gorm:"type:varchar(64);not null" json:"request_hash"`
+	// 0 while the first request is still running
+	StatusCode   int       `json:"status_code"`
+	ResponseBody string    `gorm:"type:mediumtext" json:"response_body"`
+	ExpiresAt    time.Time `gorm:"index" json:"expires_at"`
+	CreatedAt    time.Time `gorm:"autoCreateTime" json:"created_at"`
+	UpdatedAt    time.Time `gorm:"autoUpdateTime" json:"updated_at"`
+}
+
+// TableName specifies the table name for the IdempotencyKey model
+func (IdempotencyKey) TableName() string {
+	return "idempotency_keys"
+}
+
+// Completed reports whether the response of the first request has been stored
+func (k *IdempotencyKey) Completed() bool {
+	return k.StatusCode != 0
+}
+
+// ReserveIdempotencyKey claims key for userID and requestHash for ttl. It reports true when the
+// caller now owns the key and should run the request; otherwise it returns the key as stored by
+// the request that got there first. Expired keys of the user are dropped first, so they are
+// given out again.
+func ReserveIdempotencyKey(userID uint, key string, requestHash string, ttl time.Duration) (*IdempotencyKey, bool, error) {
+	now := time.Now()
+	if err := db.Where("user_id = ? AND expires_at <= ?", userID, now).Delete(&IdempotencyKey{}).Error; err != nil {
+		return nil, false, err
+	}
+
+	reserved := IdempotencyKey{UserID: userID, Key: key, RequestHash: requestHash, ExpiresAt: now.Add(ttl)}
+	result := db.Clauses(clause.OnConflict{DoNothing: true}).Create(&reserved)
+	if result.Error != nil {
+		return nil, false, result.Error
+	}
+	if result.RowsAffected == 1 {
+		return &reserved, true, nil
+	}
+
+	var existing IdempotencyKey
+	if err := db.Where("user_id = ? AND idempotency_key = ?", userID, key).First(&existing).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			// released between our insert and this read; the client may simply retry
+			return nil, false, nil
+		}
+		return nil, false, err
+	}
+	return &existing, false, nil
+}
+
+// PurgeExpiredIdempotencyKeys drops the keys of all users that expired at or before now. Reserving
+// a key only drops the requesting user's expired keys, so keys of users who never come back are
+// left to this.
+func PurgeExpiredIdempotencyKeys(now time.Time) (int64, error) {
+	result := db.Where("expires_at <= ?", now).Delete(&IdempotencyKey{})
+	return result.RowsAffected, result.Error
+}
+
+// Complete stores the response of the request that reserved the key
+func (k *IdempotencyKey) Complete(statusCode int, body string) error {
+	k.StatusCode = statusCode
+	k.ResponseBody = body
+	return db.Model(k).Updates(map[string]interface{}{"status_code": statusCode, "response_body": body}).Error
+}
+
+// Release gives up a reserved key so the request can be retried with it, e.g. after a server error
+func (k *IdempotencyKey) Release() error {
+	return db.Delete(k).Error
+}
@@ -0,0 +1,80 @@
+package models
+
+import (
+	"errors"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// JobLock is a lease that lets one replica at a time run a background job.
+// It also keeps the outcome of the job's last run so every replica can report it.
+type JobLock struct {
+	Name           string     `gorm:"primaryKey;type:varchar(64)" json:"name"`
+	Owner          string     `gorm:"type:varchar(128)" json:"owner"`
+	LockedUntil    time.Time  `json:"locked_until"`
+	LastStartedAt  *time.Time `json:"last_started_at"`
+	LastFinishedAt *time.Time `json:"last_finished_at"`
+	LastResult     string     `gorm:"type:text" json:"last_result"`
+	LastError      string     `gorm:"type:text" json:"last_error"`
+	UpdatedAt      time.Time  `gorm:"autoUpdateTime" json:"updated_at"`
+}
+
+// TableName specifies the table name for the JobLock model
+func (JobLock) TableName() string {
+	return "job_locks"
+}
+
+// AcquireJobLock takes the lease for name if it is free, expired or already held by owner.
+// It reports whether owner now holds the lease.
+func AcquireJobLock(name string, owner string, ttl time.Duration) (bool, error) {
+	now := time.Now()
+	// Make sure the row exists; losing the insert race to another replica is fine
+	seed := JobLock{Name: name, LockedUntil: now}
+	if err := db.Clauses(clause.OnConflict{DoNothing: true}).Create(&seed).Error; err != nil {
+		return false, err
+	}
+
+	result := db.Model(&JobLock{}).
+		Where("name = ? AND (locked_until <= ? OR owner = ?)", name, now, owner).
+		Updates(map[string]interface{}{
+			"owner":           owner,
+			"locked_until":    now.Add(ttl),
+			"last_started_at": now,
+		})
+	if result.Error != nil {
+		return false, result.Error
+	}
+	return result.RowsAffected == 1, nil
+}
+
+// FinishJobRun records the outcome of a run and releases the lease held by owner
+func FinishJobRun(name string, owner string, result string, runErr error) error {
+	now := time.Now()
+	lastError := ""
+	if runErr != nil {
+		lastError = runErr.Error()
+	}
+	return db.Model(&JobLock{}).
+		Where("name = ? AND owner = ?", name, owner).
+		Updates(map[string]interface{}{
+			"locked_until":     now,
+			"last_finished_at": now,
+			"last_result":      result,
+			"last_error":       lastError,
+		}).Error
+}
+
+// FindJobLock returns the lease and last run of a job, or nil if it never ran
+func FindJobLock(name string) (*JobLock, error) {
+	var lock JobLock
+	result := db.Where("name = ?", name).First(&lock)
+	if result.Error != nil {
+		if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+			return nil, nil // Job never ran
+		}
+		return nil, result.Error
+	}
+	return &lock, nil
+}
@@ -0,0 +1,63 @@
+package models
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestJobLockLease(t *testing.T) {
+	db := InitTestDB()
+	SetDB(db)
+
+	// Job never ran
+	lock, err := FindJobLock("test_job")
+	assert.NoError(t, err)
+	assert.Nil(t, lock)
+
+	// First replica takes the lease
+	acquired, err := AcquireJobLock("test_job", "replica-a", time.Minute)
+	assert.NoError(t, err)
+	assert.True(t, acquired)
+
+	// Second replica is locked out while the lease is live
+	acquired, err = AcquireJobLock("test_job", "replica-b", time.Minute)
+	assert.NoError(t, err)
+	assert.False(t, acquired)
+
+	// Finishing records the run and releases the lease
+	err = FinishJobRun("test_job", "replica-a", `{"checked":1}`, errors.New("boom"))
+	assert.NoError(t, err)
+	lock, err = FindJobLock("test_job")
+	assert.NoError(t, err)
+	assert.Equal(t, `{"checked":1}`, lock.LastResult)
+	assert.Equal(t, "boom", lock.LastError)
+	assert.NotNil(t, lock.LastFinishedAt)
+
+	acquired, err = AcquireJobLock("test_job", "replica-b", time.Minute)
+	assert.NoError(t, err)
+	assert.True(t, acquired)
+
+	// A stale owner cannot record over the new holder's lease
+	err = FinishJobRun("test_job", "replica-a", `{}`, nil)
+	assert.NoError(t, err)
+	lock, _ = FindJobLock("test_job")
+	assert.Equal(t, "replica-b", lock.Owner)
+	assert.True(t, lock.LockedUntil.After(time.Now()))
+}
+
+func TestJobLockExpiredLeaseCanBeTaken(t *testing.T) {
+	db := InitTestDB()
+	SetDB(db)
+
+	// Holder crashed without finishing
+	acquired, err := AcquireJobLock("test_job", "replica-a", -time.Second)
+	assert.NoError(t, err)
+	assert.True(t, acquired)
+
+	acquired, err = AcquireJobLock("test_job", "replica-b", time.Minute)
+	assert.NoError(t, err)
+	assert.True(t, acquired)
+}
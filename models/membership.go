@@ -0,0 +1,127 @@
+package models
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Membership is one paid period of a VIP plan. While a period is running every topic counts as
+// owned. Renewals bought before the current period ends start when it ends, so periods stack.
+type Membership struct {
+	ID        uint       `gorm:"primaryKey" json:"id"`
+	UserID    uint       `gorm:"not null;index" json:"user_id"`
+	PlanCode  string     `gorm:"type:varchar(32);not null" json:"plan_code"`
+	OrderID   uint       `gorm:"not null;uniqueIndex" json:"order_id"`
+	StartsAt  time.Time  `gorm:"not null" json:"starts_at"`
+	EndsAt    time.Time  `gorm:"not null;index" json:"ends_at"`
+	RevokedAt *time.Time `json:"revoked_at,omitempty"` // set when the order is fully refunded
+	CreatedAt time.Time  `gorm:"autoCreateTime" json:"created_at"`
+	UpdatedAt time.Time  `gorm:"autoUpdateTime" json:"updated_at"`
+}
+
+// TableName specifies the table name for the Membership model
+func (Membership) TableName() string {
+	return "memberships"
+}
+
+// IsActive reports whether the period is running at the given time
+func (m *Membership) IsActive(at time.Time) bool {
+	return m.RevokedAt == nil && !m.StartsAt.After(at) && m.EndsAt.After(at)
+}
+
+// activeMemberships scopes a query to periods running at the given time
+func activeMemberships(tx *gorm.DB, at time.Time) *gorm.DB {
+	return tx.Where("revoked_at IS NULL AND starts_at <= ? AND ends_at > ?", at, at)
+}
+
+// syncMembershipTx adds the period a paid membership order buys and revokes it once the order is
+// fully refunded. Later periods keep their dates.
+func (o *Order) syncMembershipTx(tx *gorm.DB) error {
+	now := time.Now()
+	if o.IsRefunded() {
+		return tx.Model(&Membership{}).
+			Where("order_id = ? AND revoked_at IS NULL", o.ID).
+			Update("revoked_at", now).Error
+	}
+	if !o.IsSettled() {
+		return nil
+	}
+
+	var count int64
+	if err := tx.Model(&Membership{}).Where("order_id = ?", o.ID).Count(&count).Error; err != nil {
+		return err
+	}
+	if count > 0 {
+		return nil
+	}
+
+	// A renewal starts when the last running or upcoming period ends, so paying early loses no days
+	startsAt := now
+	var last Membership
+	err := tx.Where("user_id = ? AND revoked_at IS NULL AND ends_at > ?", o.UserID, now).
+		Order("ends_at DESC").Limit(1).Find(&last).Error
+	if err != nil {
+		return err
+	}
+	if last.ID != 0 {
+		startsAt = last.EndsAt
+	}
+	membership := Membership{
+		UserID:   o.UserID,
+		PlanCode: o.PlanCode,
+		OrderID:  o.ID,
+		StartsAt: startsAt,
+		EndsAt:   startsAt.AddDate(0, 0, o.PlanDays),
+	}
+	return tx.Create(&membership).Error
+}
+
+// HasActiveMembership reports whether the user has a running membership period right now
+func HasActiveMembership(userID uint) (bool, error) {
+	var count int64
+	err := activeMemberships(db.Model(&Membership{}), time.Now()).
+		Where("user_id = ?", userID).
+		Count(&count).Error
+	return count > 0, err
+}
+
+// FindCurrentMemberships returns the user's running and upcoming periods, earliest first
+func FindCurrentMemberships(userID uint) ([]Membership, error) {
+	var memberships []Membership
+	err := db.Where("user_id = ? AND revoked_at IS NULL AND ends_at > ?", userID, time.Now()).
+		Order("starts_at ASC").
+		Find(&memberships).Error
+	return memberships, err
+}
+
+// MembershipActiveUntil returns when the membership that is running at the given time ends,
+// following renewals that start right where the previous period ends. It returns nil when no
+// period is running.
+func MembershipActiveUntil(memberships []Membership, at time.Time) *time.Time {
+	var until *time.Time
+	for i := range memberships {
+		m := memberships[i]
+		if m.RevokedAt != nil {
+			continue
+		}
+		if until == nil {
+			if m.IsActive(at) {
+				until = &m.EndsAt
+			}
+			continue
+		}
+		if m.StartsAt.After(*until) {
+			break
+		}
+		if m.EndsAt.After(*until) {
+			until = &m.EndsAt
+		}
+	}
+	return until
+}
+
+// FindOpenMembershipOrder returns the user's latest created or pending order for the plan, if any
+func FindOpenMembershipOrder(userID uint, planCode string) (*Order, error) {
+	return findOpenOrder(db.Where("user_id = ? AND plan_code = ?", userID, planCode))
+}
@@ -0,0 +1,74 @@
+package models
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMembershipRenewal(t *testing.T) {
+	SetDB(InitTestDB())
+	db.AutoMigrate(&Experience{}, &Topic{})
+
+	pay := func(outOrderNo string, days int) *Order {
+		order := Order{UserID: 1, PlanCode: "monthly", PlanDays: days, Price: 1800, Status: OrderStatusPending, OrderNo: outOrderNo, OutOrderNo: outOrderNo}
+		db.Create(&order)
+		_, err := order.MarkPaid("", OrderSourceCallback)
+		assert.NoError(t, err)
+		return &order
+	}
+
+	first := pay("OUT_VIP_1", 31)
+	active, err := HasActiveMembership(1)
+	assert.NoError(t, err)
+	assert.True(t, active)
+	assert.True(t, (&Experience{UserID: 1, TopicID: 99}).IsPaid())
+	assert.False(t, (&Experience{UserID: 2, TopicID: 99}).IsPaid())
+
+	// A renewal paid early starts when the first period ends
+	pay("OUT_VIP_2", 365)
+	memberships, err := FindCurrentMemberships(1)
+	assert.NoError(t, err)
+	assert.Len(t, memberships, 2)
+	assert.Equal(t, memberships[0].EndsAt.Unix(), memberships[1].StartsAt.Unix())
+	until := MembershipActiveUntil(memberships, time.Now())
+	assert.NotNil(t, until)
+	assert.Equal(t, memberships[1].EndsAt.Unix(), until.Unix())
+
+	// Replaying the payment adds no period
+	assert.NoError(t, first.syncMembershipTx(db))
+	memberships, _ = FindCurrentMemberships(1)
+	assert.Len(t, memberships, 2)
+
+	// Refunding the first period leaves the renewal, which has not started yet
+	assert.NoError(t, first.Transition(OrderStatusRefunded, OrderSourceAdmin, "", nil))
+	active, _ = HasActiveMembership(1)
+	assert.False(t, active)
+	memberships, _ = FindCurrentMemberships(1)
+	assert.Len(t, memberships, 1)
+	assert.Nil(t, MembershipActiveUntil(memberships, time.Now()))
+	assert.NotNil(t, MembershipActiveUntil(memberships, memberships[0].StartsAt))
+}
+
+func TestMembershipExpiry(t *testing.T) {
+	SetDB(InitTestDB())
+
+	expired := Membership{UserID: 1, PlanCode: "monthly", OrderID: 100, StartsAt: time.Now().AddDate(0, -2, 0), EndsAt: time.Now().AddDate(0, -1, 0)}
+	db.Create(&expired)
+	active, err := HasActiveMembership(1)
+	assert.NoError(t, err)
+	assert.False(t, active)
+	memberships, _ := FindCurrentMemberships(1)
+	assert.Empty(t, memberships)
+
+	// Renewing after expiry starts a new period now
+	order := Order{UserID: 1, PlanCode: "monthly", PlanDays: 31, Price: 1800, Status: OrderStatusPending, OrderNo: "OUT_VIP_3", OutOrderNo: "OUT_VIP_3"}
+	db.Create(&order)
+	assert.NoError(t, order.Transition(OrderStatusPaid, OrderSourceCallback, "", nil))
+	memberships, _ = FindCurrentMemberships(1)
+	assert.Len(t, memberships, 1)
+	assert.WithinDuration(t, time.Now(), memberships[0].StartsAt, time.Minute)
+	active, _ = HasActiveMembership(1)
+	assert.True(t, active)
+}
@@ -12,12 +12,13 @@ func InitTestDB() *gorm.DB {
 	if err != nil {
 		panic("failed to connect to test database")
 	}
-	database.AutoMigrate(&User{}, &Token{}, &Order{})
+	database.AutoMigrate(&User{}, &Token{}, &Order{}, &OrderStatusHistory{}, &Refund{}, &JobLock{}, &IdempotencyKey{}, &Entitlement{}, &Membership{}, &Coupon{}, &Bundle{}, &OrderSyncTask{}, &BillReconciliation{}, &BillReconciliationItem{}, &RevokedToken{})
 	return database
 }
 
 func SetDB(database *gorm.DB) {
 	db = database
+	resetAuthCache()
 }
 
 func GetDB() *gorm.DB {
@@ -1,6 +1,12 @@
 package models
 
-import "time"
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"gorm.io/gorm"
+)
 
 // OrderStatus represents the status of an order
 type OrderStatus int
@@ -10,8 +16,42 @@ const (
 	OrderStatusPending   OrderStatus = 1 // pending
 	OrderStatusPaid      OrderStatus = 2 // paid
 	OrderStatusConfirmed OrderStatus = 3 // confirmed
+	OrderStatusRefunded  OrderStatus = 4 // refunded
+	OrderStatusCancelled OrderStatus = 5 // cancelled
+	OrderStatusExpired   OrderStatus = 6 // expired
+	OrderStatusFailed    OrderStatus = 7 // failed
+	// partially refunded; the buyer keeps access until the full price is refunded
+	OrderStatusPartiallyRefunded OrderStatus = 8
+)
+
+// Payment gateways an order can be created through
+const (
+	OrderGatewayEcpay   = "ecpay"    // ecpay create_order (担保支付)
+	OrderGatewayTradeV2 = "trade_v2" // trade system v2 tt.requestOrder (交易系统)
+	OrderGatewayFake    = "fake"     // in-process fake gateway for dev and tests
+	OrderGatewayCoupon  = "coupon"   // nothing to pay; a coupon covers the full price
 )
 
+// ErrInvalidOrderTransition is returned when a status change is not in orderTransitions
+var ErrInvalidOrderTransition = errors.New("invalid order status transition")
+
+// ErrOrderStatusChanged is returned when another writer changed the order status first
+var ErrOrderStatusChanged = errors.New("order status changed concurrently")
+
+// orderTransitions lists the statuses each status may move to
+var orderTransitions = map[OrderStatus][]OrderStatus{
+	OrderStatusCreated:           {OrderStatusPending, OrderStatusPaid, OrderStatusCancelled, OrderStatusExpired, OrderStatusFailed},
+	OrderStatusPending:           {OrderStatusPaid, OrderStatusCancelled, OrderStatusExpired, OrderStatusFailed},
+	OrderStatusPaid:              {OrderStatusConfirmed, OrderStatusPartiallyRefunded, OrderStatusRefunded},
+	OrderStatusConfirmed:         {OrderStatusPartiallyRefunded, OrderStatusRefunded},
+	OrderStatusPartiallyRefunded: {OrderStatusRefunded},
+	// A payment can still land after the order was closed locally; the money has been taken, so
+	// accept it rather than have Douyin retry the callback forever
+	OrderStatusCancelled: {OrderStatusPaid},
+	OrderStatusExpired:   {OrderStatusPaid},
+	OrderStatusFailed:    {OrderStatusPaid},
+}
+
 // String returns the string representation of OrderStatus
 func (s OrderStatus) String() string {
 	switch s {
@@ -23,11 +63,51 @@ func (s OrderStatus) String() string {
 		return "paid"
 	case OrderStatusConfirmed:
 		return "confirmed"
+	case OrderStatusRefunded:
+		return "refunded"
+	case OrderStatusCancelled:
+		return "cancelled"
+	case OrderStatusExpired:
+		return "expired"
+	case OrderStatusFailed:
+		return "failed"
+	case OrderStatusPartiallyRefunded:
+		return "partially_refunded"
 	default:
 		return "unknown"
 	}
 }
 
+// ParseOrderStatus looks up an OrderStatus by its string representation
+func ParseOrderStatus(name string) (OrderStatus, bool) {
+	for s := OrderStatusCreated; s <= OrderStatusPartiallyRefunded; s++ {
+		if s.String() == name {
+			return s, true
+		}
+	}
+	return 0, false
+}
+
+// CanTransitionTo reports whether orderTransitions allows moving from s to next
+func (s OrderStatus) CanTransitionTo(next OrderStatus) bool {
+	for _, allowed := range orderTransitions[s] {
+		if allowed == next {
+			return true
+		}
+	}
+	return false
+}
+
+// IsTerminal reports whether no further status change is allowed
+func (s OrderStatus) IsTerminal() bool {
+	return len(orderTransitions[s]) == 0
+}
+
+// grantsAccess reports whether an order in this status unlocks its topic
+func (s OrderStatus) grantsAccess() bool {
+	return s == OrderStatusPaid || s == OrderStatusConfirmed || s == OrderStatusPartiallyRefunded
+}
+
 // MarshalJSON implements json.Marshaler interface
 func (s OrderStatus) MarshalJSON() ([]byte, error) {
 	return []byte(`"` + s.String() + `"`), nil
@@ -35,17 +115,33 @@ func (s OrderStatus) MarshalJSON() ([]byte, error) {
 
 // Order represents an order entity
 type Order struct {
-	ID           uint        `gorm:"primaryKey" json:"id"`
-	UserID       uint        `gorm:"not null" json:"user_id"`
-	ExperienceID uint        `gorm:"not null" json:"experience_id"`
-	Price        int         `json:"price"`
-	Status       OrderStatus `gorm:"type:int;default:0" json:"status"`
-	OrderNo      string      `gorm:"type:varchar(100);uniqueIndex" json:"order_no"`
-	OutOrderNo   string      `gorm:"type:varchar(100)" json:"out_order_no"`
-	CreatedAt    time.Time   `gorm:"autoCreateTime" json:"created_at"`
-	UpdatedAt    time.Time   `gorm:"autoUpdateTime" json:"updated_at"`
-	User         User        `gorm:"foreignKey:UserID;constraint:OnUpdate:CASCADE,OnDelete:CASCADE;" json:"user"`
-	Experience   Experience  `gorm:"foreignKey:ExperienceID;constraint:OnUpdate:CASCADE,OnDelete:CASCADE;" json:"experience"`
+	ID             uint         `gorm:"primaryKey" json:"id"`
+	UserID         uint         `gorm:"not null" json:"user_id"`
+	ExperienceID   *uint        `gorm:"index" json:"experience_id"`                         // nil for membership and bundle orders
+	BundleID       *uint        `gorm:"index" json:"bundle_id,omitempty"`                   // bundle of topics the order buys
+	PlanCode       string       `gorm:"type:varchar(32)" json:"plan_code,omitempty"`        // membership plan the order buys
+	PlanDays       int          `gorm:"not null;default:0" json:"plan_days,omitempty"`      // days the plan adds, copied from config when ordered
+	Price          int          `json:"price"`                                              // amount charged, after any coupon
+	OriginalPrice  int          `gorm:"not null;default:0" json:"original_price,omitempty"` // list price when a coupon was applied
+	Discount       int          `gorm:"not null;default:0" json:"discount,omitempty"`
+	CouponID       *uint        `gorm:"index" json:"coupon_id,omitempty"`
+	CouponCode     string       `gorm:"type:varchar(64)" json:"coupon_code,omitempty"`
+	Status         OrderStatus  `gorm:"type:int;default:0" json:"status"`
+	Gateway        string       `gorm:"type:varchar(20);not null;default:'ecpay'" json:"gateway"`
+	OrderNo        string       `gorm:"type:varchar(100);uniqueIndex" json:"order_no"`
+	OutOrderNo     string       `gorm:"type:varchar(100);index" json:"out_order_no"`
+	OrderToken     string       `gorm:"type:varchar(1000)" json:"order_token"`
+	RefundedAmount int          `gorm:"not null;default:0" json:"refunded_amount"`
+	SettleStatus   SettleStatus `gorm:"type:int;not null;default:0" json:"settle_status"`
+	OutSettleNo    string       `gorm:"type:varchar(100);index" json:"out_settle_no,omitempty"`
+	SettleNo       string       `gorm:"type:varchar(100)" json:"settle_no,omitempty"`
+	SettledAt      *time.Time   `json:"settled_at,omitempty"`
+	CheckedAt      *time.Time   `gorm:"index" json:"-"` // when the reconciler last asked the gateway about the open order
+	CreatedAt      time.Time    `gorm:"autoCreateTime" json:"created_at"`
+	UpdatedAt      time.Time    `gorm:"autoUpdateTime" json:"updated_at"`
+	User           User         `gorm:"foreignKey:UserID;constraint:OnUpdate:CASCADE,OnDelete:CASCADE;" json:"user"`
+	Experience     Experience   `gorm:"foreignKey:ExperienceID;constraint:OnUpdate:CASCADE,OnDelete:CASCADE;" json:"experience"`
+	Refunds        []Refund     `gorm:"foreignKey:OrderID;constraint:OnUpdate:CASCADE,OnDelete:CASCADE;" json:"refunds,omitempty"`
 }
 
 // TableName specifies the table name for the Order model
@@ -73,7 +169,293 @@ func (o *Order) IsConfirmed() bool {
 	return o.Status == OrderStatusConfirmed
 }
 
-// SetStatus updates the order status
-func (o *Order) SetStatus(status OrderStatus) {
+// IsRefunded checks if the order status is refunded
+func (o *Order) IsRefunded() bool {
+	return o.Status == OrderStatusRefunded
+}
+
+// IsCancelled checks if the order status is cancelled
+func (o *Order) IsCancelled() bool {
+	return o.Status == OrderStatusCancelled
+}
+
+// IsExpired checks if the order status is expired
+func (o *Order) IsExpired() bool {
+	return o.Status == OrderStatusExpired
+}
+
+// IsFailed checks if the order status is failed
+func (o *Order) IsFailed() bool {
+	return o.Status == OrderStatusFailed
+}
+
+// IsPartiallyRefunded checks if the order status is partially refunded
+func (o *Order) IsPartiallyRefunded() bool {
+	return o.Status == OrderStatusPartiallyRefunded
+}
+
+// IsSettled checks if the buyer has been charged and the charge still stands
+// (paid, confirmed or only partially refunded)
+func (o *Order) IsSettled() bool {
+	return o.IsPaid() || o.IsConfirmed() || o.IsPartiallyRefunded()
+}
+
+// RefundableAmount is the part of the price not yet refunded or held by a pending refund
+func (o *Order) RefundableAmount() (int, error) {
+	return o.refundableAmountTx(db)
+}
+
+func (o *Order) refundableAmountTx(tx *gorm.DB) (int, error) {
+	var pending int64
+	err := tx.Model(&Refund{}).
+		Where("order_id = ? AND status = ?", o.ID, RefundStatusPending).
+		Select("COALESCE(SUM(amount), 0)").
+		Scan(&pending).Error
+	if err != nil {
+		return 0, err
+	}
+	return o.Price - o.RefundedAmount - int(pending), nil
+}
+
+// IsMembership reports whether the order buys a membership plan rather than a topic
+func (o *Order) IsMembership() bool {
+	return o.PlanCode != ""
+}
+
+// IsOpen checks if the order is still waiting for payment
+func (o *Order) IsOpen() bool {
+	return o.IsCreated() || o.IsPending()
+}
+
+// SetStatus updates the in-memory order status if the transition is allowed.
+// Use Transition to persist the change together with its history.
+func (o *Order) SetStatus(status OrderStatus) error {
+	if !o.Status.CanTransitionTo(status) {
+		return fmt.Errorf("%w: %s -> %s", ErrInvalidOrderTransition, o.Status, status)
+	}
 	o.Status = status
+	return nil
+}
+
+// Transition persists a status change and records it in order_status_histories.
+// Extra column updates (e.g. order_no) are applied in the same statement.
+func (o *Order) Transition(status OrderStatus, source OrderStatusSource, note string, updates map[string]interface{}) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		return o.TransitionTx(tx, status, source, note, updates)
+	})
+}
+
+// TransitionTx is Transition within a caller-owned transaction. It also grants or revokes the
+// topic entitlement or membership period the order pays for, gives back the coupon use of an
+// order that ends unpaid and queues the push of the new status to the Douyin order center.
+func (o *Order) TransitionTx(tx *gorm.DB, status OrderStatus, source OrderStatusSource, note string, updates map[string]interface{}) error {
+	from := o.Status
+	if !from.CanTransitionTo(status) {
+		return fmt.Errorf("%w: %s -> %s", ErrInvalidOrderTransition, from, status)
+	}
+
+	columns := map[string]interface{}{"status": status}
+	for k, v := range updates {
+		columns[k] = v
+	}
+	// Guard on the status we read so concurrent writers cannot both apply a transition
+	result := tx.Model(&Order{}).Where("id = ? AND status = ?", o.ID, from).Updates(columns)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrOrderStatusChanged
+	}
+
+	history := OrderStatusHistory{
+		OrderID:    o.ID,
+		FromStatus: from,
+		ToStatus:   status,
+		Source:     source,
+		Note:       note,
+	}
+	if err := tx.Create(&history).Error; err != nil {
+		return err
+	}
+
+	o.Status = status
+	if err := o.syncCouponUseTx(tx, from); err != nil {
+		return err
+	}
+	if from.grantsAccess() != status.grantsAccess() {
+		if err := o.syncAccessTx(tx); err != nil {
+			return err
+		}
+	}
+	return o.queueOrderSyncTx(tx)
+}
+
+// CreateWithGatewayOrder saves the order as created, asks the payment gateway to create its side of
+// the order and stores the returned order id and token as pending. A failed gateway call removes the
+// local order again.
+//
+// An order without a coupon does all of this in one transaction. An order with a coupon is saved
+// together with its coupon use first and the gateway is called after that commits, so the coupon row
+// is only locked while the use is counted; a failed call then deletes the order and gives the use back.
+func (o *Order) CreateWithGatewayOrder(createGatewayOrder func(o *Order) (orderID string, orderToken string, err error)) error {
+	if o.CouponID == nil {
+		return db.Transaction(func(tx *gorm.DB) error {
+			if err := o.createTx(tx); err != nil {
+				return err
+			}
+			return o.startGatewayOrderTx(tx, createGatewayOrder)
+		})
+	}
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := o.createTx(tx); err != nil {
+			return err
+		}
+		return redeemCouponTx(tx, o)
+	})
+	if err != nil {
+		return err
+	}
+	orderID, orderToken, err := createGatewayOrder(o)
+	if err != nil {
+		// An order left behind, e.g. by a crash, is expired by the reconciler, which also gives the use back
+		if undoErr := o.deleteUnstarted(); undoErr != nil {
+			fmt.Println("remove order", o.OutOrderNo, "after failed gateway call failed:", undoErr)
+		}
+		return err
+	}
+	return db.Transaction(func(tx *gorm.DB) error {
+		return o.markPendingTx(tx, orderID, orderToken)
+	})
+}
+
+// createTx saves the order as created
+func (o *Order) createTx(tx *gorm.DB) error {
+	o.Status = OrderStatusCreated
+	if o.Gateway == "" {
+		o.Gateway = OrderGatewayEcpay
+	}
+	if o.OrderNo == "" {
+		// order_no is unique, so it holds out_order_no until the gateway assigns its own id
+		o.OrderNo = o.OutOrderNo
+	}
+	return tx.Create(o).Error
+}
+
+// startGatewayOrderTx asks the payment gateway to create its side of the saved order and moves the
+// order to pending with the returned order id and token
+func (o *Order) startGatewayOrderTx(tx *gorm.DB, createGatewayOrder func(o *Order) (orderID string, orderToken string, err error)) error {
+	orderID, orderToken, err := createGatewayOrder(o)
+	if err != nil {
+		return err
+	}
+	return o.markPendingTx(tx, orderID, orderToken)
+}
+
+// markPendingTx moves the order to pending with the order id and token returned by the gateway
+func (o *Order) markPendingTx(tx *gorm.DB, orderID, orderToken string) error {
+	updates := map[string]interface{}{"order_token": orderToken}
+	if orderID != "" {
+		updates["order_no"] = orderID
+	}
+	if err := o.TransitionTx(tx, OrderStatusPending, OrderSourceUser, "", updates); err != nil {
+		return err
+	}
+	if orderID != "" {
+		o.OrderNo = orderID
+	}
+	o.OrderToken = orderToken
+	return nil
+}
+
+// deleteUnstarted removes an order the gateway never created and gives its coupon use back
+func (o *Order) deleteUnstarted() error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		result := tx.Where("id = ? AND status = ?", o.ID, OrderStatusCreated).Delete(&Order{})
+		if result.Error != nil || result.RowsAffected == 0 {
+			return result.Error
+		}
+		if o.CouponID == nil {
+			return nil
+		}
+		return tx.Model(&Coupon{}).Where("id = ?", *o.CouponID).Update("used_count", gorm.Expr("used_count - 1")).Error
+	})
+}
+
+// FindOrderByOutOrderNo looks up an order by the merchant order number sent to the payment gateway
+func FindOrderByOutOrderNo(outOrderNo string) (*Order, error) {
+	var order Order
+	result := db.Where("out_order_no = ?", outOrderNo).First(&order)
+	if result.Error != nil {
+		if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+			return nil, nil // Order not found
+		}
+		return nil, result.Error
+	}
+	return &order, nil
+}
+
+// FindOpenOrders returns created or pending orders created before the given time, least recently
+// checked first, so orders that keep failing to reconcile cannot starve the others
+func FindOpenOrders(createdBefore time.Time, limit int) ([]Order, error) {
+	var orders []Order
+	err := db.Where("status IN ? AND created_at < ?", []OrderStatus{OrderStatusCreated, OrderStatusPending}, createdBefore).
+		Order("COALESCE(checked_at, created_at) ASC, id ASC").
+		Limit(limit).
+		Find(&orders).Error
+	return orders, err
+}
+
+// MarkOrdersChecked records that the reconciler asked the gateway about the orders at the given time
+func MarkOrdersChecked(ids []uint, at time.Time) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	return db.Model(&Order{}).Where("id IN ?", ids).UpdateColumn("checked_at", at).Error
+}
+
+// findOpenOrder returns the latest created or pending order matching query, if any
+func findOpenOrder(query *gorm.DB) (*Order, error) {
+	var orders []Order
+	err := query.Where("status IN ?", []OrderStatus{OrderStatusCreated, OrderStatusPending}).
+		Order("id DESC").Limit(1).
+		Find(&orders).Error
+	if err != nil || len(orders) == 0 {
+		return nil, err
+	}
+	return &orders[0], nil
+}
+
+// MarkPaid moves an open (or locally closed) order to paid and records the gateway order number.
+// It returns false without an error when the order is already paid, confirmed or refunded, so
+// repeated notifications for the same payment leave the order untouched.
+func (o *Order) MarkPaid(orderNo string, source OrderStatusSource) (bool, error) {
+	if o.IsSettled() || o.IsRefunded() {
+		return false, nil
+	}
+	updates := map[string]interface{}{}
+	if orderNo != "" {
+		updates["order_no"] = orderNo
+	}
+	err := o.Transition(OrderStatusPaid, source, "", updates)
+	if errors.Is(err, ErrOrderStatusChanged) {
+		// Someone else moved the order first; it is only a replay if they marked it paid
+		var current Order
+		if err := db.First(&current, o.ID).Error; err != nil {
+			return false, err
+		}
+		o.Status = current.Status
+		o.OrderNo = current.OrderNo
+		if current.IsSettled() || current.IsRefunded() {
+			return false, nil
+		}
+		return false, err
+	}
+	if err != nil {
+		return false, err
+	}
+	if orderNo != "" {
+		o.OrderNo = orderNo
+	}
+	return true, nil
 }
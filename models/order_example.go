@@ -8,9 +8,10 @@ import (
 // Example function to demonstrate the integer-based enum usage
 func ExampleOrderStatusUsage() {
 	// Create an order with integer-based status
+	experienceID := uint(1)
 	order := Order{
 		UserID:       1,
-		ExperienceID: 1,
+		ExperienceID: &experienceID,
 		Price:        1000,
 		Status:       OrderStatusCreated, // This is stored as integer 0 in database
 		OrderNo:      "ORD20250624001",   // Internal order number (unique)
@@ -25,8 +26,10 @@ func ExampleOrderStatusUsage() {
 		fmt.Println("Order is in created state")
 	}
 
-	// Update status
-	order.SetStatus(OrderStatusPaid)
+	// Update status; illegal transitions such as refunded -> paid are rejected
+	if err := order.SetStatus(OrderStatusPaid); err != nil {
+		fmt.Println("Status change rejected:", err)
+	}
 	fmt.Printf("Updated status: %s\n", order.Status.String()) // Output: "paid"
 
 	// JSON marshaling will show the string representation
@@ -0,0 +1,161 @@
+package models
+
+import (
+	"fmt"
+	"learning-api/config"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// OrderResponse is an order as its buyer sees it in the order history
+type OrderResponse struct {
+	ID             uint             `json:"id"`
+	OutOrderNo     string           `json:"out_order_no"`
+	Title          string           `json:"title"` // topic name, bundle name or membership plan name
+	ExperienceID   *uint            `json:"experience_id"`
+	TopicID        uint             `json:"topic_id,omitempty"`
+	BundleID       *uint            `json:"bundle_id,omitempty"`
+	PlanCode       string           `json:"plan_code,omitempty"`
+	Price          int              `json:"price"`
+	OriginalPrice  int              `json:"original_price,omitempty"`
+	Discount       int              `json:"discount,omitempty"`
+	CouponCode     string           `json:"coupon_code,omitempty"`
+	Status         string           `json:"status"`
+	Gateway        string           `json:"gateway"`
+	RefundedAmount int              `json:"refunded_amount"`
+	Refunds        []RefundResponse `json:"refunds"`
+	CreatedAt      time.Time        `json:"created_at"`
+	UpdatedAt      time.Time        `json:"updated_at"`
+}
+
+// RefundResponse is a refund as the buyer sees it; who issued it stays internal
+type RefundResponse struct {
+	ID          uint         `json:"id"`
+	OrderID     uint         `json:"order_id"`
+	OutRefundNo string       `json:"out_refund_no"`
+	RefundNo    string       `json:"refund_no"`
+	Amount      int          `json:"amount"`
+	Reason      string       `json:"reason"`
+	Status      RefundStatus `json:"status"`
+	CreatedAt   time.Time    `json:"created_at"`
+	UpdatedAt   time.Time    `json:"updated_at"`
+}
+
+// toRefundResponses converts the refunds of an order for its buyer
+func toRefundResponses(refunds []Refund) []RefundResponse {
+	resp := make([]RefundResponse, 0, len(refunds))
+	for _, r := range refunds {
+		resp = append(resp, RefundResponse{
+			ID:          r.ID,
+			OrderID:     r.OrderID,
+			OutRefundNo: r.OutRefundNo,
+			RefundNo:    r.RefundNo,
+			Amount:      r.Amount,
+			Reason:      r.Reason,
+			Status:      r.Status,
+			CreatedAt:   r.CreatedAt,
+			UpdatedAt:   r.UpdatedAt,
+		})
+	}
+	return resp
+}
+
+// orderHistoryQuery loads what an OrderResponse shows besides the order itself
+func orderHistoryQuery() *gorm.DB {
+	return db.Preload("Experience.Topic").Preload("Refunds", func(tx *gorm.DB) *gorm.DB {
+		return tx.Order("id ASC")
+	})
+}
+
+// FindUserOrders returns a page of the user's orders, newest first, with the total count. An
+// empty statuses matches every status.
+func FindUserOrders(userID uint, statuses []OrderStatus, offset, limit int) ([]Order, int64, error) {
+	filter := func(tx *gorm.DB) *gorm.DB {
+		tx = tx.Where("user_id = ?", userID)
+		if len(statuses) > 0 {
+			tx = tx.Where("status IN ?", statuses)
+		}
+		return tx
+	}
+	var total int64
+	if err := db.Model(&Order{}).Scopes(filter).Count(&total).Error; err != nil {
+		return nil, 0, err
+	}
+
+	var orders []Order
+	err := orderHistoryQuery().Scopes(filter).
+		Order("id DESC").Offset(offset).Limit(limit).
+		Find(&orders).Error
+	return orders, total, err
+}
+
+// FindOrderForHistory loads an order with what its OrderResponse shows. It returns nil when the
+// order does not exist.
+func FindOrderForHistory(id uint) (*Order, error) {
+	var orders []Order
+	if err := orderHistoryQuery().Where("id = ?", id).Limit(1).Find(&orders).Error; err != nil {
+		return nil, err
+	}
+	if len(orders) == 0 {
+		return nil, nil
+	}
+	return &orders[0], nil
+}
+
+// ToOrderResponses builds the order history entries of the given orders
+func ToOrderResponses(orders []Order) []OrderResponse {
+	// look up the bundle names in one query instead of once per order
+	bundleNames := map[uint]string{}
+	var bundleIDs []uint
+	for _, order := range orders {
+		if order.BundleID != nil {
+			bundleIDs = append(bundleIDs, *order.BundleID)
+		}
+	}
+	if len(bundleIDs) > 0 {
+		var bundles []Bundle
+		if err := db.Select("id", "name").Where("id IN ?", bundleIDs).Find(&bundles).Error; err != nil {
+			fmt.Println("load bundle names failed:", err)
+		}
+		for _, bundle := range bundles {
+			bundleNames[bundle.ID] = bundle.Name
+		}
+	}
+	cfg := config.LoadConfig()
+
+	resp := make([]OrderResponse, 0, len(orders))
+	for _, order := range orders {
+		entry := OrderResponse{
+			ID:             order.ID,
+			OutOrderNo:     order.OutOrderNo,
+			ExperienceID:   order.ExperienceID,
+			BundleID:       order.BundleID,
+			PlanCode:       order.PlanCode,
+			Price:          order.Price,
+			OriginalPrice:  order.OriginalPrice,
+			Discount:       order.Discount,
+			CouponCode:     order.CouponCode,
+			Status:         order.Status.String(),
+			Gateway:        order.Gateway,
+			RefundedAmount: order.RefundedAmount,
+			Refunds:        toRefundResponses(order.Refunds),
+			CreatedAt:      order.CreatedAt,
+			UpdatedAt:      order.UpdatedAt,
+		}
+		switch {
+		case order.BundleID != nil:
+			entry.Title = bundleNames[*order.BundleID]
+		case order.IsMembership():
+			entry.Title = order.PlanCode
+			if plan, ok := cfg.MembershipPlan(order.PlanCode); ok {
+				entry.Title = plan.Name
+			}
+		default:
+			entry.TopicID = order.Experience.TopicID
+			entry.Title = order.Experience.Topic.Name
+		}
+		resp = append(resp, entry)
+	}
+	return resp
+}
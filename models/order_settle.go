@@ -0,0 +1,200 @@
+package models
+
+import (
+	"errors"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// SettleStatus represents the ecpay settle (分账) status of an order
+type SettleStatus int
+
+const (
+	SettleStatusNone      SettleStatus = 0 // not settled yet
+	SettleStatusPending   SettleStatus = 1 // sent to the gateway, waiting for the settle callback
+	SettleStatusSucceeded SettleStatus = 2 // succeeded
+	SettleStatusFailed    SettleStatus = 3 // failed
+)
+
+// String returns the string representation of SettleStatus
+func (s SettleStatus) String() string {
+	switch s {
+	case SettleStatusNone:
+		return "none"
+	case SettleStatusPending:
+		return "pending"
+	case SettleStatusSucceeded:
+		return "succeeded"
+	case SettleStatusFailed:
+		return "failed"
+	default:
+		return "unknown"
+	}
+}
+
+// MarshalJSON implements json.Marshaler interface
+func (s SettleStatus) MarshalJSON() ([]byte, error) {
+	return []byte(`"` + s.String() + `"`), nil
+}
+
+// ConfirmDelivery moves a paid order to confirmed once the buyer has what it paid for: the results of
+// an experience, or the topics or membership period a bundle or plan unlocks on payment.
+// It returns false when the order is not paid or another request confirmed it first.
+func (o *Order) ConfirmDelivery(source OrderStatusSource) (bool, error) {
+	if !o.IsPaid() {
+		return false, nil
+	}
+	note := "results delivered"
+	if o.ExperienceID == nil {
+		note = "unlocked on payment"
+	}
+	err := o.Transition(OrderStatusConfirmed, source, note, nil)
+	if errors.Is(err, ErrOrderStatusChanged) {
+		return false, db.First(o, o.ID).Error
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// settleDue reports whether the settle of a confirmed order may be started: it never started, or
+// its last attempt failed or never reached the gateway, and was made before retryBefore
+func (o *Order) settleDue(retryBefore time.Time) bool {
+	if !o.IsConfirmed() {
+		return false
+	}
+	switch o.SettleStatus {
+	case SettleStatusNone:
+		return true
+	case SettleStatusFailed:
+		return o.UpdatedAt.Before(retryBefore)
+	case SettleStatusPending:
+		return o.SettleNo == "" && o.UpdatedAt.Before(retryBefore)
+	default:
+		return false
+	}
+}
+
+// Settle marks a confirmed order as settling and commits that before asking the payment gateway to
+// settle it, so no row lock is held during the call. out_settle_no is derived from the order, so a
+// retry after a lost gateway response cannot settle twice. A settle the gateway rejected is put back
+// as it was and started again by a later run; a failed one is retried once its last attempt is older
+// than retryBefore. It returns false when the settle is not due or another run started it first.
+func (o *Order) Settle(retryBefore time.Time, settleGatewayOrder func(o *Order) (settleNo string, err error)) (bool, error) {
+	if !o.settleDue(retryBefore) {
+		return false, nil
+	}
+	from := o.SettleStatus
+	outSettleNo := "S" + o.OutOrderNo
+
+	// Claim the settle; the claim moves updated_at on, so a second run cannot claim a retry again
+	claim := db.Model(&Order{}).Where("id = ? AND status = ? AND settle_status = ?", o.ID, OrderStatusConfirmed, from)
+	if from != SettleStatusNone {
+		claim = claim.Where("updated_at < ?", retryBefore)
+	}
+	if from == SettleStatusPending {
+		claim = claim.Where("settle_no = ?", "")
+	}
+	result := claim.Updates(map[string]interface{}{"settle_status": SettleStatusPending, "out_settle_no": outSettleNo})
+	if result.Error != nil {
+		return false, result.Error
+	}
+	if result.RowsAffected == 0 {
+		return false, nil // Another run started the settle
+	}
+	o.SettleStatus = SettleStatusPending
+	o.OutSettleNo = outSettleNo
+
+	settleNo, err := settleGatewayOrder(o)
+	if err != nil {
+		// Put the settle back unless a callback already completed it
+		release := map[string]interface{}{"settle_status": from}
+		if from == SettleStatusNone {
+			release["out_settle_no"] = ""
+		}
+		if releaseErr := db.Model(&Order{}).
+			Where("id = ? AND settle_status = ? AND settle_no = ?", o.ID, SettleStatusPending, "").
+			Updates(release).Error; releaseErr != nil {
+			return false, releaseErr
+		}
+		o.SettleStatus = from
+		if from == SettleStatusNone {
+			o.OutSettleNo = ""
+		}
+		return false, err
+	}
+
+	if err := db.Model(&Order{}).Where("id = ?", o.ID).UpdateColumn("settle_no", settleNo).Error; err != nil {
+		return false, err
+	}
+	o.SettleNo = settleNo
+	return true, nil
+}
+
+// CompleteSettle applies the result of a settle callback.
+// It returns false when the settle was already completed, e.g. for a replayed callback.
+func (o *Order) CompleteSettle(succeeded bool) (bool, error) {
+	next := SettleStatusFailed
+	updates := map[string]interface{}{}
+	var settledAt *time.Time
+	if succeeded {
+		next = SettleStatusSucceeded
+		now := time.Now()
+		settledAt = &now
+		updates["settled_at"] = now
+	}
+	updates["settle_status"] = next
+
+	result := db.Model(&Order{}).
+		Where("id = ? AND settle_status = ?", o.ID, SettleStatusPending).
+		Updates(updates)
+	if result.Error != nil {
+		return false, result.Error
+	}
+	if result.RowsAffected == 0 {
+		return false, nil
+	}
+	o.SettleStatus = next
+	o.SettledAt = settledAt
+	return true, nil
+}
+
+// FindOrderByOutSettleNo finds the order a settle callback refers to
+func FindOrderByOutSettleNo(outSettleNo string) (*Order, error) {
+	var order Order
+	result := db.Where("out_settle_no = ?", outSettleNo).First(&order)
+	if result.Error != nil {
+		if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+			return nil, nil // Order not found
+		}
+		return nil, result.Error
+	}
+	return &order, nil
+}
+
+// FindUnsettledOrders returns confirmed ecpay orders whose settle is due, oldest first: never
+// started, or last attempted before retryBefore and failed or lost before reaching the gateway
+func FindUnsettledOrders(retryBefore time.Time, limit int) ([]Order, error) {
+	var orders []Order
+	err := db.Where("status = ? AND gateway = ?", OrderStatusConfirmed, OrderGatewayEcpay).
+		Where(db.Where("settle_status = ?", SettleStatusNone).
+			Or("settle_status = ? AND updated_at < ?", SettleStatusFailed, retryBefore).
+			Or("settle_status = ? AND settle_no = ? AND updated_at < ?", SettleStatusPending, "", retryBefore)).
+		Order("id ASC").
+		Limit(limit).
+		Find(&orders).Error
+	return orders, err
+}
+
+// FindUnconfirmedPrepaidOrders returns paid bundle and membership orders, oldest first. They unlock
+// their topics or membership period as soon as they are paid, so nothing else confirms them.
+func FindUnconfirmedPrepaidOrders(limit int) ([]Order, error) {
+	var orders []Order
+	err := db.Where("status = ? AND experience_id IS NULL", OrderStatusPaid).
+		Order("id ASC").
+		Limit(limit).
+		Find(&orders).Error
+	return orders, err
+}
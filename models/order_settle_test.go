@@ -0,0 +1,150 @@
+package models
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOrderSettle(t *testing.T) {
+	db := InitTestDB()
+	SetDB(db)
+
+	experienceID := uint(1)
+	order := Order{UserID: 1, ExperienceID: &experienceID, Price: 990, Status: OrderStatusPaid, OrderNo: "ORD_SETTLE", OutOrderNo: "OUT_SETTLE"}
+	db.Create(&order)
+	settle := func(o *Order) (string, error) { return "SETTLE_1", nil }
+	retryBefore := time.Now().Add(-time.Hour)
+
+	// A paid order cannot be settled before delivery
+	started, err := order.Settle(retryBefore, settle)
+	assert.NoError(t, err)
+	assert.False(t, started)
+
+	confirmed, err := order.ConfirmDelivery(OrderSourceUser)
+	assert.NoError(t, err)
+	assert.True(t, confirmed)
+
+	// Confirming again is a no-op
+	confirmed, err = order.ConfirmDelivery(OrderSourceUser)
+	assert.NoError(t, err)
+	assert.False(t, confirmed)
+
+	// A rejected settle leaves the order ready for another attempt
+	started, err = order.Settle(retryBefore, func(o *Order) (string, error) { return "", errors.New("rejected") })
+	assert.Error(t, err)
+	assert.False(t, started)
+	unsettled, _ := FindUnsettledOrders(retryBefore, 10)
+	assert.Len(t, unsettled, 1)
+
+	started, err = order.Settle(retryBefore, settle)
+	assert.NoError(t, err)
+	assert.True(t, started)
+	assert.Equal(t, "SOUT_SETTLE", order.OutSettleNo)
+	unsettled, _ = FindUnsettledOrders(retryBefore, 10)
+	assert.Len(t, unsettled, 0)
+
+	// A stale copy cannot start a second settle
+	var stale Order
+	db.First(&stale, order.ID)
+	stale.SettleStatus = SettleStatusNone
+	started, err = stale.Settle(retryBefore, settle)
+	assert.NoError(t, err)
+	assert.False(t, started)
+
+	found, err := FindOrderByOutSettleNo("SOUT_SETTLE")
+	assert.NoError(t, err)
+	assert.Equal(t, order.ID, found.ID)
+
+	changed, err := found.CompleteSettle(true)
+	assert.NoError(t, err)
+	assert.True(t, changed)
+	assert.NotNil(t, found.SettledAt)
+
+	// Replayed callback
+	changed, err = found.CompleteSettle(false)
+	assert.NoError(t, err)
+	assert.False(t, changed)
+
+	var dbOrder Order
+	db.First(&dbOrder, order.ID)
+	assert.Equal(t, SettleStatusSucceeded, dbOrder.SettleStatus)
+	assert.Equal(t, "SETTLE_1", dbOrder.SettleNo)
+}
+
+func TestOrderSettleRetry(t *testing.T) {
+	db := InitTestDB()
+	SetDB(db)
+
+	experienceID := uint(1)
+	order := Order{UserID: 1, ExperienceID: &experienceID, Price: 990, Status: OrderStatusConfirmed, OrderNo: "ORD_RETRY", OutOrderNo: "OUT_RETRY"}
+	db.Create(&order)
+	attempts := 0
+	settle := func(o *Order) (string, error) {
+		attempts++
+		return "SETTLE_RETRY", nil
+	}
+
+	started, err := order.Settle(time.Now().Add(-time.Hour), settle)
+	assert.NoError(t, err)
+	assert.True(t, started)
+	changed, err := order.CompleteSettle(false)
+	assert.NoError(t, err)
+	assert.True(t, changed)
+
+	// A failed settle waits for its retry delay
+	unsettled, _ := FindUnsettledOrders(time.Now().Add(-time.Hour), 10)
+	assert.Len(t, unsettled, 0)
+	db.First(&order, order.ID)
+	started, err = order.Settle(time.Now().Add(-time.Hour), settle)
+	assert.NoError(t, err)
+	assert.False(t, started)
+
+	// and is then started again with the same out_settle_no
+	retryBefore := time.Now().Add(time.Minute)
+	unsettled, _ = FindUnsettledOrders(retryBefore, 10)
+	assert.Len(t, unsettled, 1)
+	started, err = unsettled[0].Settle(retryBefore, settle)
+	assert.NoError(t, err)
+	assert.True(t, started)
+	assert.Equal(t, 2, attempts)
+
+	var dbOrder Order
+	db.First(&dbOrder, order.ID)
+	assert.Equal(t, SettleStatusPending, dbOrder.SettleStatus)
+	assert.Equal(t, "SOUT_RETRY", dbOrder.OutSettleNo)
+
+	// A claim lost before reaching the gateway, e.g. to a crash, is retried as well
+	db.Model(&dbOrder).UpdateColumn("settle_no", "")
+	unsettled, _ = FindUnsettledOrders(retryBefore, 10)
+	assert.Len(t, unsettled, 1)
+}
+
+func TestFindUnconfirmedPrepaidOrders(t *testing.T) {
+	db := InitTestDB()
+	SetDB(db)
+
+	experienceID := uint(1)
+	bundleID := uint(2)
+	topicOrder := Order{UserID: 1, ExperienceID: &experienceID, Price: 990, Status: OrderStatusPaid, OrderNo: "ORD_TOPIC", OutOrderNo: "OUT_TOPIC"}
+	bundleOrder := Order{UserID: 1, BundleID: &bundleID, Price: 1990, Status: OrderStatusPaid, OrderNo: "ORD_BUNDLE", OutOrderNo: "OUT_BUNDLE"}
+	planOrder := Order{UserID: 1, PlanCode: "monthly", PlanDays: 30, Price: 2990, Status: OrderStatusPending, OrderNo: "ORD_PLAN", OutOrderNo: "OUT_PLAN"}
+	db.Create(&topicOrder)
+	db.Create(&bundleOrder)
+	db.Create(&planOrder)
+
+	orders, err := FindUnconfirmedPrepaidOrders(10)
+	assert.NoError(t, err)
+	assert.Len(t, orders, 1)
+	assert.Equal(t, bundleOrder.ID, orders[0].ID)
+
+	confirmed, err := orders[0].ConfirmDelivery(OrderSourceReconciler)
+	assert.NoError(t, err)
+	assert.True(t, confirmed)
+	histories, _ := FindOrderStatusHistories(bundleOrder.ID)
+	assert.Equal(t, "unlocked on payment", histories[0].Note)
+	orders, _ = FindUnconfirmedPrepaidOrders(10)
+	assert.Len(t, orders, 0)
+}
@@ -0,0 +1,36 @@
+package models
+
+import "time"
+
+// OrderStatusSource identifies what triggered an order status change
+type OrderStatusSource string
+
+const (
+	OrderSourceUser       OrderStatusSource = "user"       // a request made by the buyer
+	OrderSourceCallback   OrderStatusSource = "callback"   // a payment gateway notification
+	OrderSourceReconciler OrderStatusSource = "reconciler" // the background order reconciler
+	OrderSourceAdmin      OrderStatusSource = "admin"      // an admin or support action
+)
+
+// OrderStatusHistory records a single order status transition
+type OrderStatusHistory struct {
+	ID         uint              `gorm:"primaryKey" json:"id"`
+	OrderID    uint              `gorm:"not null;index" json:"order_id"`
+	FromStatus OrderStatus       `gorm:"type:int" json:"from_status"`
+	ToStatus   OrderStatus       `gorm:"type:int" json:"to_status"`
+	Source     OrderStatusSource `gorm:"type:varchar(20)" json:"source"`
+	Note       string            `gorm:"type:varchar(255)" json:"note"`
+	CreatedAt  time.Time         `gorm:"autoCreateTime" json:"created_at"`
+}
+
+// TableName specifies the table name for the OrderStatusHistory model
+func (OrderStatusHistory) TableName() string {
+	return "order_status_histories"
+}
+
+// FindOrderStatusHistories returns the transitions of an order, oldest first
+func FindOrderStatusHistories(orderID uint) ([]OrderStatusHistory, error) {
+	var histories []OrderStatusHistory
+	err := db.Where("order_id = ?", orderID).Order("id ASC").Find(&histories).Error
+	return histories, err
+}
@@ -0,0 +1,236 @@
+package models
+
+import (
+	"errors"
+	"learning-api/config"
+	"strconv"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// OrderSyncState is where an order stands in the Douyin order sync queue
+type OrderSyncState int
+
+const (
+	OrderSyncPending   OrderSyncState = 0 // waiting for its first push or a retry
+	OrderSyncSucceeded OrderSyncState = 1 // the latest status reached Douyin
+	OrderSyncFailed    OrderSyncState = 2 // gave up after the last retry; an admin can requeue it
+)
+
+// String returns the string representation of OrderSyncState
+func (s OrderSyncState) String() string {
+	switch s {
+	case OrderSyncPending:
+		return "pending"
+	case OrderSyncSucceeded:
+		return "succeeded"
+	case OrderSyncFailed:
+		return "failed"
+	default:
+		return "unknown"
+	}
+}
+
+// MarshalJSON implements json.Marshaler interface
+func (s OrderSyncState) MarshalJSON() ([]byte, error) {
+	return []byte(`"` + s.String() + `"`), nil
+}
+
+// ParseOrderSyncState looks up an OrderSyncState by its string representation
+func ParseOrderSyncState(name string) (OrderSyncState, bool) {
+	for s := OrderSyncPending; s <= OrderSyncFailed; s++ {
+		if s.String() == name {
+			return s, true
+		}
+	}
+	return 0, false
+}
+
+// OrderSyncTask queues the push of an order to the Douyin order center. Each order has one task;
+// a status change requeues it, so the push always sends the order as it is now. Revision counts
+// the requeues so a push that raced one does not mark the newer status as sent.
+type OrderSyncTask struct {
+	ID            uint           `gorm:"primaryKey" json:"id"`
+	OrderID       uint           `gorm:"not null;uniqueIndex" json:"order_id"`
+	OutOrderNo    string         `gorm:"type:varchar(100)" json:"out_order_no"`
+	OrderStatus   OrderStatus    `gorm:"type:int;not null;default:0" json:"order_status"` // status when last queued
+	State         OrderSyncState `gorm:"type:int;not null;default:0;index:idx_order_sync_due,priority:1" json:"state"`
+	Revision      int            `gorm:"not null;default:0" json:"revision"`
+	Attempts      int            `gorm:"not null;default:0" json:"attempts"` // failed pushes since the last requeue
+	NextAttemptAt time.Time      `gorm:"index:idx_order_sync_due,priority:2" json:"next_attempt_at"`
+	LastError     string         `gorm:"type:text" json:"last_error"`
+	SyncedAt      *time.Time     `json:"synced_at"`
+	CreatedAt     time.Time      `gorm:"autoCreateTime" json:"created_at"`
+	UpdatedAt     time.Time      `gorm:"autoUpdateTime" json:"updated_at"`
+}
+
+// TableName specifies the table name for the OrderSyncTask model
+func (OrderSyncTask) TableName() string {
+	return "order_sync_tasks"
+}
+
+// syncsToDouyin reports whether the order belongs in the Douyin order center through the order
+// sync API. Trade system v2 orders are listed there by Douyin itself, and fake and coupon orders
+// never went through Douyin.
+func (o *Order) syncsToDouyin() bool {
+	switch o.Gateway {
+	case OrderGatewayTradeV2, OrderGatewayFake, OrderGatewayCoupon:
+		return false
+	default:
+		return true
+	}
+}
+
+// queueOrderSyncTx queues a push of the order in its current status, within the transaction that
+// changed the status so no change is lost
+func (o *Order) queueOrderSyncTx(tx *gorm.DB) error {
+	if !o.syncsToDouyin() {
+		return nil
+	}
+	now := time.Now()
+	task := OrderSyncTask{
+		OrderID:       o.ID,
+		OutOrderNo:    o.OutOrderNo,
+		OrderStatus:   o.Status,
+		State:         OrderSyncPending,
+		NextAttemptAt: now,
+	}
+	return tx.Clauses(clause.OnConflict{
+		Columns: []clause.Column{{Name: "order_id"}},
+		DoUpdates: clause.Assignments(map[string]interface{}{
+			"order_status":    o.Status,
+			"state":           OrderSyncPending,
+			"revision":        gorm.Expr("revision + 1"),
+			"attempts":        0,
+			"next_attempt_at": now,
+			"updated_at":      now,
+		}),
+	}).Create(&task).Error
+}
+
+// FindDueOrderSyncTasks returns pending tasks whose next attempt is due, oldest first
+func FindDueOrderSyncTasks(now time.Time, limit int) ([]OrderSyncTask, error) {
+	var tasks []OrderSyncTask
+	err := db.Where("state = ? AND next_attempt_at <= ?", OrderSyncPending, now).
+		Order("next_attempt_at ASC").
+		Limit(limit).
+		Find(&tasks).Error
+	return tasks, err
+}
+
+// FindOrderSyncTasks returns a page of tasks, most recently updated first, with the total count.
+// A nil state matches every state.
+func FindOrderSyncTasks(state *OrderSyncState, offset, limit int) ([]OrderSyncTask, int64, error) {
+	filter := func(tx *gorm.DB) *gorm.DB {
+		if state != nil {
+			return tx.Where("state = ?", *state)
+		}
+		return tx
+	}
+	var total int64
+	if err := db.Model(&OrderSyncTask{}).Scopes(filter).Count(&total).Error; err != nil {
+		return nil, 0, err
+	}
+	var tasks []OrderSyncTask
+	err := db.Scopes(filter).Order("updated_at DESC").Order("id DESC").Offset(offset).Limit(limit).Find(&tasks).Error
+	return tasks, total, err
+}
+
+// MarkSynced records a successful push. It returns false when the order was requeued meanwhile,
+// leaving the task pending for the newer status.
+func (t *OrderSyncTask) MarkSynced() (bool, error) {
+	now := time.Now()
+	result := db.Model(&OrderSyncTask{}).
+		Where("id = ? AND revision = ?", t.ID, t.Revision).
+		Updates(map[string]interface{}{
+			"state":      OrderSyncSucceeded,
+			"last_error": "",
+			"synced_at":  now,
+		})
+	return result.RowsAffected == 1, result.Error
+}
+
+// MarkAttemptFailed records a failed push. The task is retried at nextAttemptAt, or gives up
+// and turns failed when giveUp is set.
+func (t *OrderSyncTask) MarkAttemptFailed(pushErr error, nextAttemptAt time.Time, giveUp bool) error {
+	state := OrderSyncPending
+	if giveUp {
+		state = OrderSyncFailed
+	}
+	return db.Model(&OrderSyncTask{}).
+		Where("id = ? AND revision = ?", t.ID, t.Revision).
+		Updates(map[string]interface{}{
+			"state":           state,
+			"attempts":        gorm.Expr("attempts + 1"),
+			"last_error":      pushErr.Error(),
+			"next_attempt_at": nextAttemptAt,
+		}).Error
+}
+
+// ErrOrderSyncTaskNotFound is returned when requeueing a task that does not exist
+var ErrOrderSyncTaskNotFound = errors.New("order sync task not found")
+
+// RequeueOrderSyncTask puts a task back in the queue for an immediate push with a fresh set of
+// retries, and returns it
+func RequeueOrderSyncTask(id uint) (*OrderSyncTask, error) {
+	result := db.Model(&OrderSyncTask{}).Where("id = ?", id).Updates(map[string]interface{}{
+		"state":           OrderSyncPending,
+		"revision":        gorm.Expr("revision + 1"),
+		"attempts":        0,
+		"next_attempt_at": time.Now(),
+	})
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	if result.RowsAffected == 0 {
+		return nil, ErrOrderSyncTaskNotFound
+	}
+	var task OrderSyncTask
+	if err := db.First(&task, id).Error; err != nil {
+		return nil, err
+	}
+	return &task, nil
+}
+
+// FindOrderForSync loads an order with its buyer and topic. It returns nil when the order does
+// not exist.
+func FindOrderForSync(id uint) (*Order, error) {
+	var orders []Order
+	if err := db.Preload("User").Preload("Experience.Topic").Where("id = ?", id).Limit(1).Find(&orders).Error; err != nil {
+		return nil, err
+	}
+	if len(orders) == 0 {
+		return nil, nil
+	}
+	return &orders[0], nil
+}
+
+// OrderProduct is what an order sells: a topic, a bundle or a membership plan
+type OrderProduct struct {
+	Code     string // topic_<id>, bundle_<id> or plan_<code>
+	Title    string
+	ImageURL string
+}
+
+// Product describes what the order buys. Topic orders need Experience.Topic loaded.
+func (o *Order) Product() (OrderProduct, error) {
+	switch {
+	case o.BundleID != nil:
+		var bundle Bundle
+		if err := db.Select("id", "name", "cover_url").First(&bundle, *o.BundleID).Error; err != nil {
+			return OrderProduct{}, err
+		}
+		return OrderProduct{Code: "bundle_" + strconv.FormatUint(uint64(bundle.ID), 10), Title: bundle.Name, ImageURL: bundle.CoverURL}, nil
+	case o.IsMembership():
+		product := OrderProduct{Code: "plan_" + o.PlanCode, Title: o.PlanCode}
+		if plan, ok := config.LoadConfig().MembershipPlan(o.PlanCode); ok {
+			product.Title = plan.Name
+		}
+		return product, nil
+	default:
+		topic := o.Experience.Topic
+		return OrderProduct{Code: "topic_" + strconv.FormatUint(uint64(topic.ID), 10), Title: topic.Name, ImageURL: topic.CoverURL}, nil
+	}
+}
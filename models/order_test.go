@@ -35,7 +35,7 @@ func TestOrderModel(t *testing.T) {
 	// Create test order
 	order := Order{
 		UserID:       user.ID,
-		ExperienceID: experience.ID,
+		ExperienceID: &experience.ID,
 		Price:        1000,
 		Status:       OrderStatusCreated,
 		OrderNo:      "ORD20250624001",
@@ -59,7 +59,7 @@ func TestOrderModel(t *testing.T) {
 
 	assert.Equal(t, order.ID, retrievedOrder.ID)
 	assert.Equal(t, user.ID, retrievedOrder.UserID)
-	assert.Equal(t, experience.ID, retrievedOrder.ExperienceID)
+	assert.Equal(t, experience.ID, *retrievedOrder.ExperienceID)
 	assert.Equal(t, 1000, retrievedOrder.Price)
 	assert.Equal(t, OrderStatusCreated, retrievedOrder.Status)
 	assert.Equal(t, "ORD20250624001", retrievedOrder.OrderNo)
@@ -83,7 +83,7 @@ func TestOrderModel(t *testing.T) {
 	for i, status := range statuses {
 		testOrder := Order{
 			UserID:       user.ID,
-			ExperienceID: experience.ID,
+			ExperienceID: &experience.ID,
 			Price:        500,
 			Status:       status,
 			OrderNo:      orderNumbers[i], // Unique order numbers
@@ -140,7 +140,7 @@ func TestOrderModel(t *testing.T) {
 	// Test unique constraint on order_no
 	duplicateOrder := Order{
 		UserID:       user.ID,
-		ExperienceID: experience.ID,
+		ExperienceID: &experience.ID,
 		Price:        500,
 		Status:       OrderStatusCreated,
 		OrderNo:      "ORD20250624001", // Same order_no as the first order
@@ -152,7 +152,7 @@ func TestOrderModel(t *testing.T) {
 	// Test order_no and out_order_no fields
 	uniqueOrder := Order{
 		UserID:       user.ID,
-		ExperienceID: experience.ID,
+		ExperienceID: &experience.ID,
 		Price:        750,
 		Status:       OrderStatusCreated,
 		OrderNo:      "ORD20250624006", // Unique order_no
@@ -163,3 +163,110 @@ func TestOrderModel(t *testing.T) {
 	assert.Equal(t, "ORD20250624006", uniqueOrder.OrderNo)
 	assert.Equal(t, "OUT20250624006", uniqueOrder.OutOrderNo)
 }
+
+func TestOrderStatusTransitions(t *testing.T) {
+	// Test String() for the new statuses
+	assert.Equal(t, "refunded", OrderStatusRefunded.String())
+	assert.Equal(t, "cancelled", OrderStatusCancelled.String())
+	assert.Equal(t, "expired", OrderStatusExpired.String())
+	assert.Equal(t, "failed", OrderStatusFailed.String())
+
+	// Allowed moves
+	assert.True(t, OrderStatusCreated.CanTransitionTo(OrderStatusPending))
+	assert.True(t, OrderStatusPending.CanTransitionTo(OrderStatusPaid))
+	assert.True(t, OrderStatusPending.CanTransitionTo(OrderStatusExpired))
+	assert.True(t, OrderStatusPaid.CanTransitionTo(OrderStatusConfirmed))
+	assert.True(t, OrderStatusPaid.CanTransitionTo(OrderStatusRefunded))
+	assert.True(t, OrderStatusConfirmed.CanTransitionTo(OrderStatusRefunded))
+	assert.True(t, OrderStatusExpired.CanTransitionTo(OrderStatusPaid))
+	assert.True(t, OrderStatusCancelled.CanTransitionTo(OrderStatusPaid))
+	assert.True(t, OrderStatusFailed.CanTransitionTo(OrderStatusPaid))
+
+	// Illegal moves
+	assert.False(t, OrderStatusPaid.CanTransitionTo(OrderStatusPending))
+	assert.False(t, OrderStatusPending.CanTransitionTo(OrderStatusRefunded))
+	assert.False(t, OrderStatusRefunded.CanTransitionTo(OrderStatusPaid))
+	assert.False(t, OrderStatusCancelled.CanTransitionTo(OrderStatusPending))
+	assert.False(t, OrderStatusConfirmed.CanTransitionTo(OrderStatusPaid))
+
+	// Terminal statuses
+	assert.True(t, OrderStatusRefunded.IsTerminal())
+	assert.False(t, OrderStatusCancelled.IsTerminal())
+	assert.False(t, OrderStatusPending.IsTerminal())
+
+	// SetStatus rejects illegal moves and leaves the status untouched
+	order := Order{Status: OrderStatusRefunded}
+	err := order.SetStatus(OrderStatusPaid)
+	assert.ErrorIs(t, err, ErrInvalidOrderTransition)
+	assert.Equal(t, OrderStatusRefunded, order.Status)
+}
+
+func TestOrderTransitionRecordsHistory(t *testing.T) {
+	db := InitTestDB()
+	db.AutoMigrate(&Experience{}, &Topic{})
+	SetDB(db)
+
+	user := User{OpenID: "history_user"}
+	db.Create(&user)
+	experience := Experience{TopicID: 1, UserID: user.ID}
+	db.Create(&experience)
+	order := Order{
+		UserID:       user.ID,
+		ExperienceID: &experience.ID,
+		Price:        1000,
+		Status:       OrderStatusPending,
+		OrderNo:      "ORD_HISTORY_001",
+		OutOrderNo:   "OUT_HISTORY_001",
+	}
+	db.Create(&order)
+
+	changed, err := order.MarkPaid("DY_HISTORY_001", OrderSourceCallback)
+	assert.NoError(t, err)
+	assert.True(t, changed)
+
+	// Replays do not add history
+	changed, err = order.MarkPaid("DY_HISTORY_001", OrderSourceCallback)
+	assert.NoError(t, err)
+	assert.False(t, changed)
+
+	err = order.Transition(OrderStatusRefunded, OrderSourceAdmin, "customer request", nil)
+	assert.NoError(t, err)
+
+	// Illegal transitions are rejected and not recorded
+	err = order.Transition(OrderStatusPaid, OrderSourceAdmin, "", nil)
+	assert.ErrorIs(t, err, ErrInvalidOrderTransition)
+
+	var stored Order
+	db.First(&stored, order.ID)
+	assert.Equal(t, OrderStatusRefunded, stored.Status)
+	assert.Equal(t, "DY_HISTORY_001", stored.OrderNo)
+
+	histories, err := FindOrderStatusHistories(order.ID)
+	assert.NoError(t, err)
+	assert.Len(t, histories, 2)
+	assert.Equal(t, OrderStatusPending, histories[0].FromStatus)
+	assert.Equal(t, OrderStatusPaid, histories[0].ToStatus)
+	assert.Equal(t, OrderSourceCallback, histories[0].Source)
+	assert.Equal(t, OrderStatusPaid, histories[1].FromStatus)
+	assert.Equal(t, OrderStatusRefunded, histories[1].ToStatus)
+	assert.Equal(t, OrderSourceAdmin, histories[1].Source)
+	assert.Equal(t, "customer request", histories[1].Note)
+	assert.NotZero(t, histories[1].CreatedAt)
+}
+
+func TestOrderTransitionDetectsConcurrentChange(t *testing.T) {
+	db := InitTestDB()
+	db.AutoMigrate(&Experience{}, &Topic{})
+	SetDB(db)
+
+	experienceID := uint(1)
+	order := Order{UserID: 1, ExperienceID: &experienceID, Status: OrderStatusPending, OrderNo: "ORD_RACE_001", OutOrderNo: "OUT_RACE_001"}
+	db.Create(&order)
+
+	// Another writer expires the order behind this copy's back
+	stale := order
+	db.Model(&Order{}).Where("id = ?", order.ID).Update("status", OrderStatusExpired)
+
+	err := stale.Transition(OrderStatusCancelled, OrderSourceAdmin, "", nil)
+	assert.ErrorIs(t, err, ErrOrderStatusChanged)
+}
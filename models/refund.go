@@ -0,0 +1,158 @@
+package models
+
+import (
+	"errors"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// ErrRefundExceedsRefundable is returned when a refund is larger than what is left to refund
+var ErrRefundExceedsRefundable = errors.New("refund amount exceeds the refundable amount")
+
+// RefundStatus represents the status of a refund
+type RefundStatus int
+
+const (
+	RefundStatusPending   RefundStatus = 0 // sent to the gateway, waiting for the refund callback
+	RefundStatusSucceeded RefundStatus = 1 // succeeded
+	RefundStatusFailed    RefundStatus = 2 // failed
+)
+
+// String returns the string representation of RefundStatus
+func (s RefundStatus) String() string {
+	switch s {
+	case RefundStatusPending:
+		return "pending"
+	case RefundStatusSucceeded:
+		return "succeeded"
+	case RefundStatusFailed:
+		return "failed"
+	default:
+		return "unknown"
+	}
+}
+
+// MarshalJSON implements json.Marshaler interface
+func (s RefundStatus) MarshalJSON() ([]byte, error) {
+	return []byte(`"` + s.String() + `"`), nil
+}
+
+// Refund represents a full or partial refund of an order
+type Refund struct {
+	ID          uint         `gorm:"primaryKey" json:"id"`
+	OrderID     uint         `gorm:"not null;index" json:"order_id"`
+	OutRefundNo string       `gorm:"type:varchar(100);uniqueIndex" json:"out_refund_no"`
+	RefundNo    string       `gorm:"type:varchar(100)" json:"refund_no"`
+	Amount      int          `gorm:"not null" json:"amount"`
+	Reason      string       `gorm:"type:varchar(255)" json:"reason"`
+	Status      RefundStatus `gorm:"type:int;default:0" json:"status"`
+	OperatorID  uint         `json:"operator_id"`
+	CreatedAt   time.Time    `gorm:"autoCreateTime" json:"created_at"`
+	UpdatedAt   time.Time    `gorm:"autoUpdateTime" json:"updated_at"`
+}
+
+// TableName specifies the table name for the Refund model
+func (Refund) TableName() string {
+	return "refunds"
+}
+
+// CreateWithGatewayRefund saves the refund as pending and asks the payment gateway to start it in
+// the same transaction, so a refund the gateway rejected leaves nothing behind. The order row stays
+// locked until commit and the amount is checked under that lock, so concurrent refunds of the order
+// cannot together return more than its price.
+func (r *Refund) CreateWithGatewayRefund(createGatewayRefund func(r *Refund) (refundNo string, err error)) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		var order Order
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&order, r.OrderID).Error; err != nil {
+			return err
+		}
+		refundable, err := order.refundableAmountTx(tx)
+		if err != nil {
+			return err
+		}
+		if r.Amount <= 0 || r.Amount > refundable {
+			return ErrRefundExceedsRefundable
+		}
+
+		r.Status = RefundStatusPending
+		if err := tx.Create(r).Error; err != nil {
+			return err
+		}
+
+		refundNo, err := createGatewayRefund(r)
+		if err != nil {
+			return err
+		}
+		r.RefundNo = refundNo
+		return tx.Model(r).Update("refund_no", refundNo).Error
+	})
+}
+
+// FindRefundByOutRefundNo looks up a refund by the merchant refund number sent to the payment gateway
+func FindRefundByOutRefundNo(outRefundNo string) (*Refund, error) {
+	var refund Refund
+	result := db.Where("out_refund_no = ?", outRefundNo).First(&refund)
+	if result.Error != nil {
+		if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+			return nil, nil // Refund not found
+		}
+		return nil, result.Error
+	}
+	return &refund, nil
+}
+
+// Complete records the gateway's refund result. A successful refund adds its amount to the order and
+// moves the order to partially refunded, or to refunded once the whole price has been returned.
+// It returns false without an error when the refund was already completed.
+func (r *Refund) Complete(succeeded bool, source OrderStatusSource) (bool, error) {
+	status := RefundStatusFailed
+	if succeeded {
+		status = RefundStatusSucceeded
+	}
+
+	changed := false
+	err := db.Transaction(func(tx *gorm.DB) error {
+		result := tx.Model(&Refund{}).
+			Where("id = ? AND status = ?", r.ID, RefundStatusPending).
+			Update("status", status)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return nil
+		}
+		changed = true
+		if !succeeded {
+			return nil
+		}
+
+		// Add the amount in the database rather than from a read, so concurrent refunds of the order
+		// both count. The update locks the order row until commit, so the status below is computed
+		// from a total no other refund can change in between.
+		if err := tx.Model(&Order{}).Where("id = ?", r.OrderID).
+			Update("refunded_amount", gorm.Expr("refunded_amount + ?", r.Amount)).Error; err != nil {
+			return err
+		}
+		var order Order
+		if err := tx.First(&order, r.OrderID).Error; err != nil {
+			return err
+		}
+		next := OrderStatusPartiallyRefunded
+		if order.RefundedAmount >= order.Price {
+			next = OrderStatusRefunded
+		}
+		if order.Status == next {
+			return nil // Another partial refund; only the amount changes
+		}
+		return order.TransitionTx(tx, next, source, "refund "+r.OutRefundNo, nil)
+	})
+	if err != nil {
+		return false, err
+	}
+	if changed {
+		r.Status = status
+	}
+	return changed, nil
+}
@@ -0,0 +1,43 @@
+package models
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"gorm.io/gorm"
+)
+
+func TestCreateWithGatewayRefundChecksAmountUnderOrderLock(t *testing.T) {
+	SetDB(InitTestDB())
+
+	order := Order{UserID: 1, Price: 1000, Status: OrderStatusPaid, OrderNo: "DY_REFUND", OutOrderNo: "OUT_REFUND"}
+	db.Create(&order)
+
+	// SQLite has no row locks, so check that the order is read with FOR UPDATE
+	var locked []string
+	db.Callback().Query().Before("gorm:query").Register("test:record_locking", func(tx *gorm.DB) {
+		if _, ok := tx.Statement.Clauses["FOR"]; ok {
+			locked = append(locked, tx.Statement.Table)
+		}
+	})
+	calls := 0
+	gateway := func(r *Refund) (string, error) {
+		calls++
+		return "RF_" + r.OutRefundNo, nil
+	}
+
+	// Both requests read 1000 as refundable before either refund was saved
+	first := Refund{OrderID: order.ID, OutRefundNo: "OUT_RF_1", Amount: 600}
+	assert.NoError(t, first.CreateWithGatewayRefund(gateway))
+	second := Refund{OrderID: order.ID, OutRefundNo: "OUT_RF_2", Amount: 600}
+	assert.ErrorIs(t, second.CreateWithGatewayRefund(gateway), ErrRefundExceedsRefundable)
+
+	assert.Equal(t, 1, calls, "the rejected refund never reaches the gateway")
+	assert.Equal(t, []string{"orders", "orders"}, locked)
+	var count int64
+	db.Model(&Refund{}).Where("order_id = ?", order.ID).Count(&count)
+	assert.Equal(t, int64(1), count)
+
+	rest := Refund{OrderID: order.ID, OutRefundNo: "OUT_RF_3", Amount: 400}
+	assert.NoError(t, rest.CreateWithGatewayRefund(gateway))
+}
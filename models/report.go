@@ -0,0 +1,171 @@
+package models
+
+import (
+	"fmt"
+	"learning-api/config"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Groupings a revenue report can aggregate orders by
+const (
+	ReportGroupByDay    = "day"
+	ReportGroupByTopic  = "topic"
+	ReportGroupByStatus = "status"
+)
+
+// chargedStatuses are the statuses of orders whose buyer was charged, including orders refunded since
+var chargedStatuses = []OrderStatus{OrderStatusPaid, OrderStatusConfirmed, OrderStatusPartiallyRefunded, OrderStatusRefunded}
+
+// RevenueRow aggregates the orders of one group. Amounts are in fen: Gross is what was charged,
+// Refunded what was given back and Net the difference.
+type RevenueRow struct {
+	Key            string `json:"key"`   // day (2006-01-02), topic:<id>, bundle:<id>, plan:<code> or the status
+	Label          string `json:"label"` // topic, bundle or plan name; the key otherwise
+	Orders         int    `json:"orders"`
+	PaidOrders     int    `json:"paid_orders"`
+	RefundedOrders int    `json:"refunded_orders"`
+	Gross          int    `json:"gross"`
+	Refunded       int    `json:"refunded"`
+	Net            int    `json:"net"`
+}
+
+func (r *RevenueRow) add(o reportOrder) {
+	r.Orders++
+	if !o.Status.isCharged() {
+		return
+	}
+	r.PaidOrders++
+	r.Gross += o.Price
+	if o.RefundedAmount > 0 {
+		r.RefundedOrders++
+		r.Refunded += o.RefundedAmount
+	}
+	r.Net = r.Gross - r.Refunded
+}
+
+// isCharged reports whether an order in this status charged its buyer at some point
+func (s OrderStatus) isCharged() bool {
+	for _, charged := range chargedStatuses {
+		if s == charged {
+			return true
+		}
+	}
+	return false
+}
+
+// reportOrder is the part of an order a revenue report needs
+type reportOrder struct {
+	Price          int
+	RefundedAmount int
+	Status         OrderStatus
+	CreatedAt      time.Time
+	TopicID        *uint
+	BundleID       *uint
+	PlanCode       string
+}
+
+// RevenueReport aggregates the orders created in [from, to) by groupBy. Days are cut in the
+// location of from. Refunds count toward the order they give money back for, whenever they
+// happened. The second result is the total over every group.
+func RevenueReport(from, to time.Time, groupBy string) ([]RevenueRow, RevenueRow, error) {
+	var orders []reportOrder
+	err := db.Model(&Order{}).
+		Select("orders.price, orders.refunded_amount, orders.status, orders.created_at, experiences.topic_id, orders.bundle_id, orders.plan_code").
+		Joins("LEFT JOIN experiences ON experiences.id = orders.experience_id").
+		// timestamps are stored in server local time
+		Where("orders.created_at >= ? AND orders.created_at < ?", from.Local(), to.Local()).
+		Scan(&orders).Error
+	if err != nil {
+		return nil, RevenueRow{}, err
+	}
+
+	var keyOf func(o reportOrder) string
+	switch groupBy {
+	case ReportGroupByDay:
+		keyOf = func(o reportOrder) string { return o.CreatedAt.In(from.Location()).Format("2006-01-02") }
+	case ReportGroupByTopic:
+		keyOf = orderProductKey
+	case ReportGroupByStatus:
+		keyOf = func(o reportOrder) string { return o.Status.String() }
+	default:
+		return nil, RevenueRow{}, fmt.Errorf("unknown report grouping %q", groupBy)
+	}
+
+	groups := map[string]*RevenueRow{}
+	if groupBy == ReportGroupByDay {
+		// list quiet days too, so a daily report has one row per day of the range
+		for day := from; day.Before(to); day = day.AddDate(0, 0, 1) {
+			key := day.Format("2006-01-02")
+			groups[key] = &RevenueRow{Key: key, Label: key}
+		}
+	}
+	total := RevenueRow{Key: "total", Label: "total"}
+	for _, o := range orders {
+		key := keyOf(o)
+		row, ok := groups[key]
+		if !ok {
+			row = &RevenueRow{Key: key, Label: key}
+			groups[key] = row
+		}
+		row.add(o)
+		total.add(o)
+	}
+
+	rows := make([]RevenueRow, 0, len(groups))
+	for _, row := range groups {
+		rows = append(rows, *row)
+	}
+	sort.Slice(rows, func(i, j int) bool { return rows[i].Key < rows[j].Key })
+	if groupBy == ReportGroupByTopic {
+		if err := labelProductRows(rows); err != nil {
+			return nil, RevenueRow{}, err
+		}
+		// the best sellers first
+		sort.SliceStable(rows, func(i, j int) bool { return rows[i].Net > rows[j].Net })
+	}
+	return rows, total, nil
+}
+
+// orderProductKey names what an order sells: a topic, a bundle or a membership plan
+func orderProductKey(o reportOrder) string {
+	switch {
+	case o.BundleID != nil:
+		return "bundle:" + strconv.FormatUint(uint64(*o.BundleID), 10)
+	case o.PlanCode != "":
+		return "plan:" + o.PlanCode
+	case o.TopicID != nil:
+		return "topic:" + strconv.FormatUint(uint64(*o.TopicID), 10)
+	default:
+		return "unknown"
+	}
+}
+
+// labelProductRows replaces the label of topic, bundle and plan rows with their names
+func labelProductRows(rows []RevenueRow) error {
+	var topics []Topic
+	if err := db.Select("id", "name").Find(&topics).Error; err != nil {
+		return err
+	}
+	var bundles []Bundle
+	if err := db.Select("id", "name").Find(&bundles).Error; err != nil {
+		return err
+	}
+	names := map[string]string{}
+	for _, topic := range topics {
+		names["topic:"+strconv.FormatUint(uint64(topic.ID), 10)] = topic.Name
+	}
+	for _, bundle := range bundles {
+		names["bundle:"+strconv.FormatUint(uint64(bundle.ID), 10)] = bundle.Name
+	}
+	for _, plan := range config.LoadConfig().MembershipPlans {
+		names["plan:"+plan.Code] = plan.Name
+	}
+	for i := range rows {
+		if name, ok := names[rows[i].Key]; ok {
+			rows[i].Label = name
+		}
+	}
+	return nil
+}
@@ -0,0 +1,61 @@
+package models
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRevenueReport(t *testing.T) {
+	SetDB(InitTestDB())
+	db.AutoMigrate(&Experience{}, &Topic{})
+
+	topic := Topic{Name: "Topic"}
+	db.Create(&topic)
+	experience := Experience{TopicID: topic.ID, UserID: 1}
+	db.Create(&experience)
+	bundle := Bundle{Name: "Pack", Price: 1990}
+	db.Create(&bundle)
+
+	loc := time.FixedZone("UTC+8", 8*60*60)
+	from := time.Date(2026, 6, 1, 0, 0, 0, 0, loc)
+	// orders are stored in server local time, like autoCreateTime stores them
+	at := func(year int, month time.Month, day, hour, min int, zone *time.Location) time.Time {
+		return time.Date(year, month, day, hour, min, 0, 0, zone).Local()
+	}
+	orders := []Order{
+		// 23:30 UTC on May 31st is June 1st in UTC+8
+		{UserID: 1, ExperienceID: &experience.ID, Price: 990, Status: OrderStatusPaid, OrderNo: "DY_1", CreatedAt: at(2026, 5, 31, 23, 30, time.UTC)},
+		{UserID: 1, ExperienceID: &experience.ID, Price: 990, Status: OrderStatusRefunded, RefundedAmount: 990, OrderNo: "DY_2", CreatedAt: at(2026, 6, 2, 10, 0, loc)},
+		{UserID: 1, BundleID: &bundle.ID, Price: 1990, Status: OrderStatusPartiallyRefunded, RefundedAmount: 500, OrderNo: "DY_3", CreatedAt: at(2026, 6, 2, 11, 0, loc)},
+		{UserID: 1, ExperienceID: &experience.ID, Price: 990, Status: OrderStatusExpired, OrderNo: "DY_4", CreatedAt: at(2026, 6, 3, 9, 0, loc)},
+		{UserID: 1, ExperienceID: &experience.ID, Price: 990, Status: OrderStatusPaid, OrderNo: "DY_5", CreatedAt: at(2026, 6, 4, 9, 0, loc)},
+	}
+	db.Create(&orders)
+
+	rows, total, err := RevenueReport(from, from.AddDate(0, 0, 3), ReportGroupByDay)
+	assert.NoError(t, err)
+	assert.Equal(t, []RevenueRow{
+		{Key: "2026-06-01", Label: "2026-06-01", Orders: 1, PaidOrders: 1, Gross: 990, Net: 990},
+		{Key: "2026-06-02", Label: "2026-06-02", Orders: 2, PaidOrders: 2, RefundedOrders: 2, Gross: 2980, Refunded: 1490, Net: 1490},
+		{Key: "2026-06-03", Label: "2026-06-03", Orders: 1},
+	}, rows)
+	assert.Equal(t, RevenueRow{Key: "total", Label: "total", Orders: 4, PaidOrders: 3, RefundedOrders: 2, Gross: 3970, Refunded: 1490, Net: 2480}, total)
+
+	rows, _, err = RevenueReport(from, from.AddDate(0, 0, 3), ReportGroupByTopic)
+	assert.NoError(t, err)
+	assert.Len(t, rows, 2)
+	assert.Equal(t, "Pack", rows[0].Label)
+	assert.Equal(t, 1490, rows[0].Net)
+	assert.Equal(t, "Topic", rows[1].Label)
+	assert.Equal(t, 3, rows[1].Orders)
+
+	rows, _, err = RevenueReport(from, from.AddDate(0, 0, 3), ReportGroupByStatus)
+	assert.NoError(t, err)
+	assert.Len(t, rows, 4)
+	assert.Equal(t, "expired", rows[0].Key)
+
+	_, _, err = RevenueReport(from, from.AddDate(0, 0, 3), "week")
+	assert.Error(t, err)
+}
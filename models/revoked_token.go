@@ -0,0 +1,128 @@
+package models
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// RevokedToken denylists an access token by its jti. JWTs stay valid until they expire, so a
+// revoked one is kept here until then and purged afterwards.
+type RevokedToken struct {
+	ID        uint      `gorm:"primaryKey" json:"id"`
+	JTI       string    `gorm:"column:jti;type:varchar(32);not null;uniqueIndex" json:"jti"`
+	UserID    uint      `gorm:"index" json:"user_id"`
+	ExpiresAt time.Time `gorm:"index" json:"expires_at"` // when the access token expires anyway
+	CreatedAt time.Time `gorm:"autoCreateTime" json:"created_at"`
+}
+
+// TableName specifies the table name for the RevokedToken model
+func (RevokedToken) TableName() string {
+	return "revoked_tokens"
+}
+
+// accessExpiresAt is when the access token of the pair expires, with a minute to spare for the
+// time between creating the row and signing the token
+func (t *Token) accessExpiresAt() time.Time {
+	return t.CreatedAt.Add(time.Duration(t.AccessTokenExpiresIn)*time.Second + time.Minute)
+}
+
+// denylistTx adds the access tokens of the given pairs to the denylist
+func denylistTx(tx *gorm.DB, tokens []Token) ([]string, error) {
+	var entries []RevokedToken
+	var jtis []string
+	for _, token := range tokens {
+		if token.AccessJTI == "" || token.accessExpiresAt().Before(time.Now()) {
+			continue
+		}
+		entries = append(entries, RevokedToken{JTI: token.AccessJTI, UserID: token.UserID, ExpiresAt: token.accessExpiresAt()})
+		jtis = append(jtis, token.AccessJTI)
+	}
+	if len(entries) == 0 {
+		return nil, nil
+	}
+	if err := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&entries).Error; err != nil {
+		return nil, err
+	}
+	return jtis, nil
+}
+
+// revokeTokens revokes the not yet revoked tokens the scope selects and denylists their access
+// tokens. It returns how many were revoked.
+func revokeTokens(scope func(*gorm.DB) *gorm.DB) (int, error) {
+	var jtis []string
+	var revoked int
+	err := db.Transaction(func(tx *gorm.DB) error {
+		var tokens []Token
+		if err := tx.Scopes(scope).Where("revoked_at IS NULL").Find(&tokens).Error; err != nil {
+			return err
+		}
+		if len(tokens) == 0 {
+			return nil
+		}
+		ids := make([]uint, 0, len(tokens))
+		for _, token := range tokens {
+			ids = append(ids, token.ID)
+		}
+		if err := tx.Model(&Token{}).Where("id IN ?", ids).Update("revoked_at", time.Now()).Error; err != nil {
+			return err
+		}
+		var err error
+		jtis, err = denylistTx(tx, tokens)
+		revoked = len(tokens)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	markRevokedInCache(jtis)
+	return revoked, nil
+}
+
+// Revoke ends the session of the pair: its access token is denylisted and its refresh token can
+// no longer be exchanged
+func (t *Token) Revoke() error {
+	_, err := revokeTokens(func(tx *gorm.DB) *gorm.DB {
+		return tx.Where("id = ?", t.ID)
+	})
+	return err
+}
+
+// RevokeUserTokens revokes every token of the user and returns how many were still active
+func RevokeUserTokens(userID uint) (int, error) {
+	return revokeTokens(func(tx *gorm.DB) *gorm.DB {
+		return tx.Where("user_id = ?", userID)
+	})
+}
+
+// RevokeAccessToken revokes the pair whose access token has the given jti. The jti is denylisted
+// even when the pair is no longer stored.
+func RevokeAccessToken(userID uint, jti string, expiresAt time.Time) error {
+	if _, err := revokeTokens(func(tx *gorm.DB) *gorm.DB {
+		return tx.Where("user_id = ? AND access_jti = ?", userID, jti)
+	}); err != nil {
+		return err
+	}
+	entry := RevokedToken{JTI: jti, UserID: userID, ExpiresAt: expiresAt}
+	if err := db.Clauses(clause.OnConflict{DoNothing: true}).Create(&entry).Error; err != nil {
+		return err
+	}
+	markRevokedInCache([]string{jti})
+	return nil
+}
+
+// IsAccessTokenRevoked reports whether the access token with the given jti is denylisted
+func IsAccessTokenRevoked(jti string) (bool, error) {
+	return revokedJTICache.get(jti, func() (bool, error) {
+		var count int64
+		err := db.Model(&RevokedToken{}).Where("jti = ?", jti).Count(&count).Error
+		return count > 0, err
+	})
+}
+
+// PurgeExpiredRevokedTokens drops the denylist entries of access tokens that expired before now
+func PurgeExpiredRevokedTokens(now time.Time) (int64, error) {
+	result := db.Where("expires_at < ?", now).Delete(&RevokedToken{})
+	return result.RowsAffected, result.Error
+}
@@ -0,0 +1,133 @@
+package models
+
+import (
+	"learning-api/config"
+	"sort"
+	"time"
+)
+
+// DeviceInfo describes the device a user signs in on
+type DeviceInfo struct {
+	Name      string // as the client reports it, e.g. "iPhone 15"
+	Platform  string // ios, android, pc, as the client reports it
+	UserAgent string
+	IP        string
+}
+
+// setDevice records the device of a login, cut to the column sizes
+func (t *Token) setDevice(device DeviceInfo) {
+	t.DeviceName = truncate(device.Name, 100)
+	t.Platform = truncate(device.Platform, 32)
+	t.UserAgent = truncate(device.UserAgent, 255)
+	t.IP = truncate(device.IP, 64)
+}
+
+func truncate(value string, size int) string {
+	runes := []rune(value)
+	if len(runes) <= size {
+		return value
+	}
+	return string(runes[:size])
+}
+
+// lastActiveAt is when the session was last used, or started
+func (t *Token) lastActiveAt() time.Time {
+	if t.LastSeenAt != nil && t.LastSeenAt.After(t.CreatedAt) {
+		return *t.LastSeenAt
+	}
+	return t.CreatedAt
+}
+
+// SessionResponse is one signed in device of the user. A session is the latest token of a login;
+// its ID changes each time the token is refreshed.
+type SessionResponse struct {
+	ID          uint       `json:"id"`
+	DeviceName  string     `json:"device_name"`
+	Platform    string     `json:"platform"`
+	UserAgent   string     `json:"user_agent"`
+	IP          string     `json:"ip"`
+	LastSeenAt  *time.Time `json:"last_seen_at"`
+	RefreshedAt time.Time  `json:"refreshed_at"` // when the current token was issued
+	Current     bool       `json:"current"`      // the session the request was made with
+}
+
+// ToSessionResponses converts sessions for display; currentJTI marks the request's own session
+func ToSessionResponses(sessions []Token, currentJTI string) []SessionResponse {
+	responses := make([]SessionResponse, 0, len(sessions))
+	for _, s := range sessions {
+		responses = append(responses, SessionResponse{
+			ID:          s.ID,
+			DeviceName:  s.DeviceName,
+			Platform:    s.Platform,
+			UserAgent:   s.UserAgent,
+			IP:          s.IP,
+			LastSeenAt:  s.LastSeenAt,
+			RefreshedAt: s.CreatedAt,
+			Current:     s.AccessJTI == currentJTI,
+		})
+	}
+	return responses
+}
+
+// FindUserSessions returns the user's signed in sessions, most recently used first: the tokens
+// not yet refreshed, revoked or expired
+func FindUserSessions(userID uint) ([]Token, error) {
+	var tokens []Token
+	if err := db.Where("user_id = ? AND rotated_at IS NULL AND revoked_at IS NULL", userID).Find(&tokens).Error; err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	sessions := tokens[:0]
+	for _, token := range tokens {
+		if token.CreatedAt.Add(time.Duration(token.RefreshTokenExpiresIn) * time.Second).After(now) {
+			sessions = append(sessions, token)
+		}
+	}
+	sort.SliceStable(sessions, func(i, j int) bool {
+		return sessions[i].lastActiveAt().After(sessions[j].lastActiveAt())
+	})
+	return sessions, nil
+}
+
+// FindUserSession returns a signed in session of the user, or nil if there is none with that ID
+func FindUserSession(userID, id uint) (*Token, error) {
+	sessions, err := FindUserSessions(userID)
+	if err != nil {
+		return nil, err
+	}
+	for i := range sessions {
+		if sessions[i].ID == id {
+			return &sessions[i], nil
+		}
+	}
+	return nil, nil
+}
+
+// enforceSessionLimit signs the user out of the least recently used sessions past max_sessions
+func enforceSessionLimit(userID uint) error {
+	limit := config.LoadConfig().MaxSessions
+	if limit <= 0 {
+		return nil
+	}
+	sessions, err := FindUserSessions(userID)
+	if err != nil || len(sessions) <= limit {
+		return err
+	}
+	for i := limit; i < len(sessions); i++ {
+		if err := sessions[i].RevokeFamily(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// TouchAccessToken records that the session of the access token was just used. Each process
+// writes it at most once per AuthCacheTTL.
+func TouchAccessToken(jti string) error {
+	_, err := lastSeenCache.get(jti, func() (bool, error) {
+		err := db.Model(&Token{}).Where("access_jti = ?", jti).
+			UpdateColumn("last_seen_at", time.Now()).Error
+		return err == nil, err
+	})
+	return err
+}
@@ -0,0 +1,80 @@
+package models
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	openApiSdkClient "github.com/bytedance/douyin-openapi-sdk-go/client"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUserSessions(t *testing.T) {
+	os.Setenv("MAX_SESSIONS", "2")
+	defer os.Unsetenv("MAX_SESSIONS")
+	SetDB(InitTestDB())
+
+	data := &openApiSdkClient.V2Jscode2sessionResponseData{}
+	data.SetOpenid("session_openid")
+	data.SetUnionid("session_unionid")
+	data.SetSessionKey("session_key")
+	login := func(device string) *Token {
+		token, err := FindOrCreateUserToken(data, DeviceInfo{Name: device, Platform: "ios", UserAgent: "Douyin", IP: "10.0.0.1"})
+		assert.NoError(t, err)
+		return token
+	}
+
+	phone := login("iPhone 15")
+	pad := login("iPad")
+	sessions, err := FindUserSessions(phone.UserID)
+	assert.NoError(t, err)
+	assert.Len(t, sessions, 2)
+
+	// Refreshing keeps the device and replaces the session's token
+	var stored Token
+	db.First(&stored, pad.ID)
+	refreshed, err := stored.RefreshToNewToken()
+	assert.NoError(t, err)
+	assert.Equal(t, "iPad", refreshed.DeviceName)
+
+	// The phone was used most recently, so the pad is the one signed out past the limit
+	later := time.Now().Add(time.Minute)
+	db.Model(&Token{}).Where("id = ?", phone.ID).UpdateColumn("last_seen_at", later)
+	login("Douyin PC")
+	sessions, err = FindUserSessions(phone.UserID)
+	assert.NoError(t, err)
+	assert.Len(t, sessions, 2)
+	assert.Equal(t, "iPhone 15", sessions[0].DeviceName)
+	assert.Equal(t, "Douyin PC", sessions[1].DeviceName)
+	revoked, _ := IsAccessTokenRevoked(refreshed.AccessJTI)
+	assert.True(t, revoked)
+
+	responses := ToSessionResponses(sessions, phone.AccessJTI)
+	assert.True(t, responses[0].Current)
+	assert.False(t, responses[1].Current)
+	assert.Equal(t, "10.0.0.1", responses[0].IP)
+
+	session, err := FindUserSession(phone.UserID, phone.ID)
+	assert.NoError(t, err)
+	assert.NotNil(t, session)
+	session, _ = FindUserSession(phone.UserID+1, phone.ID)
+	assert.Nil(t, session)
+}
+
+func TestTouchAccessToken(t *testing.T) {
+	SetDB(InitTestDB())
+	token := NewToken()
+	token.UserID = 1
+	assert.NoError(t, token.GenTokenWithDate())
+	db.Create(token)
+
+	assert.NoError(t, TouchAccessToken(token.AccessJTI))
+	db.First(token, token.ID)
+	assert.NotNil(t, token.LastSeenAt)
+	seen := *token.LastSeenAt
+
+	// A second request within the TTL does not write again
+	assert.NoError(t, TouchAccessToken(token.AccessJTI))
+	db.First(token, token.ID)
+	assert.True(t, seen.Equal(*token.LastSeenAt))
+}
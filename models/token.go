@@ -1,8 +1,11 @@
 package models
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"errors"
 	"learning-api/config"
+	"strconv"
 	"time"
 
 	openApiSdkClient "github.com/bytedance/douyin-openapi-sdk-go/client"
@@ -12,24 +15,62 @@ import (
 
 // Token represents a token entity
 type Token struct {
-	ID                    uint      `gorm:"primaryKey" json:"id"`
-	UserID                uint      `json:"user_id"`
-	AccessToken           string    `json:"access_token"`
-	AccessTokenExpiresIn  int       `json:"access_token_expires_in"`
-	RefreshToken          string    `json:"refresh_token"`
-	RefreshTokenExpiresIn int       `json:"refresh_token_expires_in"`
-	CreatedAt             time.Time `json:"created_at"`
-	UpdatedAt             time.Time `json:"updated_at"`
-	User                  User      // One-to-one relationship with User
+	ID                    uint       `gorm:"primaryKey" json:"id"`
+	UserID                uint       `json:"user_id"`
+	AccessToken           string     `json:"access_token"`
+	AccessTokenExpiresIn  int        `json:"access_token_expires_in"`
+	RefreshToken          string     `json:"refresh_token"`
+	RefreshTokenExpiresIn int        `json:"refresh_token_expires_in"`
+	AccessJTI             string     `gorm:"type:varchar(32);index" json:"-"` // jti claim of the access token
+	FamilyID              string     `gorm:"type:varchar(32);index" json:"-"` // shared by every token refreshed from the same login
+	ParentID              *uint      `json:"-"`                               // token this one was refreshed from
+	RotatedAt             *time.Time `json:"-"`                               // set once the token was exchanged on /refresh-token
+	RevokedAt             *time.Time `json:"-"`
+	DeviceName            string     `gorm:"type:varchar(100)" json:"-"` // device the login was made on, see DeviceInfo
+	Platform              string     `gorm:"type:varchar(32)" json:"-"`
+	UserAgent             string     `gorm:"type:varchar(255)" json:"-"`
+	IP                    string     `gorm:"type:varchar(64)" json:"-"`
+	LastSeenAt            *time.Time `json:"-"` // last authenticated request, updated at most every AuthCacheTTL
+	CreatedAt             time.Time  `json:"created_at"`
+	UpdatedAt             time.Time  `json:"updated_at"`
+	User                  User       // One-to-one relationship with User
 }
 
+// ErrRefreshTokenReused is returned when a refresh token that was already exchanged, or that
+// belongs to a revoked family, is presented again. The token family is revoked.
+var ErrRefreshTokenReused = errors.New("refresh token reused")
+
+// ErrTokenRevoked is returned for an access token that was refreshed or revoked, see RevokedToken
+var ErrTokenRevoked = errors.New("token revoked")
+
+// AccessClaims identifies the access token of an authenticated request
+type AccessClaims struct {
+	UserID    uint
+	JTI       string
+	ExpiresAt time.Time
+}
+
+// NewToken returns a token starting a new family
 func NewToken() *Token {
 	return &Token{
+		FamilyID:  newTokenID(),
 		CreatedAt: time.Now(),
 		UpdatedAt: time.Now(),
 	}
 }
 
+// newTokenID returns a random ID for token families and jti claims
+func newTokenID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// Active reports whether the token pair can still be used
+func (t *Token) Active() bool {
+	return t.RotatedAt == nil && t.RevokedAt == nil
+}
+
 func FindToken(accessToken, refreshToken string) (*Token, error) {
 	var token Token
 	result := db.Where("access_token = ? AND refresh_token = ?", accessToken, refreshToken).First(&token)
@@ -42,7 +83,9 @@ func FindToken(accessToken, refreshToken string) (*Token, error) {
 	return &token, nil
 }
 
-func FindOrCreateUserToken(data *openApiSdkClient.V2Jscode2sessionResponseData) (token *Token, err error) {
+// FindOrCreateUserToken signs the user in on a device, creating the user on first login. Every
+// login is a session of its own; other devices stay signed in up to the max_sessions limit.
+func FindOrCreateUserToken(data *openApiSdkClient.V2Jscode2sessionResponseData, device DeviceInfo) (token *Token, err error) {
 
 	var user *User
 
@@ -50,7 +93,7 @@ func FindOrCreateUserToken(data *openApiSdkClient.V2Jscode2sessionResponseData)
 	if result.Error != nil {
 		if errors.Is(result.Error, gorm.ErrRecordNotFound) {
 			// User not found, use your custom method to create a new one
-			user, err = createNewUserWithToken(data)
+			user, err = createNewUserWithToken(data, device)
 			if err != nil {
 				return nil, err
 			}
@@ -64,19 +107,25 @@ func FindOrCreateUserToken(data *openApiSdkClient.V2Jscode2sessionResponseData)
 		// user found, update the user updated_at and session key
 
 		token := NewToken()
+		token.UserID = user.ID
+		token.setDevice(device)
 		err := token.GenTokenWithDate()
 		if err != nil {
 			return nil, err
 		}
-		// delete all the tokens where user_id = user.ID
-		if err := db.Where("user_id = ?", user.ID).Delete(&Token{}).Error; err != nil {
-			return nil, err
-		}
 
-		user.Tokens = []Token{*token}
 		user.SessionKey = *data.SessionKey
 		user.UpdatedAt = time.Now()
-		if err := db.Save(&user).Error; err != nil {
+		err = db.Transaction(func(tx *gorm.DB) error {
+			if err := tx.Create(token).Error; err != nil {
+				return err
+			}
+			return tx.Save(&user).Error
+		})
+		if err != nil {
+			return nil, err
+		}
+		if err := enforceSessionLimit(user.ID); err != nil {
 			return nil, err
 		}
 		return token, nil
@@ -84,10 +133,10 @@ func FindOrCreateUserToken(data *openApiSdkClient.V2Jscode2sessionResponseData)
 }
 
 func NewUserAndToken(data *openApiSdkClient.V2Jscode2sessionResponseData) (*User, error) {
-	return createNewUserWithToken(data)
+	return createNewUserWithToken(data, DeviceInfo{})
 }
 
-func createNewUserWithToken(data *openApiSdkClient.V2Jscode2sessionResponseData) (*User, error) {
+func createNewUserWithToken(data *openApiSdkClient.V2Jscode2sessionResponseData, device DeviceInfo) (*User, error) {
 	user := &User{
 		OpenID:     *data.Openid,
 		UnionID:    *data.Unionid,
@@ -95,15 +144,25 @@ func createNewUserWithToken(data *openApiSdkClient.V2Jscode2sessionResponseData)
 		CreatedAt:  time.Now(),
 		UpdatedAt:  time.Now(),
 	}
-	token := NewToken()
-	err := token.GenTokenWithDate()
-	if err != nil {
-		return nil, err
-	}
-
-	user.Tokens = []Token{*token}
 
-	if err := db.Create(user).Error; err != nil {
+	// the user is created first, its ID goes into the token claims
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(user).Error; err != nil {
+			return err
+		}
+		token := NewToken()
+		token.UserID = user.ID
+		token.setDevice(device)
+		if err := token.GenTokenWithDate(); err != nil {
+			return err
+		}
+		if err := tx.Create(token).Error; err != nil {
+			return err
+		}
+		user.Tokens = []Token{*token}
+		return nil
+	})
+	if err != nil {
 		return nil, err
 	}
 
@@ -126,12 +185,23 @@ func (t *Token) GenTokenWithDate() error {
 	return nil
 }
 
+// RefreshToNewToken exchanges the token for a new pair of the same family and invalidates it.
+// A token can be exchanged once; presenting it again revokes its whole family, since either the
+// client or someone who stole the token is holding a copy.
 func (t *Token) RefreshToNewToken() (*Token, error) {
 
 	const accessTokenExpiresIn = 3600 // 1 hour (seconds)
 	newToken := NewToken()
 	newToken.UserID = t.UserID
 	newToken.AccessTokenExpiresIn = accessTokenExpiresIn
+	newToken.ParentID = &t.ID
+	// the session stays on its device
+	newToken.DeviceName, newToken.Platform, newToken.UserAgent, newToken.IP = t.DeviceName, t.Platform, t.UserAgent, t.IP
+	now := time.Now()
+	newToken.LastSeenAt = &now
+	if t.FamilyID != "" {
+		newToken.FamilyID = t.FamilyID // tokens issued before families start their own
+	}
 
 	newRefreshTokenExpiresIn := t.RefreshTokenExpiresIn - accessTokenExpiresIn
 
@@ -139,23 +209,61 @@ func (t *Token) RefreshToNewToken() (*Token, error) {
 	if err != nil {
 		return nil, err
 	}
-	if err := db.Save(newToken).Error; err != nil {
+
+	var jtis []string
+	err = db.Transaction(func(tx *gorm.DB) error {
+		// only one concurrent refresh of the same token wins
+		result := tx.Model(&Token{}).
+			Where("id = ? AND rotated_at IS NULL AND revoked_at IS NULL", t.ID).
+			Updates(map[string]interface{}{"rotated_at": time.Now(), "family_id": newToken.FamilyID})
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return ErrRefreshTokenReused
+		}
+		var denyErr error
+		if jtis, denyErr = denylistTx(tx, []Token{*t}); denyErr != nil {
+			return denyErr
+		}
+		return tx.Create(newToken).Error
+	})
+	if errors.Is(err, ErrRefreshTokenReused) {
+		if revokeErr := t.RevokeFamily(); revokeErr != nil {
+			return nil, revokeErr
+		}
 		return nil, err
 	}
+	if err != nil {
+		return nil, err
+	}
+	markRevokedInCache(jtis)
 
 	return newToken, nil
 }
 
+// RevokeFamily revokes every token refreshed from the same login as t
+func (t *Token) RevokeFamily() error {
+	_, err := revokeTokens(func(tx *gorm.DB) *gorm.DB {
+		if t.FamilyID == "" {
+			return tx.Where("id = ?", t.ID)
+		}
+		return tx.Where("family_id = ?", t.FamilyID)
+	})
+	return err
+}
+
 func (t *Token) SetAccessTokenAndRefreshToken(accessTokenExpiresIn int, refreshTokenExpiresIn int) error {
 	config := config.LoadConfig()
 	secret := config.ClientSecret
 	t.AccessTokenExpiresIn = accessTokenExpiresIn
-	accessToken, err := GenJWTToken(secret, time.Duration(accessTokenExpiresIn)*time.Second)
+	accessToken, jti, err := GenJWTToken(secret, t.UserID, TokenTypeAccess, time.Duration(accessTokenExpiresIn)*time.Second)
 	if err != nil {
 		return err
 	}
 	t.AccessToken = accessToken
-	refreshToken, err := GenJWTToken(secret, time.Duration(refreshTokenExpiresIn)*time.Second)
+	t.AccessJTI = jti
+	refreshToken, _, err := GenJWTToken(secret, t.UserID, TokenTypeRefresh, time.Duration(refreshTokenExpiresIn)*time.Second)
 	if err != nil {
 		return err
 	}
@@ -165,19 +273,37 @@ func (t *Token) SetAccessTokenAndRefreshToken(accessTokenExpiresIn int, refreshT
 	return nil
 }
 
-// GenJWTToken generates a JWT token with the specified secret and expiration duration.
+// JWT issuer and audience, checked when a token is validated
+const (
+	JWTIssuer   = "learning"
+	JWTAudience = "douyin"
+)
+
+// Values of the typ claim. Only access tokens authenticate requests; refresh tokens are only
+// exchanged on /refresh-token.
+const (
+	TokenTypeAccess  = "access"
+	TokenTypeRefresh = "refresh"
+)
 
-// gen_jwt_access_token generates a JWT access token for the user with a given secret and expiration duration.
-func GenJWTToken(secret string, expiresIn time.Duration) (string, error) {
-	//
-	const issuer = "learning" // Replace with your actual issuer
-	const audience = "douyin" // Replace with your actual audience
+// GenJWTToken generates a JWT token for the user with the given secret and expiration duration.
+// The user ID is the sub claim; the returned jti, a random ID, tells tokens issued in the same
+// second apart.
+func GenJWTToken(secret string, userID uint, tokenType string, expiresIn time.Duration) (string, string, error) {
+	jti := newTokenID()
 	claims := jwt.MapClaims{
+		"sub": strconv.FormatUint(uint64(userID), 10),
+		"jti": jti,
+		"typ": tokenType,
 		"exp": time.Now().Add(expiresIn).Unix(),
 		"iat": time.Now().Unix(),
-		"iss": issuer,   // Replace with your actual issuer
-		"aud": audience, // Replace with your actual audience
+		"iss": JWTIssuer,
+		"aud": JWTAudience,
 	}
 	jwtToken := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	return jwtToken.SignedString([]byte(secret))
+	signed, err := jwtToken.SignedString([]byte(secret))
+	if err != nil {
+		return "", "", err
+	}
+	return signed, jti, nil
 }
@@ -3,6 +3,7 @@ package models_test
 // Unit tests for models/token.go
 
 import (
+	"errors"
 	"learning-api/models"
 	"os"
 	"testing"
@@ -19,7 +20,7 @@ func setupTestDB() *gorm.DB {
 	if err != nil {
 		panic("failed to connect database")
 	}
-	db.AutoMigrate(&models.User{}, &models.Token{})
+	db.AutoMigrate(&models.User{}, &models.Token{}, &models.RevokedToken{})
 	models.SetDB(db) // Set the global db variable for model methods
 	return db
 }
@@ -52,6 +53,12 @@ func TestGenerateToken_JWTClaims(t *testing.T) {
 	if claims["aud"] != "douyin" {
 		t.Errorf("audience claim mismatch: got %v", claims["aud"])
 	}
+	if claims["sub"] != "0" {
+		t.Errorf("subject claim mismatch: got %v", claims["sub"])
+	}
+	if claims["jti"] != token.AccessJTI || token.AccessJTI == "" {
+		t.Errorf("jti claim mismatch: got %v, token has %q", claims["jti"], token.AccessJTI)
+	}
 }
 
 func TestFindOrCreateUserToken_CreatesUserAndToken(t *testing.T) {
@@ -63,7 +70,7 @@ func TestFindOrCreateUserToken_CreatesUserAndToken(t *testing.T) {
 	data.SetOpenid(openid)
 	data.SetUnionid(unionid)
 	data.SetSessionKey(sessionKey)
-	tok, err := models.FindOrCreateUserToken(data)
+	tok, err := models.FindOrCreateUserToken(data, models.DeviceInfo{})
 	if err != nil {
 		t.Fatalf("unexpected error: %v", err)
 	}
@@ -90,7 +97,7 @@ func TestFindOrCreateUserToken_NewAndExistingUser(t *testing.T) {
 	data.SetSessionKey(sessionKey)
 
 	// First time: create new user and token
-	tok, err := models.FindOrCreateUserToken(data)
+	tok, err := models.FindOrCreateUserToken(data, models.DeviceInfo{})
 	if err != nil {
 		t.Fatalf("unexpected error: %v", err)
 	}
@@ -112,7 +119,7 @@ func TestFindOrCreateUserToken_NewAndExistingUser(t *testing.T) {
 	// Second time: save existing user with new token
 	newSessionKey := "updated_sessionkey_test"
 	data.SetSessionKey(newSessionKey)
-	tok, err = models.FindOrCreateUserToken(data)
+	tok, err = models.FindOrCreateUserToken(data, models.DeviceInfo{})
 	if err != nil {
 		t.Fatalf("unexpected error: %v", err)
 	}
@@ -125,16 +132,17 @@ func TestFindOrCreateUserToken_NewAndExistingUser(t *testing.T) {
 	if user.SessionKey != newSessionKey {
 		t.Errorf("SessionKey mismatch: got %v", user.SessionKey)
 	}
+	// The first login stays signed in next to the new one
 	db.Preload("Tokens").First(&user, "open_id = ?", openid)
-	if len(user.Tokens) != 1 {
-		t.Errorf("Expected 1 token, got %d", len(user.Tokens))
+	if len(user.Tokens) != 2 {
+		t.Errorf("Expected 2 tokens, got %d", len(user.Tokens))
 	}
 }
 
 func TestGenJWTToken_Expiration(t *testing.T) {
 	secret := "expire_secret"
 	expires := time.Second * 1
-	tkn, err := models.GenJWTToken(secret, expires)
+	tkn, _, err := models.GenJWTToken(secret, 1, models.TokenTypeAccess, expires)
 	if err != nil {
 		t.Fatalf("failed to generate jwt: %v", err)
 	}
@@ -160,3 +168,45 @@ func TestGenJWTToken_Expiration(t *testing.T) {
 		t.Error("JWT should be expired but is still valid")
 	}
 }
+
+func TestRefreshToNewToken_RotatesWithinFamily(t *testing.T) {
+	db := setupTestDB()
+	login := models.NewToken()
+	if err := login.GenTokenWithDate(); err != nil {
+		t.Fatal(err)
+	}
+	other := models.NewToken()
+	if err := other.GenTokenWithDate(); err != nil {
+		t.Fatal(err)
+	}
+	db.Create(login)
+	db.Create(other)
+	if login.FamilyID == "" || login.FamilyID == other.FamilyID {
+		t.Fatalf("each login should start its own family: %q %q", login.FamilyID, other.FamilyID)
+	}
+
+	refreshed, err := login.RefreshToNewToken()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if refreshed.FamilyID != login.FamilyID || refreshed.ParentID == nil || *refreshed.ParentID != login.ID {
+		t.Errorf("refreshed token should continue the family of %d", login.ID)
+	}
+	db.First(login, login.ID)
+	if login.Active() {
+		t.Error("the exchanged token should no longer be active")
+	}
+
+	// A second exchange of the same token revokes the family but not other logins
+	if _, err := login.RefreshToNewToken(); !errors.Is(err, models.ErrRefreshTokenReused) {
+		t.Fatalf("expected ErrRefreshTokenReused, got %v", err)
+	}
+	db.First(refreshed, refreshed.ID)
+	if refreshed.RevokedAt == nil {
+		t.Error("the family's latest token should be revoked")
+	}
+	db.First(other, other.ID)
+	if !other.Active() {
+		t.Error("another login should stay active")
+	}
+}
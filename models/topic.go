@@ -10,6 +10,7 @@ type Topic struct {
 	Explaination string     `json:"explaination"`
 	Questions    []Question `json:"questions"`
 	CoverURL     string     `gorm:"type:varchar(1000)" json:"cover_url"`
+	Price        int        `gorm:"not null;default:0" json:"price"` // price of the full results in fen, 0 means not for sale
 	CreatedAt    time.Time  `json:"created_at"`
 	UpdatedAt    time.Time  `json:"updated_at"`
 }
@@ -1,6 +1,17 @@
 package models
 
-import "time"
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// User roles
+const (
+	RoleUser    = "user"    // mini program user
+	RoleSupport = "support" // customer support staff
+	RoleAdmin   = "admin"   // administrator
+)
 
 // User represents a user entity
 type User struct {
@@ -11,7 +22,30 @@ type User struct {
 	Name       string    `json:"name"`
 	Phone      string    `json:"phone"`
 	Avatar     string    `json:"avatar"`
+	Role       string    `gorm:"type:varchar(20);not null;default:'user'" json:"role"`
 	CreatedAt  time.Time `json:"created_at"`
 	UpdatedAt  time.Time `json:"updated_at"`
 	Tokens     []Token   `gorm:"foreignKey:UserID;constraint:OnUpdate:CASCADE,OnDelete:CASCADE;" json:"tokens"`
 }
+
+// HasRole reports whether the user has one of the given roles
+func (u *User) HasRole(roles ...string) bool {
+	for _, role := range roles {
+		if u.Role == role {
+			return true
+		}
+	}
+	return false
+}
+
+// AfterSave drops the user from the auth cache, so a role change applies to the next request
+func (u *User) AfterSave(tx *gorm.DB) error {
+	ForgetCachedUser(u.ID)
+	return nil
+}
+
+// AfterDelete drops the user from the auth cache
+func (u *User) AfterDelete(tx *gorm.DB) error {
+	ForgetCachedUser(u.ID)
+	return nil
+}
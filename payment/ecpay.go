@@ -0,0 +1,161 @@
+package payment
+
+import (
+	"encoding/json"
+	"fmt"
+	"learning-api/config"
+	"learning-api/helpers"
+	"net/http"
+	"time"
+)
+
+// EcpayGateway is the Douyin ecpay (担保支付) create_order API
+type EcpayGateway struct {
+	cfg config.Config
+}
+
+func NewEcpayGateway(cfg config.Config) *EcpayGateway {
+	return &EcpayGateway{cfg: cfg}
+}
+
+func (g *EcpayGateway) Name() string {
+	return GatewayEcpay
+}
+
+func (g *EcpayGateway) CreateOrder(req OrderRequest) (*CreatedOrder, error) {
+	resp, err := helpers.CreateEcpayOrder(helpers.DouyinOrderRequest{
+		AppID:       g.cfg.AppID,
+		OutOrderNo:  req.OutOrderNo,
+		TotalAmount: req.Amount,
+		Subject:     req.Subject,
+		Body:        req.Body,
+		CpExtra:     req.CpExtra,
+		ValidTime:   g.cfg.Payment.ValidTime,
+		StoreUid:    g.cfg.Payment.StoreUid,
+		NotifyURL:   g.cfg.Payment.CallbackURL("/pay/callback"),
+	})
+	if err != nil {
+		return nil, err
+	}
+	if resp.ErrNo != 0 {
+		return nil, fmt.Errorf("create_order failed: err_no %d, err_tips %s", resp.ErrNo, resp.ErrTips)
+	}
+	return &CreatedOrder{OrderID: resp.Data.OrderID, OrderToken: resp.Data.OrderToken}, nil
+}
+
+func (g *EcpayGateway) QueryOrder(outOrderNo string) (*QueryResult, error) {
+	resp, err := helpers.QueryEcpayOrder(outOrderNo)
+	if err != nil {
+		return nil, err
+	}
+	if resp.ErrNo == helpers.EcpayErrOrderNotFound {
+		// e.g. create_order never reached ecpay
+		return &QueryResult{Found: false, Message: resp.ErrTips}, nil
+	}
+	if resp.ErrNo != 0 {
+		// Any other error says nothing about the order, so it must not be expired for it
+		return nil, fmt.Errorf("query_order failed: err_no %d, err_tips %s", resp.ErrNo, resp.ErrTips)
+	}
+	return &QueryResult{
+		Found:   true,
+		Status:  ecpayStatus(resp.PaymentInfo.OrderStatus),
+		OrderID: resp.OrderID,
+		Amount:  resp.PaymentInfo.TotalFee,
+		Message: resp.PaymentInfo.OrderStatus,
+	}, nil
+}
+
+func (g *EcpayGateway) Refund(req RefundRequest) (string, error) {
+	reason := req.Reason
+	if reason == "" {
+		reason = "refund"
+	}
+	resp, err := helpers.CreateEcpayRefund(helpers.DouyinRefundRequest{
+		AppID:        g.cfg.AppID,
+		OutOrderNo:   req.OutOrderNo,
+		OutRefundNo:  req.OutRefundNo,
+		Reason:       reason,
+		RefundAmount: req.Amount,
+		NotifyURL:    g.cfg.Payment.CallbackURL("/pay/refund/callback"),
+	})
+	if err != nil {
+		return "", err
+	}
+	if resp.ErrNo != 0 {
+		return "", fmt.Errorf("create_refund failed: err_no %d, err_tips %s", resp.ErrNo, resp.ErrTips)
+	}
+	return resp.RefundNo, nil
+}
+
+// VerifyNotification checks msg_signature against the callback token configured on the platform
+// and that the timestamp is fresh, and decodes the payment, refund or settle result in msg
+func (g *EcpayGateway) VerifyNotification(r *http.Request) (*Notification, error) {
+	var req helpers.EcpayCallbackRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidNotification, err)
+	}
+	if g.cfg.Payment.CallbackToken == "" {
+		return nil, fmt.Errorf("%w: callback token is empty", ErrNotConfigured)
+	}
+	if !helpers.VerifyEcpayCallback(req, g.cfg.Payment.CallbackToken) {
+		return nil, fmt.Errorf("%w: signature mismatch, nonce: %s, timestamp: %s", ErrInvalidNotification, req.Nonce, req.Timestamp)
+	}
+	if err := helpers.CheckEcpayCallbackTimestamp(req, time.Now()); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidNotification, err)
+	}
+
+	notification := &Notification{Type: req.Type}
+	switch req.Type {
+	case helpers.EcpayCallbackPayment:
+		var msg helpers.EcpayPaymentMsg
+		if err := json.Unmarshal([]byte(req.Msg), &msg); err != nil {
+			return nil, fmt.Errorf("%w: msg: %v", ErrInvalidNotification, err)
+		}
+		notification.OutNo = msg.CpOrderNo
+		notification.GatewayNo = msg.OrderID
+		notification.Status = ecpayStatus(msg.Status)
+		notification.Amount = msg.TotalAmount
+		notification.Message = msg.Status
+	case helpers.EcpayCallbackRefund:
+		var msg helpers.EcpayRefundMsg
+		if err := json.Unmarshal([]byte(req.Msg), &msg); err != nil {
+			return nil, fmt.Errorf("%w: msg: %v", ErrInvalidNotification, err)
+		}
+		notification.OutNo = msg.CpRefundNo
+		notification.GatewayNo = msg.RefundNo
+		notification.Status = resultStatus(msg.Status == helpers.EcpayStatusSuccess)
+		notification.Amount = msg.RefundAmount
+		notification.Message = msg.Message
+	case helpers.EcpayCallbackSettle:
+		var msg helpers.EcpaySettleMsg
+		if err := json.Unmarshal([]byte(req.Msg), &msg); err != nil {
+			return nil, fmt.Errorf("%w: msg: %v", ErrInvalidNotification, err)
+		}
+		notification.OutNo = msg.CpSettleNo
+		notification.GatewayNo = msg.OrderID
+		notification.Status = resultStatus(msg.Status == helpers.EcpayStatusSuccess)
+		notification.Message = msg.Message
+	}
+	return notification, nil
+}
+
+func ecpayStatus(status string) Status {
+	switch status {
+	case helpers.EcpayStatusSuccess:
+		return StatusSuccess
+	case helpers.EcpayStatusTimeout:
+		return StatusExpired
+	case helpers.EcpayStatusFail:
+		return StatusFailed
+	default:
+		return StatusProcessing
+	}
+}
+
+// resultStatus maps the final result of a refund or settle, which is either done or failed
+func resultStatus(succeeded bool) Status {
+	if succeeded {
+		return StatusSuccess
+	}
+	return StatusFailed
+}
@@ -0,0 +1,106 @@
+package payment
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+)
+
+// DefaultFake is the fake gateway New returns, shared so orders survive between requests
+var DefaultFake = NewFake(GatewayFake)
+
+// Fake is an in-process gateway for dev environments and tests. Orders it creates are paid
+// at once, refunds are accepted and notifications are plain unsigned Notification JSON.
+type Fake struct {
+	name     string
+	mu       sync.Mutex
+	orders   map[string]QueryResult
+	failures map[string]error
+	created  []OrderRequest
+	refunds  []RefundRequest
+}
+
+// NewFake returns an empty fake that calls itself name, so it can stand in for a real gateway
+func NewFake(name string) *Fake {
+	return &Fake{name: name, orders: map[string]QueryResult{}, failures: map[string]error{}}
+}
+
+func (f *Fake) Name() string {
+	return f.name
+}
+
+func (f *Fake) CreateOrder(req OrderRequest) (*CreatedOrder, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.failures[req.OutOrderNo]; err != nil {
+		return nil, err
+	}
+	f.created = append(f.created, req)
+	orderID := "FAKE_" + req.OutOrderNo
+	if _, ok := f.orders[req.OutOrderNo]; !ok {
+		f.orders[req.OutOrderNo] = QueryResult{Found: true, Status: StatusSuccess, OrderID: orderID, Amount: req.Amount}
+	}
+	data, _ := json.Marshal(map[string]interface{}{"outOrderNo": req.OutOrderNo, "totalAmount": req.Amount})
+	return &CreatedOrder{OrderID: orderID, OrderToken: "fake_token_" + req.OutOrderNo, Data: string(data), ByteAuthorization: "FAKE"}, nil
+}
+
+func (f *Fake) QueryOrder(outOrderNo string) (*QueryResult, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.failures[outOrderNo]; err != nil {
+		return nil, err
+	}
+	result, ok := f.orders[outOrderNo]
+	if !ok {
+		return &QueryResult{Found: false, Message: "order not exist"}, nil
+	}
+	return &result, nil
+}
+
+func (f *Fake) Refund(req RefundRequest) (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.failures[req.OutOrderNo]; err != nil {
+		return "", err
+	}
+	f.refunds = append(f.refunds, req)
+	return "FAKE_" + req.OutRefundNo, nil
+}
+
+// VerifyNotification accepts a Notification posted as JSON without any signature
+func (f *Fake) VerifyNotification(r *http.Request) (*Notification, error) {
+	var notification Notification
+	if err := json.NewDecoder(r.Body).Decode(&notification); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidNotification, err)
+	}
+	return &notification, nil
+}
+
+// SetOrder replaces what QueryOrder reports for outOrderNo
+func (f *Fake) SetOrder(outOrderNo string, result QueryResult) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.orders[outOrderNo] = result
+}
+
+// FailOrder makes every call about outOrderNo return err, as if the gateway were unreachable
+func (f *Fake) FailOrder(outOrderNo string, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.failures[outOrderNo] = err
+}
+
+// Created returns the orders created so far
+func (f *Fake) Created() []OrderRequest {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]OrderRequest(nil), f.created...)
+}
+
+// Refunds returns the refunds started so far
+func (f *Fake) Refunds() []RefundRequest {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]RefundRequest(nil), f.refunds...)
+}
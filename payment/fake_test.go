@@ -0,0 +1,56 @@
+package payment
+
+import (
+	"bytes"
+	"errors"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFake(t *testing.T) {
+	fake := NewFake(GatewayEcpay)
+	assert.Equal(t, GatewayEcpay, fake.Name())
+
+	created, err := fake.CreateOrder(OrderRequest{OutOrderNo: "OUT_1", Amount: 990})
+	assert.NoError(t, err)
+	assert.Equal(t, "FAKE_OUT_1", created.OrderID)
+	assert.Len(t, fake.Created(), 1)
+
+	// Orders are paid as soon as they are created
+	result, err := fake.QueryOrder("OUT_1")
+	assert.NoError(t, err)
+	assert.Equal(t, QueryResult{Found: true, Status: StatusSuccess, OrderID: "FAKE_OUT_1", Amount: 990}, *result)
+
+	fake.SetOrder("OUT_1", QueryResult{Found: true, Status: StatusCancelled})
+	result, _ = fake.QueryOrder("OUT_1")
+	assert.Equal(t, StatusCancelled, result.Status)
+
+	result, err = fake.QueryOrder("OUT_UNKNOWN")
+	assert.NoError(t, err)
+	assert.False(t, result.Found)
+
+	refundNo, err := fake.Refund(RefundRequest{OutOrderNo: "OUT_1", OutRefundNo: "R_1", Amount: 400})
+	assert.NoError(t, err)
+	assert.Equal(t, "FAKE_R_1", refundNo)
+	assert.Len(t, fake.Refunds(), 1)
+
+	fake.FailOrder("OUT_DOWN", errors.New("connection refused"))
+	_, err = fake.QueryOrder("OUT_DOWN")
+	assert.Error(t, err)
+	_, err = fake.CreateOrder(OrderRequest{OutOrderNo: "OUT_DOWN"})
+	assert.Error(t, err)
+}
+
+func TestFake_VerifyNotification(t *testing.T) {
+	fake := NewFake(GatewayFake)
+
+	n, err := fake.VerifyNotification(httptest.NewRequest("POST", "/pay/fake/callback",
+		bytes.NewBufferString(`{"type":"refund","out_no":"R_1","status":"success","amount":400}`)))
+	assert.NoError(t, err)
+	assert.Equal(t, Notification{Type: NotificationRefund, OutNo: "R_1", Status: StatusSuccess, Amount: 400}, *n)
+
+	_, err = fake.VerifyNotification(httptest.NewRequest("POST", "/pay/fake/callback", bytes.NewBufferString("not json")))
+	assert.ErrorIs(t, err, ErrInvalidNotification)
+}
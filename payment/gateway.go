@@ -0,0 +1,125 @@
+package payment
+
+import (
+	"errors"
+	"fmt"
+	"learning-api/config"
+	"net/http"
+)
+
+// Gateway names, stored on every order as Order.Gateway
+const (
+	GatewayEcpay   = "ecpay"
+	GatewayTradeV2 = "trade_v2"
+	GatewayFake    = "fake"
+)
+
+// Status is the gateway-neutral state of an order, refund or settle
+type Status string
+
+const (
+	StatusProcessing Status = "processing"
+	StatusSuccess    Status = "success"
+	StatusFailed     Status = "failed"
+	StatusExpired    Status = "expired"
+	StatusCancelled  Status = "cancelled"
+)
+
+// Notification types
+const (
+	NotificationPayment = "payment"
+	NotificationRefund  = "refund"
+	NotificationSettle  = "settle"
+)
+
+// ErrNotConfigured is returned when the credentials a gateway needs are missing from config
+var ErrNotConfigured = errors.New("payment gateway is not configured")
+
+// ErrInvalidNotification is returned when a notification cannot be parsed or its signature does not match
+var ErrInvalidNotification = errors.New("invalid notification")
+
+// PaymentGateway creates, queries and refunds orders on one payment system and verifies
+// the notifications it posts back
+type PaymentGateway interface {
+	Name() string
+	CreateOrder(req OrderRequest) (*CreatedOrder, error)
+	// QueryOrder returns Found false when the gateway has no record of the order
+	QueryOrder(outOrderNo string) (*QueryResult, error)
+	// Refund starts a refund and returns the gateway refund number; the result arrives as a notification
+	Refund(req RefundRequest) (string, error)
+	VerifyNotification(r *http.Request) (*Notification, error)
+}
+
+// OrderRequest is an order to create on the gateway
+type OrderRequest struct {
+	OutOrderNo  string
+	Amount      int
+	Subject     string
+	Body        string
+	CpExtra     string
+	SkuID       string
+	ImageURL    string
+	EntryParams string // JSON params of the mini program page the order links back to
+}
+
+// CreatedOrder is what the client needs to pay an order. Ecpay fills OrderID and OrderToken,
+// the trade system v2 fills Data and ByteAuthorization for tt.requestOrder.
+type CreatedOrder struct {
+	OrderID           string
+	OrderToken        string
+	Data              string
+	ByteAuthorization string
+}
+
+// QueryResult is the payment state of an order on the gateway
+type QueryResult struct {
+	Found   bool
+	Status  Status
+	OrderID string
+	Amount  int
+	Message string
+}
+
+// RefundRequest is a refund to start on the gateway. OrderID is the gateway order number.
+type RefundRequest struct {
+	OutOrderNo  string
+	OrderID     string
+	OutRefundNo string
+	Amount      int
+	Reason      string
+	EntryParams string
+}
+
+// Notification is a verified payment, refund or settle result posted by the gateway.
+// OutNo is our out_order_no, out_refund_no or out_settle_no, GatewayNo the gateway's number for it.
+type Notification struct {
+	Type      string `json:"type"`
+	OutNo     string `json:"out_no"`
+	GatewayNo string `json:"gateway_no"`
+	Status    Status `json:"status"`
+	Amount    int    `json:"amount"`
+	Message   string `json:"message"`
+}
+
+// New returns the gateway orders stored with name go through
+func New(name string) (PaymentGateway, error) {
+	switch name {
+	case GatewayEcpay:
+		return NewEcpayGateway(config.LoadConfig()), nil
+	case GatewayTradeV2:
+		return NewTradeV2Gateway(config.LoadConfig()), nil
+	case GatewayFake:
+		return DefaultFake, nil
+	default:
+		return nil, fmt.Errorf("unknown payment gateway %q", name)
+	}
+}
+
+// Resolve returns the gateway new orders for name are created through: the fake gateway when
+// config selects it, name otherwise
+func Resolve(name string) string {
+	if config.LoadConfig().PaymentGateway == GatewayFake {
+		return GatewayFake
+	}
+	return name
+}
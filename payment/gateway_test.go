@@ -0,0 +1,140 @@
+package payment
+
+import (
+	"bytes"
+	"encoding/json"
+	"learning-api/config"
+	"learning-api/helpers"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNew(t *testing.T) {
+	for _, name := range []string{GatewayEcpay, GatewayTradeV2, GatewayFake} {
+		gateway, err := New(name)
+		assert.NoError(t, err)
+		assert.Equal(t, name, gateway.Name())
+	}
+
+	_, err := New("alipay")
+	assert.Error(t, err)
+}
+
+func TestResolve(t *testing.T) {
+	assert.Equal(t, GatewayEcpay, Resolve(GatewayEcpay))
+
+	t.Setenv("PAYMENT_GATEWAY", GatewayFake)
+	assert.Equal(t, GatewayFake, Resolve(GatewayEcpay))
+	assert.Equal(t, GatewayFake, Resolve(GatewayTradeV2))
+}
+
+func ecpayNotification(token string, msgType string, msg interface{}) *http.Request {
+	msgBytes, _ := json.Marshal(msg)
+	req := helpers.EcpayCallbackRequest{Timestamp: json.Number(strconv.FormatInt(time.Now().Unix(), 10)), Nonce: "9999", Msg: string(msgBytes), Type: msgType}
+	req.MsgSignature = helpers.CallbackSign([]string{token, req.Timestamp.String(), req.Nonce, req.Msg})
+	body, _ := json.Marshal(req)
+	return httptest.NewRequest("POST", "/pay/callback", bytes.NewBuffer(body))
+}
+
+func TestEcpayGateway_VerifyNotification(t *testing.T) {
+	gateway := NewEcpayGateway(config.Config{Payment: config.PaymentConfig{CallbackToken: "token"}})
+
+	n, err := gateway.VerifyNotification(ecpayNotification("token", helpers.EcpayCallbackPayment, helpers.EcpayPaymentMsg{
+		CpOrderNo: "OUT_1", OrderID: "DY_1", TotalAmount: 990, Status: helpers.EcpayStatusSuccess,
+	}))
+	assert.NoError(t, err)
+	assert.Equal(t, Notification{Type: NotificationPayment, OutNo: "OUT_1", GatewayNo: "DY_1", Status: StatusSuccess, Amount: 990, Message: "SUCCESS"}, *n)
+
+	n, err = gateway.VerifyNotification(ecpayNotification("token", helpers.EcpayCallbackRefund, helpers.EcpayRefundMsg{
+		CpRefundNo: "R_1", RefundNo: "DY_R_1", RefundAmount: 400, Status: "FAIL", Message: "balance too low",
+	}))
+	assert.NoError(t, err)
+	assert.Equal(t, Notification{Type: NotificationRefund, OutNo: "R_1", GatewayNo: "DY_R_1", Status: StatusFailed, Amount: 400, Message: "balance too low"}, *n)
+
+	_, err = gateway.VerifyNotification(ecpayNotification("wrong_token", helpers.EcpayCallbackPayment, helpers.EcpayPaymentMsg{CpOrderNo: "OUT_1"}))
+	assert.ErrorIs(t, err, ErrInvalidNotification)
+
+	_, err = NewEcpayGateway(config.Config{}).VerifyNotification(ecpayNotification("", helpers.EcpayCallbackPayment, helpers.EcpayPaymentMsg{}))
+	assert.ErrorIs(t, err, ErrNotConfigured)
+}
+
+func TestEcpayGateway_QueryOrder(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var query helpers.DouyinQueryOrderRequest
+		json.NewDecoder(r.Body).Decode(&query)
+		switch query.OutOrderNo {
+		case "OUT_1":
+			w.Write([]byte(`{"err_no":0,"out_order_no":"OUT_1","order_id":"DY_1","payment_info":{"total_fee":990,"order_status":"SUCCESS"}}`))
+		case "OUT_UNKNOWN":
+			w.Write([]byte(`{"err_no":` + strconv.Itoa(helpers.EcpayErrOrderNotFound) + `,"err_tips":"order not exist"}`))
+		default:
+			w.Write([]byte(`{"err_no":2001,"err_tips":"system busy"}`))
+		}
+	}))
+	defer server.Close()
+	t.Setenv("ECPAY_BASE_URL", server.URL)
+
+	gateway := NewEcpayGateway(config.Config{})
+
+	result, err := gateway.QueryOrder("OUT_1")
+	assert.NoError(t, err)
+	assert.Equal(t, QueryResult{Found: true, Status: StatusSuccess, OrderID: "DY_1", Amount: 990, Message: "SUCCESS"}, *result)
+
+	result, err = gateway.QueryOrder("OUT_UNKNOWN")
+	assert.NoError(t, err)
+	assert.False(t, result.Found)
+
+	// Only the not found err_no means there is no order; other errors must not expire it
+	result, err = gateway.QueryOrder("OUT_BUSY")
+	assert.EqualError(t, err, "query_order failed: err_no 2001, err_tips system busy")
+	assert.Nil(t, result)
+}
+
+func TestTradeV2Gateway_QueryOrderAndRefund(t *testing.T) {
+	var refund helpers.TradeRefundRequest
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "client_token", r.Header.Get("access-token"))
+		switch r.URL.Path {
+		case "/api/trade_basic/v1/developer/order_query/":
+			var query map[string]string
+			json.NewDecoder(r.Body).Decode(&query)
+			if query["out_order_no"] != "OUT_1" {
+				w.Write([]byte(`{"err_no":11002,"err_msg":"order not exist"}`))
+				return
+			}
+			w.Write([]byte(`{"err_no":0,"data":{"order_id":"DY_1","out_order_no":"OUT_1","pay_status":"SUCCESS","total_amount":990}}`))
+		case "/api/trade_basic/v1/developer/refund_create/":
+			json.NewDecoder(r.Body).Decode(&refund)
+			w.Write([]byte(`{"err_no":0,"data":{"refund_id":"DY_R_1"}}`))
+		}
+	}))
+	defer server.Close()
+	t.Setenv("TRADE_BASE_URL", server.URL)
+	originalToken := helpers.TradeAccessToken
+	helpers.TradeAccessToken = func() (string, error) { return "client_token", nil }
+	defer func() { helpers.TradeAccessToken = originalToken }()
+
+	gateway := NewTradeV2Gateway(config.Config{TradeEntryPath: "pages/experience/index"})
+
+	result, err := gateway.QueryOrder("OUT_1")
+	assert.NoError(t, err)
+	assert.Equal(t, QueryResult{Found: true, Status: StatusSuccess, OrderID: "DY_1", Amount: 990, Message: "SUCCESS"}, *result)
+
+	result, err = gateway.QueryOrder("OUT_UNKNOWN")
+	assert.NoError(t, err)
+	assert.False(t, result.Found)
+	assert.Equal(t, "order not exist", result.Message)
+
+	refundNo, err := gateway.Refund(RefundRequest{OrderID: "DY_1", OutRefundNo: "R_1", Amount: 400, EntryParams: `{"id":7}`})
+	assert.NoError(t, err)
+	assert.Equal(t, "DY_R_1", refundNo)
+	assert.Equal(t, "DY_1", refund.OrderID)
+	assert.Equal(t, 400, refund.RefundTotalAmount)
+	assert.Equal(t, helpers.TradeEntrySchema{Path: "pages/experience/index", Params: `{"id":7}`}, refund.OrderEntrySchema)
+	assert.Equal(t, []helpers.TradeRefundReason{{Code: helpers.TradeRefundReasonOther, Text: "refund"}}, refund.RefundReason)
+}
@@ -0,0 +1,180 @@
+package payment
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"learning-api/config"
+	"learning-api/helpers"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// TradeOrderExpireSeconds is how long a trade system v2 order can be paid
+const TradeOrderExpireSeconds = 300
+
+// tradeNotifyPath is where the trade system v2 posts pay and refund notifications
+const tradeNotifyPath = "/pay/v2/callback"
+
+// TradeV2Gateway is the Douyin trade system v2 (交易系统). Orders are created by the client
+// through tt.requestOrder, so CreateOrder only builds and signs the order data.
+type TradeV2Gateway struct {
+	cfg config.Config
+}
+
+func NewTradeV2Gateway(cfg config.Config) *TradeV2Gateway {
+	return &TradeV2Gateway{cfg: cfg}
+}
+
+func (g *TradeV2Gateway) Name() string {
+	return GatewayTradeV2
+}
+
+func (g *TradeV2Gateway) CreateOrder(req OrderRequest) (*CreatedOrder, error) {
+	var imageList []string
+	if req.ImageURL != "" {
+		imageList = []string{req.ImageURL}
+	}
+	tradeData := helpers.TradeOrderData{
+		SkuList: []helpers.TradeSku{{
+			SkuID:      req.SkuID,
+			Price:      req.Amount,
+			Quantity:   1,
+			Title:      req.Subject,
+			ImageList:  imageList,
+			Type:       helpers.TradeSkuTypeContent,
+			TagGroupID: g.cfg.TradeTagGroupID,
+		}},
+		OutOrderNo:       req.OutOrderNo,
+		TotalAmount:      req.Amount,
+		PayExpireSeconds: TradeOrderExpireSeconds,
+		OrderEntrySchema: helpers.TradeEntrySchema{Path: g.cfg.TradeEntryPath, Params: req.EntryParams},
+		PayNotifyURL:     g.cfg.Payment.CallbackURL(tradeNotifyPath),
+		CpExtra:          req.CpExtra,
+	}
+	data, err := json.Marshal(tradeData)
+	if err != nil {
+		return nil, err
+	}
+
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	byteAuthorization, err := helpers.GetByteAuthorization(g.cfg.PrivateKey, string(data), g.cfg.AppID, nonce(), timestamp, g.cfg.KeyVersion)
+	if err != nil {
+		return nil, err
+	}
+	return &CreatedOrder{Data: string(data), ByteAuthorization: byteAuthorization}, nil
+}
+
+func (g *TradeV2Gateway) QueryOrder(outOrderNo string) (*QueryResult, error) {
+	resp, err := helpers.QueryTradeOrder(outOrderNo)
+	if err != nil {
+		return nil, err
+	}
+	if resp.ErrNo != 0 {
+		// e.g. the client never called tt.requestOrder
+		return &QueryResult{Found: false, Message: resp.ErrMsg}, nil
+	}
+	return &QueryResult{
+		Found:   true,
+		Status:  tradeStatus(resp.Data.PayStatus),
+		OrderID: resp.Data.OrderID,
+		Amount:  resp.Data.TotalAmount,
+		Message: resp.Data.PayStatus,
+	}, nil
+}
+
+func (g *TradeV2Gateway) Refund(req RefundRequest) (string, error) {
+	reason := req.Reason
+	if reason == "" {
+		reason = "refund"
+	}
+	resp, err := helpers.CreateTradeRefund(helpers.TradeRefundRequest{
+		OrderID:           req.OrderID,
+		OutRefundNo:       req.OutRefundNo,
+		OrderEntrySchema:  helpers.TradeEntrySchema{Path: g.cfg.TradeEntryPath, Params: req.EntryParams},
+		RefundReason:      []helpers.TradeRefundReason{{Code: helpers.TradeRefundReasonOther, Text: reason}},
+		RefundTotalAmount: req.Amount,
+		NotifyURL:         g.cfg.Payment.CallbackURL(tradeNotifyPath),
+	})
+	if err != nil {
+		return "", err
+	}
+	if resp.ErrNo != 0 {
+		return "", fmt.Errorf("refund_create failed: err_no %d, err_msg %s", resp.ErrNo, resp.ErrMsg)
+	}
+	return resp.Data.RefundID, nil
+}
+
+// VerifyNotification checks the Byte-Signature header against the platform public key, which
+// signs trade system v2 notifications instead of the ecpay callback token, and rejects notifications
+// whose Byte-Timestamp is too far from now
+func (g *TradeV2Gateway) VerifyNotification(r *http.Request) (*Notification, error) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidNotification, err)
+	}
+	if g.cfg.PlatformPublicKey == "" {
+		return nil, fmt.Errorf("%w: platform public key is empty", ErrNotConfigured)
+	}
+	timestamp := r.Header.Get("Byte-Timestamp")
+	nonceStr := r.Header.Get("Byte-Nonce-Str")
+	if err := helpers.VerifyTradeNotification(g.cfg.PlatformPublicKey, timestamp, nonceStr, string(body), r.Header.Get("Byte-Signature")); err != nil {
+		return nil, fmt.Errorf("%w: signature mismatch, nonce: %s, timestamp: %s: %v", ErrInvalidNotification, nonceStr, timestamp, err)
+	}
+	if err := helpers.CheckTradeNotificationTimestamp(timestamp, time.Now()); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidNotification, err)
+	}
+
+	var tradeNotification helpers.TradeNotification
+	if err := json.Unmarshal(body, &tradeNotification); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidNotification, err)
+	}
+	notification := &Notification{Type: tradeNotification.Type}
+	switch tradeNotification.Type {
+	case NotificationPayment:
+		var msg helpers.TradePaymentMsg
+		if err := json.Unmarshal([]byte(tradeNotification.Msg), &msg); err != nil {
+			return nil, fmt.Errorf("%w: msg: %v", ErrInvalidNotification, err)
+		}
+		notification.OutNo = msg.OutOrderNo
+		notification.GatewayNo = msg.OrderID
+		notification.Status = tradeStatus(msg.Status)
+		notification.Amount = msg.TotalAmount
+		notification.Message = msg.Message
+	case NotificationRefund:
+		var msg helpers.TradeRefundMsg
+		if err := json.Unmarshal([]byte(tradeNotification.Msg), &msg); err != nil {
+			return nil, fmt.Errorf("%w: msg: %v", ErrInvalidNotification, err)
+		}
+		notification.OutNo = msg.OutRefundNo
+		notification.GatewayNo = msg.RefundID
+		notification.Status = resultStatus(msg.Status == helpers.TradeStatusSuccess)
+		notification.Amount = msg.RefundAmount
+		notification.Message = msg.Message
+	}
+	return notification, nil
+}
+
+func tradeStatus(status string) Status {
+	switch status {
+	case helpers.TradeStatusSuccess:
+		return StatusSuccess
+	case helpers.TradeStatusCancel:
+		return StatusCancelled
+	case helpers.TradeStatusTimeout:
+		return StatusExpired
+	case helpers.TradeStatusFail:
+		return StatusFailed
+	default:
+		return StatusProcessing
+	}
+}
+
+func nonce() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -1,17 +1,22 @@
 package routes
 
 import (
+	"learning-api/config"
 	"learning-api/handlers"
+	"learning-api/middlewares"
+	"learning-api/models"
+	"learning-api/payment"
 
 	"github.com/gin-gonic/gin"
 	"gorm.io/gorm"
 )
 
 func RegisterRoutes(r *gin.Engine, db *gorm.DB) {
-	r.POST("/experiences", func(c *gin.Context) { handlers.CreateExperience(c) })
+	r.POST("/experiences", middlewares.Idempotency(), func(c *gin.Context) { handlers.CreateExperience(c) })
 	r.GET("/experience/:id", func(c *gin.Context) { handlers.GetExperience(c) })
 	r.GET("/experiences/my", func(c *gin.Context) { handlers.GetMyExperiences(c) })
 	r.POST("/experiences/:id/paid", func(c *gin.Context) { handlers.MarkExperiencePaid(c) })
+	r.POST("/experiences/:id/confirm", func(c *gin.Context) { handlers.ConfirmExperienceDelivery(c) })
 
 	r.GET("/topics", func(c *gin.Context) { handlers.ListTopics(c, db) })
 	r.POST("/topics", func(c *gin.Context) { handlers.CreateTopic(c, db) })
@@ -34,8 +39,47 @@ func RegisterRoutes(r *gin.Engine, db *gorm.DB) {
 	r.GET("/topics/:id/questions-answers", func(c *gin.Context) { handlers.GetQuestionsWithAnswers(c, db) })
 
 	r.POST("/token", handlers.PostToken)
-	r.POST("/pay/order", handlers.PayOrder)
+	r.POST("/refresh-token", handlers.PostRefreshToken)
+	r.POST("/logout", handlers.PostLogout)
+	r.POST("/logout-all", handlers.PostLogoutAll)
+	r.GET("/me/sessions", handlers.GetMySessions)
+	r.DELETE("/me/sessions/:id", handlers.DeleteMySession)
+	r.POST("/pay/order", middlewares.Idempotency(), handlers.PayOrder)
 	r.POST("/pay/callback", handlers.PayOrderCallback)
+	r.POST("/pay/refund/callback", handlers.RefundCallback)
+	r.POST("/pay/settle/callback", handlers.SettleCallback)
+	r.POST("/pay/v2/order", handlers.PayDouOrder)
+	r.POST("/pay/v2/callback", handlers.PayDouOrderCallback)
+	if config.LoadConfig().PaymentGateway == payment.GatewayFake {
+		r.POST("/pay/fake/callback", handlers.FakePayCallback)
+	}
+
+	r.GET("/membership/plans", handlers.ListMembershipPlans)
+	r.POST("/membership/order", middlewares.Idempotency(), handlers.PayMembershipOrder)
+	r.GET("/me/membership", handlers.GetMyMembership)
+
+	r.GET("/bundles", handlers.ListBundles)
+	r.GET("/bundles/:id", handlers.GetBundle)
+	r.POST("/bundles/:id/order", middlewares.Idempotency(), handlers.PayBundleOrder)
+	r.POST("/admin/bundles", middlewares.RequireRole(models.RoleAdmin), handlers.CreateBundle)
+	r.PUT("/admin/bundles/:id", middlewares.RequireRole(models.RoleAdmin), handlers.UpdateBundle)
+	r.DELETE("/admin/bundles/:id", middlewares.RequireRole(models.RoleAdmin), handlers.DeleteBundle)
+
+	r.POST("/coupons/validate", handlers.ValidateCoupon)
+	r.GET("/admin/coupons", middlewares.RequireRole(models.RoleAdmin), handlers.ListCoupons)
+	r.POST("/admin/coupons", middlewares.RequireRole(models.RoleAdmin), handlers.CreateCoupon)
+	r.PUT("/admin/coupons/:id", middlewares.RequireRole(models.RoleAdmin), handlers.UpdateCoupon)
+
+	r.GET("/orders/my", handlers.GetMyOrders)
+	r.GET("/orders/:id", handlers.GetOrder)
+	r.POST("/orders/:id/refund", middlewares.RequireRole(models.RoleAdmin, models.RoleSupport), handlers.RefundOrder)
+	r.GET("/admin/reports/revenue", middlewares.RequireRole(models.RoleAdmin), handlers.GetRevenueReport)
+	r.GET("/admin/order-sync", middlewares.RequireRole(models.RoleAdmin, models.RoleSupport), handlers.ListOrderSyncTasks)
+	r.POST("/admin/order-sync/:id/retry", middlewares.RequireRole(models.RoleAdmin, models.RoleSupport), handlers.RetryOrderSyncTask)
+	r.GET("/admin/reconciliations", middlewares.RequireRole(models.RoleAdmin), handlers.ListBillReconciliations)
+	r.POST("/admin/reconciliations", middlewares.RequireRole(models.RoleAdmin), handlers.ReconcileBill)
+	r.GET("/admin/reconciliations/:date", middlewares.RequireRole(models.RoleAdmin), handlers.GetBillReconciliation)
+	r.GET("/admin/jobs/:name", middlewares.RequireRole(models.RoleAdmin, models.RoleSupport), handlers.GetJobStatus)
 
 	r.GET("/v1/ping", handlers.PingHandler)
 }